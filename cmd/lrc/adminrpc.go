@@ -0,0 +1,129 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/urfave/cli.v1"
+)
+
+func adminRpcFlags() []cli.Flag {
+	return []cli.Flag{
+		cli.StringFlag{
+			Name:  "url",
+			Usage: "url of the admin listener",
+			Value: "http://127.0.0.1:8089",
+		},
+		cli.StringFlag{
+			Name:  "auth-token",
+			Usage: "auth_token in [admin]",
+		},
+		cli.StringFlag{
+			Name:  "hmac-secret",
+			Usage: "hmac_secret in [admin], used if auth-token is empty",
+		},
+	}
+}
+
+// adminRpcClient calls the admin listener with the bearer token or hmac signature required by it
+type adminRpcClient struct {
+	url        string
+	authToken  string
+	hmacSecret string
+	client     *http.Client
+}
+
+func newAdminRpcClient(ctx *cli.Context) *adminRpcClient {
+	return &adminRpcClient{
+		url:        ctx.String("url"),
+		authToken:  ctx.String("auth-token"),
+		hmacSecret: ctx.String("hmac-secret"),
+		client:     &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+func (c *adminRpcClient) call(result interface{}, method string, params ...interface{}) error {
+	if nil == params {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  method,
+		"params":  params,
+	})
+	if nil != err {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if nil != err {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if "" != c.authToken {
+		req.Header.Set("Authorization", "Bearer "+c.authToken)
+	} else if "" != c.hmacSecret {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(c.hmacSecret))
+		mac.Write([]byte(ts))
+		mac.Write(body)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := c.client.Do(req)
+	if nil != err {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if nil != err {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s:%s", resp.Status, string(bytes.TrimSpace(respBody)))
+	}
+
+	var res struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(respBody, &res); nil != err {
+		return err
+	}
+	if nil != res.Error {
+		return errors.New(res.Error.Message)
+	}
+	return json.Unmarshal(res.Result, result)
+}
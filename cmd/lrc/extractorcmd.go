@@ -0,0 +1,152 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Loopring/relay/cmd/utils"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/extractor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func extractorCommands() cli.Command {
+	c := cli.Command{
+		Name:     "extractor",
+		Usage:    "maintain events extracted from the chain",
+		Category: "extractor commands",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:   "reindex",
+				Usage:  "re-process the events of a block range already extracted by the relay, can run with the relay, progress is saved and resumed",
+				Action: reindexBlocks,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "config,c",
+						Usage: "config file",
+					},
+					cli.Int64Flag{
+						Name:  "from",
+						Usage: "the first block of the range",
+					},
+					cli.Int64Flag{
+						Name:  "to",
+						Usage: "the last block of the range",
+					},
+					cli.BoolFlag{
+						Name:  "restart",
+						Usage: "ignore the saved progress of the range and start from the first block",
+					},
+					priceFlag(),
+				},
+			},
+		},
+	}
+	return c
+}
+
+func reindexBlocks(ctx *cli.Context) {
+	if !ctx.IsSet("from") || !ctx.IsSet("to") {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("from and to are required"))
+	}
+	from, to := ctx.Int64("from"), ctx.Int64("to")
+	if from > to {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("from is greater than to"))
+	}
+
+	globalConfig := utils.SetGlobalConfig(ctx)
+	logger := log.Initialize(globalConfig.Log)
+	defer func() {
+		if nil != logger {
+			logger.Sync()
+		}
+	}()
+
+	// 订单从数据库读出时需要校验hash
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+
+	rds := dao.NewRdsService(globalConfig.Mysql)
+	rds.Prepare()
+	util.Initialize(rds, globalConfig)
+
+	accessor, err := ethaccessor.NewAccessor(globalConfig.Accessor, globalConfig.Common, util.WethTokenAddress())
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+
+	// 只处理已确认且relay已经处理过的区块，避免与正在运行的extractor处理同一区块
+	var latest types.Big
+	if err := accessor.Call(&latest, "eth_blockNumber"); nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	if to > latest.Int64()-int64(globalConfig.Accessor.Confirms) {
+		utils.ExitWithErr(ctx.App.Writer, fmt.Errorf("block %d is not confirmed yet", to))
+	}
+	if block, err := rds.FindLatestBlock(); nil == err && to > block.BlockNumber {
+		utils.ExitWithErr(ctx.App.Writer, fmt.Errorf("blocks after %d are not extracted by the relay yet", block.BlockNumber))
+	}
+
+	reindexer := extractor.NewReindexer(globalConfig.Accessor, globalConfig.Common, accessor, rds)
+	checkpoint, err := reindexer.Checkpoint(from, to, ctx.Bool("restart"))
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	if checkpoint.Finished {
+		fmt.Fprintf(ctx.App.Writer, "blocks %d-%d have been reindexed, use --restart to run again\n", from, to)
+		return
+	}
+	if checkpoint.Current >= from {
+		fmt.Fprintf(ctx.App.Writer, "resume from block %d\n", checkpoint.Current+1)
+	}
+
+	// 未设置价格的代币价格为0，重建时只有剩余量不大于0的订单视为完全成交
+	mc := marketcap.NewMarketCapProvider(globalConfig.Miner)
+	setPrices(ctx, mc)
+	rebuilder := ordermanager.NewOrderStateRebuilder(rds, mc)
+
+	// 每个区间的事件保存后重建涉及的订单，再记录进度
+	err = reindexer.RunFromCheckpoint(checkpoint, func(progress extractor.ReindexProgress) error {
+		touched, err := rebuilder.TouchedOrders(progress.ChunkFrom, progress.ChunkTo)
+		if nil != err {
+			return err
+		}
+		rebuilt, err := rebuilder.Rebuild(touched)
+		if nil != err {
+			return err
+		}
+
+		percent := float64(progress.ChunkTo-from+1) * 100 / float64(to-from+1)
+		fmt.Fprintf(ctx.App.Writer, "blocks %d-%d done(%.2f%%), logs:%d, saved:%d, skipped:%d, orders rebuilt:%d\n",
+			progress.ChunkFrom, progress.ChunkTo, percent, progress.Logs, progress.Saved, progress.Skipped, rebuilt)
+		return nil
+	})
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	fmt.Fprintf(ctx.App.Writer, "blocks %d-%d reindexed\n", from, to)
+}
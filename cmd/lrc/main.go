@@ -41,6 +41,9 @@ func main() {
 
 	app.Commands = []cli.Command{
 		accountCommands(),
+		minerCommands(),
+		orderCommands(),
+		extractorCommands(),
 	}
 
 	sort.Sort(cli.CommandsByName(app.Commands))
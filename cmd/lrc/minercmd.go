@@ -18,14 +18,205 @@
 
 package main
 
-import "gopkg.in/urfave/cli.v1"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/Loopring/relay/cmd/utils"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/miner/backtest"
+	"github.com/Loopring/relay/types"
+	"gopkg.in/urfave/cli.v1"
+)
 
 func minerCommands() cli.Command {
 	minerCommand := cli.Command{
 		Name:     "miner",
-		Usage:    "miner ",
+		Usage:    "inspect and control the miner by the miner namespace of the admin listener",
 		Category: "miner commands",
-		Action:   nil,
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:   "rings",
+				Usage:  "list rings in ring_submit_info",
+				Action: listRings,
+				Flags: append(adminRpcFlags(),
+					cli.StringFlag{
+						Name:  "state",
+						Usage: "pending, submitted, mined or failed, all rings if empty",
+					},
+					cli.IntFlag{
+						Name:  "page",
+						Usage: "page index",
+						Value: 1,
+					},
+					cli.IntFlag{
+						Name:  "size",
+						Usage: "page size",
+						Value: 20,
+					},
+				),
+			},
+			cli.Command{
+				Name:      "ring",
+				Usage:     "show a ring with its orders, gas and profit",
+				ArgsUsage: "<ringhash>",
+				Action:    showRing,
+				Flags:     adminRpcFlags(),
+			},
+			cli.Command{
+				Name:   "stats",
+				Usage:  "show matching statistics of every market",
+				Action: minerRpcAction("miner_getStats"),
+				Flags:  adminRpcFlags(),
+			},
+			cli.Command{
+				Name:   "pause",
+				Usage:  "stop matching new rings",
+				Action: minerRpcAction("miner_pause"),
+				Flags:  adminRpcFlags(),
+			},
+			cli.Command{
+				Name:   "resume",
+				Usage:  "resume matching",
+				Action: minerRpcAction("miner_resume"),
+				Flags:  adminRpcFlags(),
+			},
+			cli.Command{
+				Name:   "trigger",
+				Usage:  "run a matching round immediately",
+				Action: minerRpcAction("miner_triggerRound"),
+				Flags:  adminRpcFlags(),
+			},
+			cli.Command{
+				Name:   "backtest",
+				Usage:  "replay historical orders of a block range through the matcher offline and compare with the rings mined on chain, balances and allowances are read from the historical state of the node of the config",
+				Action: runBacktest,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "config,c",
+						Usage: "config file",
+					},
+					cli.Int64Flag{
+						Name:  "from",
+						Usage: "the first block of the range",
+					},
+					cli.Int64Flag{
+						Name:  "to",
+						Usage: "the last block of the range",
+					},
+					cli.Int64Flag{
+						Name:  "gas",
+						Usage: "the gas used to submit a ring",
+						Value: 500000,
+					},
+					cli.Int64Flag{
+						Name:  "gas-price",
+						Usage: "the gas price in wei",
+						Value: 20000000000,
+					},
+					priceFlag(),
+				},
+			},
+		},
 	}
 	return minerCommand
 }
+
+func listRings(ctx *cli.Context) {
+	query := map[string]interface{}{
+		"state":     ctx.String("state"),
+		"pageIndex": ctx.Int("page"),
+		"pageSize":  ctx.Int("size"),
+	}
+	printAdminRpcResult(ctx, "miner_getRings", query)
+}
+
+func showRing(ctx *cli.Context) {
+	if ctx.NArg() < 1 {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("ringhash is required"))
+	}
+	printAdminRpcResult(ctx, "miner_getRing", ctx.Args().First())
+}
+
+func minerRpcAction(method string) func(ctx *cli.Context) {
+	return func(ctx *cli.Context) {
+		printAdminRpcResult(ctx, method)
+	}
+}
+
+func printAdminRpcResult(ctx *cli.Context, method string, params ...interface{}) {
+	var result json.RawMessage
+	if err := newAdminRpcClient(ctx).call(&result, method, params...); nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	var v interface{}
+	if err := json.Unmarshal(result, &v); nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	bs, _ := json.MarshalIndent(v, "", "  ")
+	fmt.Fprintf(ctx.App.Writer, "%s\n", string(bs))
+}
+
+func runBacktest(ctx *cli.Context) {
+	if !ctx.IsSet("from") || !ctx.IsSet("to") {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("from and to are required"))
+	}
+	globalConfig := utils.SetGlobalConfig(ctx)
+	logger := log.Initialize(globalConfig.Log)
+	defer func() {
+		if nil != logger {
+			logger.Sync()
+		}
+	}()
+
+	rds := dao.NewRdsService(globalConfig.Mysql)
+	util.Initialize(rds, globalConfig)
+	mc := marketcap.NewMarketCapProvider(globalConfig.Miner)
+	setPrices(ctx, mc)
+
+	accessor, err := ethaccessor.NewAccessor(globalConfig.Accessor, globalConfig.Common, util.WethTokenAddress())
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+
+	backtester := backtest.NewBacktester(globalConfig.Miner, globalConfig.Common, rds, accessor, mc, big.NewInt(ctx.Int64("gas")), big.NewInt(ctx.Int64("gas-price")))
+	report, err := backtester.Run(ctx.Int64("from"), ctx.Int64("to"))
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	bs, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Fprintf(ctx.App.Writer, "%s\n", string(bs))
+}
+
+func priceFlag() cli.Flag {
+	return cli.StringSliceFlag{
+		Name:  "price",
+		Usage: "the price of a token in the legal currency of the config, eg: --price LRC=1.2, listed tokens without a price are valued at 0 and unknown tokens at 1",
+	}
+}
+
+func setPrices(ctx *cli.Context, mc *marketcap.MarketCapProvider) {
+	for _, p := range ctx.StringSlice("price") {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 {
+			utils.ExitWithErr(ctx.App.Writer, errors.New("invalid price:"+p))
+		}
+		token := util.AliasToAddress(strings.ToUpper(kv[0]))
+		if types.IsZeroAddress(token) {
+			utils.ExitWithErr(ctx.App.Writer, errors.New("unsupported token:"+kv[0]))
+		}
+		price, err := strconv.ParseFloat(kv[1], 64)
+		if nil != err {
+			utils.ExitWithErr(ctx.App.Writer, err)
+		}
+		mc.SetMarketCap(token, price)
+	}
+}
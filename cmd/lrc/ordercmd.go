@@ -0,0 +1,116 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Loopring/relay/cmd/utils"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/ethereum/go-ethereum/common"
+	"gopkg.in/urfave/cli.v1"
+)
+
+func orderCommands() cli.Command {
+	c := cli.Command{
+		Name:     "orders",
+		Usage:    "maintain order states in the database",
+		Category: "order commands",
+		Subcommands: []cli.Command{
+			cli.Command{
+				Name:   "rebuild",
+				Usage:  "rebuild order states from the persisted fill, cancel and cutoff events, stop the relay before running it",
+				Action: rebuildOrders,
+				Flags: []cli.Flag{
+					cli.StringFlag{
+						Name:  "config,c",
+						Usage: "config file",
+					},
+					cli.Int64Flag{
+						Name:  "from",
+						Usage: "the first block of the range, orders touched in the range are rebuilt",
+					},
+					cli.Int64Flag{
+						Name:  "to",
+						Usage: "the last block of the range",
+					},
+					cli.StringSliceFlag{
+						Name:  "order",
+						Usage: "the hash of an order to rebuild, can be repeated",
+					},
+					priceFlag(),
+				},
+			},
+		},
+	}
+	return c
+}
+
+func rebuildOrders(ctx *cli.Context) {
+	if ctx.IsSet("from") != ctx.IsSet("to") {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("from and to must be set together"))
+	}
+	if !ctx.IsSet("from") && len(ctx.StringSlice("order")) == 0 {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("a block range or orders is required"))
+	}
+	if ctx.Int64("from") > ctx.Int64("to") {
+		utils.ExitWithErr(ctx.App.Writer, errors.New("from is greater than to"))
+	}
+
+	globalConfig := utils.SetGlobalConfig(ctx)
+	logger := log.Initialize(globalConfig.Log)
+	defer func() {
+		if nil != logger {
+			logger.Sync()
+		}
+	}()
+
+	// 订单从数据库读出时需要校验hash
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+
+	rds := dao.NewRdsService(globalConfig.Mysql)
+	util.Initialize(rds, globalConfig)
+	mc := marketcap.NewMarketCapProvider(globalConfig.Miner)
+	setPrices(ctx, mc)
+	rebuilder := ordermanager.NewOrderStateRebuilder(rds, mc)
+
+	var orderhashs []common.Hash
+	if ctx.IsSet("from") {
+		touched, err := rebuilder.TouchedOrders(ctx.Int64("from"), ctx.Int64("to"))
+		if nil != err {
+			utils.ExitWithErr(ctx.App.Writer, err)
+		}
+		orderhashs = append(orderhashs, touched...)
+	}
+	for _, v := range ctx.StringSlice("order") {
+		orderhashs = append(orderhashs, common.HexToHash(v))
+	}
+
+	rebuilt, err := rebuilder.Rebuild(orderhashs)
+	if nil != err {
+		utils.ExitWithErr(ctx.App.Writer, err)
+	}
+	fmt.Fprintf(ctx.App.Writer, "%d orders rebuilt\n", rebuilt)
+}
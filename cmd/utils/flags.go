@@ -28,7 +28,7 @@ import (
 var (
 	ModeFlag = cli.StringFlag{
 		Name:  "mode",
-		Usage: "the mode that will be run, it can be set by relay, miner or full",
+		Usage: "the mode that will be run, it can be set by relay, miner, full or readonly",
 	}
 	UnlockFlag = cli.StringFlag{
 		Name:  "unlocks",
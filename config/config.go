@@ -70,6 +70,7 @@ type GlobalConfig struct {
 	Mysql          MysqlOptions
 	Ipfs           IpfsOptions
 	Jsonrpc        JsonrpcOptions
+	Admin          AdminOptions
 	GatewayFilters GatewayFiltersOptions
 	Gateway        GateWayOptions
 	Accessor       AccessorOptions
@@ -82,7 +83,82 @@ type GlobalConfig struct {
 }
 
 type JsonrpcOptions struct {
-	Port int
+	BindAddress    string
+	Port           int
+	WebsocketPort  int
+	AllowedOrigins []string // cors origins, all origins are allowed if empty
+	TlsCert        string   // serve https if both cert and key are set
+	TlsKey         string
+	MaxRequestSize int64    // bytes, at most 128k
+	ReadTimeout    int      // seconds, no timeout if zero
+	WriteTimeout   int      // seconds, no timeout if zero
+	Namespaces     []string // namespaces exposed on the listener, loopring and eth if empty
+	Listeners      []JsonrpcListenerOptions
+}
+
+// JsonrpcListenerOptions is an additional listener, empty fields are inherited from JsonrpcOptions except namespaces
+type JsonrpcListenerOptions struct {
+	Name           string
+	BindAddress    string
+	Port           int
+	AllowedOrigins []string
+	TlsCert        string
+	TlsKey         string
+	MaxRequestSize int64
+	ReadTimeout    int
+	WriteTimeout   int
+	Namespaces     []string
+}
+
+// AllListeners returns the main listener and additional listeners, with inherited fields filled
+func (o JsonrpcOptions) AllListeners() []JsonrpcListenerOptions {
+	main := JsonrpcListenerOptions{
+		Name:           "main",
+		BindAddress:    o.BindAddress,
+		Port:           o.Port,
+		AllowedOrigins: o.AllowedOrigins,
+		TlsCert:        o.TlsCert,
+		TlsKey:         o.TlsKey,
+		MaxRequestSize: o.MaxRequestSize,
+		ReadTimeout:    o.ReadTimeout,
+		WriteTimeout:   o.WriteTimeout,
+		Namespaces:     o.Namespaces,
+	}
+	if len(main.Namespaces) == 0 {
+		main.Namespaces = []string{"loopring", "eth"}
+	}
+
+	listeners := []JsonrpcListenerOptions{main}
+	for _, l := range o.Listeners {
+		if "" == l.BindAddress {
+			l.BindAddress = o.BindAddress
+		}
+		if len(l.AllowedOrigins) == 0 {
+			l.AllowedOrigins = o.AllowedOrigins
+		}
+		if "" == l.TlsCert && "" == l.TlsKey {
+			l.TlsCert, l.TlsKey = o.TlsCert, o.TlsKey
+		}
+		if l.MaxRequestSize <= 0 {
+			l.MaxRequestSize = o.MaxRequestSize
+		}
+		if l.ReadTimeout <= 0 {
+			l.ReadTimeout = o.ReadTimeout
+		}
+		if l.WriteTimeout <= 0 {
+			l.WriteTimeout = o.WriteTimeout
+		}
+		listeners = append(listeners, l)
+	}
+	return listeners
+}
+
+type AdminOptions struct {
+	BindAddress      string
+	Port             int    // admin listener is disabled if zero, admin namespace can also be exposed by jsonrpc listeners
+	AuthToken        string // Authorization: Bearer <auth_token>
+	HmacSecret       string // X-Signature: hex(hmac_sha256(hmac_secret, X-Timestamp + body))
+	MaxTimestampSkew int64  // seconds, used by hmac auth
 }
 
 type ContractOptions struct {
@@ -102,7 +178,12 @@ type IpfsOptions struct {
 }
 
 type AccessorOptions struct {
-	RawUrl string `required:"true"`
+	RawUrl      string `required:"true"`
+	ExtractMode string //block:逐块下载全部交易, log:通过eth_getLogs按区块区间获取合约事件
+	LogMaxRange int64  //log模式每次查询的最大区块数
+	LogTarget   int    //log模式每次查询期望的事件数，据此调整区块区间
+	Confirms    uint64 //确认块数，未确认的事件以pending topic发送，确认后再发送最终事件
+	BlockWindow int    //保存最近区块hash的数量，分叉时在其中寻找共同祖先
 }
 
 type KeyStoreOptions struct {
@@ -148,6 +229,32 @@ type MinerOptions struct {
 		CurrenciesMap map[string]string //address -> name
 	}
 	RateRatioCVSThreshold int64
+	SimulateRing          bool    //submit前在pending状态上通过debug_traceCall模拟执行，节点需要开启debug接口
+	SimulateTolerance     float64 //模拟得到的成交量与evaluator计算结果允许的相对偏差
+	TransactionManager    TransactionManagerOptions
+	GasPrice              GasPriceOptions
+	MinProfit             float64 //每个环路扣除gas费用后的最低收益，法币
+	RingExpireBlocks      int64   //环路提交后超过该区块数仍未确认，则释放其占用的订单金额
+	Matcher               string  //timing:每个区块拉取订单匹配, event:维护内存订单簿，订单到达时即匹配
+	OrderBookSize         int     //event matcher从数据库加载时每个市场每个方向的订单数
+}
+
+type GasPriceOptions struct {
+	Strategy    string  //node, fixed, percentile, profit
+	FixedPrice  int64   //wei, fixed使用
+	BlockCount  int     //percentile统计最近多少个区块
+	Percentile  int     //percentile使用的分位数，0-100
+	ProfitShare float64 //profit最多将Received的该比例用于gas
+	MinPrice    int64   //wei，为0时不限制
+	MaxPrice    int64   //wei，为0时不限制
+}
+
+type TransactionManagerOptions struct {
+	ChainId                int64 //EIP-155 chain id，为0时从节点的net_version获取
+	CheckInterval          int64 //检查receipt的间隔，秒
+	ReplaceTimeout         int64 //超过该时间未被打包，则提高gasPrice重新发送，秒
+	GasPriceBumpPercentage int64 //节点要求替换交易的gasPrice至少提高10%
+	MaxReplaceTimes        int
 }
 
 type OrderManagerOptions struct {
@@ -157,15 +264,42 @@ type OrderManagerOptions struct {
 }
 
 type GatewayFiltersOptions struct {
+	Filters    []string // enabled filters in order, use gateway.DefaultFilterNames if empty
 	BaseFilter struct {
 		MinLrcFee int64
 		MaxPrice  int64
 	}
+	TokenFilter struct {
+		AllowTokens  []string //address or symbol, all supported tokens are allowed if empty
+		DeniedTokens []string
+	}
+	MarginSplitFilter struct {
+		MinMarginSplitPercentage int
+	}
+	TtlFilter struct {
+		MaxTtl int64 //seconds
+	}
+	TimestampFilter struct {
+		MaxFutureSeconds int64
+	}
+	OwnerRateFilter struct {
+		Rate  float64 // orders per second of each owner, no limit if zero
+		Burst int
+	}
+	OrderQuotaFilter struct {
+		MaxOpenOrders int // open orders of each owner in each market, no limit if zero
+	}
+	Params map[string]map[string]string //params of custom filters, keyed by filter name
 }
 
 type GateWayOptions struct {
 	IsBroadcast      bool
 	MaxBroadcastTime int
+	IpRateLimit      struct {
+		Rate  float64 // requests of submitting or cancelling orders per second of each remote ip, no limit if zero
+		Burst int
+	}
+	CancellationWindow int64 // seconds the timestamp of a soft cancellation may differ from now, default 600 if zero
 }
 
 type MysqlOptions struct {
@@ -0,0 +1,56 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package dao
+
+// AdminAudit records every call of admin json-rpc namespace
+type AdminAudit struct {
+	ID         int    `gorm:"column:id;primary_key"`
+	Action     string `gorm:"column:action;type:varchar(64)"`
+	Params     string `gorm:"column:params;type:text"`
+	RemoteAddr string `gorm:"column:remote_addr;type:varchar(64)"`
+	Success    bool   `gorm:"column:success"`
+	Err        string `gorm:"column:err;type:text"`
+	CreateTime int64  `gorm:"column:create_time"`
+}
+
+func (s *RdsServiceImpl) AdminAuditPageQuery(query map[string]interface{}, pageIndex, pageSize int) (res PageResult, err error) {
+	if pageIndex <= 0 {
+		pageIndex = 1
+	}
+	if pageSize <= 0 {
+		pageSize = 20
+	}
+
+	audits := make([]AdminAudit, 0)
+	res = PageResult{PageIndex: pageIndex, PageSize: pageSize, Data: make([]interface{}, 0)}
+
+	err = s.db.Where(query).Order("create_time desc").Offset((pageIndex - 1) * pageSize).Limit(pageSize).Find(&audits).Error
+	if err != nil {
+		return res, err
+	}
+	err = s.db.Model(&AdminAudit{}).Where(query).Count(&res.Total).Error
+	if err != nil {
+		return res, err
+	}
+
+	for _, audit := range audits {
+		res.Data = append(res.Data, audit)
+	}
+	return res, err
+}
@@ -80,7 +80,7 @@ func (s *RdsServiceImpl) FindBlockByParentHash(parenthash common.Hash) (*Block,
 
 func (s *RdsServiceImpl) FindLatestBlock() (*Block, error) {
 	var block Block
-	err := s.db.Order("create_time desc").First(&block).Error
+	err := s.db.Where("fork = ?", false).Order("block_number desc").First(&block).Error
 	return &block, err
 }
 
@@ -93,3 +93,14 @@ func (s *RdsServiceImpl) FindForkBlock() (*Block, error) {
 func (s *RdsServiceImpl) SetForkBlock(blockhash common.Hash) error {
 	return s.db.Model(&Block{}).Where("block_hash", blockhash.String()).Update("fork = ?", true).Error
 }
+
+func (s *RdsServiceImpl) GetBlocksByNumberRange(from, to int64) ([]Block, error) {
+	var list []Block
+	err := s.db.Where("block_number between ? and ? and fork = ?", from, to, false).Order("block_number asc").Find(&list).Error
+	return list, err
+}
+
+// 分叉时删除共同祖先之后的区块，新链区块与其parentHash相同
+func (s *RdsServiceImpl) RollBackBlock(from, to int64) error {
+	return s.db.Where("block_number > ? and block_number <= ?", from, to).Delete(&Block{}).Error
+}
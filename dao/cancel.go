@@ -28,6 +28,7 @@ type CancelEvent struct {
 	Protocol        string `gorm:"column:contract_address;type:varchar(42)"`
 	OrderHash       string `gorm:"column:order_hash;type:varchar(82)"`
 	TxHash          string `gorm:"column:tx_hash;type:varchar(82)"`
+	LogIndex        int64  `gorm:"column:log_index"`
 	BlockNumber     int64  `gorm:"column:block_number"`
 	CreateTime      int64  `gorm:"column:create_time"`
 	AmountCancelled string `gorm:"column:amount_cancelled;type:varchar(30)"`
@@ -38,6 +39,7 @@ func (e *CancelEvent) ConvertDown(src *types.OrderCancelledEvent) error {
 	e.AmountCancelled = src.AmountCancelled.String()
 	e.OrderHash = src.OrderHash.Hex()
 	e.TxHash = src.TxHash.Hex()
+	e.LogIndex = src.LogIndex
 	e.Protocol = src.ContractAddress.Hex()
 	e.CreateTime = src.Time.Int64()
 	e.BlockNumber = src.Blocknumber.Int64()
@@ -56,6 +58,27 @@ func (s *RdsServiceImpl) FindCancelEvent(orderhash, txhash common.Hash) (*Cancel
 	return &model, err
 }
 
+func (s *RdsServiceImpl) FindCancelEventByLogIndex(txhash common.Hash, logIndex int64) (*CancelEvent, error) {
+	var (
+		model CancelEvent
+		err   error
+	)
+	err = s.db.Where("tx_hash = ? and log_index = ?", txhash.Hex(), logIndex).First(&model).Error
+	return &model, err
+}
+
 func (s *RdsServiceImpl) RollBackCancel(from, to int64) error {
 	return s.db.Where("block_number > ? and block_number <= ?", from, to).Delete(&CancelEvent{}).Error
 }
+
+func (s *RdsServiceImpl) GetCancelEventsByBlockRange(from, to int64) ([]CancelEvent, error) {
+	var list []CancelEvent
+	err := s.db.Where("block_number between ? and ?", from, to).Order("block_number asc, id asc").Find(&list).Error
+	return list, err
+}
+
+func (s *RdsServiceImpl) GetCancelEventsByOrderHashs(orderhashs []string) ([]CancelEvent, error) {
+	var list []CancelEvent
+	err := s.db.Where("order_hash in (?)", orderhashs).Order("block_number asc, log_index asc, id asc").Find(&list).Error
+	return list, err
+}
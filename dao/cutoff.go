@@ -30,6 +30,7 @@ type CutOffEvent struct {
 	Protocol    string `gorm:"column:contract_address;type:varchar(42)"`
 	Owner       string `gorm:"column:owner;type:varchar(42);unique_index"`
 	TxHash      string `gorm:"column:tx_hash;type:varchar(82)"`
+	LogIndex    int64  `gorm:"column:log_index"`
 	BlockNumber int64  `gorm:"column:block_number"`
 	Cutoff      int64  `gorm:"column:cutoff"`
 	CreateTime  int64  `gorm:"column:create_time"`
@@ -40,6 +41,7 @@ func (e *CutOffEvent) ConvertDown(src *types.CutoffEvent) error {
 	e.Owner = src.Owner.Hex()
 	e.Protocol = src.ContractAddress.Hex()
 	e.TxHash = src.TxHash.Hex()
+	e.LogIndex = src.LogIndex
 	e.Cutoff = src.Cutoff.Int64()
 	e.BlockNumber = src.Blocknumber.Int64()
 	e.CreateTime = src.Time.Int64()
@@ -52,6 +54,7 @@ func (e *CutOffEvent) ConvertUp(dst *types.CutoffEvent) error {
 	dst.Owner = common.HexToAddress(e.Owner)
 	dst.ContractAddress = common.HexToAddress(e.Protocol)
 	dst.TxHash = common.HexToHash(e.TxHash)
+	dst.LogIndex = e.LogIndex
 	dst.Blocknumber = big.NewInt(e.BlockNumber)
 	dst.Cutoff = big.NewInt(e.Cutoff)
 	dst.Time = big.NewInt(e.CreateTime)
@@ -90,3 +93,9 @@ func (s *RdsServiceImpl) UpdateCutoffByProtocolAndOwner(protocol, owner common.A
 	item := map[string]interface{}{"tx_hash": txhash.Hex(), "block_number": blockNumber.Int64(), "cutoff": cutoff.Int64(), "create_time": createTime}
 	return s.db.Model(&CutOffEvent{}).Where("contract_address = ? and owner = ?", protocol.Hex(), owner.Hex()).Update(item).Error
 }
+
+func (s *RdsServiceImpl) GetCutoffEventsByBlockRange(from, to int64) ([]CutOffEvent, error) {
+	var list []CutOffEvent
+	err := s.db.Where("block_number between ? and ?", from, to).Order("block_number asc, id asc").Find(&list).Error
+	return list, err
+}
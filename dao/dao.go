@@ -74,6 +74,9 @@ func (s *RdsServiceImpl) Prepare() {
 	tables = append(tables, &Token{})
 	tables = append(tables, &EventLog{})
 	tables = append(tables, &FilledOrder{})
+	tables = append(tables, &AdminAudit{})
+	tables = append(tables, &PendingTransaction{})
+	tables = append(tables, &ReindexCheckpoint{})
 
 	for _, t := range tables {
 		if ok := s.db.HasTable(t); !ok {
@@ -82,4 +85,20 @@ func (s *RdsServiceImpl) Prepare() {
 			}
 		}
 	}
+
+	s.migrateLogIndex()
+}
+
+// 事件表在增加log_index之前已创建时补充该列，已有记录的log_index为0
+func (s *RdsServiceImpl) migrateLogIndex() {
+	tables := []interface{}{&RingMinedEvent{}, &FillEvent{}, &CancelEvent{}, &CutOffEvent{}}
+	for _, t := range tables {
+		scope := s.db.NewScope(t)
+		if s.db.Dialect().HasColumn(scope.TableName(), "log_index") {
+			continue
+		}
+		if err := s.db.Exec("ALTER TABLE " + scope.QuotedTableName() + " ADD COLUMN log_index bigint NOT NULL DEFAULT 0").Error; err != nil {
+			log.Fatalf("add column log_index to mysql table %s error:%s", scope.TableName(), err.Error())
+		}
+	}
 }
@@ -33,6 +33,7 @@ type FillEvent struct {
 	CreateTime    int64  `gorm:"column:create_time" json:"createTime"`
 	RingHash      string `gorm:"column:ring_hash;varchar(82)" json:"ringHash"`
 	TxHash        string `gorm:"column:tx_hash;type:varchar(82)" json:"txHash"`
+	LogIndex      int64  `gorm:"column:log_index" json:"logIndex"`
 	PreOrderHash  string `gorm:"column:pre_order_hash;varchar(82)" json:"preOrderHash"`
 	NextOrderHash string `gorm:"column:next_order_hash;varchar(82)" json:"nextOrderHash"`
 	OrderHash     string `gorm:"column:order_hash;type:varchar(82)" json:"orderHash"`
@@ -61,12 +62,14 @@ func (f *FillEvent) ConvertDown(src *types.OrderFilledEvent) error {
 	f.CreateTime = src.Time.Int64()
 	f.RingHash = src.Ringhash.Hex()
 	f.TxHash = src.TxHash.Hex()
+	f.LogIndex = src.LogIndex
 	f.PreOrderHash = src.PreOrderHash.Hex()
 	f.NextOrderHash = src.NextOrderHash.Hex()
 	f.OrderHash = src.OrderHash.Hex()
 	f.TokenS = src.TokenS.Hex()
 	f.TokenB = src.TokenB.Hex()
 	f.Owner = src.Owner.Hex()
+	f.Market = src.Market
 
 	return nil
 }
@@ -81,6 +84,16 @@ func (s *RdsServiceImpl) FindFillEventByRinghashAndOrderhash(ringhash, orderhash
 	return &fill, err
 }
 
+// 一个RingMined事件对应多个fill，需要同时根据订单hash区分
+func (s *RdsServiceImpl) FindFillEventByLogIndex(txhash common.Hash, logIndex int64, orderhash common.Hash) (*FillEvent, error) {
+	var (
+		fill FillEvent
+		err  error
+	)
+	err = s.db.Where("tx_hash = ? and log_index = ? and order_hash = ?", txhash.Hex(), logIndex, orderhash.Hex()).First(&fill).Error
+	return &fill, err
+}
+
 func (s *RdsServiceImpl) FillsPageQuery(query map[string]interface{}, pageIndex, pageSize int) (res PageResult, err error) {
 	fills := make([]FillEvent, 0)
 	res = PageResult{PageIndex: pageIndex, PageSize: pageSize, Data: make([]interface{}, 0)}
@@ -136,3 +149,15 @@ func buildTimeQueryString(start, end int64) string {
 func (s *RdsServiceImpl) RollBackFill(from, to int64) error {
 	return s.db.Where("block_number > ? and block_number <= ?", from, to).Delete(&FillEvent{}).Error
 }
+
+func (s *RdsServiceImpl) GetFillEventsByBlockRange(from, to int64) ([]FillEvent, error) {
+	var list []FillEvent
+	err := s.db.Where("block_number between ? and ?", from, to).Order("block_number asc, id asc").Find(&list).Error
+	return list, err
+}
+
+func (s *RdsServiceImpl) GetFillEventsByOrderHashs(orderhashs []string) ([]FillEvent, error) {
+	var list []FillEvent
+	err := s.db.Where("order_hash in (?)", orderhashs).Order("block_number asc, log_index asc, id asc").Find(&list).Error
+	return list, err
+}
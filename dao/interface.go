@@ -38,7 +38,9 @@ type RdsService interface {
 
 	// ring mined table
 	FindRingMinedByRingHash(ringhash string) (*RingMinedEvent, error)
+	FindRingMinedByLogIndex(txhash common.Hash, logIndex int64) (*RingMinedEvent, error)
 	RollBackRingMined(from, to int64) error
+	GetRingMinedByBlockRange(from, to int64) ([]RingMinedEvent, error)
 
 	// order table
 	GetOrderByHash(orderhash common.Hash) (*Order, error)
@@ -46,37 +48,52 @@ type RdsService interface {
 	MarkMinerOrders(filterOrderhashs []string, blockNumber int64) error
 	GetOrdersForMiner(protocol, tokenS, tokenB string, length int, filterStatus []types.OrderStatus, markBlockNumber int64) ([]*Order, error)
 	GetOrdersWithBlockNumberRange(from, to int64) ([]Order, error)
+	GetOrdersAliveBetween(fromTime, toTime int64) ([]Order, error)
 	GetCutoffOrders(cutoffTime int64) ([]Order, error)
-	SettleOrdersCutoffStatus(owner common.Address, cutoffTime *big.Int) error
+	GetCutoffOrdersByOwner(owner common.Address, cutoffTime int64) ([]Order, error)
+	SettleOrdersCutoffStatus(owner common.Address, cutoffTime *big.Int) ([]Order, error)
+	SettleOrdersExpiredStatus(blockTime int64) ([]Order, error)
+	UpdateOrderWhileSoftCancel(hash common.Hash) (int64, error)
 	CheckOrderCutoff(orderhash string, cutoff int64) bool
 	GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]Order, error)
+	CountOpenOrders(owner, tokenA, tokenB common.Address, nowtime int64) (int, error)
 	OrderPageQuery(query map[string]interface{}, pageIndex, pageSize int) (PageResult, error)
 	UpdateBroadcastTimeByHash(hash string, bt int) error
 	UpdateOrderWhileFill(hash common.Hash, status types.OrderStatus, dealtAmountS, dealtAmountB, blockNumber *big.Int) error
 	UpdateOrderWhileCancel(hash common.Hash, status types.OrderStatus, cancelledAmountS, cancelledAmountB, blockNumber *big.Int) error
+	UpdateOrderWhileRebuild(hash common.Hash, status types.OrderStatus, dealtAmountS, dealtAmountB, cancelledAmountS, cancelledAmountB, blockNumber *big.Int) error
 
 	// block table
 	FindBlockByHash(blockhash common.Hash) (*Block, error)
 	FindBlockByParentHash(parenthash common.Hash) (*Block, error)
 	FindLatestBlock() (*Block, error)
 	FindForkBlock() (*Block, error)
+	GetBlocksByNumberRange(from, to int64) ([]Block, error)
 	SetForkBlock(blockhash common.Hash) error
+	RollBackBlock(from, to int64) error
 
 	// fill event table
 	FindFillEventByRinghashAndOrderhash(ringhash, orderhash common.Hash) (*FillEvent, error)
+	FindFillEventByLogIndex(txhash common.Hash, logIndex int64, orderhash common.Hash) (*FillEvent, error)
 	QueryRecentFills(mkt, owner string, start int64, end int64) (fills []FillEvent, err error)
 	RollBackFill(from, to int64) error
+	GetFillEventsByBlockRange(from, to int64) ([]FillEvent, error)
+	GetFillEventsByOrderHashs(orderhashs []string) ([]FillEvent, error)
 	FillsPageQuery(query map[string]interface{}, pageIndex, pageSize int) (res PageResult, err error)
 
 	// cancel event table
 	FindCancelEvent(orderhash, txhash common.Hash) (*CancelEvent, error)
+	FindCancelEventByLogIndex(txhash common.Hash, logIndex int64) (*CancelEvent, error)
 	RollBackCancel(from, to int64) error
+	GetCancelEventsByBlockRange(from, to int64) ([]CancelEvent, error)
+	GetCancelEventsByOrderHashs(orderhashs []string) ([]CancelEvent, error)
 
 	// cutoff event table
 	FindCutoffEventByOwnerAddress(owner common.Address) (*CutOffEvent, error)
 	FindValidCutoffEvents() ([]CutOffEvent, error)
 	UpdateCutoffByProtocolAndOwner(protocol, owner common.Address, txhash common.Hash, blockNumber, cutoff, createTime *big.Int) error
 	RollBackCutoff(from, to int64) error
+	GetCutoffEventsByBlockRange(from, to int64) ([]CutOffEvent, error)
 
 	// trend table
 	TrendPageQuery(query Trend, pageIndex, pageSize int) (pageResult PageResult, err error)
@@ -84,6 +101,8 @@ type RdsService interface {
 
 	// white list
 	GetWhiteList() ([]WhiteList, error)
+	AddWhiteList(item *WhiteList) error
+	DelWhiteList(owner string) error
 
 	//ringSubmitInfo
 	UpdateRingSubmitInfoRegistryTxHash(ringhashs []common.Hash, txHash string) error
@@ -91,8 +110,14 @@ type RdsService interface {
 	UpdateRingSubmitInfoRegistryUsedGas(txHash string, usedGas *big.Int) error
 	UpdateRingSubmitInfoSubmitUsedGas(txHash string, usedGas *big.Int) error
 	UpdateRingSubmitInfoFailed(ringhashs []common.Hash, err string) error
+	UpdateRingSubmitInfoTxHash(oldTxHash, newTxHash string) error
+	UpdateRingSubmitInfoStatus(txHash string, status types.TransactionStatus) error
+	UpdateRingSubmitInfoRealizedProfit(ringhash common.Hash, legalFee, gasCost, profit *big.Rat) error
 	GetRingForSubmitByHash(ringhash common.Hash) (RingSubmitInfo, error)
 	GetRingHashesByTxHash(txHash common.Hash) ([]common.Hash, error)
+	GetUnfinishedRingSubmitInfos() ([]RingSubmitInfo, error)
+	GetFilledOrdersByRinghash(ringhash common.Hash) ([]FilledOrder, error)
+	RingSubmitInfoPageQuery(state, ringhash string, pageIndex, pageSize int) (PageResult, error)
 	RingMinedPageQuery(query map[string]interface{}, pageIndex, pageSize int) (res PageResult, err error)
 
 	// token
@@ -100,4 +125,16 @@ type RdsService interface {
 	FindDeniedTokens() ([]Token, error)
 	FindUnDeniedMarkets() ([]Token, error)
 	FindDeniedMarkets() ([]Token, error)
+	FindTokenByProtocol(protocol string) (*Token, error)
+	SetTokenDeny(protocol string, deny bool) error
+
+	// admin audit
+	AdminAuditPageQuery(query map[string]interface{}, pageIndex, pageSize int) (PageResult, error)
+
+	// reindex checkpoint table
+	FindReindexCheckpoint(from, to int64) (*ReindexCheckpoint, error)
+
+	// pending transaction table
+	GetUnfinishedTransactions() ([]PendingTransaction, error)
+	UpdatePendingTransactionStatus(txHashes []string, status types.TransactionStatus, updateTime int64) error
 }
@@ -199,7 +199,7 @@ func (s *RdsServiceImpl) GetOrdersWithBlockNumberRange(from, to int64) ([]Order,
 		err  error
 	)
 
-	if from < to {
+	if from > to {
 		return list, fmt.Errorf("dao/order GetOrdersWithBlockNumberRange invalid block number")
 	}
 
@@ -219,6 +219,12 @@ func (s *RdsServiceImpl) GetCutoffOrders(cutoffTime int64) ([]Order, error) {
 	return list, err
 }
 
+func (s *RdsServiceImpl) GetCutoffOrdersByOwner(owner common.Address, cutoffTime int64) ([]Order, error) {
+	var list []Order
+	err := s.db.Where("owner = ? and create_time < ?", owner.Hex(), cutoffTime).Find(&list).Error
+	return list, err
+}
+
 func (s *RdsServiceImpl) CheckOrderCutoff(orderhash string, cutoff int64) bool {
 	model := Order{}
 	err := s.db.Where("order_hash = ? and create_time < ?").Find(&model).Error
@@ -229,10 +235,36 @@ func (s *RdsServiceImpl) CheckOrderCutoff(orderhash string, cutoff int64) bool {
 	return true
 }
 
-func (s *RdsServiceImpl) SettleOrdersCutoffStatus(owner common.Address, cutoffTime *big.Int) error {
+// 将owner在cutoffTime之前创建的有效订单状态置为cutoff，返回被修改的订单
+func (s *RdsServiceImpl) SettleOrdersCutoffStatus(owner common.Address, cutoffTime *big.Int) ([]Order, error) {
+	filterStatus := []types.OrderStatus{types.ORDER_PARTIAL, types.ORDER_NEW, types.ORDER_SOFT_CANCEL}
+	return s.settleOrdersStatus(filterStatus, types.ORDER_CUTOFF, "create_time < ? and owner = ?", cutoffTime.Int64(), owner.Hex())
+}
+
+// 将blockTime时已过期的订单状态置为expire，返回被修改的订单
+func (s *RdsServiceImpl) SettleOrdersExpiredStatus(blockTime int64) ([]Order, error) {
 	filterStatus := []types.OrderStatus{types.ORDER_PARTIAL, types.ORDER_NEW}
-	err := s.db.Model(&Order{}).Where("create_time < ? and owner = ? and status in (?)", cutoffTime.Int64(), owner.Hex(), filterStatus).Update("status", types.ORDER_CUTOFF).Error
-	return err
+	return s.settleOrdersStatus(filterStatus, types.ORDER_EXPIRE, "create_time + ttl <= ?", blockTime)
+}
+
+// 先查询再按order_hash修改，状态在此期间已变化的订单不会被修改
+func (s *RdsServiceImpl) settleOrdersStatus(filterStatus []types.OrderStatus, status types.OrderStatus, query string, args ...interface{}) ([]Order, error) {
+	var list []Order
+	args = append(args, filterStatus)
+	if err := s.db.Where(query+" and status in (?)", args...).Find(&list).Error; err != nil {
+		return nil, err
+	}
+	if len(list) == 0 {
+		return list, nil
+	}
+
+	hashes := []string{}
+	for i := range list {
+		hashes = append(hashes, list[i].OrderHash)
+		list[i].Status = uint8(status)
+	}
+	err := s.db.Model(&Order{}).Where("order_hash in (?) and status in (?)", hashes, filterStatus).Update("status", status).Error
+	return list, err
 }
 
 func (s *RdsServiceImpl) GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]Order, error) {
@@ -241,12 +273,30 @@ func (s *RdsServiceImpl) GetOrderBook(protocol, tokenS, tokenB common.Address, l
 		err  error
 	)
 
+	filterStatus := []types.OrderStatus{types.ORDER_PARTIAL, types.ORDER_NEW}
+	nowtime := time.Now().Unix()
 	err = s.db.Where("protocol = ? and token_s = ? and token_b = ?", protocol.Hex(), tokenS.Hex(), tokenB.Hex()).
+		Where("status in (?)", filterStatus).
+		Where("create_time + ttl > ?", nowtime).
 		Order("price desc").Limit(length).Find(&list).Error
 
 	return list, err
 }
 
+// CountOpenOrders counts orders of owner which can still be matched in the market of tokenA and tokenB, both sides are included
+func (s *RdsServiceImpl) CountOpenOrders(owner, tokenA, tokenB common.Address, nowtime int64) (int, error) {
+	var count int
+
+	filterStatus := []types.OrderStatus{types.ORDER_PARTIAL, types.ORDER_NEW}
+	err := s.db.Model(&Order{}).Where("owner = ?", owner.Hex()).
+		Where("(token_s = ? and token_b = ?) or (token_s = ? and token_b = ?)", tokenA.Hex(), tokenB.Hex(), tokenB.Hex(), tokenA.Hex()).
+		Where("status in (?)", filterStatus).
+		Where("create_time + ttl > ?", nowtime).
+		Count(&count).Error
+
+	return count, err
+}
+
 func (s *RdsServiceImpl) OrderPageQuery(query map[string]interface{}, pageIndex, pageSize int) (PageResult, error) {
 	var (
 		orders     []Order
@@ -303,3 +353,30 @@ func (s *RdsServiceImpl) UpdateOrderWhileCancel(hash common.Hash, status types.O
 	}
 	return s.db.Model(&Order{}).Where("order_hash = ?", hash.Hex()).Update(items).Error
 }
+
+// 重建订单时只更新成交及取消量、状态，其余字段由order manager维护
+func (s *RdsServiceImpl) UpdateOrderWhileRebuild(hash common.Hash, status types.OrderStatus, dealtAmountS, dealtAmountB, cancelledAmountS, cancelledAmountB, blockNumber *big.Int) error {
+	items := map[string]interface{}{
+		"status":             uint8(status),
+		"dealt_amount_s":     dealtAmountS.String(),
+		"dealt_amount_b":     dealtAmountB.String(),
+		"cancelled_amount_s": cancelledAmountS.String(),
+		"cancelled_amount_b": cancelledAmountB.String(),
+		"updated_block":      blockNumber.Int64(),
+	}
+	return s.db.Model(&Order{}).Where("order_hash = ?", hash.Hex()).Update(items).Error
+}
+
+// 软取消只作用于未完成的订单
+func (s *RdsServiceImpl) UpdateOrderWhileSoftCancel(hash common.Hash) (int64, error) {
+	filterStatus := []types.OrderStatus{types.ORDER_PARTIAL, types.ORDER_NEW}
+	db := s.db.Model(&Order{}).Where("order_hash = ? and status in (?)", hash.Hex(), filterStatus).Update("status", types.ORDER_SOFT_CANCEL)
+	return db.RowsAffected, db.Error
+}
+
+// 在[fromTime, toTime]内曾处于有效期的订单
+func (s *RdsServiceImpl) GetOrdersAliveBetween(fromTime, toTime int64) ([]Order, error) {
+	var list []Order
+	err := s.db.Where("create_time <= ? and create_time + ttl >= ?", toTime, fromTime).Find(&list).Error
+	return list, err
+}
@@ -0,0 +1,50 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package dao
+
+import (
+	"github.com/Loopring/relay/types"
+)
+
+// PendingTransaction records every transaction sent by miner accounts, a replacement is a new row with the same sender and nonce
+type PendingTransaction struct {
+	ID         int    `gorm:"column:id;primary_key"`
+	Sender     string `gorm:"column:sender;type:varchar(42)"`
+	Nonce      int64  `gorm:"column:nonce;type:bigint"`
+	TxHash     string `gorm:"column:tx_hash;type:varchar(82);unique_index"`
+	To         string `gorm:"column:to_address;type:varchar(42)"`
+	Value      string `gorm:"column:value;type:varchar(50)"`
+	Gas        string `gorm:"column:gas;type:varchar(50)"`
+	GasPrice   string `gorm:"column:gas_price;type:varchar(50)"`
+	Data       string `gorm:"column:data;type:text"`
+	Status     uint8  `gorm:"column:status;type:tinyint(4)"`
+	CreateTime int64  `gorm:"column:create_time"`
+	UpdateTime int64  `gorm:"column:update_time"`
+}
+
+// 未得到最终结果的交易，按id排序，同一nonce最后一条为最新发送的交易
+func (s *RdsServiceImpl) GetUnfinishedTransactions() ([]PendingTransaction, error) {
+	var txs []PendingTransaction
+	err := s.db.Where("status in (?)", []uint8{uint8(types.TX_STATUS_PENDING), uint8(types.TX_STATUS_REPLACED)}).Order("id asc").Find(&txs).Error
+	return txs, err
+}
+
+func (s *RdsServiceImpl) UpdatePendingTransactionStatus(txHashes []string, status types.TransactionStatus, updateTime int64) error {
+	return s.db.Model(&PendingTransaction{}).Where("tx_hash in (?)", txHashes).Updates(map[string]interface{}{"status": uint8(status), "update_time": updateTime}).Error
+}
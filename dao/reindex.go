@@ -0,0 +1,39 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package dao
+
+// ReindexCheckpoint 记录重新解析历史区块的进度，同一区间重复执行时从Current的下一个区块继续
+type ReindexCheckpoint struct {
+	ID         int   `gorm:"column:id;primary_key"`
+	FromBlock  int64 `gorm:"column:from_block;unique_index:idx_reindex_range"`
+	ToBlock    int64 `gorm:"column:to_block;unique_index:idx_reindex_range"`
+	Current    int64 `gorm:"column:current"`
+	Finished   bool  `gorm:"column:finished"`
+	CreateTime int64 `gorm:"column:create_time"`
+	UpdateTime int64 `gorm:"column:update_time"`
+}
+
+func (s *RdsServiceImpl) FindReindexCheckpoint(from, to int64) (*ReindexCheckpoint, error) {
+	var (
+		model ReindexCheckpoint
+		err   error
+	)
+	err = s.db.Where("from_block = ? and to_block = ?", from, to).First(&model).Error
+	return &model, err
+}
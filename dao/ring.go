@@ -19,6 +19,7 @@
 package dao
 
 import (
+	"fmt"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
@@ -109,6 +110,14 @@ func (daoFilledOrder *FilledOrder) ConvertUp(filledOrder *types.FilledOrder, rds
 	return nil
 }
 
+// 环路在ring_submit_info中的状态
+const (
+	RING_STATE_PENDING   = "pending"   //未提交submitRing交易
+	RING_STATE_SUBMITTED = "submitted" //submitRing交易未确认
+	RING_STATE_MINED     = "mined"
+	RING_STATE_FAILED    = "failed"
+)
+
 type RingSubmitInfo struct {
 	ID               int    `gorm:"column:id;primary_key;"`
 	RingHash         string `gorm:"column:ringhash;type:varchar(82)"`
@@ -127,8 +136,15 @@ type RingSubmitInfo struct {
 	ProtocolTxHash string `gorm:"column:protocol_tx_hash;type:varchar(82)"`
 	RegistryTxHash string `gorm:"column:registry_tx_hash;type:varchar(82)"`
 
-	Miner string `gorm:"column:miner;type:varchar(42)"`
-	Err   string `gorm:"column:err;type:text"`
+	Miner  string `gorm:"column:miner;type:varchar(42)"`
+	Err    string `gorm:"column:err;type:text"`
+	Status uint8  `gorm:"column:status;type:tinyint(4)"` //submitRing交易的状态
+
+	LegalFee         string `gorm:"column:legal_fee;type:varchar(82)"`          //提交时预估的法币收入
+	Received         string `gorm:"column:received;type:varchar(82)"`           //提交时预估的收益
+	RealizedLegalFee string `gorm:"column:realized_legal_fee;type:varchar(82)"` //根据RingMined事件计算的法币收入
+	RealizedGasCost  string `gorm:"column:realized_gas_cost;type:varchar(82)"`  //根据实际使用的gas计算的法币费用
+	RealizedProfit   string `gorm:"column:realized_profit;type:varchar(82)"`
 }
 
 func getBigIntString(v *big.Int) string {
@@ -152,6 +168,10 @@ func (info *RingSubmitInfo) ConvertDown(typesInfo *types.RingSubmitInfo) error {
 	info.RegistryUsedGas = getBigIntString(typesInfo.RegistryUsedGas)
 	info.RegistryGasPrice = getBigIntString(typesInfo.RegistryGasPrice)
 	info.Miner = typesInfo.Miner.Hex()
+	if nil != typesInfo.RawRing {
+		info.LegalFee = getRatString(typesInfo.RawRing.LegalFee)
+	}
+	info.Received = getRatString(typesInfo.Received)
 	return nil
 }
 
@@ -176,6 +196,10 @@ func (info *RingSubmitInfo) ConvertUp(typesInfo *types.RingSubmitInfo) error {
 	typesInfo.SubmitTxHash = common.HexToHash(info.ProtocolTxHash)
 	typesInfo.RegistryTxHash = common.HexToHash(info.RegistryTxHash)
 	typesInfo.Miner = common.HexToAddress(info.Miner)
+	if "" != info.Received {
+		typesInfo.Received = new(big.Rat)
+		typesInfo.Received.SetString(info.Received)
+	}
 	return nil
 }
 
@@ -214,13 +238,26 @@ func (s *RdsServiceImpl) GetRingHashesByTxHash(txHash common.Hash) ([]common.Has
 		hashesStr []string
 	)
 
-	err = s.db.Model(&RingSubmitInfo{}).Where("registry_tx_hash = ? or submit_tx_hash = ? ", txHash.Hex(), txHash.Hex()).Pluck("ringhash", hashesStr).Error
+	err = s.db.Model(&RingSubmitInfo{}).Where("registry_tx_hash = ? or protocol_tx_hash = ? ", txHash.Hex(), txHash.Hex()).Pluck("ringhash", &hashesStr).Error
 	for _, h := range hashesStr {
 		hashes = append(hashes, common.HexToHash(h))
 	}
 	return hashes, err
 }
 
+// 交易被替换后，环路跟随新的交易
+func (s *RdsServiceImpl) UpdateRingSubmitInfoTxHash(oldTxHash, newTxHash string) error {
+	if err := s.db.Model(&RingSubmitInfo{}).Where("protocol_tx_hash = ?", oldTxHash).Update("protocol_tx_hash", newTxHash).Error; nil != err {
+		return err
+	}
+	return s.db.Model(&RingSubmitInfo{}).Where("registry_tx_hash = ?", oldTxHash).Update("registry_tx_hash", newTxHash).Error
+}
+
+func (s *RdsServiceImpl) UpdateRingSubmitInfoStatus(txHash string, status types.TransactionStatus) error {
+	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("protocol_tx_hash = ?", txHash)
+	return dbForUpdate.Update("status", uint8(status)).Error
+}
+
 func (s *RdsServiceImpl) UpdateRingSubmitInfoRegistryUsedGas(txHash string, usedGas *big.Int) error {
 	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("registry_tx_hash = ?", txHash)
 	return dbForUpdate.Update("registry_used_gas", getBigIntString(usedGas)).Error
@@ -230,3 +267,79 @@ func (s *RdsServiceImpl) UpdateRingSubmitInfoSubmitUsedGas(txHash string, usedGa
 	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("protocol_tx_hash = ?", txHash)
 	return dbForUpdate.Update("protocol_used_gas", getBigIntString(usedGas)).Error
 }
+
+func (s *RdsServiceImpl) UpdateRingSubmitInfoRealizedProfit(ringhash common.Hash, legalFee, gasCost, profit *big.Rat) error {
+	dbForUpdate := s.db.Model(&RingSubmitInfo{}).Where("ringhash = ?", ringhash.Hex())
+	return dbForUpdate.Updates(map[string]interface{}{
+		"realized_legal_fee": getRatString(legalFee),
+		"realized_gas_cost":  getRatString(gasCost),
+		"realized_profit":    getRatString(profit),
+	}).Error
+}
+
+// 已提交但未打包也未失败的环路，用于miner重启后恢复
+func (s *RdsServiceImpl) GetUnfinishedRingSubmitInfos() ([]RingSubmitInfo, error) {
+	var infos []RingSubmitInfo
+	statuses := []uint8{uint8(types.TX_STATUS_UNKNOWN), uint8(types.TX_STATUS_PENDING), uint8(types.TX_STATUS_REPLACED)}
+	err := s.db.Where("(err = '' or err is null) and status in (?)", statuses).Find(&infos).Error
+	return infos, err
+}
+
+func (s *RdsServiceImpl) GetFilledOrdersByRinghash(ringhash common.Hash) ([]FilledOrder, error) {
+	var filledOrders []FilledOrder
+	err := s.db.Where("ringhash = ?", ringhash.Hex()).Find(&filledOrders).Error
+	return filledOrders, err
+}
+
+func (info *RingSubmitInfo) State() string {
+	if "" != info.Err || info.Status == uint8(types.TX_STATUS_FAILED) || info.Status == uint8(types.TX_STATUS_DROPPED) || info.Status == uint8(types.TX_STATUS_TIMEOUT) {
+		return RING_STATE_FAILED
+	} else if info.Status == uint8(types.TX_STATUS_SUCCESS) {
+		return RING_STATE_MINED
+	} else if "" != info.ProtocolTxHash {
+		return RING_STATE_SUBMITTED
+	} else {
+		return RING_STATE_PENDING
+	}
+}
+
+func (s *RdsServiceImpl) RingSubmitInfoPageQuery(state, ringhash string, pageIndex, pageSize int) (res PageResult, err error) {
+	if pageIndex <= 0 {
+		pageIndex = 1
+	}
+	if pageSize <= 0 || pageSize > 50 {
+		pageSize = 20
+	}
+	res = PageResult{PageIndex: pageIndex, PageSize: pageSize, Data: make([]interface{}, 0)}
+
+	db := s.db.Model(&RingSubmitInfo{})
+	if "" != ringhash {
+		db = db.Where("ringhash = ?", ringhash)
+	}
+	noErr := "(err = '' or err is null)"
+	switch state {
+	case "":
+	case RING_STATE_FAILED:
+		db = db.Where("(err <> '' and err is not null) or status in (?)", []uint8{uint8(types.TX_STATUS_FAILED), uint8(types.TX_STATUS_DROPPED), uint8(types.TX_STATUS_TIMEOUT)})
+	case RING_STATE_MINED:
+		db = db.Where(noErr+" and status = ?", uint8(types.TX_STATUS_SUCCESS))
+	case RING_STATE_SUBMITTED:
+		db = db.Where(noErr+" and protocol_tx_hash <> '' and status in (?)", []uint8{uint8(types.TX_STATUS_UNKNOWN), uint8(types.TX_STATUS_PENDING), uint8(types.TX_STATUS_REPLACED)})
+	case RING_STATE_PENDING:
+		db = db.Where(noErr+" and (protocol_tx_hash = '' or protocol_tx_hash is null) and status in (?)", []uint8{uint8(types.TX_STATUS_UNKNOWN), uint8(types.TX_STATUS_PENDING), uint8(types.TX_STATUS_REPLACED)})
+	default:
+		return res, fmt.Errorf("dao,unsupported ring state:%s", state)
+	}
+
+	if err = db.Count(&res.Total).Error; nil != err {
+		return res, err
+	}
+	var infos []RingSubmitInfo
+	if err = db.Order("id desc").Offset((pageIndex - 1) * pageSize).Limit(pageSize).Find(&infos).Error; nil != err {
+		return res, err
+	}
+	for _, info := range infos {
+		res.Data = append(res.Data, info)
+	}
+	return res, nil
+}
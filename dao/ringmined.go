@@ -30,6 +30,7 @@ type RingMinedEvent struct {
 	RingIndex          string `gorm:"column:ring_index;type:varchar(30)" json:"ringIndex"`
 	RingHash           string `gorm:"column:ring_hash;type:varchar(82);unique_index" json:"ringHash"`
 	TxHash             string `gorm:"column:tx_hash;type:varchar(82)" json:"txHash"`
+	LogIndex           int64  `gorm:"column:log_index" json:"logIndex"`
 	Miner              string `gorm:"column:miner;type:varchar(42);" json:"miner"`
 	FeeRecipient       string `gorm:"column:fee_recipient;type:varchar(42)" json:"feeRecipient"`
 	IsRinghashReserved bool   `gorm:"column:is_ring_hash_reserved;" json:"isRinghashReserved"`
@@ -47,6 +48,7 @@ func (r *RingMinedEvent) ConvertDown(event *types.RingMinedEvent) error {
 	r.FeeRecipient = event.FeeRecipient.Hex()
 	r.RingHash = event.Ringhash.Hex()
 	r.TxHash = event.TxHash.Hex()
+	r.LogIndex = event.LogIndex
 	r.IsRinghashReserved = event.IsRinghashReserved
 	r.BlockNumber = event.Blocknumber.Int64()
 	r.Time = event.Time.Int64()
@@ -60,6 +62,7 @@ func (r *RingMinedEvent) ConvertUp(event *types.RingMinedEvent) error {
 	event.TotalLrcFee, _ = new(big.Int).SetString(r.TotalLrcFee, 0)
 	event.Ringhash = common.HexToHash(r.RingHash)
 	event.TxHash = common.HexToHash(r.TxHash)
+	event.LogIndex = r.LogIndex
 	event.Miner = common.HexToAddress(r.Miner)
 	event.FeeRecipient = common.HexToAddress(r.FeeRecipient)
 	event.IsRinghashReserved = r.IsRinghashReserved
@@ -81,6 +84,15 @@ func (s *RdsServiceImpl) FindRingMinedByRingHash(ringHash string) (*RingMinedEve
 	return &model, err
 }
 
+func (s *RdsServiceImpl) FindRingMinedByLogIndex(txhash common.Hash, logIndex int64) (*RingMinedEvent, error) {
+	var (
+		model RingMinedEvent
+		err   error
+	)
+	err = s.db.Where("tx_hash = ? and log_index = ?", txhash.Hex(), logIndex).First(&model).Error
+	return &model, err
+}
+
 func (s *RdsServiceImpl) RollBackRingMined(from, to int64) error {
 	err := s.db.Where("block_number > ? and block_number <= ?", from, to).Delete(&RingMinedEvent{}).Error
 	return err
@@ -105,3 +117,9 @@ func (s *RdsServiceImpl) RingMinedPageQuery(query map[string]interface{}, pageIn
 	}
 	return
 }
+
+func (s *RdsServiceImpl) GetRingMinedByBlockRange(from, to int64) ([]RingMinedEvent, error) {
+	var list []RingMinedEvent
+	err := s.db.Where("block_number between ? and ?", from, to).Order("block_number asc").Find(&list).Error
+	return list, err
+}
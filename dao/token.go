@@ -79,3 +79,13 @@ func (s *RdsServiceImpl) FindDeniedMarkets() ([]Token, error) {
 	err := s.db.Where("deny = ? and is_market = ?", true, true).Find(&list).Error
 	return list, err
 }
+
+func (s *RdsServiceImpl) FindTokenByProtocol(protocol string) (*Token, error) {
+	token := &Token{}
+	err := s.db.Where("protocol = ?", protocol).First(token).Error
+	return token, err
+}
+
+func (s *RdsServiceImpl) SetTokenDeny(protocol string, deny bool) error {
+	return s.db.Model(&Token{}).Where("protocol = ?", protocol).Update("deny", deny).Error
+}
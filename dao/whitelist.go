@@ -22,6 +22,7 @@ import (
 	"errors"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/jinzhu/gorm"
 )
 
 type WhiteList struct {
@@ -42,6 +43,23 @@ func (s *RdsServiceImpl) GetWhiteList() ([]WhiteList, error) {
 	return list, err
 }
 
+// AddWhiteList inserts the owner, or restores it if it has been deleted before
+func (s *RdsServiceImpl) AddWhiteList(item *WhiteList) error {
+	var current WhiteList
+	err := s.db.Where("owner = ?", item.Owner).First(&current).Error
+	if err == gorm.ErrRecordNotFound {
+		return s.db.Create(item).Error
+	} else if err != nil {
+		return err
+	}
+
+	return s.db.Model(&current).Updates(map[string]interface{}{"is_deleted": false, "create_time": item.CreateTime}).Error
+}
+
+func (s *RdsServiceImpl) DelWhiteList(owner string) error {
+	return s.db.Model(&WhiteList{}).Where("owner = ?", owner).Update("is_deleted", true).Error
+}
+
 func (w *WhiteList) ConvertDown(src *types.WhiteListUser) error {
 	w.Owner = src.Owner.Hex()
 	w.CreateTime = src.CreateTime
@@ -133,6 +133,46 @@ func (accessor *EthNodeAccessor) EstimateGas(callData []byte, to common.Address)
 	return
 }
 
+// 在blockParameter对应的状态上执行交易但不上链，交易失败时返回节点的错误
+func (accessor *EthNodeAccessor) SimulateTransaction(sender, to common.Address, gas, gasPrice *big.Int, callData []byte, blockParameter string) (string, error) {
+	var result string
+	callArg := &CallArg{}
+	callArg.From = sender
+	callArg.To = to
+	callArg.Data = common.ToHex(callData)
+	if nil != gas {
+		callArg.Gas = *types.NewBigPtr(gas)
+	}
+	if nil != gasPrice {
+		callArg.GasPrice = *types.NewBigPtr(gasPrice)
+	}
+	err := accessor.Call(&result, "eth_call", callArg, blockParameter)
+	return result, err
+}
+
+// 与SimulateTransaction相同，但通过debug_traceCall执行，返回的调用帧中包含交易产生的日志，节点需要开启debug接口
+func (accessor *EthNodeAccessor) TraceTransaction(sender, to common.Address, gas, gasPrice *big.Int, callData []byte, blockParameter string) (*CallFrame, error) {
+	callArg := &CallArg{}
+	callArg.From = sender
+	callArg.To = to
+	callArg.Data = common.ToHex(callData)
+	if nil != gas {
+		callArg.Gas = *types.NewBigPtr(gas)
+	}
+	if nil != gasPrice {
+		callArg.GasPrice = *types.NewBigPtr(gasPrice)
+	}
+	tracerOptions := map[string]interface{}{
+		"tracer":       "callTracer",
+		"tracerConfig": map[string]interface{}{"withLog": true},
+	}
+	frame := &CallFrame{}
+	if err := accessor.Call(frame, "debug_traceCall", callArg, blockParameter, tracerOptions); nil != err {
+		return nil, err
+	}
+	return frame, nil
+}
+
 func (accessor *EthNodeAccessor) ContractCallMethod(a *abi.ABI, contractAddress common.Address) func(result interface{}, methodName, blockParameter string, args ...interface{}) error {
 	return func(result interface{}, methodName string, blockParameter string, args ...interface{}) error {
 		if callData, err := a.Pack(methodName, args...); nil != err {
@@ -95,18 +95,19 @@ type LogParameter struct {
 }
 
 type TransactionReceipt struct {
-	BlockHash         string    `json:"blockHash"`
-	BlockNumber       types.Big `json:"blockNumber"`
-	ContractAddress   string    `json:"contractAddress"`
-	CumulativeGasUsed types.Big `json:"cumulativeGasUsed"`
-	From              string    `json:"from"`
-	GasUsed           types.Big `json:"gasUsed"`
-	Logs              []Log     `json:"logs"`
-	LogsBloom         string    `json:"logsBloom"`
-	Root              string    `json:"root"`
-	To                string    `json:"to"`
-	TransactionHash   string    `json:"transactionHash"`
-	TransactionIndex  types.Big `json:"transactionIndex"`
+	BlockHash         string     `json:"blockHash"`
+	BlockNumber       types.Big  `json:"blockNumber"`
+	ContractAddress   string     `json:"contractAddress"`
+	CumulativeGasUsed types.Big  `json:"cumulativeGasUsed"`
+	From              string     `json:"from"`
+	GasUsed           types.Big  `json:"gasUsed"`
+	Logs              []Log      `json:"logs"`
+	LogsBloom         string     `json:"logsBloom"`
+	Root              string     `json:"root"`
+	Status            *types.Big `json:"status"` //byzantium之后才有
+	To                string     `json:"to"`
+	TransactionHash   string     `json:"transactionHash"`
+	TransactionIndex  types.Big  `json:"transactionIndex"`
 }
 
 type BlockIterator struct {
@@ -118,6 +119,33 @@ type BlockIterator struct {
 	confirms      uint64
 }
 
+// debug_traceCall使用callTracer并设置withLog时返回的调用帧，子调用的日志在Calls中
+type CallFrame struct {
+	Type   string      `json:"type"`
+	From   string      `json:"from"`
+	To     string      `json:"to"`
+	Output string      `json:"output"`
+	Error  string      `json:"error"`
+	Logs   []CallLog   `json:"logs"`
+	Calls  []CallFrame `json:"calls"`
+}
+
+type CallLog struct {
+	Address string   `json:"address"`
+	Topics  []string `json:"topics"`
+	Data    string   `json:"data"`
+}
+
+// AllLogs 按执行顺序返回该调用及其子调用产生的日志
+func (frame *CallFrame) AllLogs() []CallLog {
+	logs := []CallLog{}
+	logs = append(logs, frame.Logs...)
+	for idx := range frame.Calls {
+		logs = append(logs, frame.Calls[idx].AllLogs()...)
+	}
+	return logs
+}
+
 type CallArg struct {
 	From     common.Address `json:"from"`
 	To       common.Address `json:"to"`
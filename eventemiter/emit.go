@@ -29,11 +29,11 @@ type Topic string
 const (
 	OrderCanceled                  = "OrderCanceled"
 	OrderFilled                    = "OrderFilled"
-	ExtractorFork                  = "ExtractorFork" //chain forked
-	OrderManagerFork               = "OrderManagerFork"
+	ExtractorFork                  = "ExtractorFork"    //chain forked, rollback blocks (ForkBlock, EndBlock]
 	RingSubmitFailed               = "RingSubmitFailed" //submit ring failed
 	Transaction                    = "Transaction"
 	Gateway                        = "Gateway"
+	GatewaySoftCancel              = "GatewaySoftCancel"
 	AccountTransfer                = "AccountTransfer"
 	AccountApproval                = "AccountApproval"
 	TokenRegistered                = "TokenRegistered"
@@ -46,7 +46,8 @@ const (
 	OrderManagerExtractorFill      = "OrderManagerExtractorFill"
 	OrderManagerExtractorCancel    = "OrderManagerExtractorCancel"
 	OrderManagerExtractorCutoff    = "OrderManagerExtractorCutoff"
-	MinedOrderState                = "MinedOrderState" //orderbook send orderstate to miner
+	OrderManagerOrderStatusChanged = "OrderManagerOrderStatusChanged" //cancel、cutoff、soft cancel、expire后的订单状态
+	MinedOrderState                = "MinedOrderState"                //orderbook send orderstate to miner
 
 	//Miner
 	Miner_DeleteOrderState           = "Miner_DeleteOrderState"
@@ -57,6 +58,8 @@ const (
 	Miner_SubmitRing_Method          = "Miner_SubmitRing_Method"
 	Miner_SubmitRingHash_Method      = "Miner_SubmitRingHash_Method"
 	Miner_BatchSubmitRingHash_Method = "Miner_BatchSubmitRingHash_Method"
+	Miner_TransactionReplaced        = "Miner_TransactionReplaced"
+	Miner_TransactionFinished        = "Miner_TransactionFinished"
 
 	// Block
 	Block_New = "Block_New"
@@ -67,6 +70,17 @@ const (
 	// Methods
 	WethDepositMethod    = "WethDepositMethod"
 	WethWithdrawalMethod = "WethWithdrawalMethod"
+
+	// Pending:未达到确认块数的事件，只用于展示，不改变订单状态
+	PendingRingMined      = "PendingRingMined"
+	PendingOrderFilled    = "PendingOrderFilled"
+	PendingOrderCancelled = "PendingOrderCancelled"
+	PendingCutoff         = "PendingCutoff"
+	PendingTransfer       = "PendingTransfer"
+	PendingApproval       = "PendingApproval"
+	PendingWethDeposit    = "PendingWethDeposit"
+	PendingWethWithdrawal = "PendingWethWithdrawal"
+	PendingRetracted      = "PendingRetracted" //未确认区块被分叉，FromBlock及之后区块的pending事件作废
 )
 
 var watchers map[string][]*Watcher
@@ -51,10 +51,10 @@ func (l *ExtractorServiceImpl) loadProtocolAddress() {
 	}
 
 	for _, v := range l.accessor.ProtocolAddresses {
-		protocolSymbol := "loopring"
-		delegateSymbol := "transfer_delegate"
-		ringhashRegisterSymbol := "ringhash_register"
-		tokenRegisterSymbol := "token_register"
+		protocolSymbol := PROTOCOL_SYMBOL
+		delegateSymbol := DELEGATE_SYMBOL
+		ringhashRegisterSymbol := RINGHASH_REGISTER_SYMBOL
+		tokenRegisterSymbol := TOKEN_REGISTER_SYMBOL
 
 		l.protocols[v.ContractAddress] = protocolSymbol
 		l.protocols[v.TokenRegistryAddress] = tokenRegisterSymbol
@@ -72,12 +72,15 @@ type EventData struct {
 	Event           interface{}
 	ContractAddress string // 某个合约具体地址
 	TxHash          string // transaction hash
+	LogIndex        int64  // 事件在区块中的序号，与TxHash一起用于去重
 	CAbi            *abi.ABI
 	Id              common.Hash
 	Name            string
 	BlockNumber     *big.Int
 	Time            *big.Int
 	Topics          []string
+	Pending         bool // 未达到确认块数
+	handler         func(input eventemitter.EventData) error
 }
 
 type MethodData struct {
@@ -96,6 +99,7 @@ type MethodData struct {
 	LogAmount       int
 	Gas             *big.Int
 	GasPrice        *big.Int
+	Pending         bool // 未达到确认块数
 }
 
 func (m *MethodData) IsValid() error {
@@ -105,6 +109,13 @@ func (m *MethodData) IsValid() error {
 	return nil
 }
 
+const (
+	PROTOCOL_SYMBOL          = "loopring"
+	DELEGATE_SYMBOL          = "transfer_delegate"
+	RINGHASH_REGISTER_SYMBOL = "ringhash_register"
+	TOKEN_REGISTER_SYMBOL    = "token_register"
+)
+
 const (
 	RINGMINED_EVT_NAME           = "RingMined"
 	CANCEL_EVT_NAME              = "OrderCancelled"
@@ -126,6 +137,13 @@ const (
 	WETH_WITHDRAWAL_METHOD_NAME = "withdraw"
 )
 
+// 重新解析历史区块的实例不注册全局watcher，事件直接交给自身的handler，与运行中的extractor互不影响
+func (l *ExtractorServiceImpl) on(topic string, watcher *eventemitter.Watcher) {
+	if l.sink == nil {
+		eventemitter.On(topic, watcher)
+	}
+}
+
 func newEventData(event *abi.Event, cabi *abi.ABI) EventData {
 	var c EventData
 
@@ -167,7 +185,8 @@ func (l *ExtractorServiceImpl) loadProtocolContract() {
 			watcher = &eventemitter.Watcher{Concurrent: false, Handle: l.handleCutoffTimestampEvent}
 		}
 
-		eventemitter.On(contract.Id.Hex(), watcher)
+		l.on(contract.Id.Hex(), watcher)
+		contract.handler = watcher.Handle
 		l.events[contract.Id] = contract
 		log.Debugf("extracotr,contract event name:%s -> key:%s", contract.Name, contract.Id.Hex())
 	}
@@ -189,7 +208,7 @@ func (l *ExtractorServiceImpl) loadProtocolContract() {
 			watcher = &eventemitter.Watcher{Concurrent: false, Handle: l.handleCancelOrderMethod}
 		}
 
-		eventemitter.On(contract.Id, watcher)
+		l.on(contract.Id, watcher)
 		l.methods[contract.Id] = contract
 		log.Debugf("extracotr,contract method name:%s -> key:%s", contract.Name, contract.Id)
 	}
@@ -213,7 +232,8 @@ func (l *ExtractorServiceImpl) loadErc20Contract() {
 			watcher = &eventemitter.Watcher{Concurrent: false, Handle: l.handleApprovalEvent}
 		}
 
-		eventemitter.On(contract.Id.Hex(), watcher)
+		l.on(contract.Id.Hex(), watcher)
+		contract.handler = watcher.Handle
 		l.events[contract.Id] = contract
 		log.Debugf("extracotr,contract event name:%s -> key:%s", contract.Name, contract.Id.Hex())
 	}
@@ -237,7 +257,7 @@ func (l *ExtractorServiceImpl) loadWethContract() {
 			watcher = &eventemitter.Watcher{Concurrent: false, Handle: l.handleWethWithdrawalMethod}
 		}
 
-		eventemitter.On(contract.Id, watcher)
+		l.on(contract.Id, watcher)
 		l.methods[contract.Id] = contract
 		log.Debugf("extracotr,contract method name:%s -> key:%s", contract.Name, contract.Id)
 	}
@@ -261,7 +281,8 @@ func (l *ExtractorServiceImpl) loadTokenRegisterContract() {
 			watcher = &eventemitter.Watcher{Concurrent: false, Handle: l.handleTokenUnRegisteredEvent}
 		}
 
-		eventemitter.On(contract.Id.Hex(), watcher)
+		l.on(contract.Id.Hex(), watcher)
+		contract.handler = watcher.Handle
 		l.events[contract.Id] = contract
 		log.Debugf("extracotr,contract event name:%s -> key:%s", contract.Name, contract.Id.Hex())
 	}
@@ -277,8 +298,9 @@ func (l *ExtractorServiceImpl) loadRingHashRegisteredContract() {
 		contract.Event = &ethaccessor.RingHashSubmittedEvent{}
 
 		watcher := &eventemitter.Watcher{Concurrent: false, Handle: l.handleRinghashSubmitEvent}
-		eventemitter.On(contract.Id.Hex(), watcher)
+		l.on(contract.Id.Hex(), watcher)
 
+		contract.handler = watcher.Handle
 		l.events[contract.Id] = contract
 		log.Debugf("extracotr,contract event name:%s -> key:%s", contract.Name, contract.Id.Hex())
 	}
@@ -300,7 +322,7 @@ func (l *ExtractorServiceImpl) loadRingHashRegisteredContract() {
 			watcher = &eventemitter.Watcher{Concurrent: false, Handle: l.handleBatchSubmitRingHashMethod}
 		}
 
-		eventemitter.On(contract.Id, watcher)
+		l.on(contract.Id, watcher)
 		l.methods[contract.Id] = contract
 		log.Debugf("extracotr,contract method name:%s -> key:%s", contract.Name, contract.Id)
 	}
@@ -324,7 +346,8 @@ func (l *ExtractorServiceImpl) loadTokenTransferDelegateProtocol() {
 			watcher = &eventemitter.Watcher{Concurrent: false, Handle: l.handleAddressDeAuthorizedEvent}
 		}
 
-		eventemitter.On(contract.Id.Hex(), watcher)
+		l.on(contract.Id.Hex(), watcher)
+		contract.handler = watcher.Handle
 		l.events[contract.Id] = contract
 		log.Debugf("extracotr,contract event name:%s -> key:%s", contract.Name, contract.Id.Hex())
 	}
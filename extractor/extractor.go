@@ -54,25 +54,39 @@ type ExtractorServiceImpl struct {
 	dao          dao.RdsService
 	stop         chan struct{}
 	lock         sync.RWMutex
+	processMtx   sync.Mutex // 最终事件与pending事件共用合约解析结构，解析及发送需串行
 	events       map[common.Hash]EventData
 	methods      map[string]MethodData
 	protocols    map[common.Address]string
 	syncComplete bool
+	detector     *ForkDetector
+	sink         func(topic string, event eventemitter.EventData) // 不为空时事件交给sink处理而不发送，用于重新解析历史区块
+	pendingHash  map[int64]common.Hash                            // 已处理的未确认区块hash，只在pending协程中使用
 }
 
 func NewExtractorService(options config.AccessorOptions,
 	commonOpts config.CommonOptions,
 	accessor *ethaccessor.EthNodeAccessor,
 	rds dao.RdsService) *ExtractorServiceImpl {
+	return newExtractorService(options, commonOpts, accessor, rds, nil)
+}
+
+func newExtractorService(options config.AccessorOptions,
+	commonOpts config.CommonOptions,
+	accessor *ethaccessor.EthNodeAccessor,
+	rds dao.RdsService,
+	sink func(topic string, event eventemitter.EventData)) *ExtractorServiceImpl {
 	var l ExtractorServiceImpl
 
+	l.sink = sink
+	l.options = options
 	l.commOpts = commonOpts
 	l.accessor = accessor
 	l.dao = rds
 	l.syncComplete = false
+	l.detector = NewForkDetector(accessor, options.BlockWindow)
 
 	l.loadContract()
-	l.startDetectFork()
 
 	return &l
 }
@@ -82,7 +96,15 @@ func (l *ExtractorServiceImpl) Start() {
 
 	log.Info("extractor start...")
 	start, end := l.getBlockNumberRange()
-	iterator := l.accessor.BlockIterator(start, end, true, uint64(0))
+	l.loadBlockWindow(start)
+	if l.options.Confirms > 0 {
+		go l.extractPending()
+	}
+	if "log" == l.options.ExtractMode {
+		go l.extractByLogs(start, end)
+		return
+	}
+	iterator := l.accessor.BlockIterator(start, end, true, l.options.Confirms)
 
 	go func() {
 		for {
@@ -95,40 +117,23 @@ func (l *ExtractorServiceImpl) Start() {
 			block := inter.(*ethaccessor.BlockWithTxObject)
 			log.Debugf("extractor,get block:%s->%s", block.Number.BigInt().String(), block.Hash.Hex())
 
-			currentBlock := &types.Block{}
-			currentBlock.BlockNumber = block.Number.BigInt()
-			currentBlock.ParentHash = block.ParentHash
-			currentBlock.BlockHash = block.Hash
-			currentBlock.CreateTime = block.Timestamp.Int64()
-
 			// sync chain block number
 			if l.syncComplete == false {
 				var syncBlock types.Big
 				if err := l.accessor.Call(&syncBlock, "eth_blockNumber"); err != nil {
 					log.Fatalf("extractor,sync chain block,get ethereum node current block number error:%s", err.Error())
 				}
-				if syncBlock.BigInt().Cmp(currentBlock.BlockNumber) <= 0 && l.syncComplete == false {
-					eventemitter.Emit(eventemitter.SyncChainComplete, syncBlock)
-					l.syncComplete = true
-					log.Debugf("extractor,sync chain block complete!")
-				} else {
-					log.Debugf("extractor,chain block syncing... ")
-				}
+				l.checkSyncComplete(&syncBlock, block.Number.BigInt())
 			}
 
-			// emit new block
-			blockEvent := &types.BlockEvent{}
-			blockEvent.BlockNumber = block.Number.BigInt()
-			blockEvent.BlockHash = block.Hash
-			eventemitter.Emit(eventemitter.Block_New, blockEvent)
-
-			// convert block to dao entity
-			var entity dao.Block
-			if err := entity.ConvertDown(currentBlock); err != nil {
-				log.Debugf("extractor,convert block to dao/entity error:%s", err.Error())
-			} else {
-				l.dao.Add(&entity)
+			// detect chain fork,分叉时从共同祖先的下一个区块重新解析
+			currentBlock := newBlock(&block.Block)
+			if forkEvent := l.detectFork(currentBlock); forkEvent != nil {
+				l.processFork(forkEvent)
+				iterator = l.accessor.BlockIterator(new(big.Int).Add(forkEvent.ForkBlock, big.NewInt(1)), end, true, l.options.Confirms)
+				continue
 			}
+			l.processBlock(currentBlock)
 
 			// base filter
 			txcnt := len(block.Transactions)
@@ -139,12 +144,6 @@ func (l *ExtractorServiceImpl) Start() {
 				log.Infof("extractor,get block transaction list length %d", txcnt)
 			}
 
-			// detect chain fork
-			if err := l.detectFork(currentBlock); err != nil {
-				log.Debugf("extractor,detect fork error:%s", err.Error())
-				continue
-			}
-
 			// process block
 			for _, tx := range block.Transactions {
 				log.Debugf("extractor,get transaction hash:%s", tx.Hash)
@@ -155,7 +154,7 @@ func (l *ExtractorServiceImpl) Start() {
 				}
 
 				// 解析method，获得ring内等orders并发送到orderbook保存
-				if err := l.processMethod(tx.Hash, block.Timestamp.BigInt(), block.Number.BigInt(), logAmount); err != nil {
+				if err := l.processMethod(tx.Hash, block.Timestamp.BigInt(), block.Number.BigInt(), logAmount, false); err != nil {
 					log.Errorf(err.Error())
 				}
 			}
@@ -163,6 +162,46 @@ func (l *ExtractorServiceImpl) Start() {
 	}()
 }
 
+// 最终事件落后节点最新块确认块数，处理到已确认的最新块即同步完成
+func (l *ExtractorServiceImpl) checkSyncComplete(syncBlock *types.Big, blockNumber *big.Int) {
+	confirmedNumber := new(big.Int).Add(blockNumber, new(big.Int).SetUint64(l.options.Confirms))
+	if syncBlock.BigInt().Cmp(confirmedNumber) <= 0 && l.syncComplete == false {
+		eventemitter.Emit(eventemitter.SyncChainComplete, *syncBlock)
+		l.syncComplete = true
+		log.Debugf("extractor,sync chain block complete!")
+	} else {
+		log.Debugf("extractor,chain block syncing... ")
+	}
+}
+
+func newBlock(block *ethaccessor.Block) *types.Block {
+	currentBlock := &types.Block{}
+	currentBlock.BlockNumber = block.Number.BigInt()
+	currentBlock.ParentHash = block.ParentHash
+	currentBlock.BlockHash = block.Hash
+	currentBlock.CreateTime = block.Timestamp.Int64()
+
+	return currentBlock
+}
+
+// 发送新区块事件并保存区块
+func (l *ExtractorServiceImpl) processBlock(currentBlock *types.Block) {
+	// emit new block
+	blockEvent := &types.BlockEvent{}
+	blockEvent.BlockNumber = currentBlock.BlockNumber
+	blockEvent.BlockHash = currentBlock.BlockHash
+	blockEvent.BlockTime = big.NewInt(currentBlock.CreateTime)
+	eventemitter.Emit(eventemitter.Block_New, blockEvent)
+
+	// convert block to dao entity
+	var entity dao.Block
+	if err := entity.ConvertDown(currentBlock); err != nil {
+		log.Debugf("extractor,convert block to dao/entity error:%s", err.Error())
+	} else {
+		l.dao.Add(&entity)
+	}
+}
+
 func (l *ExtractorServiceImpl) Stop() {
 	l.lock.Lock()
 	defer l.lock.Unlock()
@@ -178,7 +217,10 @@ func (l *ExtractorServiceImpl) Restart() {
 	l.Start()
 }
 
-func (l *ExtractorServiceImpl) processMethod(txhash string, time, blockNumber *big.Int, logAmount int) error {
+func (l *ExtractorServiceImpl) processMethod(txhash string, time, blockNumber *big.Int, logAmount int, pending bool) error {
+	l.processMtx.Lock()
+	defer l.processMtx.Unlock()
+
 	var tx ethaccessor.Transaction
 	if err := l.accessor.Call(&tx, "eth_getTransactionByHash", txhash); err != nil {
 		return fmt.Errorf("extractor,get transaction error:%s", err.Error())
@@ -208,6 +250,7 @@ func (l *ExtractorServiceImpl) processMethod(txhash string, time, blockNumber *b
 	contract.Gas = tx.Gas.BigInt()
 	contract.GasPrice = tx.Gas.BigInt()
 	contract.LogAmount = logAmount
+	contract.Pending = pending
 
 	eventemitter.Emit(contract.Id, contract)
 	return nil
@@ -224,7 +267,17 @@ func (l *ExtractorServiceImpl) processEvent(tx *ethaccessor.Transaction, time *b
 		return 0, fmt.Errorf("extractor,transaction %s recipient do not have any logs", tx.Hash)
 	}
 
-	for _, evtLog := range receipt.Logs {
+	l.processLogs(tx.Hash, receipt.Logs, time, false)
+
+	return len(receipt.Logs), nil
+}
+
+// 解析交易中支持的合约事件并分发
+func (l *ExtractorServiceImpl) processLogs(txhash string, logs []ethaccessor.Log, time *big.Int, pending bool) {
+	l.processMtx.Lock()
+	defer l.processMtx.Unlock()
+
+	for _, evtLog := range logs {
 		var (
 			contract EventData
 			ok       bool
@@ -245,11 +298,11 @@ func (l *ExtractorServiceImpl) processEvent(tx *ethaccessor.Transaction, time *b
 			continue
 		}
 
-		if l.commOpts.SaveEventLog {
+		if l.commOpts.SaveEventLog && !pending && l.sink == nil {
 			if bs, err := json.Marshal(evtLog); err != nil {
 				el := &dao.EventLog{}
 				el.Protocol = evtLog.Address
-				el.TxHash = tx.Hash
+				el.TxHash = txhash
 				el.BlockNumber = evtLog.BlockNumber.Int64()
 				el.CreateTime = time.Int64()
 				el.Data = bs
@@ -269,12 +322,18 @@ func (l *ExtractorServiceImpl) processEvent(tx *ethaccessor.Transaction, time *b
 		contract.BlockNumber = evtLog.BlockNumber.BigInt()
 		contract.Time = time
 		contract.ContractAddress = evtLog.Address
-		contract.TxHash = tx.Hash
+		contract.TxHash = txhash
+		contract.LogIndex = evtLog.LogIndex.Int64()
+		contract.Pending = pending
 
+		if l.sink != nil {
+			if err := contract.handler(contract); nil != err {
+				log.Errorf("extractor,handle event %s of tx %s error:%s", contract.Name, txhash, err.Error())
+			}
+			continue
+		}
 		eventemitter.Emit(contract.Id.Hex(), contract)
 	}
-
-	return len(receipt.Logs), nil
 }
 
 // 只需要解析submitRing,cancel，cutoff这些方法在event里，如果方法不成功也不用执行后续逻辑
@@ -396,7 +455,7 @@ func (l *ExtractorServiceImpl) handleWethDepositMethod(input eventemitter.EventD
 		log.Debugf("extractor,weth deposit method,from:%s, to:%s, value:%s", deposit.From.Hex(), deposit.To.Hex(), deposit.Value.String())
 	}
 
-	eventemitter.Emit(eventemitter.WethDepositMethod, deposit)
+	l.emit(contractData.Pending, eventemitter.WethDepositMethod, deposit)
 	return nil
 }
 
@@ -421,7 +480,7 @@ func (l *ExtractorServiceImpl) handleWethWithdrawalMethod(input eventemitter.Eve
 		log.Debugf("extractor,weth withdrawal method,from:%s, to:%s, value:%s", withdrawal.From.Hex(), withdrawal.To.Hex(), withdrawal.Value.String())
 	}
 
-	eventemitter.Emit(eventemitter.WethWithdrawalMethod, withdrawal)
+	l.emit(contractData.Pending, eventemitter.WethWithdrawalMethod, withdrawal)
 	return nil
 }
 
@@ -440,8 +499,10 @@ func (l *ExtractorServiceImpl) handleRingMinedEvent(input eventemitter.EventData
 	}
 	ringmined.ContractAddress = common.HexToAddress(contractData.ContractAddress)
 	ringmined.TxHash = common.HexToHash(contractData.TxHash)
+	ringmined.LogIndex = contractData.LogIndex
 	ringmined.Time = contractData.Time
 	ringmined.Blocknumber = contractData.BlockNumber
+	ringmined.Fills = fills
 
 	if l.commOpts.Develop {
 		log.Debugf("extractor,ring mined event,ringhash:%s, ringIndex:%s, miner:%s, feeRecipient:%s,isRinghashReserved:%t",
@@ -452,7 +513,7 @@ func (l *ExtractorServiceImpl) handleRingMinedEvent(input eventemitter.EventData
 			ringmined.IsRinghashReserved)
 	}
 
-	eventemitter.Emit(eventemitter.OrderManagerExtractorRingMined, ringmined)
+	l.emit(contractData.Pending, eventemitter.OrderManagerExtractorRingMined, ringmined)
 
 	var (
 		fillList      []*types.OrderFilledEvent
@@ -460,6 +521,7 @@ func (l *ExtractorServiceImpl) handleRingMinedEvent(input eventemitter.EventData
 	)
 	for _, fill := range fills {
 		fill.TxHash = common.HexToHash(contractData.TxHash)
+		fill.LogIndex = contractData.LogIndex
 		fill.ContractAddress = common.HexToAddress(contractData.ContractAddress)
 		fill.Time = contractData.Time
 		fill.Blocknumber = contractData.BlockNumber
@@ -494,7 +556,7 @@ func (l *ExtractorServiceImpl) handleRingMinedEvent(input eventemitter.EventData
 			v.Owner = common.HexToAddress(ord.Owner)
 			v.Market, _ = util.WrapMarketByAddress(v.TokenS.Hex(), v.TokenB.Hex())
 
-			eventemitter.Emit(eventemitter.OrderManagerExtractorFill, v)
+			l.emit(contractData.Pending, eventemitter.OrderManagerExtractorFill, v)
 		} else {
 			log.Debugf("extractor,order filled event cann't match order %s", ord.OrderHash)
 		}
@@ -514,6 +576,7 @@ func (l *ExtractorServiceImpl) handleOrderCancelledEvent(input eventemitter.Even
 
 	evt := contractEvent.ConvertDown()
 	evt.TxHash = common.HexToHash(contractData.TxHash)
+	evt.LogIndex = contractData.LogIndex
 	evt.ContractAddress = common.HexToAddress(contractData.ContractAddress)
 	evt.Time = contractData.Time
 	evt.Blocknumber = contractData.BlockNumber
@@ -522,7 +585,7 @@ func (l *ExtractorServiceImpl) handleOrderCancelledEvent(input eventemitter.Even
 		log.Debugf("extractor,order cancelled event,orderhash:%s, cancelAmount:%s", evt.OrderHash.Hex(), evt.AmountCancelled.String())
 	}
 
-	eventemitter.Emit(eventemitter.OrderManagerExtractorCancel, evt)
+	l.emit(contractData.Pending, eventemitter.OrderManagerExtractorCancel, evt)
 
 	return nil
 }
@@ -538,6 +601,7 @@ func (l *ExtractorServiceImpl) handleCutoffTimestampEvent(input eventemitter.Eve
 
 	evt := contractEvent.ConvertDown()
 	evt.TxHash = common.HexToHash(contractData.TxHash)
+	evt.LogIndex = contractData.LogIndex
 	evt.ContractAddress = common.HexToAddress(contractData.ContractAddress)
 	evt.Time = contractData.Time
 	evt.Blocknumber = contractData.BlockNumber
@@ -546,7 +610,7 @@ func (l *ExtractorServiceImpl) handleCutoffTimestampEvent(input eventemitter.Eve
 		log.Debugf("extractor,cutoffTimestampChanged event,ownerAddress:%s, cutOffTime:%s", evt.Owner.Hex(), evt.Cutoff.String())
 	}
 
-	eventemitter.Emit(eventemitter.OrderManagerExtractorCutoff, evt)
+	l.emit(contractData.Pending, eventemitter.OrderManagerExtractorCutoff, evt)
 
 	return nil
 }
@@ -571,7 +635,7 @@ func (l *ExtractorServiceImpl) handleTransferEvent(input eventemitter.EventData)
 		log.Debugf("extractor,transfer event,from:%s, to:%s, value:%s", evt.From.Hex(), evt.To.Hex(), evt.Value.String())
 	}
 
-	eventemitter.Emit(eventemitter.AccountTransfer, evt)
+	l.emit(contractData.Pending, eventemitter.AccountTransfer, evt)
 
 	return nil
 }
@@ -595,7 +659,7 @@ func (l *ExtractorServiceImpl) handleApprovalEvent(input eventemitter.EventData)
 		log.Debugf("extractor,approval event,owner:%s, spender:%s, value:%s", evt.Owner.Hex(), evt.Spender.Hex(), evt.Value.String())
 	}
 
-	eventemitter.Emit(eventemitter.AccountApproval, evt)
+	l.emit(contractData.Pending, eventemitter.AccountApproval, evt)
 
 	return nil
 }
@@ -613,7 +677,7 @@ func (l *ExtractorServiceImpl) handleTokenRegisteredEvent(input eventemitter.Eve
 		log.Debugf("extractor,token registered event,address:%s, symbol:%s", evt.Token.Hex(), evt.Symbol)
 	}
 
-	eventemitter.Emit(eventemitter.TokenRegistered, evt)
+	l.emit(contractData.Pending, eventemitter.TokenRegistered, evt)
 
 	return nil
 }
@@ -631,7 +695,7 @@ func (l *ExtractorServiceImpl) handleTokenUnRegisteredEvent(input eventemitter.E
 		log.Debugf("extractor,token unregistered event,address:%s, symbol:%s", evt.Token.Hex(), evt.Symbol)
 	}
 
-	eventemitter.Emit(eventemitter.TokenUnRegistered, evt)
+	l.emit(contractData.Pending, eventemitter.TokenUnRegistered, evt)
 
 	return nil
 }
@@ -656,7 +720,7 @@ func (l *ExtractorServiceImpl) handleRinghashSubmitEvent(input eventemitter.Even
 		log.Debugf("extractor,ringhash submit event,ringhash:%s, ringMiner:%s", evt.RingHash.Hex(), evt.RingMiner.Hex())
 	}
 
-	eventemitter.Emit(eventemitter.RingHashSubmitted, evt)
+	l.emit(contractData.Pending, eventemitter.RingHashSubmitted, evt)
 
 	return nil
 }
@@ -679,7 +743,7 @@ func (l *ExtractorServiceImpl) handleAddressAuthorizedEvent(input eventemitter.E
 		log.Debugf("extractor,address authorized event address:%s, number:%d", evt.Protocol.Hex(), evt.Number)
 	}
 
-	eventemitter.Emit(eventemitter.AddressAuthorized, evt)
+	l.emit(contractData.Pending, eventemitter.AddressAuthorized, evt)
 
 	return nil
 }
@@ -702,7 +766,7 @@ func (l *ExtractorServiceImpl) handleAddressDeAuthorizedEvent(input eventemitter
 		log.Debugf("extractor,address deauthorized event,address:%s, number:%d", evt.Protocol.Hex(), evt.Number)
 	}
 
-	eventemitter.Emit(eventemitter.AddressAuthorized, evt)
+	l.emit(contractData.Pending, eventemitter.AddressAuthorized, evt)
 
 	return nil
 }
@@ -714,15 +778,7 @@ func (l *ExtractorServiceImpl) getBlockNumberRange() (*big.Int, *big.Int) {
 	start := l.commOpts.DefaultBlockNumber
 	end := l.commOpts.EndBlockNumber
 
-	// 寻找分叉块，并归零分叉标记
-	forkBlock, err := l.dao.FindForkBlock()
-	if err == nil {
-		blockHash := common.HexToHash(forkBlock.BlockHash)
-		l.dao.SetForkBlock(blockHash)
-		return ret.BlockNumber, end
-	}
-
-	// 寻找最新块
+	// 寻找最新块,分叉回滚的区块已从数据库删除
 	latestBlock, err := l.dao.FindLatestBlock()
 	if err != nil {
 		log.Debugf("extractor,get latest block number error:%s", err.Error())
@@ -19,102 +19,203 @@
 package extractor
 
 import (
-	"github.com/Loopring/relay/dao"
+	"errors"
+	"math/big"
+	"time"
+
 	"github.com/Loopring/relay/ethaccessor"
 	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/types"
-	"math/big"
 )
 
-func (l *ExtractorServiceImpl) startDetectFork() {
-	forkWatcher := &eventemitter.Watcher{Concurrent: true, Handle: l.processFork}
-	eventemitter.On(eventemitter.ExtractorFork, forkWatcher)
-}
+const defaultBlockWindow = 100
 
-func (l *ExtractorServiceImpl) detectFork(block *types.Block) error {
-	var (
-		latestBlock   types.Block
-		newBlockModel dao.Block
-		forkEvent     types.ForkedEvent
-	)
+var ErrForkOutOfWindow = errors.New("extractor,common ancestor of forked chain is out of block window")
 
-	latestBlockModel, err := l.dao.FindLatestBlock()
+/**
+分叉检测：保存最近处理的区块hash窗口，新区块的parentHash与窗口中上一个区块不一致时，
+沿新链按parentHash逐块回溯，同时与窗口中同高度的旧链区块比较，hash一致的区块即为共同祖先，
+窗口回滚到共同祖先，由调用方回滚数据并从共同祖先的下一个区块重新解析
+*/
+
+// 启动时用数据库中最近的区块初始化窗口，start为最新区块
+func (l *ExtractorServiceImpl) loadBlockWindow(start *big.Int) {
+	blocks := []*types.Block{}
+	models, err := l.dao.GetBlocksByNumberRange(start.Int64()-int64(l.detector.size)+1, start.Int64())
 	if err != nil {
-		return err
+		log.Errorf("extractor,load block window error:%s", err.Error())
 	}
-	if err := latestBlockModel.ConvertUp(&latestBlock); err != nil {
-		return err
+	for _, v := range models {
+		block := &types.Block{}
+		if err := v.ConvertUp(block); err != nil {
+			log.Errorf("extractor,load block window convert up error:%s", err.Error())
+			continue
+		}
+		blocks = append(blocks, block)
 	}
+	l.detector.Reset(blocks)
+}
 
-	// 重启时第一个块
-	if block.BlockHash == latestBlock.BlockHash {
-		return nil
+// 回溯新链出错时重试，共同祖先超出窗口时无法回滚
+func (l *ExtractorServiceImpl) detectFork(block *types.Block) *types.ForkedEvent {
+	for {
+		event, err := l.detector.Detect(block)
+		if err == nil {
+			return event
+		}
+		if err == ErrForkOutOfWindow {
+			log.Fatalf("extractor,detect fork at block %s error:%s", block.BlockNumber.String(), err.Error())
+		}
+		log.Errorf("extractor,detect fork at block %s error:%s", block.BlockNumber.String(), err.Error())
+		time.Sleep(5 * time.Second)
 	}
+}
 
-	// 没有分叉
-	if block.ParentHash == latestBlock.BlockHash || types.IsZeroHash(latestBlock.ParentHash) {
-		if err := newBlockModel.ConvertUp(block); err != nil {
-			return err
-		}
-		if err := l.dao.Add(newBlockModel); err != nil {
-			return err
+// 删除回滚区间内的区块并发送分叉事件，订单等模块同步回滚后再从共同祖先的下一个区块继续解析
+func (l *ExtractorServiceImpl) processFork(event *types.ForkedEvent) {
+	log.Infof("extractor,chain forked at block %s->%s, detected at block %s->%s, rollback blocks (%s, %s]",
+		event.ForkBlock.String(), event.ForkHash.Hex(),
+		event.DetectedBlock.String(), event.DetectedHash.Hex(),
+		event.ForkBlock.String(), event.EndBlock.String())
+
+	if err := l.dao.RollBackBlock(event.ForkBlock.Int64(), event.EndBlock.Int64()); err != nil {
+		log.Errorf("extractor,rollback blocks error:%s", err.Error())
+	}
+
+	eventemitter.Emit(eventemitter.ExtractorFork, event)
+}
+
+type ForkDetector struct {
+	accessor *ethaccessor.EthNodeAccessor
+	size     int
+	blocks   []*types.Block // 按区块号升序，log模式同步期间区块可能不连续
+}
+
+func NewForkDetector(accessor *ethaccessor.EthNodeAccessor, size int) *ForkDetector {
+	if size <= 0 {
+		size = defaultBlockWindow
+	}
+	return &ForkDetector{accessor: accessor, size: size}
+}
+
+// 重启时用数据库中最近的区块初始化窗口
+func (d *ForkDetector) Reset(blocks []*types.Block) {
+	d.blocks = []*types.Block{}
+	for _, block := range blocks {
+		d.push(block)
+	}
+}
+
+// 返回nil表示没有分叉，区块加入窗口；发现分叉时窗口回滚到共同祖先，该区块不加入窗口
+func (d *ForkDetector) Detect(block *types.Block) (*types.ForkedEvent, error) {
+	number := block.BlockNumber.Int64()
+
+	// 重启时重复处理的区块
+	if old := d.get(number); old != nil && old.BlockHash == block.BlockHash {
+		return nil, nil
+	}
+
+	latest := d.latest()
+	if latest == nil {
+		d.push(block)
+		return nil, nil
+	}
+	if latest.BlockNumber.Int64() < number {
+		// 区块不连续时无法根据parentHash判断
+		if prev := d.get(number - 1); prev == nil || prev.BlockHash == block.ParentHash {
+			d.push(block)
+			return nil, nil
 		}
 	}
 
-	// 已经分叉,寻找分叉块,出错则在下一个块继续检查
-	forkBlock, err := l.getForkedBlock(block)
+	ancestor, err := d.findCommonAncestor(block)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// 更新block分叉标记
-	model := dao.Block{}
-	if err := model.ConvertDown(forkBlock); err == nil {
-		l.dao.SetForkBlock(forkBlock.BlockHash)
-	}
+	event := &types.ForkedEvent{}
+	event.DetectedBlock = new(big.Int).Set(block.BlockNumber)
+	event.DetectedHash = block.BlockHash
+	event.ForkBlock = new(big.Int).Set(ancestor.BlockNumber)
+	event.ForkHash = ancestor.BlockHash
+	event.EndBlock = new(big.Int).Set(latest.BlockNumber)
 
-	// 发送分叉事件
-	forkEvent.ForkHash = forkBlock.BlockHash
-	forkEvent.ForkBlock = forkBlock.BlockNumber
-	forkEvent.DetectedHash = block.BlockHash
-	forkEvent.DetectedBlock = block.BlockNumber
+	d.rollback(ancestor.BlockNumber.Int64())
 
-	eventemitter.Emit(eventemitter.ExtractorFork, &forkEvent)
-	eventemitter.Emit(eventemitter.OrderManagerFork, &forkEvent)
+	return event, nil
+}
 
+func (d *ForkDetector) Latest() *types.Block {
+	if latest := d.latest(); latest != nil {
+		return copyBlock(latest)
+	}
 	return nil
 }
 
-func (l *ExtractorServiceImpl) getForkedBlock(block *types.Block) (*types.Block, error) {
-	var (
-		ethBlock    ethaccessor.Block
-		parentBlock types.Block
-	)
+// 沿新链回溯直到与窗口中同高度区块的hash一致，窗口中没有的高度继续回溯
+func (d *ForkDetector) findCommonAncestor(block *types.Block) (*types.Block, error) {
+	oldest := d.blocks[0].BlockNumber.Int64()
+	hash := block.ParentHash
+	number := block.BlockNumber.Int64() - 1
+
+	for ; number >= oldest; number-- {
+		if old := d.get(number); old != nil && old.BlockHash == hash {
+			return copyBlock(old), nil
+		}
 
-	// 如果数据库已存在,则该block即为分叉根节点
-	if parentBlockModel, err := l.dao.FindBlockByParentHash(block.ParentHash); err == nil {
-		if err := parentBlockModel.ConvertUp(&parentBlock); err != nil {
+		var parent ethaccessor.Block
+		if err := d.accessor.Call(&parent, "eth_getBlockByHash", hash, false); err != nil {
 			return nil, err
-		} else {
-			return &parentBlock, nil
 		}
+		if parent.Hash != hash {
+			return nil, errors.New("extractor,get block by hash " + hash.Hex() + " not found")
+		}
+		hash = parent.ParentHash
 	}
 
-	// 如果不存在,则查询以太坊
-	parentBlockNumber := block.BlockNumber.Sub(block.BlockNumber, big.NewInt(1))
-	if err := l.accessor.Call(&ethBlock, "eth_getBlockByNumber", parentBlockNumber, false); err != nil {
-		return nil, err
+	return nil, ErrForkOutOfWindow
+}
+
+func (d *ForkDetector) push(block *types.Block) {
+	d.blocks = append(d.blocks, copyBlock(block))
+	if len(d.blocks) > d.size {
+		d.blocks = d.blocks[len(d.blocks)-d.size:]
 	}
+}
 
-	preBlock := &types.Block{}
-	preBlock.BlockNumber = ethBlock.Number.BigInt()
-	preBlock.BlockHash = ethBlock.Hash
-	preBlock.ParentHash = ethBlock.ParentHash
+func (d *ForkDetector) get(number int64) *types.Block {
+	for i := len(d.blocks) - 1; i >= 0; i-- {
+		if n := d.blocks[i].BlockNumber.Int64(); n == number {
+			return d.blocks[i]
+		} else if n < number {
+			break
+		}
+	}
+	return nil
+}
 
-	return l.getForkedBlock(preBlock)
+func (d *ForkDetector) latest() *types.Block {
+	if len(d.blocks) == 0 {
+		return nil
+	}
+	return d.blocks[len(d.blocks)-1]
 }
 
-func (l *ExtractorServiceImpl) processFork(input eventemitter.EventData) error {
-	l.Restart()
-	return nil
+// 删除窗口中number之后的区块
+func (d *ForkDetector) rollback(number int64) {
+	idx := len(d.blocks)
+	for idx > 0 && d.blocks[idx-1].BlockNumber.Int64() > number {
+		idx--
+	}
+	d.blocks = d.blocks[:idx]
+}
+
+func copyBlock(block *types.Block) *types.Block {
+	return &types.Block{
+		BlockHash:   block.BlockHash,
+		ParentHash:  block.ParentHash,
+		BlockNumber: new(big.Int).Set(block.BlockNumber),
+		CreateTime:  block.CreateTime,
+	}
 }
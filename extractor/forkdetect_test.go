@@ -0,0 +1,168 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor_test
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/extractor"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// 模拟链，保存所有分支的区块，只提供分叉检测需要的eth_getBlockByHash
+type testChain struct {
+	blocks    map[common.Hash]*types.Block
+	canonical []*types.Block
+}
+
+type TestChainApi struct {
+	chain *testChain
+}
+
+func (api *TestChainApi) GetBlockByHash(hash common.Hash, full bool) (map[string]interface{}, error) {
+	block, ok := api.chain.blocks[hash]
+	if !ok {
+		return nil, nil
+	}
+	return map[string]interface{}{
+		"number":     fmt.Sprintf("%#x", block.BlockNumber),
+		"hash":       block.BlockHash.Hex(),
+		"parentHash": block.ParentHash.Hex(),
+		"timestamp":  fmt.Sprintf("%#x", block.CreateTime),
+	}, nil
+}
+
+func newTestChain(length int) *testChain {
+	chain := &testChain{blocks: make(map[common.Hash]*types.Block)}
+	chain.extend(common.Hash{}, 0, length, 0)
+	return chain
+}
+
+// 从number区块之后生成长度为length的新分支作为主链
+func (chain *testChain) extend(parent common.Hash, number, length int, branch int) {
+	chain.canonical = chain.canonical[:number]
+	for i := 0; i < length; i++ {
+		n := number + i
+		block := &types.Block{
+			BlockNumber: big.NewInt(int64(n)),
+			BlockHash:   common.BytesToHash([]byte(fmt.Sprintf("branch-%d-block-%d", branch, n))),
+			ParentHash:  parent,
+			CreateTime:  int64(1500000000 + n*15),
+		}
+		chain.blocks[block.BlockHash] = block
+		chain.canonical = append(chain.canonical, block)
+		parent = block.BlockHash
+	}
+}
+
+// 共同祖先之后depth个区块被替换，新链比旧链长一个区块
+func (chain *testChain) reorg(depth int, branch int) {
+	ancestor := chain.canonical[len(chain.canonical)-1-depth]
+	number := int(ancestor.BlockNumber.Int64()) + 1
+	chain.extend(ancestor.BlockHash, number, depth+1, branch)
+}
+
+func newTestDetector(t *testing.T, chain *testChain, size int) *extractor.ForkDetector {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &TestChainApi{chain: chain}); nil != err {
+		t.Fatal(err)
+	}
+	accessor := &ethaccessor.EthNodeAccessor{}
+	accessor.Client = rpc.DialInProc(server)
+	return extractor.NewForkDetector(accessor, size)
+}
+
+func detectAll(detector *extractor.ForkDetector, blocks []*types.Block) (*types.ForkedEvent, error) {
+	for _, block := range blocks {
+		if event, err := detector.Detect(block); nil != err || nil != event {
+			return event, err
+		}
+	}
+	return nil, nil
+}
+
+func TestForkDetector_Reorg(t *testing.T) {
+	for _, depth := range []int{1, 2, 5, 20} {
+		chain := newTestChain(30)
+		detector := newTestDetector(t, chain, 30)
+		if event, err := detectAll(detector, chain.canonical); nil != err || nil != event {
+			t.Fatalf("depth:%d, unexpected fork on canonical chain, event:%+v err:%v", depth, event, err)
+		}
+
+		oldTip := chain.canonical[len(chain.canonical)-1]
+		chain.reorg(depth, depth)
+		detected := chain.canonical[len(chain.canonical)-1]
+
+		event, err := detector.Detect(detected)
+		if nil != err || nil == event {
+			t.Fatalf("depth:%d, fork not detected, err:%v", depth, err)
+		}
+		ancestorNumber := oldTip.BlockNumber.Int64() - int64(depth)
+		if event.ForkBlock.Int64() != ancestorNumber || event.ForkHash != chain.canonical[ancestorNumber].BlockHash {
+			t.Fatalf("depth:%d, common ancestor:%s->%s, expected:%d", depth, event.ForkBlock.String(), event.ForkHash.Hex(), ancestorNumber)
+		}
+		if event.EndBlock.Cmp(oldTip.BlockNumber) != 0 || event.DetectedBlock.Cmp(detected.BlockNumber) != 0 || event.DetectedHash != detected.BlockHash {
+			t.Fatalf("depth:%d, rollback range (%s, %s], detected:%s", depth, event.ForkBlock.String(), event.EndBlock.String(), event.DetectedBlock.String())
+		}
+		if latest := detector.Latest(); latest.BlockHash != chain.canonical[ancestorNumber].BlockHash {
+			t.Fatalf("depth:%d, block window should rollback to ancestor, latest:%s", depth, latest.BlockNumber.String())
+		}
+
+		// 从共同祖先的下一个区块重新解析新链
+		if event, err := detectAll(detector, chain.canonical[ancestorNumber+1:]); nil != err || nil != event {
+			t.Fatalf("depth:%d, unexpected fork on new chain, event:%+v err:%v", depth, event, err)
+		}
+	}
+}
+
+func TestForkDetector_RepeatedBlock(t *testing.T) {
+	chain := newTestChain(10)
+	detector := newTestDetector(t, chain, 10)
+	detector.Reset(chain.canonical)
+
+	// 重启时从数据库中最新的区块开始
+	if event, err := detector.Detect(chain.canonical[9]); nil != err || nil != event {
+		t.Fatalf("repeated block should not fork, event:%+v err:%v", event, err)
+	}
+
+	// 重启期间发生分叉，重复处理的高度上区块已被替换
+	chain.reorg(2, 1)
+	event, err := detector.Detect(chain.canonical[9])
+	if nil != err || nil == event || event.ForkBlock.Int64() != 7 || event.EndBlock.Int64() != 9 {
+		t.Fatalf("fork at repeated block not detected, event:%+v err:%v", event, err)
+	}
+}
+
+func TestForkDetector_OutOfWindow(t *testing.T) {
+	chain := newTestChain(30)
+	detector := newTestDetector(t, chain, 5)
+	if event, err := detectAll(detector, chain.canonical); nil != err || nil != event {
+		t.Fatalf("unexpected fork on canonical chain, event:%+v err:%v", event, err)
+	}
+
+	chain.reorg(8, 1)
+	if _, err := detector.Detect(chain.canonical[len(chain.canonical)-1]); err != extractor.ErrForkOutOfWindow {
+		t.Fatalf("fork deeper than block window should fail, err:%v", err)
+	}
+}
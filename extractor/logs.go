@@ -0,0 +1,289 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const (
+	defaultLogMaxRange = 5000
+	defaultLogTarget   = 1000
+)
+
+/**
+log模式：按区块区间调用eth_getLogs获取支持的合约事件，只下载包含事件的区块头，
+只有事件来自loopring合约或者weth时才查询交易并解析方法，区间大小根据节点返回的事件数以及错误自适应调整；
+没有事件的交易(例如失败的submitRing以及不产生Transfer事件的weth存取)不会被解析
+*/
+
+// 查询失败后连续成功的次数达到该值时，区间上限加倍，直到恢复为配置的最大值
+const logRangeRecoverSuccesses = 10
+
+// logRange 根据上一次查询的结果调整区间大小，查询失败时暂时降低区间上限，之后连续成功时逐步恢复
+type logRange struct {
+	size      int64
+	limit     int64 // 当前的区间上限
+	maxSize   int64 // 配置的区间上限
+	target    int
+	successes int
+}
+
+func newLogRange(maxSize int64, target int) *logRange {
+	if maxSize <= 0 {
+		maxSize = defaultLogMaxRange
+	}
+	if target <= 0 {
+		target = defaultLogTarget
+	}
+	return &logRange{size: maxSize, limit: maxSize, maxSize: maxSize, target: target}
+}
+
+// 查询出错(超时、节点限制返回数量等)时区间减半
+func (r *logRange) failed() bool {
+	r.successes = 0
+	if r.size <= 1 {
+		return false
+	}
+	r.limit = r.size - 1
+	r.size = r.size / 2
+	return true
+}
+
+func (r *logRange) succeeded(logCount int) {
+	if r.limit < r.maxSize {
+		r.successes += 1
+		if r.successes >= logRangeRecoverSuccesses {
+			r.successes = 0
+			r.limit = r.limit * 2
+			if r.limit > r.maxSize {
+				r.limit = r.maxSize
+			}
+		}
+	}
+
+	if logCount > r.target && r.size > 1 {
+		r.size = r.size / 2
+	} else if logCount < r.target/2 && r.size < r.limit {
+		if r.size*2 <= r.limit {
+			r.size = r.size * 2
+		} else {
+			r.size = (r.size + r.limit + 1) / 2
+		}
+	}
+}
+
+func (l *ExtractorServiceImpl) extractByLogs(start, end *big.Int) {
+	var (
+		from = start.Int64()
+		lr   = newLogRange(l.options.LogMaxRange, l.options.LogTarget)
+	)
+	addresses, topics := l.logFilter()
+
+	for {
+		select {
+		case <-l.stop:
+			log.Info("extractor,log extraction stopped")
+			return
+		default:
+		}
+
+		var latest types.Big
+		if err := l.accessor.Call(&latest, "eth_blockNumber"); err != nil {
+			log.Errorf("extractor,get ethereum node current block number error:%s", err.Error())
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if nil != end && end.Sign() > 0 && from > end.Int64() {
+			log.Info("extractor,log extraction finished")
+			return
+		}
+		confirmed := latest.Int64() - int64(l.options.Confirms)
+		if from > confirmed {
+			time.Sleep(5 * time.Second)
+			continue
+		}
+
+		to := from + lr.size - 1
+		if to > confirmed {
+			to = confirmed
+		}
+		if nil != end && end.Sign() > 0 && to > end.Int64() {
+			to = end.Int64()
+		}
+
+		logs, err := l.getLogs(from, to, addresses, topics)
+		if err != nil {
+			if lr.failed() {
+				log.Debugf("extractor,get logs of blocks %d-%d error:%s, retry with range:%d", from, to, err.Error(), lr.size)
+			} else {
+				log.Errorf("extractor,get logs of block %d error:%s", from, err.Error())
+				time.Sleep(5 * time.Second)
+			}
+			continue
+		}
+		lr.succeeded(len(logs))
+		log.Debugf("extractor,get %d logs of blocks %d-%d", len(logs), from, to)
+
+		forkEvent, err := l.processLogRange(from, to, logs)
+		if err != nil {
+			log.Errorf("extractor,process logs of blocks %d-%d error:%s", from, to, err.Error())
+			time.Sleep(5 * time.Second)
+			continue
+		}
+		if forkEvent != nil {
+			from = forkEvent.ForkBlock.Int64() + 1
+			continue
+		}
+
+		if !l.syncComplete {
+			l.checkSyncComplete(&latest, big.NewInt(to))
+		}
+		from = to + 1
+	}
+}
+
+// 包含事件的区块按顺序处理，区间最后一个区块用于记录进度，同步完成后处理每个区块以便matcher等按块触发，
+// 发现分叉时返回分叉事件，从共同祖先的下一个区块重新查询
+func (l *ExtractorServiceImpl) processLogRange(from, to int64, logs []ethaccessor.Log) (*types.ForkedEvent, error) {
+	blockLogs, blockNumbers := groupLogsByBlock(logs)
+	if l.syncComplete {
+		blockNumbers = []int64{}
+		for number := from; number <= to; number++ {
+			blockNumbers = append(blockNumbers, number)
+		}
+	} else if len(blockNumbers) == 0 || blockNumbers[len(blockNumbers)-1] != to {
+		blockNumbers = append(blockNumbers, to)
+	}
+
+	for _, number := range blockNumbers {
+		var block ethaccessor.Block
+		if err := l.accessor.Call(&block, "eth_getBlockByNumber", fmt.Sprintf("%#x", number), false); err != nil {
+			return nil, err
+		}
+
+		currentBlock := newBlock(&block)
+		if forkEvent := l.detectFork(currentBlock); forkEvent != nil {
+			l.processFork(forkEvent)
+			return forkEvent, nil
+		}
+		l.processBlock(currentBlock)
+
+		l.processBlockLogs(blockLogs[number], block.Timestamp.BigInt(), block.Number.BigInt(), false)
+	}
+	return nil, nil
+}
+
+// 按区块分组，区块号按事件顺序(升序)返回
+func groupLogsByBlock(logs []ethaccessor.Log) (map[int64][]ethaccessor.Log, []int64) {
+	blockLogs := make(map[int64][]ethaccessor.Log)
+	blockNumbers := []int64{}
+	for _, evtLog := range logs {
+		if evtLog.Removed {
+			continue
+		}
+		number := evtLog.BlockNumber.Int64()
+		if _, ok := blockLogs[number]; !ok {
+			blockNumbers = append(blockNumbers, number)
+		}
+		blockLogs[number] = append(blockLogs[number], evtLog)
+	}
+	return blockLogs, blockNumbers
+}
+
+// 按交易分组，交易hash按事件顺序返回
+func groupLogsByTx(logs []ethaccessor.Log) (map[string][]ethaccessor.Log, []string) {
+	txLogs := make(map[string][]ethaccessor.Log)
+	txHashes := []string{}
+	for _, evtLog := range logs {
+		if _, ok := txLogs[evtLog.TransactionHash]; !ok {
+			txHashes = append(txHashes, evtLog.TransactionHash)
+		}
+		txLogs[evtLog.TransactionHash] = append(txLogs[evtLog.TransactionHash], evtLog)
+	}
+	return txLogs, txHashes
+}
+
+// 按交易分组处理事件，交易涉及loopring合约或weth时查询交易解析方法，pending事件只解析weth方法
+func (l *ExtractorServiceImpl) processBlockLogs(logs []ethaccessor.Log, blockTime, blockNumber *big.Int, pending bool) {
+	txLogs, txHashes := groupLogsByTx(logs)
+	for _, txhash := range txHashes {
+		logs := txLogs[txhash]
+		l.processLogs(txhash, logs, blockTime, pending)
+
+		needMethod := false
+		for _, evtLog := range logs {
+			address := common.HexToAddress(evtLog.Address)
+			if (pending && address == l.accessor.WethAddress) || (!pending && l.isMethodContract(address)) {
+				needMethod = true
+				break
+			}
+		}
+		if needMethod {
+			if err := l.processMethod(txhash, blockTime, blockNumber, len(logs), pending); err != nil {
+				log.Errorf(err.Error())
+			}
+		}
+	}
+}
+
+func (l *ExtractorServiceImpl) getLogs(from, to int64, addresses []common.Address, topics [][]common.Hash) ([]ethaccessor.Log, error) {
+	var logs []ethaccessor.Log
+	query := ethaccessor.FilterQuery{
+		FromBlock: fmt.Sprintf("%#x", from),
+		ToBlock:   fmt.Sprintf("%#x", to),
+		Address:   addresses,
+		Topics:    topics,
+	}
+	err := l.accessor.Call(&logs, "eth_getLogs", query)
+	return logs, err
+}
+
+// 过滤条件为l.protocols中的合约地址以及l.events中的事件
+func (l *ExtractorServiceImpl) logFilter() ([]common.Address, [][]common.Hash) {
+	addresses := []common.Address{}
+	for address := range l.protocols {
+		if !types.IsZeroAddress(address) {
+			addresses = append(addresses, address)
+		}
+	}
+	ids := []common.Hash{}
+	for id := range l.events {
+		ids = append(ids, id)
+	}
+	return addresses, [][]common.Hash{ids}
+}
+
+func (l *ExtractorServiceImpl) isMethodContract(address common.Address) bool {
+	if address == l.accessor.WethAddress {
+		return true
+	}
+	switch l.protocols[address] {
+	case PROTOCOL_SYMBOL, DELEGATE_SYMBOL, RINGHASH_REGISTER_SYMBOL, TOKEN_REGISTER_SYMBOL:
+		return true
+	}
+	return false
+}
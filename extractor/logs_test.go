@@ -0,0 +1,109 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import "testing"
+
+func TestLogRange_Defaults(t *testing.T) {
+	r := newLogRange(0, 0)
+	if r.size != defaultLogMaxRange || r.maxSize != defaultLogMaxRange || r.target != defaultLogTarget {
+		t.Fatalf("size:%d maxSize:%d target:%d, expect defaults", r.size, r.maxSize, r.target)
+	}
+}
+
+func TestLogRange_Succeeded(t *testing.T) {
+	r := newLogRange(1000, 100)
+
+	// 事件过多时减半
+	r.succeeded(101)
+	if r.size != 500 {
+		t.Fatalf("size %d, expect 500", r.size)
+	}
+	// 事件数在target/2与target之间时不变
+	r.succeeded(60)
+	if r.size != 500 {
+		t.Fatalf("size %d, expect 500", r.size)
+	}
+	// 事件过少时加倍，不超过上限
+	r.succeeded(0)
+	if r.size != 1000 {
+		t.Fatalf("size %d, expect 1000", r.size)
+	}
+	r.succeeded(0)
+	if r.size != 1000 {
+		t.Fatalf("size %d, expect 1000", r.size)
+	}
+
+	r.size = 700
+	r.succeeded(0)
+	if r.size != 850 {
+		t.Fatalf("size %d, expect 850", r.size)
+	}
+}
+
+func TestLogRange_FailedAndRecover(t *testing.T) {
+	r := newLogRange(1000, 100)
+
+	if !r.failed() {
+		t.Fatalf("should retry with smaller range")
+	}
+	if r.size != 500 || r.limit != 999 {
+		t.Fatalf("size:%d limit:%d, expect 500 999", r.size, r.limit)
+	}
+	if !r.failed() || r.size != 250 || r.limit != 499 {
+		t.Fatalf("size:%d limit:%d, expect 250 499", r.size, r.limit)
+	}
+
+	// 上限降低期间，区间不超过上限
+	r.succeeded(0)
+	if r.size != 375 {
+		t.Fatalf("size %d, expect 375", r.size)
+	}
+	for i := 0; i < 10; i++ {
+		r.succeeded(0)
+		if r.size > r.limit {
+			t.Fatalf("size %d exceeds limit %d", r.size, r.limit)
+		}
+	}
+	// 连续成功后上限逐步恢复到配置的最大值
+	for i := 0; i < 3*logRangeRecoverSuccesses; i++ {
+		r.succeeded(0)
+	}
+	if r.limit != 1000 || r.size != 1000 {
+		t.Fatalf("size:%d limit:%d, expect recovered to 1000", r.size, r.limit)
+	}
+
+	// 失败会重新计数
+	r.failed()
+	for i := 0; i < logRangeRecoverSuccesses-1; i++ {
+		r.succeeded(0)
+	}
+	r.failed()
+	for i := 0; i < logRangeRecoverSuccesses-1; i++ {
+		r.succeeded(0)
+	}
+	if r.limit != 998 {
+		t.Fatalf("limit %d, expect 998", r.limit)
+	}
+
+	single := newLogRange(1, 100)
+	if single.failed() {
+		t.Fatalf("range of one block can't be smaller")
+	}
+}
@@ -0,0 +1,181 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+pending事件：确认块数大于0时，最终事件只处理达到确认块数的区块，订单状态只根据最终事件变化；
+未确认区块中的事件以pending topic发送，供前端展示。
+每次轮询先检查已处理的未确认区块hash，区块被分叉时发送PendingRetracted撤回该区块及之后的pending事件，
+再从该区块重新处理新链上的事件
+*/
+
+var pendingTopics = map[string]string{
+	eventemitter.OrderManagerExtractorRingMined: eventemitter.PendingRingMined,
+	eventemitter.OrderManagerExtractorFill:      eventemitter.PendingOrderFilled,
+	eventemitter.OrderManagerExtractorCancel:    eventemitter.PendingOrderCancelled,
+	eventemitter.OrderManagerExtractorCutoff:    eventemitter.PendingCutoff,
+	eventemitter.AccountTransfer:                eventemitter.PendingTransfer,
+	eventemitter.AccountApproval:                eventemitter.PendingApproval,
+	eventemitter.WethDepositMethod:              eventemitter.PendingWethDeposit,
+	eventemitter.WethWithdrawalMethod:           eventemitter.PendingWethWithdrawal,
+}
+
+// pending事件发送到对应的pending topic，没有pending topic的事件等确认后再发送
+func (l *ExtractorServiceImpl) emit(pending bool, topic string, event eventemitter.EventData) {
+	if l.sink != nil {
+		l.sink(topic, event)
+		return
+	}
+	if !pending {
+		eventemitter.Emit(topic, event)
+		return
+	}
+	if pendingTopic, ok := pendingTopics[topic]; ok {
+		eventemitter.Emit(pendingTopic, event)
+	}
+}
+
+// 轮询节点最新块，通过eth_getLogs获取未确认区块中的事件，每个区块只处理一次
+func (l *ExtractorServiceImpl) extractPending() {
+	var next int64
+	addresses, topics := l.logFilter()
+	l.pendingHash = make(map[int64]common.Hash)
+
+	for {
+		select {
+		case <-l.stop:
+			log.Info("extractor,pending extraction stopped")
+			return
+		case <-time.After(5 * time.Second):
+		}
+
+		var latest types.Big
+		if err := l.accessor.Call(&latest, "eth_blockNumber"); err != nil {
+			log.Errorf("extractor,pending get ethereum node current block number error:%s", err.Error())
+			continue
+		}
+
+		forkBlock, forked, err := l.pendingForkBlock(latest.Int64())
+		if err != nil {
+			log.Errorf("extractor,pending check fork error:%s", err.Error())
+			continue
+		}
+		if forked {
+			log.Infof("extractor,pending blocks from %d forked, retract pending events", forkBlock)
+			eventemitter.Emit(eventemitter.PendingRetracted, &types.PendingRetractedEvent{FromBlock: big.NewInt(forkBlock)})
+			next = forkBlock
+		}
+
+		from := latest.Int64() - int64(l.options.Confirms) + 1
+		if from < next {
+			from = next
+		}
+		if from > latest.Int64() {
+			continue
+		}
+
+		if next, err = l.processPendingRange(from, latest.Int64(), addresses, topics); err != nil {
+			log.Errorf("extractor,process pending blocks %d-%d error:%s", from, latest.Int64(), err.Error())
+		}
+	}
+}
+
+// 返回下一个待处理的区块号，出错时从出错的区块重新处理，每个区块记录hash用于发现分叉
+func (l *ExtractorServiceImpl) processPendingRange(from, to int64, addresses []common.Address, topics [][]common.Hash) (int64, error) {
+	logs, err := l.getLogs(from, to, addresses, topics)
+	if err != nil {
+		return from, err
+	}
+
+	blockLogs, _ := groupLogsByBlock(logs)
+	for number := from; number <= to; number++ {
+		var block ethaccessor.Block
+		if err := l.accessor.Call(&block, "eth_getBlockByNumber", fmt.Sprintf("%#x", number), false); err != nil {
+			return number, err
+		}
+		logs, ok := blockLogs[number]
+		if ok && common.HexToHash(logs[0].BlockHash) != block.Hash {
+			return number, fmt.Errorf("block %d changed while getting logs", number)
+		}
+		l.pendingHash[number] = block.Hash
+		if ok {
+			log.Debugf("extractor,pending block:%d->%s", number, block.Hash.Hex())
+			l.processBlockLogs(logs, block.Timestamp.BigInt(), block.Number.BigInt(), true)
+		}
+	}
+
+	return to + 1, nil
+}
+
+// 返回hash发生变化的最低未确认区块，已达到确认块数的区块不再检查，由最终事件的分叉检测处理
+func (l *ExtractorServiceImpl) pendingForkBlock(latest int64) (int64, bool, error) {
+	lowest := latest - int64(l.options.Confirms) + 1
+	numbers := []int64{}
+	for number := range l.pendingHash {
+		if number < lowest {
+			delete(l.pendingHash, number)
+			continue
+		}
+		numbers = append(numbers, number)
+	}
+	if len(numbers) == 0 {
+		return 0, false, nil
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+
+	// 最高区块未变化时，之前的区块也不会变化
+	if changed, err := l.pendingBlockChanged(numbers[len(numbers)-1]); err != nil || !changed {
+		return 0, false, err
+	}
+	for idx, number := range numbers {
+		changed, err := l.pendingBlockChanged(number)
+		if err != nil {
+			return 0, false, err
+		}
+		if changed {
+			for _, n := range numbers[idx:] {
+				delete(l.pendingHash, n)
+			}
+			return number, true, nil
+		}
+	}
+	return 0, false, nil
+}
+
+// 新链比已处理的区块短时，该区块同样视为变化
+func (l *ExtractorServiceImpl) pendingBlockChanged(number int64) (bool, error) {
+	var block *ethaccessor.Block
+	if err := l.accessor.Call(&block, "eth_getBlockByNumber", fmt.Sprintf("%#x", number), false); err != nil {
+		return false, err
+	}
+	return block == nil || block.Hash != l.pendingHash[number], nil
+}
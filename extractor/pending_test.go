@@ -0,0 +1,168 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"fmt"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.uber.org/zap"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+type topicRecorder struct {
+	mtx    sync.Mutex
+	topics []string
+}
+
+func (r *topicRecorder) watch(topic string) *eventemitter.Watcher {
+	watcher := &eventemitter.Watcher{Concurrent: false, Handle: func(input eventemitter.EventData) error {
+		r.mtx.Lock()
+		defer r.mtx.Unlock()
+		r.topics = append(r.topics, topic)
+		return nil
+	}}
+	eventemitter.On(topic, watcher)
+	return watcher
+}
+
+func (r *topicRecorder) take() []string {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	topics := r.topics
+	r.topics = nil
+	return topics
+}
+
+func TestExtractorServiceImpl_Emit(t *testing.T) {
+	recorder := &topicRecorder{}
+	for _, topic := range []string{
+		eventemitter.OrderManagerExtractorFill,
+		eventemitter.PendingOrderFilled,
+		eventemitter.TokenRegistered,
+	} {
+		watcher := recorder.watch(topic)
+		defer eventemitter.Un(topic, watcher)
+	}
+
+	l := &ExtractorServiceImpl{}
+	cases := []struct {
+		pending bool
+		topic   string
+		expect  string
+	}{
+		{false, eventemitter.OrderManagerExtractorFill, eventemitter.OrderManagerExtractorFill},
+		{true, eventemitter.OrderManagerExtractorFill, eventemitter.PendingOrderFilled},
+		{false, eventemitter.TokenRegistered, eventemitter.TokenRegistered},
+		// 没有pending topic的事件等确认后再发送
+		{true, eventemitter.TokenRegistered, ""},
+	}
+	for _, c := range cases {
+		l.emit(c.pending, c.topic, nil)
+		topics := recorder.take()
+		if c.expect == "" && len(topics) != 0 {
+			t.Errorf("pending:%t topic:%s emitted to %v, expect none", c.pending, c.topic, topics)
+		}
+		if c.expect != "" && (len(topics) != 1 || topics[0] != c.expect) {
+			t.Errorf("pending:%t topic:%s emitted to %v, expect %s", c.pending, c.topic, topics, c.expect)
+		}
+	}
+
+	// 重新解析历史区块时事件只交给sink
+	sunk := []string{}
+	l.sink = func(topic string, event eventemitter.EventData) {
+		sunk = append(sunk, topic)
+	}
+	l.emit(false, eventemitter.OrderManagerExtractorFill, nil)
+	if topics := recorder.take(); len(topics) != 0 || len(sunk) != 1 || sunk[0] != eventemitter.OrderManagerExtractorFill {
+		t.Errorf("emitted to %v, sunk %v, expect only sunk to %s", topics, sunk, eventemitter.OrderManagerExtractorFill)
+	}
+}
+
+// 模拟节点，区块hash可以在测试中替换
+type PendingApi struct {
+	mtx    sync.Mutex
+	hashes map[int64]common.Hash
+}
+
+func (api *PendingApi) GetBlockByNumber(number string, withTxs bool) map[string]interface{} {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	n, _ := strconv.ParseInt(number, 0, 64)
+	hash, ok := api.hashes[n]
+	if !ok {
+		return nil
+	}
+	return map[string]interface{}{"number": fmt.Sprintf("%#x", n), "hash": hash.Hex(), "timestamp": "0x0"}
+}
+
+func TestExtractorServiceImpl_PendingForkBlock(t *testing.T) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+
+	api := &PendingApi{hashes: make(map[int64]common.Hash)}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", api); err != nil {
+		t.Fatal(err)
+	}
+	l := &ExtractorServiceImpl{accessor: &ethaccessor.EthNodeAccessor{Client: rpc.DialInProc(server)}}
+	l.options.Confirms = 6
+	l.pendingHash = make(map[int64]common.Hash)
+	for n := int64(100); n <= 105; n++ {
+		api.hashes[n] = common.HexToHash(fmt.Sprintf("0x%d", n))
+		l.pendingHash[n] = api.hashes[n]
+	}
+
+	if _, forked, err := l.pendingForkBlock(105); err != nil || forked {
+		t.Fatalf("forked:%t err:%v, expect no fork", forked, err)
+	}
+
+	// 新区块106使100达到确认块数，不再检查
+	api.hashes[106] = common.HexToHash("0x106")
+	l.pendingHash[106] = api.hashes[106]
+	if _, forked, err := l.pendingForkBlock(106); err != nil || forked {
+		t.Fatalf("forked:%t err:%v, expect no fork", forked, err)
+	}
+	if _, ok := l.pendingHash[100]; ok {
+		t.Fatalf("confirmed block should be removed")
+	}
+
+	// 103之后的区块被替换，新链只到105
+	for n := int64(103); n <= 105; n++ {
+		api.hashes[n] = common.HexToHash(fmt.Sprintf("0xf%d", n))
+	}
+	delete(api.hashes, 106)
+	forkBlock, forked, err := l.pendingForkBlock(105)
+	if err != nil || !forked || forkBlock != 103 {
+		t.Fatalf("fork block:%d forked:%t err:%v, expect 103", forkBlock, forked, err)
+	}
+	for n := int64(103); n <= 106; n++ {
+		if _, ok := l.pendingHash[n]; ok {
+			t.Errorf("block %d forked should be removed", n)
+		}
+	}
+	if len(l.pendingHash) != 2 {
+		t.Errorf("pending blocks %d, expect 101 and 102", len(l.pendingHash))
+	}
+}
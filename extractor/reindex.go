@@ -0,0 +1,260 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/jinzhu/gorm"
+)
+
+/**
+重新解析历史区块：按区间通过eth_getLogs获取事件，复用extractor的事件解析逻辑，
+不注册全局watcher，事件直接交给本实例的handler，解析结果不发送到eventemitter(miner、orderbook等不会收到通知)，只保存ringmined、fill、cancel、cutoff事件，
+按交易hash及事件序号去重，重复执行同一区间结果不变。不解析合约方法，也不处理分叉，区间应当已达到确认块数。
+订单状态由调用方根据保存的事件重建，与正在运行的extractor处理不同区间时互不影响
+*/
+
+type ReindexProgress struct {
+	From      int64 // 重新解析的区间
+	To        int64
+	ChunkFrom int64 // 本次处理完成的区间
+	ChunkTo   int64
+	Logs      int // 本次执行累计获取的事件数
+	Saved     int // 本次执行累计新保存的事件数
+	Skipped   int // 本次执行累计已存在而跳过的事件数
+}
+
+type Reindexer struct {
+	extractor *ExtractorServiceImpl
+	rds       dao.RdsService
+	saved     int
+	skipped   int
+	err       error
+}
+
+func NewReindexer(options config.AccessorOptions,
+	commonOpts config.CommonOptions,
+	accessor *ethaccessor.EthNodeAccessor,
+	rds dao.RdsService) *Reindexer {
+	r := &Reindexer{rds: rds}
+	r.extractor = newExtractorService(options, commonOpts, accessor, rds, r.save)
+	return r
+}
+
+// 按区间顺序处理[from, to]，每处理完一个区间调用handle，handle返回错误时停止，调用方据此记录进度
+func (r *Reindexer) Run(from, to int64, handle func(progress ReindexProgress) error) error {
+	var (
+		l        = r.extractor
+		lr       = newLogRange(l.options.LogMaxRange, l.options.LogTarget)
+		progress = ReindexProgress{From: from, To: to}
+	)
+	addresses, topics := l.logFilter()
+	r.saved, r.skipped, r.err = 0, 0, nil
+
+	for start := from; start <= to; {
+		end := start + lr.size - 1
+		if end > to {
+			end = to
+		}
+
+		logs, err := l.getLogs(start, end, addresses, topics)
+		if err != nil {
+			if lr.failed() {
+				log.Debugf("extractor,reindex get logs of blocks %d-%d error:%s, retry with range:%d", start, end, err.Error(), lr.size)
+				continue
+			}
+			return fmt.Errorf("extractor,reindex get logs of block %d error:%s", start, err.Error())
+		}
+		lr.succeeded(len(logs))
+
+		if err := r.processLogs(logs); err != nil {
+			return fmt.Errorf("extractor,reindex process logs of blocks %d-%d error:%s", start, end, err.Error())
+		}
+
+		progress.ChunkFrom = start
+		progress.ChunkTo = end
+		progress.Logs += len(logs)
+		progress.Saved = r.saved
+		progress.Skipped = r.skipped
+		if err := handle(progress); err != nil {
+			return err
+		}
+		start = end + 1
+	}
+
+	return nil
+}
+
+// Checkpoint 返回区间已保存的进度，没有时创建，restart时从第一个区块重新开始
+func (r *Reindexer) Checkpoint(from, to int64, restart bool) (*dao.ReindexCheckpoint, error) {
+	checkpoint, err := r.rds.FindReindexCheckpoint(from, to)
+	if err == gorm.ErrRecordNotFound {
+		checkpoint = &dao.ReindexCheckpoint{FromBlock: from, ToBlock: to, Current: from - 1, CreateTime: time.Now().Unix()}
+		return checkpoint, r.rds.Add(checkpoint)
+	} else if err != nil {
+		return nil, err
+	}
+	if restart {
+		checkpoint.Current = from - 1
+		checkpoint.Finished = false
+	}
+	return checkpoint, nil
+}
+
+// RunFromCheckpoint 从进度的下一个区块开始处理，每个区间handle成功后保存进度，中断后重新执行时最多重复处理一个区间
+func (r *Reindexer) RunFromCheckpoint(checkpoint *dao.ReindexCheckpoint, handle func(progress ReindexProgress) error) error {
+	return r.Run(checkpoint.Current+1, checkpoint.ToBlock, func(progress ReindexProgress) error {
+		if err := handle(progress); err != nil {
+			return err
+		}
+		checkpoint.Current = progress.ChunkTo
+		checkpoint.Finished = progress.ChunkTo == checkpoint.ToBlock
+		checkpoint.UpdateTime = time.Now().Unix()
+		return r.rds.Save(checkpoint)
+	})
+}
+
+func (r *Reindexer) processLogs(logs []ethaccessor.Log) error {
+	blockLogs, blockNumbers := groupLogsByBlock(logs)
+	for _, number := range blockNumbers {
+		var block ethaccessor.Block
+		if err := r.extractor.accessor.Call(&block, "eth_getBlockByNumber", fmt.Sprintf("%#x", number), false); err != nil {
+			return err
+		}
+
+		txLogs, txHashes := groupLogsByTx(blockLogs[number])
+		for _, txhash := range txHashes {
+			r.extractor.processLogs(txhash, txLogs[txhash], block.Timestamp.BigInt(), false)
+			if r.err != nil {
+				return r.err
+			}
+		}
+	}
+	return nil
+}
+
+// processLogs直接调用handler，事件在同一协程中依次处理，出错后忽略后续事件，由processLogs返回错误
+func (r *Reindexer) save(topic string, event eventemitter.EventData) {
+	if r.err != nil {
+		return
+	}
+
+	var (
+		saved bool
+		err   error
+	)
+	switch topic {
+	case eventemitter.OrderManagerExtractorRingMined:
+		saved, err = r.saveRingMined(event.(*types.RingMinedEvent))
+	case eventemitter.OrderManagerExtractorFill:
+		saved, err = r.saveFill(event.(*types.OrderFilledEvent))
+	case eventemitter.OrderManagerExtractorCancel:
+		saved, err = r.saveCancel(event.(*types.OrderCancelledEvent))
+	case eventemitter.OrderManagerExtractorCutoff:
+		saved, err = r.saveCutoff(event.(*types.CutoffEvent))
+	default:
+		return
+	}
+
+	if err != nil {
+		r.err = err
+	} else if saved {
+		r.saved++
+	} else {
+		r.skipped++
+	}
+}
+
+// 增加log_index之前保存的事件没有事件序号，同时按ringhash去重
+func (r *Reindexer) saveRingMined(event *types.RingMinedEvent) (bool, error) {
+	if _, err := r.rds.FindRingMinedByLogIndex(event.TxHash, event.LogIndex); err == nil {
+		return false, nil
+	}
+	if _, err := r.rds.FindRingMinedByRingHash(event.Ringhash.Hex()); err == nil {
+		return false, nil
+	}
+
+	model := &dao.RingMinedEvent{}
+	if err := model.ConvertDown(event); err != nil {
+		return false, err
+	}
+	return true, r.rds.Add(model)
+}
+
+func (r *Reindexer) saveFill(event *types.OrderFilledEvent) (bool, error) {
+	if _, err := r.rds.FindFillEventByLogIndex(event.TxHash, event.LogIndex, event.OrderHash); err == nil {
+		return false, nil
+	}
+	if _, err := r.rds.FindFillEventByRinghashAndOrderhash(event.Ringhash, event.OrderHash); err == nil {
+		return false, nil
+	}
+
+	model := &dao.FillEvent{}
+	if err := model.ConvertDown(event); err != nil {
+		return false, err
+	}
+	return true, r.rds.Add(model)
+}
+
+func (r *Reindexer) saveCancel(event *types.OrderCancelledEvent) (bool, error) {
+	if _, err := r.rds.FindCancelEventByLogIndex(event.TxHash, event.LogIndex); err == nil {
+		return false, nil
+	}
+	if model, err := r.rds.FindCancelEvent(event.OrderHash, event.TxHash); err == nil && model.LogIndex == 0 {
+		return false, nil
+	}
+
+	model := &dao.CancelEvent{}
+	if err := model.ConvertDown(event); err != nil {
+		return false, err
+	}
+	return true, r.rds.Add(model)
+}
+
+// 每个owner只保存最新的cutoff，已保存的cutoff更新时只替换为区块及事件序号更大的事件
+func (r *Reindexer) saveCutoff(event *types.CutoffEvent) (bool, error) {
+	model, err := r.rds.FindCutoffEventByOwnerAddress(event.Owner)
+	if err != nil {
+		model = &dao.CutOffEvent{}
+		if err := model.ConvertDown(event); err != nil {
+			return false, err
+		}
+		return true, r.rds.Add(model)
+	}
+
+	number := event.Blocknumber.Int64()
+	if model.BlockNumber > number || (model.BlockNumber == number && model.LogIndex >= event.LogIndex) {
+		return false, nil
+	}
+
+	id := model.ID
+	if err := model.ConvertDown(event); err != nil {
+		return false, err
+	}
+	model.ID = id
+	return true, r.rds.Save(model)
+}
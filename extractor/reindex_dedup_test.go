@@ -0,0 +1,167 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor
+
+import (
+	"errors"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"testing"
+)
+
+// 只保存ringmined和fill事件的dao，查询条件与RdsServiceImpl一致
+type dedupRds struct {
+	dao.RdsService
+	ringMineds []*dao.RingMinedEvent
+	fills      []*dao.FillEvent
+}
+
+func (rds *dedupRds) Add(item interface{}) error {
+	switch v := item.(type) {
+	case *dao.RingMinedEvent:
+		rds.ringMineds = append(rds.ringMineds, v)
+	case *dao.FillEvent:
+		rds.fills = append(rds.fills, v)
+	}
+	return nil
+}
+
+func (rds *dedupRds) FindRingMinedByLogIndex(txhash common.Hash, logIndex int64) (*dao.RingMinedEvent, error) {
+	for _, v := range rds.ringMineds {
+		if v.TxHash == txhash.Hex() && v.LogIndex == logIndex {
+			return v, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (rds *dedupRds) FindRingMinedByRingHash(ringHash string) (*dao.RingMinedEvent, error) {
+	for _, v := range rds.ringMineds {
+		if v.RingHash == ringHash {
+			return v, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (rds *dedupRds) FindFillEventByLogIndex(txhash common.Hash, logIndex int64, orderhash common.Hash) (*dao.FillEvent, error) {
+	for _, v := range rds.fills {
+		if v.TxHash == txhash.Hex() && v.LogIndex == logIndex && v.OrderHash == orderhash.Hex() {
+			return v, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (rds *dedupRds) FindFillEventByRinghashAndOrderhash(ringhash, orderhash common.Hash) (*dao.FillEvent, error) {
+	for _, v := range rds.fills {
+		if v.RingHash == ringhash.Hex() && v.OrderHash == orderhash.Hex() {
+			return v, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func newDedupRingMined(ringhash, txhash common.Hash, logIndex int64) *types.RingMinedEvent {
+	return &types.RingMinedEvent{
+		RingIndex:   big.NewInt(1),
+		Time:        big.NewInt(1500000000),
+		Blocknumber: big.NewInt(10),
+		TotalLrcFee: big.NewInt(100),
+		Ringhash:    ringhash,
+		TxHash:      txhash,
+		LogIndex:    logIndex,
+	}
+}
+
+func newDedupFill(ringhash, orderhash, txhash common.Hash, logIndex int64) *types.OrderFilledEvent {
+	return &types.OrderFilledEvent{
+		Ringhash:    ringhash,
+		OrderHash:   orderhash,
+		TxHash:      txhash,
+		LogIndex:    logIndex,
+		RingIndex:   big.NewInt(1),
+		Time:        big.NewInt(1500000000),
+		Blocknumber: big.NewInt(10),
+		AmountS:     big.NewInt(100),
+		AmountB:     big.NewInt(50),
+		LrcReward:   big.NewInt(0),
+		LrcFee:      big.NewInt(1),
+		SplitS:      big.NewInt(0),
+		SplitB:      big.NewInt(0),
+	}
+}
+
+func TestReindexer_SaveRingMined(t *testing.T) {
+	var (
+		ringhash = common.HexToHash("0x1")
+		txhash   = common.HexToHash("0x2")
+	)
+	rds := &dedupRds{}
+	// 增加log_index之前保存的记录，log_index为0
+	rds.ringMineds = append(rds.ringMineds, &dao.RingMinedEvent{RingHash: common.HexToHash("0x3").Hex(), TxHash: common.HexToHash("0x4").Hex()})
+	r := &Reindexer{rds: rds}
+
+	r.save(eventemitter.OrderManagerExtractorRingMined, newDedupRingMined(ringhash, txhash, 3))
+	r.save(eventemitter.OrderManagerExtractorRingMined, newDedupRingMined(ringhash, txhash, 3))
+	r.save(eventemitter.OrderManagerExtractorRingMined, newDedupRingMined(common.HexToHash("0x3"), common.HexToHash("0x4"), 5))
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.saved != 1 || r.skipped != 2 || len(rds.ringMineds) != 2 {
+		t.Fatalf("saved:%d skipped:%d ringmineds:%d, expect 1 2 2", r.saved, r.skipped, len(rds.ringMineds))
+	}
+	if saved := rds.ringMineds[1]; saved.RingHash != ringhash.Hex() || saved.LogIndex != 3 {
+		t.Fatalf("ringmined not saved correctly:%+v", saved)
+	}
+}
+
+func TestReindexer_SaveFill(t *testing.T) {
+	var (
+		ringhash = common.HexToHash("0x1")
+		txhash   = common.HexToHash("0x2")
+		order1   = common.HexToHash("0x11")
+		order2   = common.HexToHash("0x12")
+		legacy   = common.HexToHash("0x13")
+	)
+	rds := &dedupRds{}
+	// 增加log_index之前保存的记录，log_index为0
+	rds.fills = append(rds.fills, &dao.FillEvent{RingHash: ringhash.Hex(), OrderHash: legacy.Hex(), TxHash: txhash.Hex()})
+	r := &Reindexer{rds: rds}
+
+	// 同一RingMined事件的多个fill共用交易hash及事件序号，按订单区分
+	r.save(eventemitter.OrderManagerExtractorFill, newDedupFill(ringhash, order1, txhash, 3))
+	r.save(eventemitter.OrderManagerExtractorFill, newDedupFill(ringhash, order2, txhash, 3))
+	r.save(eventemitter.OrderManagerExtractorFill, newDedupFill(ringhash, order1, txhash, 3))
+	r.save(eventemitter.OrderManagerExtractorFill, newDedupFill(ringhash, legacy, txhash, 3))
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.saved != 2 || r.skipped != 2 || len(rds.fills) != 3 {
+		t.Fatalf("saved:%d skipped:%d fills:%d, expect 2 2 3", r.saved, r.skipped, len(rds.fills))
+	}
+	for idx, orderhash := range []common.Hash{order1, order2} {
+		if saved := rds.fills[idx+1]; saved.OrderHash != orderhash.Hex() || saved.LogIndex != 3 || saved.AmountS != "100" {
+			t.Fatalf("fill not saved correctly:%+v", saved)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package extractor_test
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+	"testing"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/extractor"
+	"github.com/Loopring/relay/log"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/jinzhu/gorm"
+	"go.uber.org/zap"
+)
+
+// 只保存cancel、cutoff事件以及进度的dao
+type reindexRds struct {
+	dao.RdsService
+	cancels       []*dao.CancelEvent
+	cutoffs       map[string]*dao.CutOffEvent
+	checkpoints   map[string]dao.ReindexCheckpoint
+	checkpointErr error
+}
+
+func (rds *reindexRds) Add(item interface{}) error {
+	switch v := item.(type) {
+	case *dao.CancelEvent:
+		rds.cancels = append(rds.cancels, v)
+	case *dao.CutOffEvent:
+		rds.cutoffs[v.Owner] = v
+	case *dao.ReindexCheckpoint:
+		rds.checkpoints[fmt.Sprintf("%d-%d", v.FromBlock, v.ToBlock)] = *v
+	}
+	return nil
+}
+
+func (rds *reindexRds) FindReindexCheckpoint(from, to int64) (*dao.ReindexCheckpoint, error) {
+	if rds.checkpointErr != nil {
+		return nil, rds.checkpointErr
+	}
+	if v, ok := rds.checkpoints[fmt.Sprintf("%d-%d", from, to)]; ok {
+		return &v, nil
+	}
+	return nil, gorm.ErrRecordNotFound
+}
+
+func (rds *reindexRds) Save(item interface{}) error {
+	return rds.Add(item)
+}
+
+func (rds *reindexRds) FindCancelEventByLogIndex(txhash common.Hash, logIndex int64) (*dao.CancelEvent, error) {
+	for _, v := range rds.cancels {
+		if v.TxHash == txhash.Hex() && v.LogIndex == logIndex {
+			return v, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (rds *reindexRds) FindCancelEvent(orderhash, txhash common.Hash) (*dao.CancelEvent, error) {
+	for _, v := range rds.cancels {
+		if v.OrderHash == orderhash.Hex() && v.TxHash == txhash.Hex() {
+			return v, nil
+		}
+	}
+	return nil, errors.New("record not found")
+}
+
+func (rds *reindexRds) FindCutoffEventByOwnerAddress(owner common.Address) (*dao.CutOffEvent, error) {
+	if v, ok := rds.cutoffs[owner.Hex()]; ok {
+		copied := *v
+		return &copied, nil
+	}
+	return nil, errors.New("record not found")
+}
+
+// 模拟节点，提供eth_getLogs及eth_getBlockByNumber
+type ReindexApi struct {
+	logs []map[string]interface{}
+}
+
+func (api *ReindexApi) GetLogs(query ethaccessor.FilterQuery) ([]map[string]interface{}, error) {
+	from, _ := new(big.Int).SetString(query.FromBlock[2:], 16)
+	to, _ := new(big.Int).SetString(query.ToBlock[2:], 16)
+	res := []map[string]interface{}{}
+	for _, v := range api.logs {
+		number, _ := new(big.Int).SetString(v["blockNumber"].(string)[2:], 16)
+		if number.Cmp(from) >= 0 && number.Cmp(to) <= 0 {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+func (api *ReindexApi) GetBlockByNumber(number string, full bool) (map[string]interface{}, error) {
+	n, _ := new(big.Int).SetString(number[2:], 16)
+	return map[string]interface{}{
+		"number":     number,
+		"hash":       common.BigToHash(n).Hex(),
+		"parentHash": common.BigToHash(new(big.Int).Sub(n, big.NewInt(1))).Hex(),
+		"timestamp":  fmt.Sprintf("%#x", 1500000000+n.Int64()*15),
+	}, nil
+}
+
+func (api *ReindexApi) addLog(address common.Address, number, logIndex int64, data int64, topics ...common.Hash) {
+	topicList := []string{}
+	for _, v := range topics {
+		topicList = append(topicList, v.Hex())
+	}
+	api.logs = append(api.logs, map[string]interface{}{
+		"logIndex":         fmt.Sprintf("%#x", logIndex),
+		"blockNumber":      fmt.Sprintf("%#x", number),
+		"blockHash":        common.BigToHash(big.NewInt(number)).Hex(),
+		"transactionHash":  common.BigToHash(big.NewInt(number*100 + logIndex)).Hex(),
+		"transactionIndex": "0x0",
+		"address":          address.Hex(),
+		"data":             fmt.Sprintf("0x%064x", data),
+		"topics":           topicList,
+	})
+}
+
+func newTestReindexer(t *testing.T, api *ReindexApi, protocol common.Address) (*extractor.Reindexer, *reindexRds, *ethaccessor.EthNodeAccessor) {
+	logOpts := zap.NewDevelopmentConfig()
+	logOpts.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	log.Initialize(config.LogOptions{ZapOpts: logOpts})
+
+	cfg := config.LoadConfig("../config/relay.toml")
+	accessor := &ethaccessor.EthNodeAccessor{}
+	accessor.Erc20Abi, _ = ethaccessor.NewAbi(cfg.Common.Erc20Abi)
+	accessor.WethAbi, _ = ethaccessor.NewAbi(cfg.Common.WethAbi)
+	accessor.ProtocolImplAbi, _ = ethaccessor.NewAbi(cfg.Common.ProtocolImpl.ImplAbi)
+	accessor.RinghashRegistryAbi, _ = ethaccessor.NewAbi(cfg.Common.ProtocolImpl.RegistryAbi)
+	accessor.DelegateAbi, _ = ethaccessor.NewAbi(cfg.Common.ProtocolImpl.DelegateAbi)
+	accessor.TokenRegistryAbi, _ = ethaccessor.NewAbi(cfg.Common.ProtocolImpl.TokenRegistryAbi)
+	accessor.ProtocolAddresses = map[common.Address]*ethaccessor.ProtocolAddress{
+		protocol: {ContractAddress: protocol},
+	}
+
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", api); err != nil {
+		t.Fatal(err)
+	}
+	accessor.Client = rpc.DialInProc(server)
+
+	rds := &reindexRds{cutoffs: make(map[string]*dao.CutOffEvent), checkpoints: make(map[string]dao.ReindexCheckpoint)}
+	options := config.AccessorOptions{LogMaxRange: 4}
+	return extractor.NewReindexer(options, cfg.Common, accessor, rds), rds, accessor
+}
+
+func TestReindexer_Run(t *testing.T) {
+	var (
+		api       = &ReindexApi{}
+		protocol  = common.HexToAddress("0x1000000000000000000000000000000000000001")
+		owner     = common.HexToAddress("0x2000000000000000000000000000000000000002")
+		orderhash = common.HexToHash("0x3")
+	)
+	reindexer, rds, accessor := newTestReindexer(t, api, protocol)
+
+	cancelId := accessor.ProtocolImplAbi.Events["OrderCancelled"].Id()
+	cutoffId := accessor.ProtocolImplAbi.Events["CutoffTimestampChanged"].Id()
+	api.addLog(protocol, 5, 2, 1000, cancelId, orderhash)
+	api.addLog(protocol, 6, 0, 100, cutoffId, common.BytesToHash(owner.Bytes()))
+	api.addLog(protocol, 9, 1, 200, cutoffId, common.BytesToHash(owner.Bytes()))
+
+	run := func(from, to int64) extractor.ReindexProgress {
+		var last extractor.ReindexProgress
+		if err := reindexer.Run(from, to, func(progress extractor.ReindexProgress) error {
+			if progress.ChunkFrom != last.ChunkTo+1 && last.ChunkTo != 0 {
+				t.Fatalf("chunk %d-%d does not follow %d", progress.ChunkFrom, progress.ChunkTo, last.ChunkTo)
+			}
+			last = progress
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if last.ChunkTo != to {
+			t.Fatalf("reindex stopped at %d, expect %d", last.ChunkTo, to)
+		}
+		return last
+	}
+
+	first := run(1, 20)
+	if first.Logs != 3 || first.Saved != 3 || first.Skipped != 0 {
+		t.Fatalf("first run logs:%d saved:%d skipped:%d", first.Logs, first.Saved, first.Skipped)
+	}
+	if len(rds.cancels) != 1 || rds.cancels[0].LogIndex != 2 || rds.cancels[0].AmountCancelled != "1000" {
+		t.Fatalf("cancel events not saved correctly:%+v", rds.cancels)
+	}
+	if cutoff := rds.cutoffs[owner.Hex()]; cutoff == nil || cutoff.Cutoff != 200 || cutoff.BlockNumber != 9 {
+		t.Fatalf("cutoff event not saved correctly:%+v", cutoff)
+	}
+
+	// 重复执行以及只包含旧cutoff的区间不改变已保存的事件
+	second := run(1, 20)
+	third := run(6, 6)
+	if second.Saved != 0 || second.Skipped != 3 || third.Saved != 0 || third.Skipped != 1 {
+		t.Fatalf("rerun saved:%d/%d skipped:%d/%d", second.Saved, third.Saved, second.Skipped, third.Skipped)
+	}
+	if len(rds.cancels) != 1 || rds.cutoffs[owner.Hex()].Cutoff != 200 {
+		t.Fatalf("rerun changed saved events, cancels:%d cutoff:%d", len(rds.cancels), rds.cutoffs[owner.Hex()].Cutoff)
+	}
+}
+
+func TestReindexer_RunFromCheckpoint(t *testing.T) {
+	var (
+		api       = &ReindexApi{}
+		protocol  = common.HexToAddress("0x1000000000000000000000000000000000000001")
+		orderhash = common.HexToHash("0x3")
+		stopped   = errors.New("stopped")
+	)
+	reindexer, rds, accessor := newTestReindexer(t, api, protocol)
+	cancelId := accessor.ProtocolImplAbi.Events["OrderCancelled"].Id()
+	api.addLog(protocol, 2, 0, 100, cancelId, orderhash)
+	api.addLog(protocol, 7, 1, 200, cancelId, orderhash)
+
+	// 第二个区间处理失败时中断，进度停留在第一个区间
+	checkpoint, err := reindexer.Checkpoint(1, 12, false)
+	if err != nil || checkpoint.Current != 0 || checkpoint.Finished {
+		t.Fatalf("new checkpoint:%+v err:%v", checkpoint, err)
+	}
+	var chunks []extractor.ReindexProgress
+	err = reindexer.RunFromCheckpoint(checkpoint, func(progress extractor.ReindexProgress) error {
+		chunks = append(chunks, progress)
+		if len(chunks) == 2 {
+			return stopped
+		}
+		return nil
+	})
+	if err != stopped || len(chunks) != 2 {
+		t.Fatalf("run should stop at the second chunk, chunks:%d err:%v", len(chunks), err)
+	}
+	firstTo := chunks[0].ChunkTo
+	if saved, _ := rds.FindReindexCheckpoint(1, 12); saved.Current != firstTo || saved.Finished {
+		t.Fatalf("saved checkpoint:%+v, expect current:%d", saved, firstTo)
+	}
+
+	// 从保存的进度继续，失败的区间重新处理，已保存的事件不重复保存
+	checkpoint, _ = reindexer.Checkpoint(1, 12, false)
+	chunks = nil
+	if err := reindexer.RunFromCheckpoint(checkpoint, func(progress extractor.ReindexProgress) error {
+		chunks = append(chunks, progress)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) == 0 || chunks[0].ChunkFrom != firstTo+1 || chunks[len(chunks)-1].ChunkTo != 12 {
+		t.Fatalf("resumed chunks:%+v, expect from %d to 12", chunks, firstTo+1)
+	}
+	if len(rds.cancels) != 2 {
+		t.Fatalf("cancels:%d, expect 2", len(rds.cancels))
+	}
+	if saved, _ := rds.FindReindexCheckpoint(1, 12); saved.Current != 12 || !saved.Finished {
+		t.Fatalf("saved checkpoint:%+v, expect finished", saved)
+	}
+
+	if checkpoint, _ = reindexer.Checkpoint(1, 12, false); !checkpoint.Finished {
+		t.Fatalf("checkpoint should be finished")
+	}
+	if checkpoint, _ = reindexer.Checkpoint(1, 12, true); checkpoint.Finished || checkpoint.Current != 0 {
+		t.Fatalf("restarted checkpoint:%+v", checkpoint)
+	}
+}
+
+// 查询进度出错时不能当作没有进度而从头开始
+func TestReindexer_CheckpointError(t *testing.T) {
+	protocol := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	reindexer, rds, _ := newTestReindexer(t, &ReindexApi{}, protocol)
+	rds.checkpoints["1-12"] = dao.ReindexCheckpoint{FromBlock: 1, ToBlock: 12, Current: 8}
+	rds.checkpointErr = errors.New("connection refused")
+
+	if checkpoint, err := reindexer.Checkpoint(1, 12, false); err != rds.checkpointErr || checkpoint != nil {
+		t.Fatalf("checkpoint:%+v err:%v, expect the query error", checkpoint, err)
+	}
+	if saved := rds.checkpoints["1-12"]; saved.Current != 8 {
+		t.Fatalf("saved progress changed:%+v", saved)
+	}
+}
+
+// 重新解析不经过全局eventemitter：运行中的extractor收不到历史事件，重新解析也不保存运行中的extractor发出的事件
+func TestReindexer_Isolated(t *testing.T) {
+	var (
+		api       = &ReindexApi{}
+		protocol  = common.HexToAddress("0x1000000000000000000000000000000000000001")
+		orderhash = common.HexToHash("0x3")
+	)
+	reindexer, rds, accessor := newTestReindexer(t, api, protocol)
+	cancelId := accessor.ProtocolImplAbi.Events["OrderCancelled"].Id()
+	api.addLog(protocol, 2, 0, 100, cancelId, orderhash)
+
+	cfg := config.LoadConfig("../config/relay.toml")
+	extractor.NewExtractorService(config.AccessorOptions{}, cfg.Common, accessor, &reindexRds{})
+	var (
+		mtx      sync.Mutex
+		received int
+	)
+	watcher := &eventemitter.Watcher{Concurrent: false, Handle: func(eventData eventemitter.EventData) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		received++
+		return nil
+	}}
+	eventemitter.On(eventemitter.OrderManagerExtractorCancel, watcher)
+	defer eventemitter.Un(eventemitter.OrderManagerExtractorCancel, watcher)
+
+	if err := reindexer.Run(1, 4, func(progress extractor.ReindexProgress) error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	mtx.Lock()
+	if received != 0 {
+		t.Fatalf("reindexed events should not be emitted, received:%d", received)
+	}
+	mtx.Unlock()
+	if len(rds.cancels) != 1 {
+		t.Fatalf("cancels:%d, expect 1", len(rds.cancels))
+	}
+}
@@ -0,0 +1,420 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/Loopring/relay/usermanager"
+	"github.com/ethereum/go-ethereum/common"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxAdminRequestSize = 1024 * 128
+
+type AdminService interface {
+	Start()
+	Stop()
+
+	// Api returns methods of admin namespace, it is used to expose the namespace on jsonrpc listeners
+	Api() interface{}
+
+	// MinerApi returns methods of miner namespace, it is nil if the node doesn't run a miner
+	MinerApi() interface{}
+
+	// Authenticator requires authentication of requests calling admin methods
+	Authenticator(next http.Handler) http.Handler
+}
+
+// MinerController is implemented by miner.Miner, it is nil if the node doesn't run a miner
+type MinerController interface {
+	Pause()
+	Resume()
+	IsPaused() bool
+	Api() interface{}
+}
+
+// AdminServiceImpl serves the admin json-rpc namespace on its own listener,
+// every request must be authenticated by the bearer token or hmac signature in options
+type AdminServiceImpl struct {
+	options  config.AdminOptions
+	api      *AdminApi
+	minerApi interface{}
+	rds      dao.RdsService
+	listener *rpcListener
+}
+
+// AdminApi contains methods of admin namespace, every call is recorded in admin audit table
+type AdminApi struct {
+	rds            dao.RdsService
+	userManager    usermanager.UserManager
+	ipfsSubService IPFSSubService
+	miner          MinerController
+}
+
+type AdminAuditQuery struct {
+	Action    string `json:"action"`
+	PageIndex int    `json:"pageIndex"`
+	PageSize  int    `json:"pageSize"`
+}
+
+func NewAdminService(options config.AdminOptions, rds dao.RdsService, userManager usermanager.UserManager, ipfsSubService IPFSSubService, miner MinerController) *AdminServiceImpl {
+	s := &AdminServiceImpl{}
+	s.options = options
+	s.rds = rds
+	s.api = &AdminApi{rds: rds, userManager: userManager, ipfsSubService: ipfsSubService, miner: miner}
+	if nil != miner {
+		s.minerApi = miner.Api()
+	}
+	return s
+}
+
+func (s *AdminServiceImpl) Start() {
+	if s.options.Port <= 0 {
+		log.Info("admin,listener is disabled")
+		return
+	}
+	if "" == s.options.AuthToken && "" == s.options.HmacSecret {
+		log.Errorf("admin,auth_token or hmac_secret must be set, listener is disabled")
+		return
+	}
+
+	options := config.JsonrpcListenerOptions{
+		Name:           "admin",
+		BindAddress:    s.options.BindAddress,
+		Port:           s.options.Port,
+		MaxRequestSize: maxAdminRequestSize,
+		Namespaces:     []string{"admin"},
+	}
+	apis := map[string][]interface{}{"admin": {s.api}}
+	if nil != s.minerApi {
+		options.Namespaces = append(options.Namespaces, "miner")
+		apis["miner"] = []interface{}{s.minerApi}
+	}
+	wrap := func(next http.Handler) http.Handler {
+		return &adminAuthHandler{service: s, next: next}
+	}
+
+	var err error
+	if s.listener, err = newRpcListener(options, apis, wrap); err != nil {
+		log.Errorf("%s", err.Error())
+		return
+	}
+	if err = s.listener.start(); err != nil {
+		log.Errorf("%s", err.Error())
+		s.listener = nil
+	}
+}
+
+func (s *AdminServiceImpl) Stop() {
+	if s.listener != nil {
+		s.listener.stop()
+		s.listener = nil
+	}
+}
+
+func (s *AdminServiceImpl) Api() interface{} {
+	return s.api
+}
+
+func (s *AdminServiceImpl) MinerApi() interface{} {
+	return s.minerApi
+}
+
+func (s *AdminServiceImpl) Authenticator(next http.Handler) http.Handler {
+	return &adminAuthHandler{service: s, next: next, adminMethodsOnly: true}
+}
+
+// authenticate accepts either "Authorization: Bearer <auth_token>",
+// or "X-Timestamp: <unix seconds>" and "X-Signature: hex(hmac_sha256(hmac_secret, X-Timestamp + body))"
+func (s *AdminServiceImpl) authenticate(r *http.Request, body []byte) error {
+	if auth := r.Header.Get("Authorization"); "" != s.options.AuthToken && strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.options.AuthToken)) != 1 {
+			return errors.New("admin,invalid bearer token")
+		}
+		return nil
+	}
+
+	if sig := r.Header.Get("X-Signature"); "" != s.options.HmacSecret && "" != sig {
+		ts := r.Header.Get("X-Timestamp")
+		timestamp, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil {
+			return errors.New("admin,invalid X-Timestamp")
+		}
+		if skew := time.Now().Unix() - timestamp; skew > s.options.MaxTimestampSkew || -skew > s.options.MaxTimestampSkew {
+			return errors.New("admin,X-Timestamp is out of range")
+		}
+		mac := hmac.New(sha256.New, []byte(s.options.HmacSecret))
+		mac.Write([]byte(ts))
+		mac.Write(body)
+		expected := hex.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(strings.ToLower(strings.TrimPrefix(sig, "0x"))), []byte(expected)) {
+			return errors.New("admin,invalid X-Signature")
+		}
+		return nil
+	}
+
+	return errors.New("admin,missing credentials")
+}
+
+// adminAuthHandler authenticates all requests, or only requests calling admin methods if adminMethodsOnly is set
+type adminAuthHandler struct {
+	service          *AdminServiceImpl
+	next             http.Handler
+	adminMethodsOnly bool
+}
+
+func (h *adminAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxAdminRequestSize+1))
+	if err != nil {
+		http.Error(w, "read request error", http.StatusBadRequest)
+		return
+	}
+	if len(body) > maxAdminRequestSize {
+		http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if h.adminMethodsOnly && !isAdminRequest(body) {
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		h.next.ServeHTTP(w, r)
+		return
+	}
+
+	if err := h.service.authenticate(r, body); err != nil {
+		h.service.api.audit(&RpcRequest{RemoteAddr: r.RemoteAddr}, "authenticate", nil, err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	h.next.ServeHTTP(w, r)
+}
+
+// isAdminRequest reports whether the single or batch request calls any admin or miner method,
+// it is treated as an admin request if the body can't be parsed
+func isAdminRequest(body []byte) bool {
+	type request struct {
+		Method string `json:"method"`
+	}
+
+	var (
+		reqs []request
+		err  error
+	)
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &reqs)
+	} else {
+		var req request
+		err = json.Unmarshal(body, &req)
+		reqs = append(reqs, req)
+	}
+	if err != nil {
+		return true
+	}
+
+	for _, req := range reqs {
+		if strings.HasPrefix(req.Method, "admin_") || strings.HasPrefix(req.Method, "miner_") {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *AdminApi) AddWhiteListUser(req *RpcRequest, owner string) (res bool, err error) {
+	defer func() { a.audit(req, "addWhiteListUser", owner, err) }()
+
+	if !common.IsHexAddress(owner) {
+		return false, fmt.Errorf("admin,invalid owner %s", owner)
+	}
+	user := types.WhiteListUser{Owner: common.HexToAddress(owner), CreateTime: time.Now().Unix()}
+	if err = a.userManager.AddWhiteListUser(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *AdminApi) DelWhiteListUser(req *RpcRequest, owner string) (res bool, err error) {
+	defer func() { a.audit(req, "delWhiteListUser", owner, err) }()
+
+	if !common.IsHexAddress(owner) {
+		return false, fmt.Errorf("admin,invalid owner %s", owner)
+	}
+	user := types.WhiteListUser{Owner: common.HexToAddress(owner)}
+	if err = a.userManager.DelWhiteListUser(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DenyToken marks the token as denied, orders of it will be rejected by the token filter and it is excluded from matching
+func (a *AdminApi) DenyToken(req *RpcRequest, token string) (res bool, err error) {
+	defer func() { a.audit(req, "denyToken", token, err) }()
+
+	var model *dao.Token
+	if model, err = a.findToken(token); err != nil {
+		return false, err
+	}
+	if model.IsMarket {
+		return false, fmt.Errorf("admin,market token %s can't be denied", model.Symbol)
+	}
+	if model.Deny {
+		return true, nil
+	}
+	if err = a.rds.SetTokenDeny(model.Protocol, true); err != nil {
+		return false, err
+	}
+
+	var t types.Token
+	model.ConvertUp(&t)
+	return true, util.DenyToken(t)
+}
+
+func (a *AdminApi) AllowToken(req *RpcRequest, token string) (res bool, err error) {
+	defer func() { a.audit(req, "allowToken", token, err) }()
+
+	var model *dao.Token
+	if model, err = a.findToken(token); err != nil {
+		return false, err
+	}
+	if !model.Deny {
+		return true, nil
+	}
+	if err = a.rds.SetTokenDeny(model.Protocol, false); err != nil {
+		return false, err
+	}
+
+	var t types.Token
+	model.ConvertUp(&t)
+	t.Deny = false
+	return true, util.AllowToken(t)
+}
+
+func (a *AdminApi) RegisterIpfsTopic(req *RpcRequest, topic string) (res bool, err error) {
+	defer func() { a.audit(req, "registerIpfsTopic", topic, err) }()
+
+	if err = a.ipfsSubService.Register(topic); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *AdminApi) UnregisterIpfsTopic(req *RpcRequest, topic string) (res bool, err error) {
+	defer func() { a.audit(req, "unregisterIpfsTopic", topic, err) }()
+
+	if err = a.ipfsSubService.Unregister(topic); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (a *AdminApi) PauseMiner(req *RpcRequest) (res bool, err error) {
+	defer func() { a.audit(req, "pauseMiner", nil, err) }()
+
+	if nil == a.miner {
+		return false, errors.New("admin,miner isn't running in this node")
+	}
+	a.miner.Pause()
+	return true, nil
+}
+
+func (a *AdminApi) ResumeMiner(req *RpcRequest) (res bool, err error) {
+	defer func() { a.audit(req, "resumeMiner", nil, err) }()
+
+	if nil == a.miner {
+		return false, errors.New("admin,miner isn't running in this node")
+	}
+	a.miner.Resume()
+	return true, nil
+}
+
+func (a *AdminApi) IsMinerPaused() (res bool, err error) {
+	if nil == a.miner {
+		return false, errors.New("admin,miner isn't running in this node")
+	}
+	return a.miner.IsPaused(), nil
+}
+
+func (a *AdminApi) GetAuditLogs(query AdminAuditQuery) (res dao.PageResult, err error) {
+	q := make(map[string]interface{})
+	if "" != query.Action {
+		q["action"] = query.Action
+	}
+	return a.rds.AdminAuditPageQuery(q, query.PageIndex, query.PageSize)
+}
+
+// findToken accepts token address or symbol
+func (a *AdminApi) findToken(token string) (*dao.Token, error) {
+	protocol := ""
+	if util.IsAddress(token) {
+		if !common.IsHexAddress(token) {
+			return nil, fmt.Errorf("admin,invalid token address %s", token)
+		}
+		protocol = common.HexToAddress(token).Hex()
+	} else if t, ok := util.AllTokens[strings.ToUpper(token)]; ok {
+		protocol = t.Protocol.Hex()
+	} else if t, ok := util.AllTokens[token]; ok {
+		protocol = t.Protocol.Hex()
+	} else {
+		return nil, fmt.Errorf("admin,token %s not found, use address for denied tokens", token)
+	}
+
+	model, err := a.rds.FindTokenByProtocol(protocol)
+	if err != nil {
+		return nil, fmt.Errorf("admin,token %s not found:%s", token, err.Error())
+	}
+	return model, nil
+}
+
+func (a *AdminApi) audit(req *RpcRequest, action string, params interface{}, err error) {
+	record := &dao.AdminAudit{Action: action, Success: err == nil, CreateTime: time.Now().Unix()}
+	if nil != params {
+		if bs, e := json.Marshal(params); e == nil {
+			record.Params = string(bs)
+		}
+	}
+	record.RemoteAddr = req.remoteAddr()
+	if nil != err {
+		record.Err = err.Error()
+	}
+
+	if e := a.rds.Add(record); e != nil {
+		log.Errorf("admin,save audit of %s error:%s", action, e.Error())
+	}
+	log.Infof("admin,%s params:%s remote:%s success:%t", action, record.Params, record.RemoteAddr, record.Success)
+}
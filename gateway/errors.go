@@ -0,0 +1,119 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"fmt"
+)
+
+// ErrorReason is the machine-readable reason of a rejection, wallets should rely on it rather than the message
+type ErrorReason string
+
+const (
+	ReasonInvalidOrder          ErrorReason = "INVALID_ORDER"
+	ReasonInvalidSignature      ErrorReason = "INVALID_SIGNATURE"
+	ReasonTokenNotSupported     ErrorReason = "TOKEN_NOT_SUPPORTED"
+	ReasonFeeTooLow             ErrorReason = "FEE_TOO_LOW"
+	ReasonPriceOutOfRange       ErrorReason = "PRICE_OUT_OF_RANGE"
+	ReasonOrderCutoff           ErrorReason = "ORDER_CUTOFF"
+	ReasonOrderExists           ErrorReason = "ORDER_EXISTS"
+	ReasonMarginSplitTooLow     ErrorReason = "MARGIN_SPLIT_TOO_LOW"
+	ReasonTtlTooLong            ErrorReason = "TTL_TOO_LONG"
+	ReasonTimestampInFuture     ErrorReason = "TIMESTAMP_IN_FUTURE"
+	ReasonOrderRejected         ErrorReason = "ORDER_REJECTED"
+	ReasonOrderExpired          ErrorReason = "ORDER_EXPIRED"
+	ReasonOrderNotFound         ErrorReason = "ORDER_NOT_FOUND"
+	ReasonOrderNotCancellable   ErrorReason = "ORDER_NOT_CANCELLABLE"
+	ReasonOrderFinished         ErrorReason = "ORDER_FINISHED"
+	ReasonInsufficientBalance   ErrorReason = "INSUFFICIENT_BALANCE"
+	ReasonInsufficientAllowance ErrorReason = "INSUFFICIENT_ALLOWANCE"
+	ReasonTooManyOrders         ErrorReason = "TOO_MANY_ORDERS"
+	ReasonRateLimited           ErrorReason = "RATE_LIMITED"
+	ReasonTooManyOpenOrders     ErrorReason = "TOO_MANY_OPEN_ORDERS"
+	ReasonCancellationExpired   ErrorReason = "CANCELLATION_EXPIRED"
+	ReasonInternalError         ErrorReason = "INTERNAL_ERROR"
+)
+
+// json-rpc error codes, the values must never be changed once released
+var errorCodes = map[ErrorReason]int{
+	ReasonInvalidOrder:          -32001,
+	ReasonInvalidSignature:      -32002,
+	ReasonTokenNotSupported:     -32003,
+	ReasonFeeTooLow:             -32004,
+	ReasonPriceOutOfRange:       -32005,
+	ReasonOrderCutoff:           -32006,
+	ReasonOrderExists:           -32007,
+	ReasonMarginSplitTooLow:     -32008,
+	ReasonTtlTooLong:            -32009,
+	ReasonTimestampInFuture:     -32010,
+	ReasonOrderRejected:         -32011,
+	ReasonOrderExpired:          -32012,
+	ReasonOrderNotFound:         -32013,
+	ReasonOrderNotCancellable:   -32014,
+	ReasonOrderFinished:         -32015,
+	ReasonInsufficientBalance:   -32016,
+	ReasonInsufficientAllowance: -32017,
+	ReasonTooManyOrders:         -32018,
+	ReasonRateLimited:           -32019,
+	ReasonTooManyOpenOrders:     -32020,
+	ReasonCancellationExpired:   -32021,
+	ReasonInternalError:         -32099,
+}
+
+// GatewayError implements rpc.Error, the code and data are returned in json-rpc error object if it's returned by RpcRequest.fail
+type GatewayError struct {
+	Reason  ErrorReason
+	Message string
+	Data    map[string]interface{}
+}
+
+func NewGatewayError(reason ErrorReason, data map[string]interface{}, format string, args ...interface{}) *GatewayError {
+	return &GatewayError{Reason: reason, Message: fmt.Sprintf(format, args...), Data: data}
+}
+
+func (e *GatewayError) Error() string {
+	return e.Message
+}
+
+func (e *GatewayError) ErrorCode() int {
+	if code, ok := errorCodes[e.Reason]; ok {
+		return code
+	}
+	return errorCodes[ReasonInternalError]
+}
+
+func (e *GatewayError) ErrorData() interface{} {
+	data := make(map[string]interface{})
+	for k, v := range e.Data {
+		data[k] = v
+	}
+	data["reason"] = e.Reason
+	return data
+}
+
+// toGatewayError keeps GatewayError as it is, and wraps others as internal error
+func toGatewayError(err error) *GatewayError {
+	if err == nil {
+		return nil
+	}
+	if ge, ok := err.(*GatewayError); ok {
+		return ge
+	}
+	return NewGatewayError(ReasonInternalError, nil, "%s", err.Error())
+}
@@ -18,11 +18,6 @@ func (e *EthForwarder) GetBalance(address, blockNumber string) (result string, e
 	return
 }
 
-func (e *EthForwarder) SendRawTransaction(tx string) (result string, err error) {
-	err = e.Accessor.Call(&result, "eth_sendRawTransaction", tx)
-	return
-}
-
 func (e *EthForwarder) GetTransactionCount(address, blockNumber string) (result string, err error) {
 	fmt.Println("get balance log")
 	fmt.Println("intput is " + address + " " + blockNumber)
@@ -39,3 +34,13 @@ func (e *EthForwarder) Call(ethCall ethaccessor.CallArg, blockNumber string) (re
 	fmt.Println(result)
 	return result, nil
 }
+
+// EthWriteForwarder forwards methods sending transactions, it is not registered in readonly mode
+type EthWriteForwarder struct {
+	Accessor ethaccessor.EthNodeAccessor
+}
+
+func (e *EthWriteForwarder) SendRawTransaction(tx string) (result string, err error) {
+	err = e.Accessor.Call(&result, "eth_sendRawTransaction", tx)
+	return
+}
@@ -0,0 +1,426 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FilterNameBase        = "base"
+	FilterNameSign        = "sign"
+	FilterNameToken       = "token"
+	FilterNameCutoff      = "cutoff"
+	FilterNameMarginSplit = "margin_split"
+	FilterNameTtl         = "ttl"
+	FilterNameTimestamp   = "timestamp"
+	FilterNameExpire      = "expire"
+	FilterNameOwnerRate   = "owner_rate"
+	FilterNameOrderQuota  = "order_quota"
+)
+
+// filters used when gateway_filters.filters is not set
+var DefaultFilterNames = []string{FilterNameBase, FilterNameSign, FilterNameToken, FilterNameCutoff, FilterNameExpire}
+
+// Filter should return a GatewayError when the order is rejected,
+// other errors will be wrapped with reason ORDER_REJECTED
+type Filter interface {
+	Name() string
+	Filter(o *types.Order) (bool, error)
+}
+
+// QuotaFilter is a filter which only checks it's quota in Filter, the quota is consumed by Consume
+// after the order is accepted by all filters, so that validations and rejected orders cost nothing
+type QuotaFilter interface {
+	Filter
+	Consume(o *types.Order) error
+}
+
+// FilterCreator creates filter with options in [gateway_filters],
+// custom filter can read it's params from gateway_filters.params.<name>
+type FilterCreator func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error)
+
+var (
+	filterCreators   = make(map[string]FilterCreator)
+	filterCreatorMtx sync.RWMutex
+)
+
+// RegisterFilter makes a filter available by name in gateway_filters.filters,
+// it should be called before gateway.Initialize
+func RegisterFilter(name string, creator FilterCreator) {
+	filterCreatorMtx.Lock()
+	defer filterCreatorMtx.Unlock()
+	filterCreators[name] = creator
+}
+
+func NewFilters(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) ([]Filter, error) {
+	filterCreatorMtx.RLock()
+	defer filterCreatorMtx.RUnlock()
+
+	names := options.Filters
+	if len(names) == 0 {
+		names = DefaultFilterNames
+	}
+
+	filters := make([]Filter, 0)
+	for _, name := range names {
+		creator, ok := filterCreators[name]
+		if !ok {
+			return nil, fmt.Errorf("gateway,filter %s not registered", name)
+		}
+		f, err := creator(options, om)
+		if err != nil {
+			return nil, fmt.Errorf("gateway,create filter %s failed:%s", name, err.Error())
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+func applyFilters(filters []Filter, o *types.Order) error {
+	for _, v := range filters {
+		valid, err := v.Filter(o)
+		if valid {
+			continue
+		}
+		if err == nil {
+			err = fmt.Errorf("gateway,filter %s rejected order %s", v.Name(), o.Hash.Hex())
+		}
+		ge, ok := err.(*GatewayError)
+		if !ok {
+			ge = NewGatewayError(ReasonOrderRejected, nil, "%s", err.Error())
+		}
+		if ge.Data == nil {
+			ge.Data = make(map[string]interface{})
+		}
+		ge.Data["filter"] = v.Name()
+		return ge
+	}
+	return nil
+}
+
+// consumeFilters is called once the order passed all filters and is going to be stored
+func consumeFilters(filters []Filter, o *types.Order) error {
+	for _, v := range filters {
+		if f, ok := v.(QuotaFilter); ok {
+			if err := f.Consume(o); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	RegisterFilter(FilterNameBase, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return &BaseFilter{MinLrcFee: big.NewInt(options.BaseFilter.MinLrcFee), MaxPrice: big.NewInt(options.BaseFilter.MaxPrice)}, nil
+	})
+	RegisterFilter(FilterNameSign, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return &SignFilter{}, nil
+	})
+	RegisterFilter(FilterNameToken, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return NewTokenFilter(options.TokenFilter.AllowTokens, options.TokenFilter.DeniedTokens)
+	})
+	RegisterFilter(FilterNameCutoff, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return &CutoffFilter{om: om}, nil
+	})
+	RegisterFilter(FilterNameMarginSplit, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		if options.MarginSplitFilter.MinMarginSplitPercentage > 100 {
+			return nil, fmt.Errorf("min_margin_split_percentage should not be greater than 100")
+		}
+		return &MarginSplitFilter{MinMarginSplitPercentage: uint8(options.MarginSplitFilter.MinMarginSplitPercentage)}, nil
+	})
+	RegisterFilter(FilterNameTtl, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return &TtlFilter{MaxTtl: big.NewInt(options.TtlFilter.MaxTtl)}, nil
+	})
+	RegisterFilter(FilterNameTimestamp, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return &TimestampFilter{MaxFutureSeconds: options.TimestampFilter.MaxFutureSeconds}, nil
+	})
+	RegisterFilter(FilterNameExpire, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return &ExpireFilter{}, nil
+	})
+	RegisterFilter(FilterNameOwnerRate, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return &OwnerRateFilter{limiter: NewRateLimiter(options.OwnerRateFilter.Rate, options.OwnerRateFilter.Burst)}, nil
+	})
+	RegisterFilter(FilterNameOrderQuota, func(options *config.GatewayFiltersOptions, om ordermanager.OrderManager) (Filter, error) {
+		return &OrderQuotaFilter{om: om, MaxOpenOrders: options.OrderQuotaFilter.MaxOpenOrders}, nil
+	})
+}
+
+type BaseFilter struct {
+	MinLrcFee *big.Int
+	MaxPrice  *big.Int
+}
+
+func (f *BaseFilter) Name() string { return FilterNameBase }
+
+func (f *BaseFilter) Filter(o *types.Order) (bool, error) {
+	const (
+		addrLength = 20
+		hashLength = 32
+	)
+
+	if len(o.Hash) != hashLength {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "hash"}, "gateway,base filter,order %s length error", o.Hash.Hex())
+	}
+	if len(o.TokenB) != addrLength {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "tokenB"}, "gateway,base filter,order %s tokenB %s address length error", o.Hash.Hex(), o.TokenB.Hex())
+	}
+	if len(o.TokenS) != addrLength {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "tokenS"}, "gateway,base filter,order %s tokenS %s address length error", o.Hash.Hex(), o.TokenS.Hex())
+	}
+	if o.TokenB == o.TokenS {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "tokenB"}, "gateway,base filter,order %s tokenB == tokenS", o.Hash.Hex())
+	}
+	if f.MinLrcFee.Cmp(o.LrcFee) >= 0 {
+		return false, NewGatewayError(ReasonFeeTooLow, map[string]interface{}{"lrcFee": o.LrcFee.String(), "minLrcFee": f.MinLrcFee.String()}, "gateway,base filter,order %s lrc fee %s invalid", o.Hash.Hex(), o.LrcFee.String())
+	}
+	if len(o.Owner) != addrLength {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "owner"}, "gateway,base filter,order %s owner %s address length error", o.Hash.Hex(), o.Owner.Hex())
+	}
+	if len(o.Protocol) != addrLength {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "protocol"}, "gateway,base filter,order %s protocol %s address length error", o.Hash.Hex(), o.Owner.Hex())
+	}
+	if o.Price.Cmp(new(big.Rat).SetFrac(f.MaxPrice, big.NewInt(1))) > 0 || o.Price.Cmp(new(big.Rat).SetFrac(big.NewInt(1), f.MaxPrice)) < 0 {
+		return false, NewGatewayError(ReasonPriceOutOfRange, map[string]interface{}{"price": o.Price.FloatString(8), "maxPrice": f.MaxPrice.String()}, "gateway,base filter,order %s price out of range", o.Hash.Hex())
+	}
+	return true, nil
+}
+
+type SignFilter struct {
+}
+
+func (f *SignFilter) Name() string { return FilterNameSign }
+
+func (f *SignFilter) Filter(o *types.Order) (bool, error) {
+	o.Hash = o.GenerateHash()
+
+	if addr, err := o.SignerAddress(); nil != err {
+		return false, NewGatewayError(ReasonInvalidSignature, nil, "gateway,sign filter,order %s signature invalid:%s", o.Hash.Hex(), err.Error())
+	} else if addr != o.Owner {
+		return false, NewGatewayError(ReasonInvalidSignature, map[string]interface{}{"owner": o.Owner.Hex(), "signer": addr.Hex()}, "gateway,sign filter,o.Owner %s and signeraddress %s are not match", o.Owner.Hex(), addr.Hex())
+	}
+
+	return true, nil
+}
+
+type TokenFilter struct {
+	AllowTokens  map[common.Address]bool
+	DeniedTokens map[common.Address]bool
+}
+
+// tokens can be configured by address or symbol
+func NewTokenFilter(allowTokens, deniedTokens []string) (*TokenFilter, error) {
+	f := &TokenFilter{AllowTokens: make(map[common.Address]bool), DeniedTokens: make(map[common.Address]bool)}
+	for _, t := range allowTokens {
+		addr, err := tokenToAddress(t)
+		if err != nil {
+			return nil, err
+		}
+		f.AllowTokens[addr] = true
+	}
+	for _, t := range deniedTokens {
+		addr, err := tokenToAddress(t)
+		if err != nil {
+			return nil, err
+		}
+		f.DeniedTokens[addr] = true
+	}
+	return f, nil
+}
+
+func tokenToAddress(t string) (common.Address, error) {
+	if util.IsAddress(t) {
+		return common.HexToAddress(t), nil
+	}
+	if token, ok := util.AllTokens[strings.ToUpper(t)]; ok {
+		return token.Protocol, nil
+	}
+	return common.Address{}, fmt.Errorf("gateway,token filter,token %s not found", t)
+}
+
+func (f *TokenFilter) Name() string { return FilterNameToken }
+
+func (f *TokenFilter) Filter(o *types.Order) (bool, error) {
+	for _, token := range []common.Address{o.TokenS, o.TokenB} {
+		if f.DeniedTokens[token] {
+			return false, NewGatewayError(ReasonTokenNotSupported, map[string]interface{}{"token": token.Hex(), "denied": true}, "gateway,token filter,token:%s is denied", token.Hex())
+		}
+		if len(f.AllowTokens) > 0 && !f.AllowTokens[token] {
+			return false, NewGatewayError(ReasonTokenNotSupported, map[string]interface{}{"token": token.Hex()}, "gateway,token filter,token:%s is not allowed", token.Hex())
+		}
+	}
+
+	supportTokenS := false
+	supportTokenB := false
+	for _, v := range util.AllTokens {
+		if v.Protocol == o.TokenS && !v.Deny {
+			supportTokenS = true
+		}
+		if v.Protocol == o.TokenB && !v.Deny {
+			supportTokenB = true
+		}
+	}
+
+	if !supportTokenS {
+		return false, NewGatewayError(ReasonTokenNotSupported, map[string]interface{}{"token": o.TokenS.Hex()}, "gateway,token filter,tokenS:%s do not supported", o.TokenS.Hex())
+	}
+	if !supportTokenB {
+		return false, NewGatewayError(ReasonTokenNotSupported, map[string]interface{}{"token": o.TokenB.Hex()}, "gateway,token filter,tokenB:%s do not supported", o.TokenB.Hex())
+	}
+
+	return true, nil
+}
+
+type CutoffFilter struct {
+	om ordermanager.OrderManager
+}
+
+func (f *CutoffFilter) Name() string { return FilterNameCutoff }
+
+// 如果订单接收在cutoff(cancel)事件之后，则该订单直接过滤
+func (f *CutoffFilter) Filter(o *types.Order) (bool, error) {
+	if f.om.IsOrderCutoff(o.Owner, o.Timestamp) {
+		return false, NewGatewayError(ReasonOrderCutoff, map[string]interface{}{"owner": o.Owner.Hex(), "timestamp": o.Timestamp.String()}, "gateway,cutoff filter order %s create time %s is out of range", o.Owner.Hex(), o.Timestamp.String())
+	}
+
+	return true, nil
+}
+
+type MarginSplitFilter struct {
+	MinMarginSplitPercentage uint8
+}
+
+func (f *MarginSplitFilter) Name() string { return FilterNameMarginSplit }
+
+func (f *MarginSplitFilter) Filter(o *types.Order) (bool, error) {
+	if o.MarginSplitPercentage > 100 {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "marginSplitPercentage"}, "gateway,margin split filter,order %s margin split percentage %d greater than 100", o.Hash.Hex(), o.MarginSplitPercentage)
+	}
+	if o.MarginSplitPercentage < f.MinMarginSplitPercentage {
+		return false, NewGatewayError(ReasonMarginSplitTooLow, map[string]interface{}{"marginSplitPercentage": o.MarginSplitPercentage, "minMarginSplitPercentage": f.MinMarginSplitPercentage}, "gateway,margin split filter,order %s margin split percentage %d less than %d", o.Hash.Hex(), o.MarginSplitPercentage, f.MinMarginSplitPercentage)
+	}
+	return true, nil
+}
+
+type TtlFilter struct {
+	MaxTtl *big.Int
+}
+
+func (f *TtlFilter) Name() string { return FilterNameTtl }
+
+func (f *TtlFilter) Filter(o *types.Order) (bool, error) {
+	if o.Ttl == nil || o.Ttl.Sign() <= 0 {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "ttl"}, "gateway,ttl filter,order %s ttl invalid", o.Hash.Hex())
+	}
+	if f.MaxTtl.Sign() > 0 && o.Ttl.Cmp(f.MaxTtl) > 0 {
+		return false, NewGatewayError(ReasonTtlTooLong, map[string]interface{}{"ttl": o.Ttl.String(), "maxTtl": f.MaxTtl.String()}, "gateway,ttl filter,order %s ttl %s greater than %s", o.Hash.Hex(), o.Ttl.String(), f.MaxTtl.String())
+	}
+	return true, nil
+}
+
+type TimestampFilter struct {
+	MaxFutureSeconds int64
+}
+
+func (f *TimestampFilter) Name() string { return FilterNameTimestamp }
+
+func (f *TimestampFilter) Filter(o *types.Order) (bool, error) {
+	if o.Timestamp == nil || o.Timestamp.Sign() <= 0 {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "timestamp"}, "gateway,timestamp filter,order %s timestamp invalid", o.Hash.Hex())
+	}
+	latest := time.Now().Unix() + f.MaxFutureSeconds
+	if o.Timestamp.Int64() > latest {
+		return false, NewGatewayError(ReasonTimestampInFuture, map[string]interface{}{"timestamp": o.Timestamp.String(), "maxFutureSeconds": f.MaxFutureSeconds}, "gateway,timestamp filter,order %s timestamp %s is too far in the future", o.Hash.Hex(), o.Timestamp.String())
+	}
+	return true, nil
+}
+
+type ExpireFilter struct {
+}
+
+func (f *ExpireFilter) Name() string { return FilterNameExpire }
+
+func (f *ExpireFilter) Filter(o *types.Order) (bool, error) {
+	if o.Timestamp == nil || o.Ttl == nil {
+		return false, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "ttl"}, "gateway,expire filter,order %s timestamp or ttl is empty", o.Hash.Hex())
+	}
+	if o.IsExpired(time.Now().Unix()) {
+		expireTime := new(big.Int).Add(o.Timestamp, o.Ttl)
+		return false, NewGatewayError(ReasonOrderExpired, map[string]interface{}{"expireTime": expireTime.String()}, "gateway,expire filter,order %s expired at %s", o.Hash.Hex(), expireTime.String())
+	}
+	return true, nil
+}
+
+// OwnerRateFilter limits orders per second of each owner, it should be placed after sign filter
+type OwnerRateFilter struct {
+	limiter *RateLimiter
+}
+
+func (f *OwnerRateFilter) Name() string { return FilterNameOwnerRate }
+
+func (f *OwnerRateFilter) Filter(o *types.Order) (bool, error) {
+	if !f.limiter.Available(o.Owner.Hex()) {
+		return false, f.rateLimited(o)
+	}
+	return true, nil
+}
+
+func (f *OwnerRateFilter) Consume(o *types.Order) error {
+	if !f.limiter.Allow(o.Owner.Hex()) {
+		return f.rateLimited(o)
+	}
+	return nil
+}
+
+func (f *OwnerRateFilter) rateLimited(o *types.Order) error {
+	return NewGatewayError(ReasonRateLimited, map[string]interface{}{"owner": o.Owner.Hex(), "filter": f.Name()}, "gateway,owner rate filter,owner %s submits orders too frequently", o.Owner.Hex())
+}
+
+// OrderQuotaFilter limits open orders of each owner in each market
+type OrderQuotaFilter struct {
+	om            ordermanager.OrderManager
+	MaxOpenOrders int
+}
+
+func (f *OrderQuotaFilter) Name() string { return FilterNameOrderQuota }
+
+func (f *OrderQuotaFilter) Filter(o *types.Order) (bool, error) {
+	if f.MaxOpenOrders <= 0 {
+		return true, nil
+	}
+
+	count, err := f.om.CountOpenOrders(o.Owner, o.TokenS, o.TokenB)
+	if err != nil {
+		return false, NewGatewayError(ReasonInternalError, nil, "gateway,order quota filter,count open orders of %s error:%s", o.Owner.Hex(), err.Error())
+	}
+	if count >= f.MaxOpenOrders {
+		return false, NewGatewayError(ReasonTooManyOpenOrders, map[string]interface{}{"owner": o.Owner.Hex(), "openOrders": count, "maxOpenOrders": f.MaxOpenOrders}, "gateway,order quota filter,owner %s has %d open orders in the market", o.Owner.Hex(), count)
+	}
+	return true, nil
+}
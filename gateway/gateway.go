@@ -19,15 +19,12 @@
 package gateway
 
 import (
-	"fmt"
 	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
-	"github.com/Loopring/relay/market/util"
 	"github.com/Loopring/relay/ordermanager"
 	"github.com/Loopring/relay/types"
-	"github.com/ethereum/go-ethereum/common"
-	"math/big"
+	"time"
 )
 
 type Gateway struct {
@@ -36,38 +33,36 @@ type Gateway struct {
 	isBroadcast      bool
 	maxBroadcastTime int
 	ipfsPubService   IPFSPubService
+	ipLimiter        *RateLimiter
+	cancelWindow     int64
 }
 
-var gateway Gateway
+const defaultCancellationWindow = 600
 
-type Filter interface {
-	filter(o *types.Order) (bool, error)
-}
+var gateway Gateway
 
 func Initialize(filterOptions *config.GatewayFiltersOptions, options *config.GateWayOptions, ipfsOptions *config.IpfsOptions, om ordermanager.OrderManager) {
 	// add gateway watcher
 	gatewayWatcher := &eventemitter.Watcher{Concurrent: false, Handle: HandleOrder}
 	eventemitter.On(eventemitter.Gateway, gatewayWatcher)
+	softCancelWatcher := &eventemitter.Watcher{Concurrent: false, Handle: HandleSoftCancel}
+	eventemitter.On(eventemitter.GatewaySoftCancel, softCancelWatcher)
 
 	gateway = Gateway{filters: make([]Filter, 0), om: om, isBroadcast: options.IsBroadcast, maxBroadcastTime: options.MaxBroadcastTime}
-	gateway.ipfsPubService = NewIPFSPubService(ipfsOptions)
-
-	// new base filter
-	baseFilter := &BaseFilter{MinLrcFee: big.NewInt(filterOptions.BaseFilter.MinLrcFee), MaxPrice: big.NewInt(filterOptions.BaseFilter.MaxPrice)}
-
-	// new token filter
-	tokenFilter := &TokenFilter{}
-
-	// new sign filter
-	signFilter := &SignFilter{}
-
-	// new cutoff filter
-	cutoffFilter := &CutoffFilter{om: om}
+	if gateway.isBroadcast {
+		gateway.ipfsPubService = NewIPFSPubService(ipfsOptions)
+	}
+	gateway.ipLimiter = NewRateLimiter(options.IpRateLimit.Rate, options.IpRateLimit.Burst)
+	gateway.cancelWindow = options.CancellationWindow
+	if gateway.cancelWindow <= 0 {
+		gateway.cancelWindow = defaultCancellationWindow
+	}
 
-	gateway.filters = append(gateway.filters, baseFilter)
-	gateway.filters = append(gateway.filters, signFilter)
-	gateway.filters = append(gateway.filters, tokenFilter)
-	gateway.filters = append(gateway.filters, cutoffFilter)
+	filters, err := NewFilters(filterOptions, om)
+	if err != nil {
+		log.Fatalf("%s", err.Error())
+	}
+	gateway.filters = filters
 }
 
 func HandleOrder(input eventemitter.EventData) error {
@@ -83,32 +78,27 @@ func HandleOrder(input eventemitter.EventData) error {
 
 	//TODO(xiaolu) 这里需要测试一下，超时error和查询数据为空的error，处理方式不应该一样
 	if state, err = gateway.om.GetOrderByHash(order.Hash); err != nil {
+		if err := checkAmounts(order); err != nil {
+			return err
+		}
 		order.GeneratePrice()
 
-		for _, v := range gateway.filters {
-			valid, err := v.filter(order)
-			if !valid {
-				log.Errorf(err.Error())
-				return err
-			}
+		if err := applyFilters(gateway.filters, order); err != nil {
+			log.Errorf(err.Error())
+			return err
 		}
-
-		state := &types.OrderState{}
-		state.RawOrder = *order
-
-		broadcastTime = 0
-
-		if gateway.isBroadcast && broadcastTime < gateway.maxBroadcastTime {
-			state.BroadcastTime = 1
+		if err := consumeFilters(gateway.filters, order); err != nil {
+			return err
 		}
 
+		broadcastTime = 0
 		state = &types.OrderState{}
 		state.RawOrder = *order
 
 		eventemitter.Emit(eventemitter.OrderManagerGatewayNewOrder, state)
 	} else {
 		broadcastTime = state.BroadcastTime
-		return fmt.Errorf("gateway,order %s exist,will not insert again", order.Hash.Hex())
+		return NewGatewayError(ReasonOrderExists, map[string]interface{}{"orderHash": order.Hash.Hex()}, "gateway,order %s exist,will not insert again", order.Hash.Hex())
 	}
 
 	gateway.broadcast(state, broadcastTime)
@@ -129,95 +119,50 @@ func (g *Gateway) broadcast(state *types.OrderState, bt int) {
 	}
 }
 
-type BaseFilter struct {
-	MinLrcFee *big.Int
-	MaxPrice  *big.Int
-}
-
-func (f *BaseFilter) filter(o *types.Order) (bool, error) {
-	const (
-		addrLength = 20
-		hashLength = 32
-	)
+// HandleSoftCancel verify the cancellation signed by order owner, then remove the order from depth and miner,
+// the cancellation will be broadcast to other relays only if it's accepted here, so that it will not be broadcast repeatedly
+func HandleSoftCancel(input eventemitter.EventData) error {
+	cancellation := input.(*types.OrderCancellation)
+	hash := cancellation.OrderHash
 
-	if len(o.Hash) != hashLength {
-		return false, fmt.Errorf("gateway,base filter,order %s length error", o.Hash.Hex())
-	}
-	if len(o.TokenB) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenB %s address length error", o.Hash.Hex(), o.TokenB.Hex())
-	}
-	if len(o.TokenS) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenS %s address length error", o.Hash.Hex(), o.TokenS.Hex())
-	}
-	if o.TokenB == o.TokenS {
-		return false, fmt.Errorf("gateway,base filter,order %s tokenB == tokenS", o.Hash.Hex())
+	if signer, err := cancellation.SignerAddress(); err != nil {
+		return NewGatewayError(ReasonInvalidSignature, nil, "gateway,soft cancel,order %s signature invalid:%s", hash.Hex(), err.Error())
+	} else if signer != cancellation.Owner {
+		return NewGatewayError(ReasonInvalidSignature, map[string]interface{}{"owner": cancellation.Owner.Hex(), "signer": signer.Hex()}, "gateway,soft cancel,owner %s and signer %s are not match", cancellation.Owner.Hex(), signer.Hex())
 	}
-	if f.MinLrcFee.Cmp(o.LrcFee) >= 0 {
-		return false, fmt.Errorf("gateway,base filter,order %s lrc fee %s invalid", o.Hash.Hex(), o.LrcFee.String())
+	if err := checkCancellationTimestamp(cancellation, time.Now().Unix(), gateway.cancelWindow); err != nil {
+		return err
 	}
-	if len(o.Owner) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s owner %s address length error", o.Hash.Hex(), o.Owner.Hex())
+
+	state, err := gateway.om.GetOrderByHash(hash)
+	if err != nil {
+		return NewGatewayError(ReasonOrderNotFound, map[string]interface{}{"orderHash": hash.Hex()}, "gateway,soft cancel,order %s not found", hash.Hex())
 	}
-	if len(o.Protocol) != addrLength {
-		return false, fmt.Errorf("gateway,base filter,order %s protocol %s address length error", o.Hash.Hex(), o.Owner.Hex())
+	if state.RawOrder.Owner != cancellation.Owner {
+		return NewGatewayError(ReasonInvalidSignature, map[string]interface{}{"owner": state.RawOrder.Owner.Hex(), "signer": cancellation.Owner.Hex()}, "gateway,soft cancel,order %s owner %s and signer %s are not match", hash.Hex(), state.RawOrder.Owner.Hex(), cancellation.Owner.Hex())
 	}
-	if o.Price.Cmp(new(big.Rat).SetFrac(f.MaxPrice, big.NewInt(1))) > 0 || o.Price.Cmp(new(big.Rat).SetFrac(big.NewInt(1), f.MaxPrice)) < 0 {
-		return false, fmt.Errorf("dao order convert down,price out of range")
+	if state.Status != types.ORDER_NEW && state.Status != types.ORDER_PARTIAL {
+		return NewGatewayError(ReasonOrderNotCancellable, map[string]interface{}{"orderHash": hash.Hex(), "status": getStringStatus(state.Status)}, "gateway,soft cancel,order %s status %d can not be cancelled", hash.Hex(), state.Status)
 	}
-	return true, nil
-}
-
-type SignFilter struct {
-}
-
-func (f *SignFilter) filter(o *types.Order) (bool, error) {
-	o.Hash = o.GenerateHash()
 
-	if addr, err := o.SignerAddress(); nil != err {
-		return false, err
-	} else if addr != o.Owner {
-		return false, fmt.Errorf("gateway,sign filter,o.Owner %s and signeraddress %s are not match", o.Owner.Hex(), addr.Hex())
+	if err := gateway.om.SoftCancelOrder(cancellation); err != nil {
+		return NewGatewayError(ReasonOrderNotCancellable, map[string]interface{}{"orderHash": hash.Hex()}, "%s", err.Error())
 	}
 
-	return true, nil
-}
-
-type TokenFilter struct {
-	AllowTokens  map[common.Address]bool
-	DeniedTokens map[common.Address]bool
-}
-
-func (f *TokenFilter) filter(o *types.Order) (bool, error) {
-	supportTokenS := false
-	supportTokenB := false
-	for _, v := range util.AllTokens {
-		if v.Protocol == o.TokenS && !v.Deny {
-			supportTokenS = true
-		}
-		if v.Protocol == o.TokenB && !v.Deny {
-			supportTokenB = true
-		}
-	}
-
-	if !supportTokenS {
-		return false, fmt.Errorf("gateway,token filter,tokenS:%s do not supported", o.TokenS.Hex())
-	}
-	if !supportTokenB {
-		return false, fmt.Errorf("gateway,token filter,tokenB:%s do not supported", o.TokenB.Hex())
+	if gateway.isBroadcast {
+		go func() {
+			if err := gateway.ipfsPubService.PublishCancellation(*cancellation); err != nil {
+				log.Errorf("gateway,publish order cancellation %s failed", hash.Hex())
+			}
+		}()
 	}
-
-	return true, nil
-}
-
-type CutoffFilter struct {
-	om ordermanager.OrderManager
+	return nil
 }
 
-// 如果订单接收在cutoff(cancel)事件之后，则该订单直接过滤
-func (f *CutoffFilter) filter(o *types.Order) (bool, error) {
-	if f.om.IsOrderCutoff(o.Owner, o.Timestamp) {
-		return false, fmt.Errorf("gateway,cutoff filter order %s create time %s is out of range", o.Owner.Hex(), o.Timestamp.String())
+// 签名只覆盖orderHash,owner,timestamp,限制timestamp与当前时间的差值,防止截获的取消请求在之后被重放
+func checkCancellationTimestamp(cancellation *types.OrderCancellation, now, window int64) error {
+	if diff := now - cancellation.Timestamp; diff > window || diff < -window {
+		return NewGatewayError(ReasonCancellationExpired, map[string]interface{}{"orderHash": cancellation.OrderHash.Hex(), "timestamp": cancellation.Timestamp, "window": window}, "gateway,soft cancel,order %s cancellation timestamp %d is out of %d seconds from now", cancellation.OrderHash.Hex(), cancellation.Timestamp, window)
 	}
-
-	return true, nil
+	return nil
 }
@@ -0,0 +1,52 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/types"
+	"testing"
+)
+
+func TestCheckCancellationTimestamp(t *testing.T) {
+	const (
+		now    = int64(1506014710)
+		window = int64(600)
+	)
+	cases := []struct {
+		timestamp int64
+		accepted  bool
+	}{
+		{now, true},
+		{now - window, true},
+		{now + window, true},
+		{now - window - 1, false},
+		{now + window + 1, false},
+		{0, false},
+	}
+	for _, c := range cases {
+		cancellation := &types.OrderCancellation{Timestamp: c.timestamp}
+		err := checkCancellationTimestamp(cancellation, now, window)
+		if accepted := err == nil; accepted != c.accepted {
+			t.Errorf("timestamp %d accepted:%t, expect:%t", c.timestamp, accepted, c.accepted)
+		}
+		if ge, ok := err.(*GatewayError); err != nil && (!ok || ge.Reason != ReasonCancellationExpired) {
+			t.Errorf("timestamp %d rejected with %v, expect %s", c.timestamp, err, ReasonCancellationExpired)
+		}
+	}
+}
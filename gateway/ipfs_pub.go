@@ -27,6 +27,7 @@ import (
 
 type IPFSPubService interface {
 	PublishOrder(order types.Order) error
+	PublishCancellation(cancellation types.OrderCancellation) error
 }
 
 type IPFSPubServiceImpl struct {
@@ -54,3 +55,16 @@ func (p *IPFSPubServiceImpl) PublishOrder(order types.Order) error {
 	}
 	return pubErr
 }
+
+func (p *IPFSPubServiceImpl) PublishCancellation(cancellation types.OrderCancellation) error {
+	cancellationJson, err := cancellation.MarshalJSON()
+	if err != nil {
+		log.Debugf("ipfs pub,marshal order cancellation error:%s", err.Error())
+		return err
+	}
+	pubErr := p.sh.PubSubPublish(p.options.BroadcastTopics[0], string(cancellationJson))
+	if pubErr != nil {
+		log.Debugf("ipfs pub,pub sub publish error:%s", pubErr.Error())
+	}
+	return pubErr
+}
@@ -174,7 +174,14 @@ func (p *subProxy) listen() {
 			data := record.Data()
 			ord := &types.Order{}
 			if err := ord.UnmarshalJSON(data); err != nil {
-				log.Errorf("ipfs sub,failed to accept data %s", err.Error())
+				// the topic is shared by orders and soft cancellations
+				cancellation := &types.OrderCancellation{}
+				if cancelErr := cancellation.UnmarshalJSON(data); cancelErr != nil {
+					log.Errorf("ipfs sub,failed to accept data %s", err.Error())
+					continue
+				}
+				log.Debugf("ipfs sub,accept cancellation from topic %s and data is %s", p.topic, string(data))
+				eventemitter.Emit(eventemitter.GatewaySoftCancel, cancellation)
 				continue
 			}
 
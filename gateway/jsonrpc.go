@@ -21,6 +21,7 @@ package gateway
 import (
 	"errors"
 	"fmt"
+	"github.com/Loopring/relay/config"
 	"github.com/Loopring/relay/dao"
 	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/market"
@@ -29,9 +30,8 @@ import (
 	"github.com/Loopring/relay/ordermanager"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/rpc"
 	"math/big"
-	"net"
+	"net/http"
 	"sort"
 	"strconv"
 	"strings"
@@ -136,15 +136,16 @@ type TokenPrice struct {
 	Price float64 `json:"price"`
 }
 
-var RemoteAddrContextKey = "RemoteAddr"
-
 type JsonrpcService interface {
 	Start(port string)
 	Stop()
 }
 
 type JsonrpcServiceImpl struct {
-	port           string
+	options        config.JsonrpcOptions
+	listeners      []*rpcListener
+	admin          AdminService
+	readOnly       bool
 	trendManager   market.TrendManager
 	orderManager   ordermanager.OrderManager
 	accountManager market.AccountManager
@@ -152,9 +153,11 @@ type JsonrpcServiceImpl struct {
 	marketCap      *marketcap.MarketCapProvider
 }
 
-func NewJsonrpcService(port string, trendManager market.TrendManager, orderManager ordermanager.OrderManager, accountManager market.AccountManager, ethForwarder *EthForwarder, capProvider *marketcap.MarketCapProvider) *JsonrpcServiceImpl {
+func NewJsonrpcService(options config.JsonrpcOptions, trendManager market.TrendManager, orderManager ordermanager.OrderManager, accountManager market.AccountManager, ethForwarder *EthForwarder, capProvider *marketcap.MarketCapProvider, admin AdminService, readOnly bool) *JsonrpcServiceImpl {
 	l := &JsonrpcServiceImpl{}
-	l.port = port
+	l.options = options
+	l.admin = admin
+	l.readOnly = readOnly
 	l.trendManager = trendManager
 	l.orderManager = orderManager
 	l.accountManager = accountManager
@@ -163,36 +166,48 @@ func NewJsonrpcService(port string, trendManager market.TrendManager, orderManag
 	return l
 }
 
+// Start opens every listener in options, a listener exposing admin or miner namespace requires authentication of admin and miner methods.
+// methods changing orders or sending transactions are not registered in readonly mode
 func (j *JsonrpcServiceImpl) Start() {
-	handler := rpc.NewServer()
-	if err := handler.RegisterName("loopring", j); err != nil {
-		fmt.Println(err)
-		return
-	}
-	if err := handler.RegisterName("eth", j.ethForwarder); err != nil {
-		fmt.Println(err)
-		return
-	}
-	var (
-		listener net.Listener
-		err      error
-	)
-	if listener, err = net.Listen("tcp", ":8083"); err != nil {
-		return
+	apis := map[string][]interface{}{
+		"loopring": {j},
+		"eth":      {j.ethForwarder},
+	}
+	if !j.readOnly {
+		apis["loopring"] = append(apis["loopring"], &JsonrpcWriteServiceImpl{})
+		apis["eth"] = append(apis["eth"], &EthWriteForwarder{Accessor: j.ethForwarder.Accessor})
+	}
+	if nil != j.admin {
+		apis["admin"] = []interface{}{j.admin.Api()}
+		if minerApi := j.admin.MinerApi(); nil != minerApi {
+			apis["miner"] = []interface{}{minerApi}
+		}
 	}
-	go rpc.NewHTTPServer([]string{"*"}, handler).Serve(listener)
-	log.Info(fmt.Sprintf("HTTP endpoint opened: http://%s", ":8083"))
 
-	return
-}
+	for _, options := range j.options.AllListeners() {
+		var wrap func(next http.Handler) http.Handler
+		for _, namespace := range options.Namespaces {
+			if ("admin" == namespace || "miner" == namespace) && nil != j.admin {
+				wrap = j.admin.Authenticator
+			}
+		}
 
-func (j *JsonrpcServiceImpl) SubmitOrder(order *types.OrderJsonRequest) (res string, err error) {
-	err = HandleOrder(types.ToOrder(order))
-	if err != nil {
-		fmt.Println(err)
+		listener, err := newRpcListener(options, apis, wrap)
+		if err != nil {
+			log.Errorf("%s", err.Error())
+			continue
+		}
+		if err = listener.start(); err != nil {
+			log.Errorf("%s", err.Error())
+			continue
+		}
+		j.listeners = append(j.listeners, listener)
 	}
-	res = "SUBMIT_SUCCESS"
-	return res, err
+}
+
+// ValidateOrder is a dry run of SubmitOrder, the order will not be stored or broadcast
+func (j *JsonrpcServiceImpl) ValidateOrder(order *types.OrderJsonRequest) (res OrderValidation, err error) {
+	return ValidateOrder(types.ToOrder(order), &j.ethForwarder.Accessor), nil
 }
 
 func (j *JsonrpcServiceImpl) GetOrders(query *OrderQuery) (res PageResult, err error) {
@@ -369,6 +384,10 @@ func convertStatus(s string) types.OrderStatus {
 		return types.ORDER_CANCEL
 	case "ORDER_CUTOFF":
 		return types.ORDER_CUTOFF
+	case "ORDER_EXPIRED":
+		return types.ORDER_EXPIRE
+	case "ORDER_SOFT_CANCELED":
+		return types.ORDER_SOFT_CANCEL
 	}
 	return types.ORDER_UNKNOWN
 }
@@ -385,6 +404,10 @@ func getStringStatus(s types.OrderStatus) string {
 		return "ORDER_CANCELED"
 	case types.ORDER_CUTOFF:
 		return "ORDER_CUTOFF"
+	case types.ORDER_EXPIRE:
+		return "ORDER_EXPIRED"
+	case types.ORDER_SOFT_CANCEL:
+		return "ORDER_SOFT_CANCELED"
 	}
 	return "ORDER_UNKNOWN"
 }
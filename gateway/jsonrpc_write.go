@@ -0,0 +1,115 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"net"
+)
+
+// JsonrpcWriteServiceImpl contains loopring methods which accept orders and cancellations from wallets,
+// it is registered in loopring namespace together with JsonrpcServiceImpl except in readonly mode
+type JsonrpcWriteServiceImpl struct{}
+
+// checkRemoteRate limits requests of each remote ip, orders from ipfs are not limited here
+func checkRemoteRate(req *RpcRequest) error {
+	addr := req.remoteAddr()
+	if addr == "" {
+		return nil
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	if !gateway.ipLimiter.Allow(addr) {
+		return NewGatewayError(ReasonRateLimited, map[string]interface{}{"remoteAddr": addr}, "gateway,too many requests from %s", addr)
+	}
+	return nil
+}
+
+// SubmitOrder returns hash of the order, or a GatewayError with the reason why the order is rejected
+func (w *JsonrpcWriteServiceImpl) SubmitOrder(req *RpcRequest, order *types.OrderJsonRequest) (res string, err error) {
+	if err = checkRemoteRate(req); err != nil {
+		return "", req.fail(err)
+	}
+
+	ord := types.ToOrder(order)
+	if err = HandleOrder(ord); err != nil {
+		log.Debugf("gateway,submit order failed:%s", err.Error())
+		return "", req.fail(err)
+	}
+	return ord.Hash.Hex(), nil
+}
+
+type SubmitOrderError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+type SubmitOrderResult struct {
+	OrderHash string            `json:"orderHash"`
+	Success   bool              `json:"success"`
+	Error     *SubmitOrderError `json:"error,omitempty"`
+}
+
+const maxSubmitOrdersBatchSize = 100
+
+// SubmitOrders handles orders one by one, the result of each order is returned in the same sequence,
+// every order takes a token of the remote ip as SubmitOrder, orders beyond the limit are rejected with RATE_LIMITED
+func (w *JsonrpcWriteServiceImpl) SubmitOrders(req *RpcRequest, orders []*types.OrderJsonRequest) (res []SubmitOrderResult, err error) {
+	if len(orders) > maxSubmitOrdersBatchSize {
+		return nil, req.fail(NewGatewayError(ReasonTooManyOrders, map[string]interface{}{"maxBatchSize": maxSubmitOrdersBatchSize}, "gateway,submit orders,batch size %d exceeds %d", len(orders), maxSubmitOrdersBatchSize))
+	}
+
+	res = make([]SubmitOrderResult, 0, len(orders))
+	for _, order := range orders {
+		ord := types.ToOrder(order)
+		result := SubmitOrderResult{}
+		handleErr := checkRemoteRate(req)
+		if handleErr == nil {
+			handleErr = HandleOrder(ord)
+		} else {
+			ord.Hash = ord.GenerateHash()
+		}
+		if handleErr != nil {
+			ge := toGatewayError(handleErr)
+			result.Error = &SubmitOrderError{Code: ge.ErrorCode(), Message: ge.Error(), Data: ge.ErrorData()}
+		} else {
+			result.Success = true
+		}
+		result.OrderHash = ord.Hash.Hex()
+		res = append(res, result)
+	}
+	return res, nil
+}
+
+// CancelOrder soft cancels the order with a cancellation signed by the owner, it returns hash of the order.
+// the order can still be filled by rings which has been submitted, use cancelOrder of the protocol to cancel it on chain
+func (w *JsonrpcWriteServiceImpl) CancelOrder(req *RpcRequest, cancellation *types.OrderCancellation) (res string, err error) {
+	if err = checkRemoteRate(req); err != nil {
+		return "", req.fail(err)
+	}
+
+	if err = HandleSoftCancel(cancellation); err != nil {
+		log.Debugf("gateway,cancel order failed:%s", err.Error())
+		return "", req.fail(err)
+	}
+	return cancellation.OrderHash.Hex(), nil
+}
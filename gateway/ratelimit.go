@@ -0,0 +1,124 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket limiter keyed by remote ip or owner,
+// every key has a bucket of burst tokens which is refilled by rate tokens per second
+type RateLimiter struct {
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	mtx       sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter returns nil if rate is not positive, a nil limiter allows everything
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	l := &RateLimiter{}
+	l.rate = rate
+	l.burst = float64(burst)
+	l.buckets = make(map[string]*tokenBucket)
+	l.lastSweep = time.Now()
+	return l
+}
+
+// Allow takes a token of the key if there is one
+func (l *RateLimiter) Allow(key string) bool {
+	return l.allowAt(key, time.Now())
+}
+
+// Available reports whether the key has a token without taking it
+func (l *RateLimiter) Available(key string) bool {
+	return l.availableAt(key, time.Now())
+}
+
+func (l *RateLimiter) allowAt(key string, now time.Time) bool {
+	if nil == l {
+		return true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	bucket := l.refill(key, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+
+func (l *RateLimiter) availableAt(key string, now time.Time) bool {
+	if nil == l {
+		return true
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	return l.refill(key, now).tokens >= 1
+}
+
+func (l *RateLimiter) refill(key string, now time.Time) *tokenBucket {
+	l.sweep(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	if elapsed := now.Sub(bucket.updated).Seconds(); elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+		bucket.updated = now
+	}
+	return bucket
+}
+
+// buckets which have been refilled are the same as new ones, remove them to bound the memory
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_AllowAt(t *testing.T) {
+	l := NewRateLimiter(2, 3)
+	now := time.Unix(1506014710, 0)
+
+	for i := 0; i < 3; i++ {
+		if !l.allowAt("a", now) {
+			t.Fatalf("token %d within burst should be allowed", i)
+		}
+	}
+	if l.allowAt("a", now) {
+		t.Fatalf("token beyond burst should not be allowed")
+	}
+	if !l.allowAt("b", now) {
+		t.Fatalf("buckets of different keys should be independent")
+	}
+
+	// 2 tokens per second, one token is refilled after 500ms
+	if l.allowAt("a", now.Add(400*time.Millisecond)) {
+		t.Fatalf("token should not be refilled after 400ms")
+	}
+	if !l.allowAt("a", now.Add(500*time.Millisecond)) {
+		t.Fatalf("token should be refilled after 500ms")
+	}
+
+	// refill never exceeds burst
+	later := now.Add(time.Hour)
+	for i := 0; i < 3; i++ {
+		if !l.allowAt("a", later) {
+			t.Fatalf("token %d should be refilled to burst", i)
+		}
+	}
+	if l.allowAt("a", later) {
+		t.Fatalf("tokens should not be refilled beyond burst")
+	}
+}
+
+func TestRateLimiter_AvailableAt(t *testing.T) {
+	l := NewRateLimiter(1, 1)
+	now := time.Unix(1506014710, 0)
+
+	for i := 0; i < 3; i++ {
+		if !l.availableAt("a", now) {
+			t.Fatalf("checking availability should not take the token")
+		}
+	}
+	if !l.allowAt("a", now) {
+		t.Fatalf("token should be allowed")
+	}
+	if l.availableAt("a", now) {
+		t.Fatalf("token has been taken")
+	}
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	l := NewRateLimiter(1, 2)
+	now := time.Unix(1506014710, 0)
+	l.lastSweep = now
+
+	l.allowAt("a", now)
+	l.allowAt("b", now.Add(time.Minute))
+	if _, ok := l.buckets["a"]; ok {
+		t.Fatalf("refilled bucket should be swept")
+	}
+	if _, ok := l.buckets["b"]; !ok {
+		t.Fatalf("bucket in use should not be swept")
+	}
+}
+
+func TestRateLimiter_Nil(t *testing.T) {
+	l := NewRateLimiter(0, 10)
+	if l != nil {
+		t.Fatalf("limiter should be nil if rate is zero")
+	}
+	for i := 0; i < 100; i++ {
+		if !l.allowAt("a", time.Now()) || !l.availableAt("a", time.Now()) {
+			t.Fatalf("nil limiter should allow everything")
+		}
+	}
+}
+
+type rejectFilter struct{}
+
+func (f *rejectFilter) Name() string { return "reject" }
+
+func (f *rejectFilter) Filter(o *types.Order) (bool, error) { return false, nil }
+
+func TestOwnerRateFilter_Consume(t *testing.T) {
+	f := &OwnerRateFilter{limiter: NewRateLimiter(0.001, 2)}
+	o := &types.Order{Owner: common.HexToAddress("0x1111111111111111111111111111111111111111")}
+
+	// orders validated or rejected by later filters take no token
+	for i := 0; i < 5; i++ {
+		if err := applyFilters([]Filter{f, &rejectFilter{}}, o); err == nil {
+			t.Fatalf("order should be rejected by the later filter")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if err := applyFilters([]Filter{f}, o); err != nil {
+			t.Fatalf("order %d should pass, %s", i, err.Error())
+		}
+		if err := consumeFilters([]Filter{f}, o); err != nil {
+			t.Fatalf("order %d should take a token, %s", i, err.Error())
+		}
+	}
+
+	err := applyFilters([]Filter{f}, o)
+	if ge, ok := err.(*GatewayError); !ok || ge.Reason != ReasonRateLimited {
+		t.Fatalf("order beyond burst should be rate limited, got %v", err)
+	}
+	if err := consumeFilters([]Filter{f}, o); err == nil {
+		t.Fatalf("order beyond burst should not take a token")
+	}
+}
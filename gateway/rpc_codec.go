@@ -0,0 +1,150 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/rs/cors"
+)
+
+// RpcRequest is passed to methods which declare it as the first parameter, it isn't one of the json-rpc params.
+// the vendored rpc server doesn't pass the http request to methods, so it is injected by rpcCodec.
+// the server also passes only the message of errors returned by methods to the codec,
+// methods return GatewayError by fail so that the codec can find the code and data by the message
+type RpcRequest struct {
+	RemoteAddr string
+	errs       map[string]*GatewayError
+	mtx        sync.Mutex
+}
+
+func newRpcRequest(remoteAddr string) *RpcRequest {
+	return &RpcRequest{RemoteAddr: remoteAddr, errs: make(map[string]*GatewayError)}
+}
+
+// fail converts err to GatewayError and records it
+func (r *RpcRequest) fail(err error) error {
+	if nil == err {
+		return nil
+	}
+	ge := toGatewayError(err)
+	if nil == r {
+		return ge
+	}
+	r.mtx.Lock()
+	r.errs[ge.Error()] = ge
+	r.mtx.Unlock()
+	return ge
+}
+
+func (r *RpcRequest) gatewayError(msg string) *GatewayError {
+	if nil == r {
+		return nil
+	}
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.errs[msg]
+}
+
+func (r *RpcRequest) remoteAddr() string {
+	if nil == r {
+		return ""
+	}
+	return r.RemoteAddr
+}
+
+var rpcRequestType = reflect.TypeOf(&RpcRequest{})
+
+// rpcCodec is the json codec of a single http request
+type rpcCodec struct {
+	rpc.ServerCodec
+	req *RpcRequest
+}
+
+func (c *rpcCodec) ParseRequestArguments(argTypes []reflect.Type, params interface{}) ([]reflect.Value, rpc.Error) {
+	if len(argTypes) == 0 || argTypes[0] != rpcRequestType {
+		return c.ServerCodec.ParseRequestArguments(argTypes, params)
+	}
+
+	args, err := c.ServerCodec.ParseRequestArguments(argTypes[1:], params)
+	if nil != err {
+		return nil, err
+	}
+	return append([]reflect.Value{reflect.ValueOf(c.req)}, args...), nil
+}
+
+// errors returned by methods are replaced with the GatewayError recorded, whose code and data are kept in the error object
+func (c *rpcCodec) CreateErrorResponse(id interface{}, err rpc.Error) interface{} {
+	if ge := c.req.gatewayError(err.Error()); nil != ge {
+		return c.ServerCodec.CreateErrorResponseWithInfo(id, ge, ge.ErrorData())
+	}
+	return c.ServerCodec.CreateErrorResponse(id, err)
+}
+
+// rpcHttpHandler serves json-rpc over http like rpc.Server.ServeHTTP, except that requests are served with rpcCodec
+type rpcHttpHandler struct {
+	server *rpc.Server
+}
+
+func newRpcHttpHandler(server *rpc.Server, allowedOrigins []string) http.Handler {
+	var h http.Handler = &rpcHttpHandler{server: server}
+	if len(allowedOrigins) == 0 {
+		return h
+	}
+
+	c := cors.New(cors.Options{
+		AllowedOrigins: allowedOrigins,
+		AllowedMethods: []string{"POST", "GET"},
+		MaxAge:         600,
+		AllowedHeaders: []string{"*"},
+	})
+	return c.Handler(h)
+}
+
+// the request size is limited by requestSizeHandler
+func (h *rpcHttpHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("content-type"))
+	if err != nil || mt != "application/json" {
+		http.Error(w, "invalid content type, only application/json is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("content-type", "application/json")
+
+	codec := &rpcCodec{
+		ServerCodec: rpc.NewJSONCodec(&httpReadWriteNopCloser{r.Body, w}),
+		req:         newRpcRequest(r.RemoteAddr),
+	}
+	defer codec.Close()
+	h.server.ServeSingleRequest(codec, rpc.OptionMethodInvocation)
+}
+
+type httpReadWriteNopCloser struct {
+	io.Reader
+	io.Writer
+}
+
+func (t *httpReadWriteNopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,136 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+type TestRpcApi struct{}
+
+func (api *TestRpcApi) RemoteAddr(req *RpcRequest) (string, error) {
+	return req.remoteAddr(), nil
+}
+
+func (api *TestRpcApi) Echo(req *RpcRequest, msg string, n int) (string, error) {
+	return req.remoteAddr() + ":" + msg + ":" + strings.Repeat("!", n), nil
+}
+
+func (api *TestRpcApi) Plain(msg string) (string, error) {
+	return msg, nil
+}
+
+func (api *TestRpcApi) Reject(req *RpcRequest, internal bool) (string, error) {
+	if internal {
+		return "", req.fail(errors.New("database is down"))
+	}
+	return "", req.fail(NewGatewayError(ReasonFeeTooLow, map[string]interface{}{"minLrcFee": "10"}, "fee too low"))
+}
+
+func (api *TestRpcApi) Unrecorded() (string, error) {
+	return "", NewGatewayError(ReasonFeeTooLow, nil, "not recorded")
+}
+
+type testRpcResponse struct {
+	Result string `json:"result"`
+	Error  *struct {
+		Code    int                    `json:"code"`
+		Message string                 `json:"message"`
+		Data    map[string]interface{} `json:"data"`
+	} `json:"error"`
+}
+
+func callTestRpc(t *testing.T, handler http.Handler, body string) []testRpcResponse {
+	r := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	r.Header.Set("content-type", "application/json")
+	r.RemoteAddr = "10.0.0.1:4321"
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	var resps []testRpcResponse
+	data := strings.TrimSpace(w.Body.String())
+	if strings.HasPrefix(data, "[") {
+		if err := json.Unmarshal([]byte(data), &resps); err != nil {
+			t.Fatalf("unmarshal %s error:%s", data, err.Error())
+		}
+	} else {
+		var resp testRpcResponse
+		if err := json.Unmarshal([]byte(data), &resp); err != nil {
+			t.Fatalf("unmarshal %s error:%s", data, err.Error())
+		}
+		resps = append(resps, resp)
+	}
+	return resps
+}
+
+func newTestRpcHandler(t *testing.T) http.Handler {
+	server := rpc.NewServer()
+	if err := server.RegisterName("test", &TestRpcApi{}); err != nil {
+		t.Fatal(err)
+	}
+	return newRpcHttpHandler(server, nil)
+}
+
+func TestRpcHttpHandler_RemoteAddr(t *testing.T) {
+	handler := newTestRpcHandler(t)
+
+	cases := map[string]string{
+		`{"jsonrpc":"2.0","id":1,"method":"test_remoteAddr","params":[]}`:      "10.0.0.1:4321",
+		`{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["hello",2]}`:   "10.0.0.1:4321:hello:!!",
+		`{"jsonrpc":"2.0","id":1,"method":"test_plain","params":["hello"]}`:    "hello",
+		`[{"jsonrpc":"2.0","id":1,"method":"test_echo","params":["batch",1]}]`: "10.0.0.1:4321:batch:!",
+	}
+	for body, expect := range cases {
+		resps := callTestRpc(t, handler, body)
+		if len(resps) != 1 || resps[0].Error != nil || resps[0].Result != expect {
+			t.Errorf("%s, got %+v, expect %s", body, resps, expect)
+		}
+	}
+}
+
+func TestRpcHttpHandler_GatewayError(t *testing.T) {
+	handler := newTestRpcHandler(t)
+
+	body := `[{"jsonrpc":"2.0","id":1,"method":"test_reject","params":[false]},` +
+		`{"jsonrpc":"2.0","id":2,"method":"test_reject","params":[true]},` +
+		`{"jsonrpc":"2.0","id":3,"method":"test_unrecorded","params":[]}]`
+	resps := callTestRpc(t, handler, body)
+	if len(resps) != 3 {
+		t.Fatalf("got %d responses", len(resps))
+	}
+
+	if e := resps[0].Error; e == nil || e.Code != errorCodes[ReasonFeeTooLow] || e.Message != "fee too low" ||
+		e.Data["reason"] != string(ReasonFeeTooLow) || e.Data["minLrcFee"] != "10" {
+		t.Errorf("gateway error, got %+v", e)
+	}
+	if e := resps[1].Error; e == nil || e.Code != errorCodes[ReasonInternalError] || e.Data["reason"] != string(ReasonInternalError) {
+		t.Errorf("internal error, got %+v", e)
+	}
+	// errors not returned by fail keep the default code of the rpc server
+	if e := resps[2].Error; e == nil || e.Code != -32000 || e.Data != nil {
+		t.Errorf("unrecorded error, got %+v", e)
+	}
+}
@@ -0,0 +1,134 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/log"
+	"github.com/ethereum/go-ethereum/rpc"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the vendored rpc server rejects requests larger than 128k
+const maxRpcRequestSize = 1024 * 128
+
+// rpcListener serves the namespaces configured in options with an http(s) server
+type rpcListener struct {
+	options  config.JsonrpcListenerOptions
+	handler  http.Handler
+	listener net.Listener
+}
+
+// newRpcListener registers receivers of the namespaces in apis, methods of all receivers in a namespace are merged,
+// wrap is applied to the http handler if not nil
+func newRpcListener(options config.JsonrpcListenerOptions, apis map[string][]interface{}, wrap func(next http.Handler) http.Handler) (*rpcListener, error) {
+	if len(options.Namespaces) == 0 {
+		return nil, fmt.Errorf("jsonrpc,listener %s has no namespace", options.Name)
+	}
+
+	handler := rpc.NewServer()
+	for _, namespace := range options.Namespaces {
+		receivers, ok := apis[namespace]
+		if !ok || len(receivers) == 0 {
+			return nil, fmt.Errorf("jsonrpc,listener %s,namespace %s is not available", options.Name, namespace)
+		}
+		for _, receiver := range receivers {
+			if err := handler.RegisterName(namespace, receiver); err != nil {
+				return nil, fmt.Errorf("jsonrpc,listener %s,register namespace %s error:%s", options.Name, namespace, err.Error())
+			}
+		}
+	}
+
+	origins := options.AllowedOrigins
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
+
+	h := newRpcHttpHandler(handler, origins)
+	if nil != wrap {
+		h = wrap(h)
+	}
+
+	h = &requestSizeHandler{maxSize: requestSize(options.MaxRequestSize), next: h}
+
+	return &rpcListener{options: options, handler: h}, nil
+}
+
+func (l *rpcListener) start() error {
+	var err error
+	addr := net.JoinHostPort(l.options.BindAddress, strconv.Itoa(l.options.Port))
+	if l.listener, err = net.Listen("tcp", addr); err != nil {
+		return fmt.Errorf("jsonrpc,listener %s,listen on %s error:%s", l.options.Name, addr, err.Error())
+	}
+
+	server := &http.Server{
+		Handler:      l.handler,
+		ReadTimeout:  time.Duration(l.options.ReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(l.options.WriteTimeout) * time.Second,
+	}
+
+	if "" != l.options.TlsCert && "" != l.options.TlsKey {
+		go func() {
+			if err := server.ServeTLS(l.listener, l.options.TlsCert, l.options.TlsKey); err != nil {
+				log.Errorf("jsonrpc,listener %s stopped:%s", l.options.Name, err.Error())
+			}
+		}()
+		log.Infof("HTTPS endpoint opened: https://%s namespaces:%v", addr, l.options.Namespaces)
+	} else {
+		go func() {
+			if err := server.Serve(l.listener); err != nil {
+				log.Errorf("jsonrpc,listener %s stopped:%s", l.options.Name, err.Error())
+			}
+		}()
+		log.Infof("HTTP endpoint opened: http://%s namespaces:%v", addr, l.options.Namespaces)
+	}
+	return nil
+}
+
+func (l *rpcListener) stop() {
+	if nil != l.listener {
+		l.listener.Close()
+		l.listener = nil
+	}
+}
+
+func requestSize(size int64) int64 {
+	if size <= 0 || size > maxRpcRequestSize {
+		return maxRpcRequestSize
+	}
+	return size
+}
+
+type requestSizeHandler struct {
+	maxSize int64
+	next    http.Handler
+}
+
+func (h *requestSizeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > h.maxSize {
+		http.Error(w, fmt.Sprintf("content length too large (%d>%d)", r.ContentLength, h.maxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, h.maxSize)
+	h.next.ServeHTTP(w, r)
+}
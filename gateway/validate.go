@@ -0,0 +1,151 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/types"
+	"math/big"
+)
+
+const (
+	CheckNameAmount            = "amount"
+	CheckNameExists            = "exists"
+	CheckNameCancelledOrFilled = "cancelledOrFilled"
+	CheckNameBalance           = "balance"
+	CheckNameAllowance         = "allowance"
+)
+
+type ValidationCheck struct {
+	Name    string                 `json:"name"`
+	Passed  bool                   `json:"passed"`
+	Code    int                    `json:"code,omitempty"`
+	Reason  ErrorReason            `json:"reason,omitempty"`
+	Message string                 `json:"message,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+type OrderValidation struct {
+	OrderHash string            `json:"orderHash"`
+	Valid     bool              `json:"valid"`
+	Checks    []ValidationCheck `json:"checks"`
+}
+
+func (v *OrderValidation) addCheck(name string, err *GatewayError) {
+	check := ValidationCheck{Name: name, Passed: err == nil}
+	if err != nil {
+		check.Code = err.ErrorCode()
+		check.Reason = err.Reason
+		check.Message = err.Error()
+		check.Data = err.Data
+		v.Valid = false
+	}
+	v.Checks = append(v.Checks, check)
+}
+
+// ValidateOrder runs all filters and account checks without storing or broadcasting the order,
+// every check is executed even if some of them failed, so that wallets could show all problems at once
+func ValidateOrder(order *types.Order, accessor *ethaccessor.EthNodeAccessor) OrderValidation {
+	order.Hash = order.GenerateHash()
+	validation := OrderValidation{OrderHash: order.Hash.Hex(), Valid: true, Checks: make([]ValidationCheck, 0)}
+
+	// price and remained amount are divided by amountB, other checks make no sense without valid amounts
+	if err := checkAmounts(order); err != nil {
+		validation.addCheck(CheckNameAmount, err)
+		return validation
+	}
+	validation.addCheck(CheckNameAmount, nil)
+	order.GeneratePrice()
+
+	if _, err := gateway.om.GetOrderByHash(order.Hash); err == nil {
+		validation.addCheck(CheckNameExists, NewGatewayError(ReasonOrderExists, map[string]interface{}{"orderHash": order.Hash.Hex()}, "gateway,order %s exist", order.Hash.Hex()))
+	} else {
+		validation.addCheck(CheckNameExists, nil)
+	}
+
+	for _, f := range gateway.filters {
+		err := applyFilters([]Filter{f}, order)
+		if err != nil {
+			validation.addCheck(f.Name(), toGatewayError(err))
+		} else {
+			validation.addCheck(f.Name(), nil)
+		}
+	}
+
+	validateAccount(order, accessor, &validation)
+
+	return validation
+}
+
+func checkAmounts(order *types.Order) *GatewayError {
+	if order.AmountS == nil || order.AmountS.Sign() <= 0 {
+		return NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "amountS"}, "gateway,order %s amountS must be positive", order.Hash.Hex())
+	}
+	if order.AmountB == nil || order.AmountB.Sign() <= 0 {
+		return NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "amountB"}, "gateway,order %s amountB must be positive", order.Hash.Hex())
+	}
+	return nil
+}
+
+func validateAccount(order *types.Order, accessor *ethaccessor.EthNodeAccessor, validation *OrderValidation) {
+	cancelledOrFilled, err := accessor.GetCancelledOrFilled(order.Protocol, order.Hash, "latest")
+	if err != nil {
+		validation.addCheck(CheckNameCancelledOrFilled, NewGatewayError(ReasonInternalError, nil, "gateway,validate order %s,get cancelledOrFilled error:%s", order.Hash.Hex(), err.Error()))
+		return
+	}
+
+	// cancelledOrFilled is amountB if buyNoMoreThanAmountB, otherwise amountS
+	remainAmountS := new(big.Int).Sub(order.AmountS, cancelledOrFilled)
+	if order.BuyNoMoreThanAmountB {
+		remainAmountB := new(big.Int).Sub(order.AmountB, cancelledOrFilled)
+		remainAmountS = new(big.Int).Div(new(big.Int).Mul(remainAmountB, order.AmountS), order.AmountB)
+	}
+	if remainAmountS.Sign() <= 0 {
+		validation.addCheck(CheckNameCancelledOrFilled, NewGatewayError(ReasonOrderFinished, map[string]interface{}{"cancelledOrFilled": cancelledOrFilled.String()}, "gateway,validate order %s,order has been cancelled or filled", order.Hash.Hex()))
+	} else {
+		validation.addCheck(CheckNameCancelledOrFilled, nil)
+	}
+
+	spender, err := accessor.GetSenderAddress(order.Protocol)
+	if err != nil {
+		validation.addCheck(CheckNameBalance, NewGatewayError(ReasonInvalidOrder, map[string]interface{}{"field": "protocol"}, "gateway,validate order %s,%s", order.Hash.Hex(), err.Error()))
+		return
+	}
+	req := &ethaccessor.BatchErc20Req{Owner: order.Owner, Token: order.TokenS, Spender: spender, BlockParameter: "latest"}
+	if err := accessor.BatchErc20BalanceAndAllowance([]*ethaccessor.BatchErc20Req{req}); err != nil {
+		validation.addCheck(CheckNameBalance, NewGatewayError(ReasonInternalError, nil, "gateway,validate order %s,get balance and allowance error:%s", order.Hash.Hex(), err.Error()))
+		return
+	}
+
+	if req.BalanceErr != nil {
+		validation.addCheck(CheckNameBalance, NewGatewayError(ReasonInternalError, nil, "gateway,validate order %s,get balance error:%s", order.Hash.Hex(), req.BalanceErr.Error()))
+	} else if balance := req.Balance.BigInt(); balance.Cmp(remainAmountS) < 0 {
+		validation.addCheck(CheckNameBalance, NewGatewayError(ReasonInsufficientBalance, map[string]interface{}{"balance": balance.String(), "required": remainAmountS.String()}, "gateway,validate order %s,balance %s less than %s", order.Hash.Hex(), balance.String(), remainAmountS.String()))
+	} else {
+		validation.addCheck(CheckNameBalance, nil)
+	}
+
+	if req.AllowanceErr != nil {
+		validation.addCheck(CheckNameAllowance, NewGatewayError(ReasonInternalError, nil, "gateway,validate order %s,get allowance error:%s", order.Hash.Hex(), req.AllowanceErr.Error()))
+	} else if allowance := req.Allowance.BigInt(); allowance.Cmp(remainAmountS) < 0 {
+		validation.addCheck(CheckNameAllowance, NewGatewayError(ReasonInsufficientAllowance, map[string]interface{}{"allowance": allowance.String(), "required": remainAmountS.String(), "spender": spender.Hex()}, "gateway,validate order %s,allowance %s less than %s", order.Hash.Hex(), allowance.String(), remainAmountS.String()))
+	} else {
+		validation.addCheck(CheckNameAllowance, nil)
+	}
+}
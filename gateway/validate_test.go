@@ -0,0 +1,62 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"testing"
+)
+
+func TestValidateOrder_ZeroAmount(t *testing.T) {
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+
+	cases := []struct {
+		amountS, amountB int64
+		field            string
+	}{
+		{100, 0, "amountB"},
+		{0, 100, "amountS"},
+	}
+	for _, c := range cases {
+		order := &types.Order{
+			Protocol:             common.HexToAddress("0xc01172a87f6cc20e1e3b9ad13a9e715fbc2d5aa9"),
+			TokenS:               common.HexToAddress("0x1111111111111111111111111111111111111111"),
+			TokenB:               common.HexToAddress("0x2222222222222222222222222222222222222222"),
+			AmountS:              big.NewInt(c.amountS),
+			AmountB:              big.NewInt(c.amountB),
+			Timestamp:            big.NewInt(1506014710),
+			Ttl:                  big.NewInt(3600),
+			Salt:                 big.NewInt(1),
+			LrcFee:               big.NewInt(0),
+			BuyNoMoreThanAmountB: true,
+		}
+		// accessor and order manager are not reached once the amounts are rejected
+		validation := ValidateOrder(order, nil)
+		if validation.Valid || len(validation.Checks) != 1 {
+			t.Fatalf("order with %s zero should be rejected by the amount check only, got %+v", c.field, validation)
+		}
+		check := validation.Checks[0]
+		if check.Name != CheckNameAmount || check.Reason != ReasonInvalidOrder || check.Data["field"] != c.field {
+			t.Errorf("unexpected check %+v for %s zero", check, c.field)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"fmt"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"golang.org/x/net/websocket"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	WebsocketTopicDepth   = "depth"
+	WebsocketTopicTicker  = "ticker"
+	WebsocketTopicFills   = "fills"
+	WebsocketTopicOrders  = "orders"
+	WebsocketTopicBalance = "balance"
+	WebsocketTopicPending = "pending"
+
+	WebsocketMethodSubscribe   = "subscribe"
+	WebsocketMethodUnsubscribe = "unsubscribe"
+
+	// messages buffered for each client, a client falls behind more than this will be dropped
+	websocketSendBufferSize = 256
+
+	// events buffered for the push worker, events are dropped when it's full so that the emitter is never blocked
+	websocketEventBufferSize = 1024
+)
+
+// WebsocketRequest is sent by client to subscribe or unsubscribe a topic.
+// depth needs market, fills needs market or owner, orders, balance and pending need owner.
+type WebsocketRequest struct {
+	Method          string `json:"method"`
+	Topic           string `json:"topic"`
+	Market          string `json:"market"`
+	Owner           string `json:"owner"`
+	ContractVersion string `json:"contractVersion"`
+}
+
+type WebsocketResponse struct {
+	Topic   string      `json:"topic"`
+	Market  string      `json:"market,omitempty"`
+	Owner   string      `json:"owner,omitempty"`
+	Data    interface{} `json:"data,omitempty"`
+	Error   string      `json:"error,omitempty"`
+	Success bool        `json:"success"`
+}
+
+// PendingEventJson is pushed to pending subscribers, events of unconfirmed blocks are only for display.
+// Type is the pending topic of extractor, events from FromBlock are dropped by clients when Type is PendingRetracted.
+type PendingEventJson struct {
+	Type  string      `json:"type"`
+	Event interface{} `json:"event"`
+}
+
+type WebsocketService interface {
+	Start()
+	Stop()
+}
+
+type WebsocketServiceImpl struct {
+	port     string
+	jsonrpc  *JsonrpcServiceImpl
+	clients  map[*websocketClient]bool
+	mtx      sync.RWMutex
+	listener net.Listener
+	watchers map[string]*eventemitter.Watcher
+	events   chan websocketEvent
+	quit     chan struct{}
+}
+
+// websocketEvent is handled by the push worker, snapshot queries in handlers never run in the emitter
+type websocketEvent struct {
+	handle func(input eventemitter.EventData) error
+	data   eventemitter.EventData
+}
+
+type websocketClient struct {
+	conn   *websocket.Conn
+	send   chan interface{}
+	subs   map[string]WebsocketRequest
+	mtx    sync.RWMutex
+	closed bool
+}
+
+func NewWebsocketService(port string, jsonrpc *JsonrpcServiceImpl) *WebsocketServiceImpl {
+	w := &WebsocketServiceImpl{}
+	w.port = port
+	w.jsonrpc = jsonrpc
+	w.clients = make(map[*websocketClient]bool)
+	w.watchers = make(map[string]*eventemitter.Watcher)
+	return w
+}
+
+func (w *WebsocketServiceImpl) Start() {
+	w.events = make(chan websocketEvent, websocketEventBufferSize)
+	w.quit = make(chan struct{})
+	go w.handleEvents()
+
+	w.watchers[eventemitter.OrderManagerGatewayNewOrder] = &eventemitter.Watcher{Concurrent: false, Handle: w.enqueue(w.handleOrderState)}
+	w.watchers[eventemitter.OrderManagerOrderStatusChanged] = &eventemitter.Watcher{Concurrent: false, Handle: w.enqueue(w.handleOrderState)}
+	w.watchers[eventemitter.OrderManagerExtractorFill] = &eventemitter.Watcher{Concurrent: false, Handle: w.enqueue(w.handleOrderFilled)}
+	w.watchers[eventemitter.AccountTransfer] = &eventemitter.Watcher{Concurrent: false, Handle: w.enqueue(w.handleTransfer)}
+	w.watchers[eventemitter.AccountApproval] = &eventemitter.Watcher{Concurrent: false, Handle: w.enqueue(w.handleApprove)}
+	for _, topic := range pendingTopics {
+		w.watchers[topic] = &eventemitter.Watcher{Concurrent: false, Handle: w.enqueue(w.handlePending(topic))}
+	}
+	for topic, watcher := range w.watchers {
+		eventemitter.On(topic, watcher)
+	}
+
+	var err error
+	if w.listener, err = net.Listen("tcp", ":"+w.port); err != nil {
+		log.Errorf("websocket,listen on port %s failed:%s", w.port, err.Error())
+		return
+	}
+	server := &http.Server{Handler: websocket.Server{Handler: w.serve}}
+	go server.Serve(w.listener)
+	log.Info(fmt.Sprintf("WebSocket endpoint opened: ws://%s", w.listener.Addr().String()))
+}
+
+func (w *WebsocketServiceImpl) Stop() {
+	for topic, watcher := range w.watchers {
+		eventemitter.Un(topic, watcher)
+	}
+	if w.quit != nil {
+		close(w.quit)
+	}
+	if w.listener != nil {
+		w.listener.Close()
+	}
+
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	for c := range w.clients {
+		c.close()
+		delete(w.clients, c)
+	}
+}
+
+// enqueue returns a watcher handle which never blocks the emitter
+func (w *WebsocketServiceImpl) enqueue(handle func(input eventemitter.EventData) error) func(input eventemitter.EventData) error {
+	return func(input eventemitter.EventData) error {
+		select {
+		case w.events <- websocketEvent{handle: handle, data: input}:
+		default:
+			log.Infof("websocket,event queue is full, drop event")
+		}
+		return nil
+	}
+}
+
+func (w *WebsocketServiceImpl) handleEvents() {
+	for {
+		select {
+		case <-w.quit:
+			return
+		case event := <-w.events:
+			if err := event.handle(event.data); err != nil {
+				log.Debugf("websocket,handle event error:%s", err.Error())
+			}
+		}
+	}
+}
+
+func (w *WebsocketServiceImpl) serve(conn *websocket.Conn) {
+	c := &websocketClient{conn: conn, send: make(chan interface{}, websocketSendBufferSize), subs: make(map[string]WebsocketRequest)}
+
+	w.mtx.Lock()
+	w.clients[c] = true
+	w.mtx.Unlock()
+
+	defer w.remove(c)
+
+	go c.writeLoop()
+
+	for {
+		var req WebsocketRequest
+		if err := websocket.JSON.Receive(conn, &req); err != nil {
+			log.Debugf("websocket,client %s disconnected:%s", conn.Request().RemoteAddr, err.Error())
+			return
+		}
+		w.handleRequest(c, req)
+	}
+}
+
+func (w *WebsocketServiceImpl) remove(c *websocketClient) {
+	w.mtx.Lock()
+	delete(w.clients, c)
+	w.mtx.Unlock()
+	c.close()
+}
+
+func (w *WebsocketServiceImpl) handleRequest(c *websocketClient, req WebsocketRequest) {
+	req.Market = strings.ToUpper(req.Market)
+	req.Owner = strings.ToLower(req.Owner)
+	resp := WebsocketResponse{Topic: req.Topic, Market: req.Market, Owner: req.Owner}
+
+	if err := validateWebsocketRequest(req); err != nil {
+		resp.Error = err.Error()
+		w.push(c, resp)
+		return
+	}
+
+	key := subscriptionKey(req.Topic, req.Market, req.Owner)
+	switch req.Method {
+	case WebsocketMethodSubscribe:
+		c.mtx.Lock()
+		c.subs[key] = req
+		c.mtx.Unlock()
+		resp.Success = true
+		// send a snapshot so that client needn't to query it by jsonrpc
+		resp.Data = w.snapshot(req)
+	case WebsocketMethodUnsubscribe:
+		c.mtx.Lock()
+		delete(c.subs, key)
+		c.mtx.Unlock()
+		resp.Success = true
+	default:
+		resp.Error = fmt.Sprintf("unsupported method:%s", req.Method)
+	}
+	w.push(c, resp)
+}
+
+func validateWebsocketRequest(req WebsocketRequest) error {
+	switch req.Topic {
+	case WebsocketTopicDepth:
+		if req.Market == "" || req.ContractVersion == "" {
+			return fmt.Errorf("market and contractVersion must be applied")
+		}
+	case WebsocketTopicTicker:
+	case WebsocketTopicFills:
+		if req.Market == "" && req.Owner == "" {
+			return fmt.Errorf("market or owner must be applied")
+		}
+	case WebsocketTopicOrders:
+		if req.Owner == "" {
+			return fmt.Errorf("owner must be applied")
+		}
+	case WebsocketTopicBalance:
+		if req.Owner == "" || req.ContractVersion == "" {
+			return fmt.Errorf("owner and contractVersion must be applied")
+		}
+	case WebsocketTopicPending:
+		if req.Owner == "" {
+			return fmt.Errorf("owner must be applied")
+		}
+	default:
+		return fmt.Errorf("unsupported topic:%s", req.Topic)
+	}
+	return nil
+}
+
+func (w *WebsocketServiceImpl) snapshot(req WebsocketRequest) interface{} {
+	var (
+		data interface{}
+		err  error
+	)
+	switch req.Topic {
+	case WebsocketTopicDepth:
+		data, err = w.jsonrpc.GetDepth(DepthQuery{ContractVersion: req.ContractVersion, Market: req.Market})
+	case WebsocketTopicTicker:
+		data, err = w.jsonrpc.GetTicker(req.ContractVersion)
+	case WebsocketTopicBalance:
+		data, err = w.jsonrpc.GetBalance(CommonTokenRequest{ContractVersion: req.ContractVersion, Owner: req.Owner})
+	}
+	if err != nil {
+		log.Debugf("websocket,snapshot of topic %s failed:%s", req.Topic, err.Error())
+		return nil
+	}
+	return data
+}
+
+// handleOrderState pushes new orders and orders cancelled, cutoff, soft cancelled or expired to the owner
+func (w *WebsocketServiceImpl) handleOrderState(input eventemitter.EventData) error {
+	state := input.(*types.OrderState)
+	ord := state.RawOrder
+
+	w.publishOrderStatus(state)
+
+	mkt, err := util.WrapMarketByAddress(ord.TokenS.Hex(), ord.TokenB.Hex())
+	if err != nil {
+		return err
+	}
+	w.publishDepth(mkt)
+	return nil
+}
+
+func (w *WebsocketServiceImpl) handleOrderFilled(input eventemitter.EventData) error {
+	event := input.(*types.OrderFilledEvent)
+
+	mkt := event.Market
+	if mkt == "" {
+		mkt, _ = util.WrapMarketByAddress(event.TokenS.Hex(), event.TokenB.Hex())
+	}
+	owner := strings.ToLower(event.Owner.Hex())
+
+	w.broadcast(func(req WebsocketRequest) bool {
+		return fillMatched(req, mkt, owner)
+	}, func(req WebsocketRequest) interface{} {
+		return event
+	})
+
+	if state, err := w.jsonrpc.orderManager.GetOrderByHash(event.OrderHash); err == nil {
+		w.publishOrderStatus(state)
+	}
+
+	if mkt != "" {
+		w.publishDepth(mkt)
+	}
+	w.broadcast(func(req WebsocketRequest) bool {
+		return req.Topic == WebsocketTopicTicker
+	}, w.snapshot)
+
+	return nil
+}
+
+// every field applied by the subscription must match, fills of unknown market only match subscriptions with owner
+func fillMatched(req WebsocketRequest, mkt, owner string) bool {
+	if req.Topic != WebsocketTopicFills {
+		return false
+	}
+	if req.Owner != "" && req.Owner != owner {
+		return false
+	}
+	if req.Market != "" {
+		if mkt == "" {
+			return req.Owner != ""
+		}
+		return req.Market == mkt
+	}
+	return true
+}
+
+func (w *WebsocketServiceImpl) handleTransfer(input eventemitter.EventData) error {
+	event := input.(*types.TransferEvent)
+	w.publishBalance(event.From, event.To)
+	return nil
+}
+
+func (w *WebsocketServiceImpl) handleApprove(input eventemitter.EventData) error {
+	event := input.(*types.ApprovalEvent)
+	w.publishBalance(event.Owner)
+	return nil
+}
+
+var pendingTopics = []string{
+	eventemitter.PendingRingMined,
+	eventemitter.PendingOrderFilled,
+	eventemitter.PendingOrderCancelled,
+	eventemitter.PendingCutoff,
+	eventemitter.PendingTransfer,
+	eventemitter.PendingApproval,
+	eventemitter.PendingWethDeposit,
+	eventemitter.PendingWethWithdrawal,
+	eventemitter.PendingRetracted,
+}
+
+// handlePending forwards the event to pending subscribers of it's owners, retraction is sent to every pending subscriber
+func (w *WebsocketServiceImpl) handlePending(topic string) func(input eventemitter.EventData) error {
+	return func(input eventemitter.EventData) error {
+		data := PendingEventJson{Type: topic, Event: input}
+		owners, all := w.pendingOwners(input)
+		w.broadcast(func(req WebsocketRequest) bool {
+			return req.Topic == WebsocketTopicPending && (all || owners[req.Owner])
+		}, func(req WebsocketRequest) interface{} {
+			return data
+		})
+		return nil
+	}
+}
+
+func (w *WebsocketServiceImpl) pendingOwners(input eventemitter.EventData) (map[string]bool, bool) {
+	owners := make(map[string]bool)
+	add := func(addrs ...common.Address) {
+		for _, addr := range addrs {
+			owners[strings.ToLower(addr.Hex())] = true
+		}
+	}
+	switch event := input.(type) {
+	case *types.PendingRetractedEvent:
+		return owners, true
+	case *types.RingMinedEvent:
+		add(event.Miner)
+		for _, fill := range event.Fills {
+			add(fill.Owner)
+		}
+	case *types.OrderFilledEvent:
+		add(event.Owner)
+	case *types.OrderCancelledEvent:
+		if state, err := w.jsonrpc.orderManager.GetOrderByHash(event.OrderHash); err == nil {
+			add(state.RawOrder.Owner)
+		}
+	case *types.CutoffEvent:
+		add(event.Owner)
+	case *types.TransferEvent:
+		add(event.From, event.To)
+	case *types.ApprovalEvent:
+		add(event.Owner)
+	case *types.WethDepositMethodEvent:
+		add(event.From)
+	case *types.WethWithdrawalMethodEvent:
+		add(event.From)
+	}
+	return owners, false
+}
+
+func (w *WebsocketServiceImpl) publishOrderStatus(state *types.OrderState) {
+	owner := strings.ToLower(state.RawOrder.Owner.Hex())
+	data := orderStateToJson(*state)
+	w.broadcast(func(req WebsocketRequest) bool {
+		return req.Topic == WebsocketTopicOrders && req.Owner == owner
+	}, func(req WebsocketRequest) interface{} {
+		return data
+	})
+}
+
+func (w *WebsocketServiceImpl) publishDepth(mkt string) {
+	w.broadcast(func(req WebsocketRequest) bool {
+		return req.Topic == WebsocketTopicDepth && req.Market == mkt
+	}, w.snapshot)
+}
+
+func (w *WebsocketServiceImpl) publishBalance(owners ...common.Address) {
+	for _, addr := range owners {
+		owner := strings.ToLower(addr.Hex())
+		w.broadcast(func(req WebsocketRequest) bool {
+			return req.Topic == WebsocketTopicBalance && req.Owner == owner
+		}, w.snapshot)
+	}
+}
+
+// broadcast pushes data to every subscription matched, data is generated once for each distinct subscription
+func (w *WebsocketServiceImpl) broadcast(match func(req WebsocketRequest) bool, generate func(req WebsocketRequest) interface{}) {
+	w.mtx.RLock()
+	clients := make([]*websocketClient, 0, len(w.clients))
+	for c := range w.clients {
+		clients = append(clients, c)
+	}
+	w.mtx.RUnlock()
+
+	cache := make(map[string]interface{})
+	for _, c := range clients {
+		for key, req := range c.subscriptions() {
+			if !match(req) {
+				continue
+			}
+			cacheKey := key + ":" + req.ContractVersion
+			data, ok := cache[cacheKey]
+			if !ok {
+				data = generate(req)
+				cache[cacheKey] = data
+			}
+			w.push(c, WebsocketResponse{Topic: req.Topic, Market: req.Market, Owner: req.Owner, Data: data, Success: true})
+		}
+	}
+}
+
+// push never blocks the emitter, the client will be dropped if it's send buffer is full
+func (w *WebsocketServiceImpl) push(c *websocketClient, resp WebsocketResponse) {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- resp:
+	default:
+		log.Infof("websocket,client %s is too slow, drop it", c.conn.Request().RemoteAddr)
+		go w.remove(c)
+	}
+}
+
+func (c *websocketClient) subscriptions() map[string]WebsocketRequest {
+	c.mtx.RLock()
+	defer c.mtx.RUnlock()
+	subs := make(map[string]WebsocketRequest, len(c.subs))
+	for k, v := range c.subs {
+		subs[k] = v
+	}
+	return subs
+}
+
+func (c *websocketClient) writeLoop() {
+	for resp := range c.send {
+		if err := websocket.JSON.Send(c.conn, resp); err != nil {
+			log.Debugf("websocket,send to client %s failed:%s", c.conn.Request().RemoteAddr, err.Error())
+			c.conn.Close()
+			return
+		}
+	}
+}
+
+func (c *websocketClient) close() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		return
+	}
+	c.closed = true
+	close(c.send)
+	c.conn.Close()
+}
+
+func subscriptionKey(topic, market, owner string) string {
+	return topic + ":" + market + ":" + owner
+}
@@ -0,0 +1,141 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package gateway
+
+import (
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestFillMatched(t *testing.T) {
+	const (
+		mkt   = "LRC-WETH"
+		owner = "0x1111111111111111111111111111111111111111"
+		other = "0x2222222222222222222222222222222222222222"
+	)
+	cases := []struct {
+		req     WebsocketRequest
+		mkt     string
+		matched bool
+	}{
+		{WebsocketRequest{Topic: WebsocketTopicFills, Market: mkt}, mkt, true},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Market: "RDN-WETH"}, mkt, false},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Owner: owner}, mkt, true},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Owner: other}, mkt, false},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Market: mkt, Owner: owner}, mkt, true},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Market: mkt, Owner: other}, mkt, false},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Market: "RDN-WETH", Owner: owner}, mkt, false},
+		// market of the fill is unknown
+		{WebsocketRequest{Topic: WebsocketTopicFills, Market: mkt}, "", false},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Owner: owner}, "", true},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Owner: other}, "", false},
+		{WebsocketRequest{Topic: WebsocketTopicFills, Market: mkt, Owner: owner}, "", true},
+		{WebsocketRequest{Topic: WebsocketTopicOrders, Owner: owner}, mkt, false},
+	}
+	for i, c := range cases {
+		if matched := fillMatched(c.req, c.mkt, owner); matched != c.matched {
+			t.Errorf("case %d, %+v with market %q matched:%t, expect:%t", i, c.req, c.mkt, matched, c.matched)
+		}
+	}
+}
+
+func TestWebsocketServiceImpl_HandlePending(t *testing.T) {
+	owner := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	other := common.HexToAddress("0x2222222222222222222222222222222222222222")
+
+	w := NewWebsocketService("0", nil)
+	subscribe := func(req WebsocketRequest) *websocketClient {
+		c := &websocketClient{send: make(chan interface{}, 10), subs: make(map[string]WebsocketRequest)}
+		c.subs[subscriptionKey(req.Topic, req.Market, req.Owner)] = req
+		w.clients[c] = true
+		return c
+	}
+	ownerClient := subscribe(WebsocketRequest{Topic: WebsocketTopicPending, Owner: strings.ToLower(owner.Hex())})
+	otherClient := subscribe(WebsocketRequest{Topic: WebsocketTopicPending, Owner: strings.ToLower(other.Hex())})
+	fillsClient := subscribe(WebsocketRequest{Topic: WebsocketTopicFills, Owner: strings.ToLower(owner.Hex())})
+	received := func(c *websocketClient) []string {
+		pushed := []string{}
+		for len(c.send) > 0 {
+			resp := (<-c.send).(WebsocketResponse)
+			pushed = append(pushed, resp.Data.(PendingEventJson).Type)
+		}
+		return pushed
+	}
+
+	w.handlePending(eventemitter.PendingOrderFilled)(&types.OrderFilledEvent{Owner: owner})
+	w.handlePending(eventemitter.PendingTransfer)(&types.TransferEvent{From: other, To: owner})
+	w.handlePending(eventemitter.PendingRetracted)(&types.PendingRetractedEvent{FromBlock: big.NewInt(100)})
+
+	if got := received(ownerClient); len(got) != 3 || got[0] != eventemitter.PendingOrderFilled || got[1] != eventemitter.PendingTransfer || got[2] != eventemitter.PendingRetracted {
+		t.Errorf("owner received %v", got)
+	}
+	if got := received(otherClient); len(got) != 2 || got[0] != eventemitter.PendingTransfer || got[1] != eventemitter.PendingRetracted {
+		t.Errorf("other received %v", got)
+	}
+	if got := received(fillsClient); len(got) != 0 {
+		t.Errorf("fills subscriber should not receive pending events, received %v", got)
+	}
+}
+
+func TestWebsocketServiceImpl_HandleOrderState(t *testing.T) {
+	owner := common.HexToAddress("0x1111111111111111111111111111111111111111")
+	other := common.HexToAddress("0x2222222222222222222222222222222222222222")
+
+	w := NewWebsocketService("0", nil)
+	subscribe := func(req WebsocketRequest) *websocketClient {
+		c := &websocketClient{send: make(chan interface{}, 10), subs: make(map[string]WebsocketRequest)}
+		c.subs[subscriptionKey(req.Topic, req.Market, req.Owner)] = req
+		w.clients[c] = true
+		return c
+	}
+	ownerClient := subscribe(WebsocketRequest{Topic: WebsocketTopicOrders, Owner: strings.ToLower(owner.Hex())})
+	otherClient := subscribe(WebsocketRequest{Topic: WebsocketTopicOrders, Owner: strings.ToLower(other.Hex())})
+
+	for _, status := range []types.OrderStatus{types.ORDER_CANCEL, types.ORDER_CUTOFF, types.ORDER_SOFT_CANCEL, types.ORDER_EXPIRE} {
+		state := &types.OrderState{Status: status}
+		state.RawOrder.Owner = owner
+		state.RawOrder.Hash = common.HexToHash("0x01")
+		state.RawOrder.AmountS = big.NewInt(1000)
+		state.RawOrder.AmountB = big.NewInt(500)
+		state.RawOrder.Timestamp = big.NewInt(1)
+		state.RawOrder.Ttl = big.NewInt(3600)
+		state.RawOrder.Salt = big.NewInt(1)
+		state.RawOrder.LrcFee = big.NewInt(0)
+		state.DealtAmountS = big.NewInt(0)
+		state.DealtAmountB = big.NewInt(0)
+		state.CancelledAmountS = big.NewInt(100)
+		state.CancelledAmountB = big.NewInt(0)
+		w.handleOrderState(state)
+
+		if len(ownerClient.send) != 1 {
+			t.Fatalf("status %s, owner received %d messages, expect 1", getStringStatus(status), len(ownerClient.send))
+		}
+		resp := (<-ownerClient.send).(WebsocketResponse)
+		if data := resp.Data.(OrderJsonResult); resp.Topic != WebsocketTopicOrders || data.Status != getStringStatus(status) || data.CancelledAmountS != types.BigintToHex(big.NewInt(100)) {
+			t.Errorf("status %s, owner received %+v", getStringStatus(status), resp)
+		}
+		if len(otherClient.send) != 0 {
+			t.Errorf("status %s, other owner should not receive the order", getStringStatus(status))
+		}
+	}
+}
@@ -178,6 +178,16 @@ func TokenUnRegister(input eventemitter.EventData) error {
 	return nil
 }
 
+// DenyToken removes the token from supported tokens at runtime, the same as it is unregistered
+func DenyToken(token types.Token) error {
+	return TokenUnRegister(&types.TokenUnRegisterEvent{Token: token.Protocol, Symbol: token.Symbol})
+}
+
+// AllowToken adds the denied token back to supported tokens at runtime
+func AllowToken(token types.Token) error {
+	return TokenRegister(&types.TokenRegisterEvent{Token: token.Protocol, Symbol: token.Symbol, Time: big.NewInt(token.Time)})
+}
+
 func WethTokenAddress() common.Address {
 	return SupportMarkets["weth"].Protocol
 }
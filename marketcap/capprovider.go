@@ -106,9 +106,9 @@ func (cap *CurrencyMarketCap) UnmarshalJSON(input []byte) error {
 	return nil
 }
 
+// eth的价格使用weth的价格，与GetMarketCap的计算方式一致
 func (p *MarketCapProvider) GetEthCap() *big.Rat {
-	//todo:
-	return new(big.Rat).SetInt64(int64(1))
+	return p.GetMarketCap(util.GetWethAddress())
 }
 
 func (p *MarketCapProvider) GetMarketCap(tokenAddress common.Address) *big.Rat {
@@ -132,6 +132,23 @@ func (p *MarketCapProvider) GetMarketCapByCurrency(tokenAddress common.Address,
 	}
 }
 
+// SetMarketCap 设置代币在当前法币下的价格，用于回测等不从网络获取价格的场景
+func (p *MarketCapProvider) SetMarketCap(tokenAddress common.Address, price float64) {
+	c, ok := p.currenciesMap[tokenAddress]
+	if !ok {
+		c = &CurrencyMarketCap{Address: tokenAddress}
+		p.currenciesMap[tokenAddress] = c
+	}
+	switch p.currency {
+	case CNY:
+		c.PriceCny = price
+	case USD:
+		c.PriceUsd = price
+	case BTC:
+		c.PriceBtc = price
+	}
+}
+
 func (p *MarketCapProvider) Stop() {
 	//todo:
 }
@@ -0,0 +1,101 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// MinerApi contains methods of miner namespace, it's served on the admin listener and requires authentication
+type MinerApi struct {
+	miner *Miner
+	rds   dao.RdsService
+}
+
+type RingQuery struct {
+	State     string `json:"state"` //pending, submitted, mined, failed
+	RingHash  string `json:"ringHash"`
+	PageIndex int    `json:"pageIndex"`
+	PageSize  int    `json:"pageSize"`
+}
+
+type RingJsonResult struct {
+	State  string             `json:"state"`
+	Info   dao.RingSubmitInfo `json:"info"`
+	Orders []dao.FilledOrder  `json:"orders"`
+}
+
+func (api *MinerApi) GetRings(query RingQuery) (res dao.PageResult, err error) {
+	if res, err = api.rds.RingSubmitInfoPageQuery(query.State, query.RingHash, query.PageIndex, query.PageSize); nil != err {
+		return res, err
+	}
+	for idx, item := range res.Data {
+		info := item.(dao.RingSubmitInfo)
+		var ring RingJsonResult
+		if ring, err = api.ringResult(info); nil != err {
+			return res, err
+		}
+		res.Data[idx] = ring
+	}
+	return res, nil
+}
+
+func (api *MinerApi) GetRing(ringhash string) (RingJsonResult, error) {
+	info, err := api.rds.GetRingForSubmitByHash(common.HexToHash(ringhash))
+	if nil != err {
+		return RingJsonResult{}, fmt.Errorf("miner,ring %s not found:%s", ringhash, err.Error())
+	}
+	return api.ringResult(info)
+}
+
+func (api *MinerApi) GetStats() ([]MarketStats, error) {
+	return api.miner.Stats(), nil
+}
+
+func (api *MinerApi) Pause() (bool, error) {
+	api.miner.Pause()
+	return true, nil
+}
+
+func (api *MinerApi) Resume() (bool, error) {
+	api.miner.Resume()
+	return true, nil
+}
+
+func (api *MinerApi) IsPaused() (bool, error) {
+	return api.miner.IsPaused(), nil
+}
+
+func (api *MinerApi) TriggerRound() (bool, error) {
+	if err := api.miner.TriggerRound(); nil != err {
+		return false, err
+	}
+	return true, nil
+}
+
+func (api *MinerApi) ringResult(info dao.RingSubmitInfo) (RingJsonResult, error) {
+	orders, err := api.rds.GetFilledOrdersByRinghash(common.HexToHash(info.RingHash))
+	if nil != err {
+		return RingJsonResult{}, err
+	}
+	return RingJsonResult{State: info.State(), Info: info, Orders: orders}, nil
+}
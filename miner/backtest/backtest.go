@@ -0,0 +1,394 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package backtest
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/miner/timing_matcher"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Backtester 将区块区间内的历史订单逐块回放给TimingMatcher以及Evaluator，
+// 统计匹配出的环路，并与链上实际成交的环路对比
+//
+// 找到的环路视为在下一个区块成交，其成交量计入订单，历史成交同样计入，因此同一订单可能被重复计算；
+// 余额和授权在每个区块按区块号从节点读取，需要节点保留历史状态，模拟成交卖出的量从中扣除；
+// 数据库中没有交易gas的历史，链上环路的gas按与回测相同的gas以及gasPrice估算
+type Backtester struct {
+	options       config.MinerOptions
+	commonOptions config.CommonOptions
+	rds           dao.RdsService
+	node          *ethaccessor.EthNodeAccessor
+	mc            *marketcap.MarketCapProvider
+	gas           *big.Int
+	gasPrice      *big.Int
+
+	mtx   sync.Mutex
+	rings []*types.RingSubmitInfo
+}
+
+type ReportSide struct {
+	Rings      int                 `json:"rings"`
+	Orders     int                 `json:"orders"`
+	FillVolume map[string]*big.Int `json:"fillVolume"`
+	LegalFee   float64             `json:"legalFee"`
+	GasCost    float64             `json:"gasCost"`
+	Profit     float64             `json:"profit"`
+}
+
+type Report struct {
+	FromBlock int64      `json:"fromBlock"`
+	ToBlock   int64      `json:"toBlock"`
+	Blocks    int        `json:"blocks"`
+	Orders    int        `json:"orders"`
+	Simulated ReportSide `json:"simulated"`
+	Chain     ReportSide `json:"chain"`
+}
+
+// backtestRds 不恢复也不更新数据库中的环路，其余读取操作透传
+type backtestRds struct {
+	dao.RdsService
+}
+
+func (rds *backtestRds) GetUnfinishedRingSubmitInfos() ([]dao.RingSubmitInfo, error) {
+	return []dao.RingSubmitInfo{}, nil
+}
+
+func (rds *backtestRds) UpdateRingSubmitInfoFailed(ringhashs []common.Hash, err string) error {
+	return nil
+}
+
+// node 为连接以太坊节点的accessor，只用于读取历史区块的余额以及授权
+func NewBacktester(options config.MinerOptions, commonOptions config.CommonOptions, rds dao.RdsService, node *ethaccessor.EthNodeAccessor, mc *marketcap.MarketCapProvider, gas, gasPrice *big.Int) *Backtester {
+	backtester := &Backtester{}
+	backtester.options = options
+	backtester.commonOptions = commonOptions
+	backtester.rds = rds
+	backtester.node = node
+	backtester.mc = mc
+	backtester.gas = gas
+	backtester.gasPrice = gasPrice
+	return backtester
+}
+
+func (b *Backtester) Run(from, to int64) (*Report, error) {
+	if from > to {
+		return nil, fmt.Errorf("backtest,invalid block range:%d-%d", from, to)
+	}
+	blocks, err := b.rds.GetBlocksByNumberRange(from, to)
+	if nil != err {
+		return nil, err
+	}
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("backtest,no blocks between %d and %d", from, to)
+	}
+	orders, err := b.rds.GetOrdersAliveBetween(blocks[0].CreateTime, blocks[len(blocks)-1].CreateTime)
+	if nil != err {
+		return nil, err
+	}
+	//有效期内的订单可能在from之前已部分成交，从头加载成交以及取消事件
+	fills, err := b.rds.GetFillEventsByBlockRange(0, to)
+	if nil != err {
+		return nil, err
+	}
+	cancels, err := b.rds.GetCancelEventsByBlockRange(0, to)
+	if nil != err {
+		return nil, err
+	}
+	ringMineds, err := b.rds.GetRingMinedByBlockRange(from, to)
+	if nil != err {
+		return nil, err
+	}
+
+	chain := NewSimulatedChain(b.gas, b.gasPrice)
+	accessor, err := b.newAccessor(chain)
+	if nil != err {
+		return nil, err
+	}
+	keydir, err := b.unlockMiner()
+	if nil != err {
+		return nil, err
+	}
+	defer os.RemoveAll(keydir)
+
+	om := newReplayOrderManager(accessor, b.mc, chain)
+	for _, order := range orders {
+		om.addOrder(order)
+	}
+
+	options := b.options
+	options.SimulateRing = false
+	options.IfRegistryRingHash = false
+	options.RingExpireBlocks = 0
+	options.GasPrice = config.GasPriceOptions{Strategy: "node"}
+	rds := &backtestRds{RdsService: b.rds}
+	submitter := miner.NewSubmitter(options, accessor, rds, b.mc)
+	evaluator := miner.NewEvaluator(b.mc, options.RateRatioCVSThreshold, accessor)
+	matcher := timing_matcher.NewTimingMatcher(options, submitter, evaluator, om, rds)
+
+	newRingWatcher := &eventemitter.Watcher{Concurrent: false, Handle: b.newRings}
+	eventemitter.On(eventemitter.Miner_NewRing, newRingWatcher)
+	matcher.Start()
+	defer func() {
+		matcher.Stop()
+		eventemitter.Un(eventemitter.Miner_NewRing, newRingWatcher)
+	}()
+
+	report := &Report{FromBlock: from, ToBlock: to, Blocks: len(blocks), Orders: len(orders)}
+	report.Simulated.FillVolume = make(map[string]*big.Int)
+	report.Chain.FillVolume = make(map[string]*big.Int)
+
+	fillIdx, cancelIdx := 0, 0
+	for _, block := range blocks {
+		//只有之前区块的事件对当前区块的匹配可见
+		for ; fillIdx < len(fills) && fills[fillIdx].BlockNumber < block.BlockNumber; fillIdx++ {
+			om.applyFill(fills[fillIdx])
+		}
+		for ; cancelIdx < len(cancels) && cancels[cancelIdx].BlockNumber < block.BlockNumber; cancelIdx++ {
+			om.applyCancel(cancels[cancelIdx])
+		}
+
+		blockNumber := big.NewInt(block.BlockNumber)
+		om.setBlockTime(block.CreateTime)
+		if err := b.loadBalances(chain, om, blockNumber); nil != err {
+			return nil, err
+		}
+		chain.SetBlockNumber(blockNumber)
+		eventemitter.Emit(eventemitter.Block_New, &types.BlockEvent{
+			BlockNumber: blockNumber,
+			BlockHash:   common.HexToHash(block.BlockHash),
+			BlockTime:   big.NewInt(block.CreateTime),
+		})
+
+		b.mtx.Lock()
+		rings := b.rings
+		b.rings = nil
+		b.mtx.Unlock()
+		for _, ring := range rings {
+			b.addSimulatedRing(report, om, ring)
+			eventemitter.Emit(eventemitter.OrderManagerExtractorRingMined, &types.RingMinedEvent{Ringhash: ring.Ringhash})
+		}
+		log.Debugf("backtest,block:%d rings:%d", block.BlockNumber, len(rings))
+	}
+
+	b.addChainRings(report, ringMineds, fills, om)
+	return report, nil
+}
+
+func (b *Backtester) newRings(eventData eventemitter.EventData) error {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.rings = append(b.rings, eventData.([]*types.RingSubmitInfo)...)
+	return nil
+}
+
+// 环路的成交量计入订单，gas成本按evaluator估算的gas以及gasPrice计算
+func (b *Backtester) addSimulatedRing(report *Report, om *replayOrderManager, ring *types.RingSubmitInfo) {
+	side := &report.Simulated
+	side.Rings += 1
+	side.Orders += len(ring.RawRing.Orders)
+	for _, filledOrder := range ring.RawRing.Orders {
+		order := filledOrder.OrderState.RawOrder
+		fillAmountS := new(big.Int).Div(filledOrder.FillAmountS.Num(), filledOrder.FillAmountS.Denom())
+		fillAmountB := new(big.Int).Div(filledOrder.FillAmountB.Num(), filledOrder.FillAmountB.Denom())
+		addVolume(side.FillVolume, order.TokenS, fillAmountS)
+		om.chain.AddSpent(order.TokenS, order.Owner, fillAmountS)
+		om.applyFill(dao.FillEvent{
+			OrderHash: order.Hash.Hex(),
+			AmountS:   fillAmountS.String(),
+			AmountB:   fillAmountB.String(),
+		})
+	}
+	legalFee := legalAmount(ring.RawRing.LegalFee)
+	received := legalAmount(ring.Received)
+	side.LegalFee += legalFee
+	side.Profit += received
+	side.GasCost += legalFee - received
+}
+
+// 链上环路的费用按成交事件计算，gas成本为估算值
+func (b *Backtester) addChainRings(report *Report, ringMineds []dao.RingMinedEvent, fills []dao.FillEvent, om *replayOrderManager) {
+	side := &report.Chain
+	side.Rings = len(ringMineds)
+	legalFee := new(big.Rat)
+	for _, fill := range fills {
+		if fill.BlockNumber < report.FromBlock {
+			continue
+		}
+		side.Orders += 1
+		tokenS := common.HexToAddress(fill.TokenS)
+		if amountS, ok := new(big.Int).SetString(fill.AmountS, 0); ok {
+			addVolume(side.FillVolume, tokenS, amountS)
+		}
+		legalFee.Add(legalFee, b.fillLegalFee(fill, om))
+	}
+	gasCost := new(big.Rat).SetInt(new(big.Int).Mul(b.gas, b.gasPrice))
+	gasCost.Mul(gasCost, new(big.Rat).SetInt64(int64(len(ringMineds))))
+	gasCost.Mul(gasCost, b.mc.GetEthCap())
+
+	side.LegalFee = legalAmount(legalFee)
+	side.GasCost = legalAmount(gasCost)
+	side.Profit = legalAmount(new(big.Rat).Sub(legalFee, gasCost))
+}
+
+// 法币金额为wei数量乘以价格，报告中换算为以ether计
+func legalAmount(amount *big.Rat) float64 {
+	v, _ := new(big.Rat).Quo(amount, new(big.Rat).SetFloat64(util.WeiToEther)).Float64()
+	return v
+}
+
+// loadBalances 从节点读取区块记录的有效订单owner的余额以及授权
+func (b *Backtester) loadBalances(chain *SimulatedChain, om *replayOrderManager, blockNumber *big.Int) error {
+	accounts := om.accounts()
+	if len(accounts) == 0 {
+		return nil
+	}
+	reqs := []*ethaccessor.BatchErc20Req{}
+	for _, account := range accounts {
+		impl, ok := b.node.ProtocolAddresses[account.protocol]
+		if !ok {
+			continue
+		}
+		reqs = append(reqs, &ethaccessor.BatchErc20Req{
+			Owner:          account.owner,
+			Token:          account.token,
+			Spender:        impl.DelegateAddress,
+			BlockParameter: types.BigintToHex(blockNumber),
+		})
+	}
+	if err := b.node.BatchErc20BalanceAndAllowance(reqs); nil != err {
+		return fmt.Errorf("backtest,load balances of block:%s err:%s", blockNumber.String(), err.Error())
+	}
+	for _, req := range reqs {
+		if nil != req.BalanceErr {
+			return fmt.Errorf("backtest,load balance of owner:%s token:%s err:%s", req.Owner.Hex(), req.Token.Hex(), req.BalanceErr.Error())
+		}
+		if nil != req.AllowanceErr {
+			return fmt.Errorf("backtest,load allowance of owner:%s token:%s err:%s", req.Owner.Hex(), req.Token.Hex(), req.AllowanceErr.Error())
+		}
+		chain.SetBalance(req.Token, req.Owner, req.Balance.BigInt())
+		chain.SetAllowance(req.Token, req.Owner, req.Allowance.BigInt())
+	}
+	return nil
+}
+
+// 与submitter统计实际收益的方式一致：(lrcFee - lrcReward)的法币价值加上分润
+func (b *Backtester) fillLegalFee(fill dao.FillEvent, om *replayOrderManager) *big.Rat {
+	legalFee := new(big.Rat)
+	ratFromString := func(s string) *big.Rat {
+		if v, ok := new(big.Int).SetString(s, 0); ok {
+			return new(big.Rat).SetInt(v)
+		}
+		return new(big.Rat)
+	}
+	if impl, ok := om.accessor.ProtocolAddresses[common.HexToAddress(fill.Protocol)]; ok {
+		lrc := new(big.Rat).Sub(ratFromString(fill.LrcFee), ratFromString(fill.LrcReward))
+		legalFee.Add(legalFee, lrc.Mul(lrc, b.mc.GetMarketCap(impl.LrcTokenAddress)))
+	}
+	splitS := ratFromString(fill.SplitS)
+	legalFee.Add(legalFee, splitS.Mul(splitS, b.mc.GetMarketCap(common.HexToAddress(fill.TokenS))))
+	splitB := ratFromString(fill.SplitB)
+	legalFee.Add(legalFee, splitB.Mul(splitB, b.mc.GetMarketCap(common.HexToAddress(fill.TokenB))))
+	return legalFee
+}
+
+// 协议的lrc地址从代币列表获取，其余合约地址在回测中用不到
+func (b *Backtester) newAccessor(chain *SimulatedChain) (*ethaccessor.EthNodeAccessor, error) {
+	var err error
+	accessor := &ethaccessor.EthNodeAccessor{}
+	if accessor.Erc20Abi, err = ethaccessor.NewAbi(b.commonOptions.Erc20Abi); nil != err {
+		return nil, err
+	}
+	if accessor.WethAbi, err = ethaccessor.NewAbi(b.commonOptions.WethAbi); nil != err {
+		return nil, err
+	}
+	if accessor.ProtocolImplAbi, err = ethaccessor.NewAbi(b.commonOptions.ProtocolImpl.ImplAbi); nil != err {
+		return nil, err
+	}
+	if accessor.RinghashRegistryAbi, err = ethaccessor.NewAbi(b.commonOptions.ProtocolImpl.RegistryAbi); nil != err {
+		return nil, err
+	}
+	accessor.WethAddress = util.WethTokenAddress()
+
+	var lrcAddress common.Address
+	for _, token := range util.AllTokens {
+		if "LRC" == token.Symbol {
+			lrcAddress = token.Protocol
+		}
+	}
+	if types.IsZeroAddress(lrcAddress) {
+		return nil, errors.New("backtest,can't find the address of LRC")
+	}
+	accessor.ProtocolAddresses = make(map[common.Address]*ethaccessor.ProtocolAddress)
+	for version, address := range b.commonOptions.ProtocolImpl.Address {
+		impl := &ethaccessor.ProtocolAddress{Version: version, ContractAddress: common.HexToAddress(address), LrcTokenAddress: lrcAddress}
+		accessor.ProtocolAddresses[impl.ContractAddress] = impl
+	}
+	return chain.Accessor(accessor)
+}
+
+// 使用临时keystore中新建的账户签名环路
+func (b *Backtester) unlockMiner() (string, error) {
+	keydir, err := ioutil.TempDir("", "lrc-backtest")
+	if nil != err {
+		return "", err
+	}
+	ks := keystore.NewKeyStore(keydir, keystore.LightScryptN, keystore.LightScryptP)
+	account, err := ks.NewAccount("")
+	if nil != err {
+		os.RemoveAll(keydir)
+		return "", err
+	}
+	crypto.Initialize(crypto.NewCrypto(true, ks))
+	if err := crypto.UnlockAccount(account, ""); nil != err {
+		os.RemoveAll(keydir)
+		return "", err
+	}
+	b.options.Miner = account.Address.Hex()
+	return keydir, nil
+}
+
+func addVolume(volumes map[string]*big.Int, token common.Address, amount *big.Int) {
+	symbol := util.AddressToAlias(token.Hex())
+	if "" == symbol {
+		symbol = token.Hex()
+	}
+	if v, ok := volumes[symbol]; ok {
+		v.Add(v, amount)
+	} else {
+		volumes[symbol] = new(big.Int).Set(amount)
+	}
+}
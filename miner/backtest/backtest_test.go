@@ -0,0 +1,227 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package backtest_test
+
+import (
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/miner/backtest"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+var (
+	testProtocol = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	testLrc      = common.HexToAddress("0x000000000000000000000000000000000000001c")
+	testWeth     = common.HexToAddress("0x000000000000000000000000000000000000000e")
+	testTokenA   = common.HexToAddress("0x000000000000000000000000000000000000000a")
+	testTokenB   = common.HexToAddress("0x000000000000000000000000000000000000000b")
+)
+
+// 只实现Run读取的方法
+type testRds struct {
+	dao.RdsService
+	blocks     []dao.Block
+	orders     []dao.Order
+	fills      []dao.FillEvent
+	ringMineds []dao.RingMinedEvent
+}
+
+func (rds *testRds) GetBlocksByNumberRange(from, to int64) ([]dao.Block, error) {
+	return rds.blocks, nil
+}
+
+func (rds *testRds) GetOrdersAliveBetween(fromTime, toTime int64) ([]dao.Order, error) {
+	return rds.orders, nil
+}
+
+func (rds *testRds) GetFillEventsByBlockRange(from, to int64) ([]dao.FillEvent, error) {
+	return rds.fills, nil
+}
+
+func (rds *testRds) GetCancelEventsByBlockRange(from, to int64) ([]dao.CancelEvent, error) {
+	return []dao.CancelEvent{}, nil
+}
+
+func (rds *testRds) GetRingMinedByBlockRange(from, to int64) ([]dao.RingMinedEvent, error) {
+	return rds.ringMineds, nil
+}
+
+func ether(amount int64) *big.Int {
+	return new(big.Int).Mul(big.NewInt(amount), big.NewInt(1e18))
+}
+
+func newTestOrder(t *testing.T, owner, tokenS, tokenB common.Address, amountS, amountB, lrcFee int64) dao.Order {
+	state := &types.OrderState{}
+	state.RawOrder.Protocol = testProtocol
+	state.RawOrder.Owner = owner
+	state.RawOrder.TokenS = tokenS
+	state.RawOrder.TokenB = tokenB
+	state.RawOrder.AmountS = ether(amountS)
+	state.RawOrder.AmountB = ether(amountB)
+	state.RawOrder.Timestamp = big.NewInt(1506014710)
+	state.RawOrder.Ttl = big.NewInt(3600)
+	state.RawOrder.Salt = big.NewInt(amountS)
+	state.RawOrder.LrcFee = ether(lrcFee)
+	state.RawOrder.MarginSplitPercentage = 100
+	state.RawOrder.GeneratePrice()
+	state.RawOrder.Hash = state.RawOrder.GenerateHash()
+	if err := state.RawOrder.GenerateAndSetSignature(owner); nil != err {
+		t.Fatal(err)
+	}
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	model := dao.Order{}
+	if err := model.ConvertDown(state); nil != err {
+		t.Fatal(err)
+	}
+	return model
+}
+
+func newTestFill(order dao.Order, blockNumber int64, amountS, amountB, lrcFee int64) dao.FillEvent {
+	return dao.FillEvent{
+		Protocol:    testProtocol.Hex(),
+		BlockNumber: blockNumber,
+		RingHash:    "0x01",
+		OrderHash:   order.OrderHash,
+		TokenS:      order.TokenS,
+		TokenB:      order.TokenB,
+		AmountS:     ether(amountS).String(),
+		AmountB:     ether(amountB).String(),
+		LrcFee:      ether(lrcFee).String(),
+		LrcReward:   "0",
+		SplitS:      "0",
+		SplitB:      "0",
+	}
+}
+
+func checkFloat(t *testing.T, name string, expect, got float64) {
+	if math.Abs(expect-got) > 1e-9 {
+		t.Errorf("%s expect:%f, got:%f", name, expect, got)
+	}
+}
+
+// 两个订单价格互为倒数，没有分润，手续费为每单10LRC；记录的余额中owner只有50个tokenB，
+// 因此第一个区块的环路只能成交一半，之后tokenB被模拟成交用完，不再有环路
+func TestBacktester_Run(t *testing.T) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+	cfg := config.LoadConfig("../../config/relay.toml")
+
+	dir, err := ioutil.TempDir("", "backtest-keystore")
+	if nil != err {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	ownerAcc, err := ks.NewAccount("1")
+	if nil != err {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock(ownerAcc, "1"); nil != err {
+		t.Fatal(err)
+	}
+	crypto.Initialize(crypto.NewCrypto(true, ks))
+	owner := ownerAcc.Address
+
+	util.AllTokens = map[string]types.Token{
+		"LRC":  {Protocol: testLrc, Symbol: "LRC"},
+		"WETH": {Protocol: testWeth, Symbol: "WETH"},
+	}
+	util.AllTokenPairs = []util.TokenPair{{TokenS: testTokenA, TokenB: testTokenB}}
+	mc := marketcap.NewMarketCapProvider(cfg.Miner)
+	mc.SetMarketCap(testLrc, 1)
+	mc.SetMarketCap(testWeth, 100)
+	mc.SetMarketCap(testTokenA, 1)
+	mc.SetMarketCap(testTokenB, 1)
+
+	sellA := newTestOrder(t, owner, testTokenA, testTokenB, 100, 100, 10)
+	sellB := newTestOrder(t, owner, testTokenB, testTokenA, 100, 100, 10)
+	rds := &testRds{
+		blocks: []dao.Block{
+			{BlockNumber: 100, BlockHash: "0x64", CreateTime: 1506014720},
+			{BlockNumber: 101, BlockHash: "0x65", CreateTime: 1506014730},
+			{BlockNumber: 102, BlockHash: "0x66", CreateTime: 1506014740},
+		},
+		orders: []dao.Order{sellA, sellB},
+		fills: []dao.FillEvent{
+			newTestFill(sellA, 101, 20, 20, 2),
+			newTestFill(sellB, 101, 20, 20, 2),
+		},
+		ringMineds: []dao.RingMinedEvent{{Protocol: testProtocol.Hex(), RingHash: "0x01", BlockNumber: 101}},
+	}
+
+	node := backtest.NewSimulatedChain(big.NewInt(0), big.NewInt(0))
+	nodeAccessor := newTestAccessor(t, node, testProtocol)
+	node.SetBalance(testTokenA, owner, ether(100))
+	node.SetAllowance(testTokenA, owner, ether(100))
+	node.SetBalance(testTokenB, owner, ether(50))
+	node.SetAllowance(testTokenB, owner, ether(100))
+
+	options := cfg.Miner
+	options.RingMaxLength = 2
+	options.GasLimit = 1000000
+	options.MinProfit = 0
+	commonOptions := cfg.Common
+	commonOptions.ProtocolImpl.Address = map[string]string{"v1.0": testProtocol.Hex()}
+
+	// gas成本为500000 * 20gwei = 0.01eth，eth价格为100
+	backtester := backtest.NewBacktester(options, commonOptions, rds, nodeAccessor, mc, big.NewInt(500000), big.NewInt(20000000000))
+	report, err := backtester.Run(100, 102)
+	if nil != err {
+		t.Fatal(err)
+	}
+
+	if report.Blocks != 3 || report.Orders != 2 {
+		t.Fatalf("blocks:%d orders:%d, expect 3 2", report.Blocks, report.Orders)
+	}
+	simulated := report.Simulated
+	if simulated.Rings != 1 || simulated.Orders != 2 {
+		t.Fatalf("simulated rings:%d orders:%d, expect 1 2", simulated.Rings, simulated.Orders)
+	}
+	for symbol, volume := range simulated.FillVolume {
+		if volume.Cmp(ether(50)) != 0 {
+			t.Errorf("simulated volume of %s expect:%s, got:%s", symbol, ether(50).String(), volume.String())
+		}
+	}
+	checkFloat(t, "simulated legalFee", 10, simulated.LegalFee)
+	checkFloat(t, "simulated gasCost", 1, simulated.GasCost)
+	checkFloat(t, "simulated profit", 9, simulated.Profit)
+
+	chain := report.Chain
+	if chain.Rings != 1 || chain.Orders != 2 {
+		t.Fatalf("chain rings:%d orders:%d, expect 1 2", chain.Rings, chain.Orders)
+	}
+	checkFloat(t, "chain legalFee", 4, chain.LegalFee)
+	checkFloat(t, "chain gasCost", 1, chain.GasCost)
+	checkFloat(t, "chain profit", 3, chain.Profit)
+}
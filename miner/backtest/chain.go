@@ -0,0 +1,188 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package backtest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+	"sync"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// SimulatedChain 代替以太坊节点，按回放到当前区块的状态响应eth_call等请求，供EthNodeAccessor使用
+type SimulatedChain struct {
+	accessor          *ethaccessor.EthNodeAccessor
+	mtx               sync.RWMutex
+	blockNumber       *big.Int
+	gas               *big.Int
+	gasPrice          *big.Int
+	balances          map[common.Address]map[common.Address]*big.Int //token -> owner -> amount
+	allowances        map[common.Address]map[common.Address]*big.Int
+	spent             map[common.Address]map[common.Address]*big.Int //回测中模拟成交卖出的量，从链上记录的余额以及授权中扣除
+	cancelledOrFilled map[common.Hash]*big.Int
+}
+
+func NewSimulatedChain(gas, gasPrice *big.Int) *SimulatedChain {
+	return &SimulatedChain{
+		blockNumber:       big.NewInt(0),
+		gas:               gas,
+		gasPrice:          gasPrice,
+		balances:          make(map[common.Address]map[common.Address]*big.Int),
+		allowances:        make(map[common.Address]map[common.Address]*big.Int),
+		spent:             make(map[common.Address]map[common.Address]*big.Int),
+		cancelledOrFilled: make(map[common.Hash]*big.Int),
+	}
+}
+
+// Accessor 返回通过进程内rpc连接到模拟链的accessor，abi以及协议地址由调用方设置
+func (chain *SimulatedChain) Accessor(accessor *ethaccessor.EthNodeAccessor) (*ethaccessor.EthNodeAccessor, error) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &SimulatedEthApi{chain: chain}); nil != err {
+		return nil, err
+	}
+	accessor.Client = rpc.DialInProc(server)
+	chain.accessor = accessor
+	return accessor, nil
+}
+
+func (chain *SimulatedChain) SetBlockNumber(blockNumber *big.Int) {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+	chain.blockNumber = new(big.Int).Set(blockNumber)
+}
+
+func (chain *SimulatedChain) SetBalance(token, owner common.Address, amount *big.Int) {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+	setAmount(chain.balances, token, owner, amount)
+}
+
+func (chain *SimulatedChain) SetAllowance(token, owner common.Address, amount *big.Int) {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+	setAmount(chain.allowances, token, owner, amount)
+}
+
+func (chain *SimulatedChain) AddSpent(token, owner common.Address, amount *big.Int) {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+	spent := getAmount(chain.spent, token, owner)
+	setAmount(chain.spent, token, owner, spent.Add(spent, amount))
+}
+
+func (chain *SimulatedChain) AddCancelledOrFilled(orderhash common.Hash, amount *big.Int) {
+	chain.mtx.Lock()
+	defer chain.mtx.Unlock()
+	if v, ok := chain.cancelledOrFilled[orderhash]; ok {
+		v.Add(v, amount)
+	} else {
+		chain.cancelledOrFilled[orderhash] = new(big.Int).Set(amount)
+	}
+}
+
+func (chain *SimulatedChain) balanceOf(token, owner common.Address) *big.Int {
+	return chain.unspent(getAmount(chain.balances, token, owner), token, owner)
+}
+
+func (chain *SimulatedChain) allowance(token, owner common.Address) *big.Int {
+	return chain.unspent(getAmount(chain.allowances, token, owner), token, owner)
+}
+
+func (chain *SimulatedChain) unspent(amount *big.Int, token, owner common.Address) *big.Int {
+	amount.Sub(amount, getAmount(chain.spent, token, owner))
+	if amount.Sign() < 0 {
+		amount.SetInt64(0)
+	}
+	return amount
+}
+
+func setAmount(amounts map[common.Address]map[common.Address]*big.Int, token, owner common.Address, amount *big.Int) {
+	if _, ok := amounts[token]; !ok {
+		amounts[token] = make(map[common.Address]*big.Int)
+	}
+	amounts[token][owner] = new(big.Int).Set(amount)
+}
+
+func getAmount(amounts map[common.Address]map[common.Address]*big.Int, token, owner common.Address) *big.Int {
+	if ownerAmounts, ok := amounts[token]; ok {
+		if amount, ok := ownerAmounts[owner]; ok {
+			return new(big.Int).Set(amount)
+		}
+	}
+	return big.NewInt(0)
+}
+
+// SimulatedEthApi 是eth namespace的实现，rpc要求注册的类型导出，只支持matcher、evaluator以及submitter用到的方法
+type SimulatedEthApi struct {
+	chain *SimulatedChain
+}
+
+func (api *SimulatedEthApi) BlockNumber() (string, error) {
+	api.chain.mtx.RLock()
+	defer api.chain.mtx.RUnlock()
+	return types.BigintToHex(api.chain.blockNumber), nil
+}
+
+func (api *SimulatedEthApi) GasPrice() (string, error) {
+	return types.BigintToHex(api.chain.gasPrice), nil
+}
+
+func (api *SimulatedEthApi) EstimateGas(arg ethaccessor.CallArg) (string, error) {
+	return types.BigintToHex(api.chain.gas), nil
+}
+
+func (api *SimulatedEthApi) Call(arg ethaccessor.CallArg, blockParameter string) (string, error) {
+	chain := api.chain
+	chain.mtx.RLock()
+	defer chain.mtx.RUnlock()
+
+	data := common.FromHex(arg.Data)
+	if len(data) < 4 {
+		return "", errors.New("backtest,invalid call data")
+	}
+	selector, args := data[:4], data[4:]
+	word := func(i int) []byte {
+		if len(args) < 32*(i+1) {
+			return make([]byte, 32)
+		}
+		return args[32*i : 32*(i+1)]
+	}
+
+	accessor := chain.accessor
+	switch {
+	case bytes.Equal(selector, accessor.Erc20Abi.Methods["balanceOf"].Id()):
+		return types.BigintToHex(chain.balanceOf(arg.To, common.BytesToAddress(word(0)))), nil
+	case bytes.Equal(selector, accessor.Erc20Abi.Methods["allowance"].Id()):
+		return types.BigintToHex(chain.allowance(arg.To, common.BytesToAddress(word(0)))), nil
+	case bytes.Equal(selector, accessor.ProtocolImplAbi.Methods["cancelledOrFilled"].Id()):
+		if amount, ok := chain.cancelledOrFilled[common.BytesToHash(word(0))]; ok {
+			return types.BigintToHex(amount), nil
+		}
+		return types.BigintToHex(big.NewInt(0)), nil
+	case bytes.Equal(selector, accessor.ProtocolImplAbi.Methods["cutoffs"].Id()):
+		return types.BigintToHex(big.NewInt(0)), nil
+	}
+	return "", fmt.Errorf("backtest,unsupported call:%s", common.ToHex(selector))
+}
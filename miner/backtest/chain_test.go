@@ -0,0 +1,94 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package backtest_test
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/miner/backtest"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const testErc20Abi = `[{"constant":true,"inputs":[{"name":"_owner","type":"address"}],"name":"balanceOf","outputs":[{"name":"balance","type":"uint256"}],"payable":false,"type":"function"},{"constant":true,"inputs":[{"name":"_owner","type":"address"},{"name":"_spender","type":"address"}],"name":"allowance","outputs":[{"name":"remaining","type":"uint256"}],"payable":false,"type":"function"}]`
+
+const testProtocolImplAbi = `[{"constant":true,"inputs":[{"name":"","type":"bytes32"}],"name":"cancelledOrFilled","outputs":[{"name":"","type":"uint256"}],"payable":false,"type":"function"},{"constant":true,"inputs":[{"name":"","type":"address"}],"name":"cutoffs","outputs":[{"name":"","type":"uint256"}],"payable":false,"type":"function"}]`
+
+func newTestAccessor(t *testing.T, chain *backtest.SimulatedChain, protocol common.Address) *ethaccessor.EthNodeAccessor {
+	var err error
+	accessor := &ethaccessor.EthNodeAccessor{}
+	if accessor.Erc20Abi, err = ethaccessor.NewAbi(testErc20Abi); nil != err {
+		t.Fatal(err)
+	}
+	if accessor.ProtocolImplAbi, err = ethaccessor.NewAbi(testProtocolImplAbi); nil != err {
+		t.Fatal(err)
+	}
+	accessor.ProtocolAddresses = map[common.Address]*ethaccessor.ProtocolAddress{
+		protocol: {Version: "v1.0", ContractAddress: protocol},
+	}
+	if _, err = chain.Accessor(accessor); nil != err {
+		t.Fatal(err)
+	}
+	return accessor
+}
+
+func TestSimulatedChain(t *testing.T) {
+	chain := backtest.NewSimulatedChain(big.NewInt(500000), big.NewInt(20000000000))
+	token := common.HexToAddress("0xef68e7c694f40c8202821edf525de3782458639f")
+	owner := common.HexToAddress("0xb1018949b241d76a1ab2094f473e9befeabb5ead")
+	spender := common.HexToAddress("0x5567ee920f7e62274284985d793344351a00142b")
+	protocol := common.HexToAddress("0x03e0f73a93993e5101362656af1162ed80fb5dc4")
+	orderhash := common.HexToHash("0x1a2b3c")
+	accessor := newTestAccessor(t, chain, protocol)
+
+	chain.SetBlockNumber(big.NewInt(100))
+	chain.SetBalance(token, owner, big.NewInt(1000))
+	chain.AddCancelledOrFilled(orderhash, big.NewInt(10))
+	chain.AddCancelledOrFilled(orderhash, big.NewInt(5))
+
+	if balance, err := accessor.Erc20Balance(token, owner, "latest"); nil != err || balance.Int64() != 1000 {
+		t.Fatalf("balance:%v err:%v", balance, err)
+	}
+	if allowance, err := accessor.Erc20Allowance(token, owner, spender, "latest"); nil != err || allowance.Sign() != 0 {
+		t.Fatalf("allowance of unrecorded account should be 0, allowance:%v err:%v", allowance, err)
+	}
+	if amount, err := accessor.GetCancelledOrFilled(protocol, orderhash, "latest"); nil != err || amount.Int64() != 15 {
+		t.Fatalf("cancelledOrFilled:%v err:%v", amount, err)
+	}
+
+	reqs := []*ethaccessor.BatchErc20Req{{Owner: owner, Token: token, Spender: spender, BlockParameter: "latest"}}
+	if err := accessor.BatchErc20BalanceAndAllowance(reqs); nil != err || nil != reqs[0].BalanceErr || reqs[0].Balance.Int64() != 1000 {
+		t.Fatalf("batch balance:%v err:%v", reqs[0].Balance.BigInt(), err)
+	}
+
+	chain.SetAllowance(token, owner, big.NewInt(300))
+	chain.AddSpent(token, owner, big.NewInt(400))
+	if balance, err := accessor.Erc20Balance(token, owner, "latest"); nil != err || balance.Int64() != 600 {
+		t.Fatalf("balance after spent:%v err:%v", balance, err)
+	}
+	if allowance, err := accessor.Erc20Allowance(token, owner, spender, "latest"); nil != err || allowance.Sign() != 0 {
+		t.Fatalf("allowance after spent:%v err:%v", allowance, err)
+	}
+
+	gas, gasPrice, err := accessor.EstimateGas([]byte{}, protocol)
+	if nil != err || gas.Int64() != 500000 || gasPrice.Int64() != 20000000000 {
+		t.Fatalf("gas:%v gasPrice:%v err:%v", gas, gasPrice, err)
+	}
+}
@@ -0,0 +1,288 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package backtest
+
+import (
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var errNotSupported = errors.New("backtest,not supported")
+
+// replayOrderManager 实现ordermanager.OrderManager，订单的成交以及取消量来自回放到当前区块的链上事件
+type replayOrderManager struct {
+	accessor  *ethaccessor.EthNodeAccessor
+	mc        *marketcap.MarketCapProvider
+	chain     *SimulatedChain
+	mtx       sync.RWMutex
+	orders    map[common.Hash]*types.OrderState
+	blockTime int64
+}
+
+func newReplayOrderManager(accessor *ethaccessor.EthNodeAccessor, mc *marketcap.MarketCapProvider, chain *SimulatedChain) *replayOrderManager {
+	return &replayOrderManager{
+		accessor: accessor,
+		mc:       mc,
+		chain:    chain,
+		orders:   make(map[common.Hash]*types.OrderState),
+	}
+}
+
+// addOrder 订单的成交以及取消量清零，由回放的事件重新累计
+func (om *replayOrderManager) addOrder(model dao.Order) {
+	state := &types.OrderState{}
+	model.ConvertUp(state)
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	om.orders[state.RawOrder.Hash] = state
+}
+
+func (om *replayOrderManager) setBlockTime(blockTime int64) {
+	om.mtx.Lock()
+	defer om.mtx.Unlock()
+	om.blockTime = blockTime
+}
+
+type account struct {
+	owner    common.Address
+	token    common.Address
+	protocol common.Address
+}
+
+// accounts 返回当前区块时间有效且未完全成交的订单的owner以及tokenS，用于加载链上记录的余额和授权
+func (om *replayOrderManager) accounts() []account {
+	om.mtx.RLock()
+	defer om.mtx.RUnlock()
+
+	loaded := make(map[common.Address]map[common.Address]bool)
+	accounts := []account{}
+	for _, state := range om.orders {
+		order := state.RawOrder
+		if order.Timestamp.Int64() > om.blockTime || order.Timestamp.Int64()+order.Ttl.Int64() < om.blockTime {
+			continue
+		}
+		if om.IsOrderFullFinished(state) {
+			continue
+		}
+		if _, ok := loaded[order.TokenS]; !ok {
+			loaded[order.TokenS] = make(map[common.Address]bool)
+		}
+		if loaded[order.TokenS][order.Owner] {
+			continue
+		}
+		loaded[order.TokenS][order.Owner] = true
+		accounts = append(accounts, account{owner: order.Owner, token: order.TokenS, protocol: order.Protocol})
+	}
+	return accounts
+}
+
+func (om *replayOrderManager) applyFill(fill dao.FillEvent) {
+	om.mtx.Lock()
+	defer om.mtx.Unlock()
+
+	state, ok := om.orders[common.HexToHash(fill.OrderHash)]
+	if !ok {
+		return
+	}
+	amountS, _ := new(big.Int).SetString(fill.AmountS, 0)
+	amountB, _ := new(big.Int).SetString(fill.AmountB, 0)
+	if nil == amountS || nil == amountB {
+		return
+	}
+	state.DealtAmountS.Add(state.DealtAmountS, amountS)
+	state.DealtAmountB.Add(state.DealtAmountB, amountB)
+	if state.RawOrder.BuyNoMoreThanAmountB {
+		om.chain.AddCancelledOrFilled(state.RawOrder.Hash, amountB)
+	} else {
+		om.chain.AddCancelledOrFilled(state.RawOrder.Hash, amountS)
+	}
+}
+
+func (om *replayOrderManager) applyCancel(cancel dao.CancelEvent) {
+	om.mtx.Lock()
+	defer om.mtx.Unlock()
+
+	state, ok := om.orders[common.HexToHash(cancel.OrderHash)]
+	if !ok {
+		return
+	}
+	amount, _ := new(big.Int).SetString(cancel.AmountCancelled, 0)
+	if nil == amount {
+		return
+	}
+	if state.RawOrder.BuyNoMoreThanAmountB {
+		state.CancelledAmountB.Add(state.CancelledAmountB, amount)
+	} else {
+		state.CancelledAmountS.Add(state.CancelledAmountS, amount)
+	}
+	om.chain.AddCancelledOrFilled(state.RawOrder.Hash, amount)
+}
+
+func (om *replayOrderManager) Start() {}
+
+func (om *replayOrderManager) Stop() {}
+
+// MinerOrders 返回当前区块时间有效的订单的副本，matcher会修改其中的成交量
+func (om *replayOrderManager) MinerOrders(protocol, tokenS, tokenB common.Address, length int, filterOrderhashs []common.Hash) []*types.OrderState {
+	om.mtx.RLock()
+	filters := make(map[common.Hash]bool)
+	for _, h := range filterOrderhashs {
+		filters[h] = true
+	}
+	candidates := []*types.OrderState{}
+	for hash, state := range om.orders {
+		order := state.RawOrder
+		if filters[hash] || order.Protocol != protocol || order.TokenS != tokenS || order.TokenB != tokenB {
+			continue
+		}
+		if order.Timestamp.Int64() > om.blockTime || order.Timestamp.Int64()+order.Ttl.Int64() < om.blockTime {
+			continue
+		}
+		if om.IsOrderFullFinished(state) {
+			continue
+		}
+		candidates = append(candidates, copyOrderState(state))
+	}
+	om.mtx.RUnlock()
+
+	sort.Slice(candidates, func(i, j int) bool {
+		pi, pj := candidates[i].RawOrder.Price, candidates[j].RawOrder.Price
+		if nil == pi || nil == pj {
+			return candidates[i].RawOrder.Hash.Hex() < candidates[j].RawOrder.Hash.Hex()
+		}
+		return pi.Cmp(pj) > 0
+	})
+	if len(candidates) > length {
+		candidates = candidates[:length]
+	}
+
+	implAddress, ok := om.accessor.ProtocolAddresses[protocol]
+	if !ok || len(candidates) == 0 {
+		return []*types.OrderState{}
+	}
+	reqs := []*ethaccessor.BatchErc20Req{}
+	for _, state := range candidates {
+		reqs = append(reqs, &ethaccessor.BatchErc20Req{
+			Owner:          state.RawOrder.Owner,
+			Token:          state.RawOrder.TokenS,
+			Spender:        implAddress.DelegateAddress,
+			BlockParameter: "latest",
+		})
+	}
+	if err := om.accessor.BatchErc20BalanceAndAllowance(reqs); nil != err {
+		return []*types.OrderState{}
+	}
+
+	list := []*types.OrderState{}
+	for idx, req := range reqs {
+		if nil != req.BalanceErr || nil != req.AllowanceErr {
+			continue
+		}
+		state := candidates[idx]
+		available := new(big.Int).Sub(state.RawOrder.AmountS, new(big.Int).Add(state.DealtAmountS, state.CancelledAmountS))
+		if available.Cmp(req.Balance.BigInt()) > 0 {
+			available = new(big.Int).Set(req.Balance.BigInt())
+		}
+		if available.Cmp(req.Allowance.BigInt()) > 0 {
+			available = new(big.Int).Set(req.Allowance.BigInt())
+		}
+		state.AvailableAmountS = available
+		value := new(big.Rat).Mul(om.mc.GetMarketCap(state.RawOrder.TokenS), new(big.Rat).SetInt(available))
+		if value.Cmp(big.NewRat(1, 1)) > 0 {
+			list = append(list, state)
+		}
+	}
+	return list
+}
+
+// 与OrderManagerImpl一致，剩余量的法币价值不大于1时视为完全成交
+func (om *replayOrderManager) IsOrderFullFinished(state *types.OrderState) bool {
+	var remain *big.Rat
+	if state.RawOrder.BuyNoMoreThanAmountB {
+		remainAmountB := new(big.Int).Sub(state.RawOrder.AmountB, new(big.Int).Add(state.DealtAmountB, state.CancelledAmountB))
+		remain = new(big.Rat).Mul(om.mc.GetMarketCap(state.RawOrder.TokenB), new(big.Rat).SetInt(remainAmountB))
+	} else {
+		remainAmountS := new(big.Int).Sub(state.RawOrder.AmountS, new(big.Int).Add(state.DealtAmountS, state.CancelledAmountS))
+		remain = new(big.Rat).Mul(om.mc.GetMarketCap(state.RawOrder.TokenS), new(big.Rat).SetInt(remainAmountS))
+	}
+	return remain.Cmp(big.NewRat(1, 1)) <= 0
+}
+
+func (om *replayOrderManager) GetOrderBook(protocol, tokenS, tokenB common.Address, length int) ([]types.OrderState, error) {
+	return nil, errNotSupported
+}
+
+func (om *replayOrderManager) GetOrders(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error) {
+	return dao.PageResult{}, errNotSupported
+}
+
+func (om *replayOrderManager) GetOrderByHash(hash common.Hash) (*types.OrderState, error) {
+	om.mtx.RLock()
+	defer om.mtx.RUnlock()
+	if state, ok := om.orders[hash]; ok {
+		return copyOrderState(state), nil
+	}
+	return nil, errors.New("backtest,order not found")
+}
+
+func (om *replayOrderManager) UpdateBroadcastTimeByHash(hash common.Hash, bt int) error {
+	return errNotSupported
+}
+
+func (om *replayOrderManager) FillsPageQuery(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error) {
+	return dao.PageResult{}, errNotSupported
+}
+
+func (om *replayOrderManager) RingMinedPageQuery(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error) {
+	return dao.PageResult{}, errNotSupported
+}
+
+func (om *replayOrderManager) IsOrderCutoff(owner common.Address, createTime *big.Int) bool {
+	return false
+}
+
+func (om *replayOrderManager) SoftCancelOrder(cancellation *types.OrderCancellation) error {
+	return errNotSupported
+}
+
+func (om *replayOrderManager) CountOpenOrders(owner, tokenS, tokenB common.Address) (int, error) {
+	return 0, errNotSupported
+}
+
+func copyOrderState(state *types.OrderState) *types.OrderState {
+	s := *state
+	s.DealtAmountS = new(big.Int).Set(state.DealtAmountS)
+	s.DealtAmountB = new(big.Int).Set(state.DealtAmountB)
+	s.CancelledAmountS = new(big.Int).Set(state.CancelledAmountS)
+	s.CancelledAmountB = new(big.Int).Set(state.CancelledAmountB)
+	if nil != state.AvailableAmountS {
+		s.AvailableAmountS = new(big.Int).Set(state.AvailableAmountS)
+	}
+	return &s
+}
@@ -20,148 +20,220 @@ package miner
 
 import (
 	"errors"
+	"fmt"
 	"github.com/Loopring/relay/ethaccessor"
 	"github.com/Loopring/relay/log"
 	"github.com/Loopring/relay/marketcap"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/common"
-	"math"
 	"math/big"
 )
 
+// 与合约中的常量保持一致
+const (
+	RateRatioScale            = 10000 //RATE_RATIO_SCALE
+	MarginSplitPercentageBase = 100   //MARGIN_SPLIT_PERCENTAGE_BASE
+)
+
+// 折价比例的精度，ReducedRate = 开方结果 / RateScale
+var RateScale = new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+
 type Evaluator struct {
 	marketCapProvider     *marketcap.MarketCapProvider
 	rateRatioCVSThreshold int64
 	accessor              *ethaccessor.EthNodeAccessor
 }
 
-func availableAmountS(filledOrder *types.FilledOrder) error {
-	filledOrder.AvailableAmountS, filledOrder.AvailableAmountB = filledOrder.OrderState.RemainedAmount()
-	sellPrice := new(big.Rat).SetFrac(filledOrder.OrderState.RawOrder.AmountS, filledOrder.OrderState.RawOrder.AmountB)
+// 合约计算成交量时使用的中间状态，全部为整数
+type fillState struct {
+	filledOrder      *types.FilledOrder
+	rateAmountS      *big.Int
+	availableAmountB *big.Int
+	fillAmountS      *big.Int
+	fillAmountB      *big.Int
+	lrcFee           *big.Int
+}
 
-	if filledOrder.OrderState.RawOrder.BuyNoMoreThanAmountB {
-		filledOrder.AvailableAmountS.Mul(filledOrder.AvailableAmountB, sellPrice)
+// 与合约相同，按照剩余量缩放订单，buyNoMoreThanAmountB时以amountB为准
+func availableAmount(orderState *types.OrderState) (availableAmountS, availableAmountB *big.Int) {
+	order := orderState.RawOrder
+	if order.BuyNoMoreThanAmountB {
+		availableAmountB = new(big.Int).Set(order.AmountB)
+		subIfNotNil(availableAmountB, orderState.DealtAmountB)
+		subIfNotNil(availableAmountB, orderState.CancelledAmountB)
+		availableAmountS = new(big.Int).Mul(availableAmountB, order.AmountS)
+		availableAmountS.Quo(availableAmountS, order.AmountB)
 	} else {
-		filledOrder.AvailableAmountB.Mul(filledOrder.AvailableAmountB, new(big.Rat).Inv(sellPrice))
+		availableAmountS = new(big.Int).Set(order.AmountS)
+		subIfNotNil(availableAmountS, orderState.DealtAmountS)
+		subIfNotNil(availableAmountS, orderState.CancelledAmountS)
+		availableAmountB = new(big.Int).Mul(availableAmountS, order.AmountB)
+		availableAmountB.Quo(availableAmountB, order.AmountS)
 	}
-
-	return nil
+	return availableAmountS, availableAmountB
 }
 
-func (e *Evaluator) ComputeRing(ringState *types.Ring) error {
-
-	ringState.LegalFee = new(big.Rat)
-
-	productAmountS := big.NewRat(int64(1), int64(1))
-	productAmountB := big.NewRat(int64(1), int64(1))
-
-	//compute price
-	for _, order := range ringState.Orders {
-		amountS := new(big.Rat).SetInt(order.OrderState.RawOrder.AmountS)
-		amountB := new(big.Rat).SetInt(order.OrderState.RawOrder.AmountB)
+func subIfNotNil(x, y *big.Int) {
+	if nil != y {
+		x.Sub(x, y)
+	}
+}
 
-		productAmountS.Mul(productAmountS, amountS)
-		productAmountB.Mul(productAmountB, amountB)
+// NthRoot returns the largest integer r such that r^n <= x
+func NthRoot(x *big.Int, n int) *big.Int {
+	if x.Sign() <= 0 || n <= 0 {
+		return big.NewInt(0)
+	}
+	if n == 1 {
+		return new(big.Int).Set(x)
+	}
+	bigN := big.NewInt(int64(n))
+	bigN1 := big.NewInt(int64(n - 1))
+	//2^ceil(bitlen/n) >= root，牛顿迭代单调递减直到收敛
+	r := new(big.Int).Lsh(big.NewInt(1), uint((x.BitLen()+n-1)/n))
+	for {
+		next := new(big.Int).Exp(r, bigN1, nil)
+		next.Quo(x, next)
+		next.Add(next, new(big.Int).Mul(r, bigN1))
+		next.Quo(next, bigN)
+		if next.Cmp(r) >= 0 {
+			return r
+		}
+		r = next
+	}
+}
 
-		order.SPrice = new(big.Rat)
-		order.SPrice.Quo(amountS, amountB)
+// ComputeFillAmounts 按照合约的整数运算规则计算rateAmountS、成交量、lrcFee以及分润，所有除法均向下取整
+func ComputeFillAmounts(ringState *types.Ring) error {
+	ringSize := len(ringState.Orders)
+	if ringSize < 2 {
+		return errors.New("miner,ring must contain at least two orders")
+	}
 
-		order.BPrice = new(big.Rat)
-		order.BPrice.Quo(amountB, amountS)
+	productAmountS := big.NewInt(1)
+	productAmountB := big.NewInt(1)
+	for _, filledOrder := range ringState.Orders {
+		productAmountS.Mul(productAmountS, filledOrder.OrderState.RawOrder.AmountS)
+		productAmountB.Mul(productAmountB, filledOrder.OrderState.RawOrder.AmountB)
+	}
+	if productAmountS.Cmp(productAmountB) < 0 {
+		return errors.New("miner,the price of ring is invalid")
 	}
 
-	productPrice := new(big.Rat)
-	productPrice.Quo(productAmountS, productAmountB)
-	//todo:change pow to big.Int
-	priceOfFloat, _ := productPrice.Float64()
-	rootOfRing := math.Pow(priceOfFloat, 1/float64(len(ringState.Orders)))
-	rate := new(big.Rat).SetFloat64(rootOfRing)
-	ringState.ReducedRate = new(big.Rat)
-	ringState.ReducedRate.Inv(rate)
-	log.Debugf("miner,rate:%s, priceFloat:%f , len:%d, rootOfRing:%f, reducedRate:%s ", rate.String(), priceOfFloat, len(ringState.Orders), rootOfRing, ringState.ReducedRate.RatString())
-
-	//todo:get the fee for select the ring of mix income
-	//LRC等比例下降，首先需要计算fillAmountS
-	//分润的fee，首先需要计算fillAmountS，fillAmountS取决于整个环路上的完全匹配的订单
-	//如何计算最小成交量的订单，计算下一次订单的卖出或买入，然后根据比例替换
-	minVolumeIdx := 0
+	//reducedRate = (productAmountB/productAmountS)^(1/n)，放大RateScale^n倍后开方，向下取整保证rateAmountS不超过amountS
+	scaledRate := new(big.Int).Exp(RateScale, big.NewInt(int64(ringSize)), nil)
+	scaledRate.Mul(scaledRate, productAmountB).Quo(scaledRate, productAmountS)
+	reducedRate := NthRoot(scaledRate, ringSize)
+	ringState.ReducedRate = new(big.Rat).SetFrac(reducedRate, RateScale)
+	log.Debugf("miner,ring:%s len:%d, reducedRate:%s", ringState.Hash.Hex(), ringSize, ringState.ReducedRate.FloatString(18))
 
+	states := make([]*fillState, ringSize)
 	for idx, filledOrder := range ringState.Orders {
-		filledOrder.SPrice.Mul(filledOrder.SPrice, ringState.ReducedRate)
+		order := filledOrder.OrderState.RawOrder
+		rateAmountS := new(big.Int).Mul(order.AmountS, reducedRate)
+		rateAmountS.Quo(rateAmountS, RateScale)
+		if rateAmountS.Sign() <= 0 {
+			return fmt.Errorf("miner,rateAmountS of order:%s is zero", order.Hash.Hex())
+		}
+		availableAmountS, availableAmountB := availableAmount(&filledOrder.OrderState)
+		//与合约一致，卖出量不能超过余额与授权
+		if spendable := filledOrder.OrderState.AvailableAmountS; nil != spendable && availableAmountS.Cmp(spendable) > 0 {
+			availableAmountS = new(big.Int).Set(spendable)
+		}
+		if availableAmountS.Sign() <= 0 || availableAmountB.Sign() <= 0 {
+			return fmt.Errorf("miner,order:%s has been finished", order.Hash.Hex())
+		}
 
-		filledOrder.BPrice.Inv(filledOrder.SPrice)
+		filledOrder.RateAmountS = new(big.Rat).SetInt(rateAmountS)
+		filledOrder.SPrice = new(big.Rat).SetFrac(rateAmountS, order.AmountB)
+		filledOrder.BPrice = new(big.Rat).SetFrac(order.AmountB, rateAmountS)
+		filledOrder.AvailableAmountS = new(big.Rat).SetInt(availableAmountS)
+		filledOrder.AvailableAmountB = new(big.Rat).SetInt(availableAmountB)
+		states[idx] = &fillState{
+			filledOrder:      filledOrder,
+			rateAmountS:      rateAmountS,
+			availableAmountB: availableAmountB,
+			fillAmountS:      availableAmountS,
+		}
+	}
 
-		//todo:当以Sell为基准时，考虑账户余额、订单剩余金额的最小值
-		if err := availableAmountS(filledOrder); nil != err {
+	//与合约calculateRingFillAmount一致，先找到最小成交量的订单，再从头修正之前的订单
+	smallestIdx := 0
+	for i := 0; i < ringSize; i++ {
+		j := (i + 1) % ringSize
+		smallestIdx = calculateOrderFillAmount(states[i], states[j], i, j, smallestIdx)
+	}
+	for i := 0; i < smallestIdx; i++ {
+		calculateOrderFillAmount(states[i], states[(i+1)%ringSize], 0, 0, 0)
+	}
+
+	for idx, state := range states {
+		next := states[(idx+1)%ringSize]
+		split, err := calculateSplit(state, next)
+		if nil != err {
 			return err
 		}
-		amountS := new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS)
-		amountB := new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB)
-
-		//根据用户设置，判断是以卖还是买为基准
-		//买入不超过amountB
-		filledOrder.RateAmountS = new(big.Rat).Set(amountS)
-		filledOrder.RateAmountS.Mul(amountS, ringState.ReducedRate)
-		//if BuyNoMoreThanAmountB , AvailableAmountS need to be reduced by the ratePrice
-		if filledOrder.OrderState.RawOrder.BuyNoMoreThanAmountB {
-			availbleAmountB := new(big.Rat).Set(filledOrder.AvailableAmountB)
-			availableAmountS := new(big.Rat).Mul(filledOrder.RateAmountS, availbleAmountB)
-			availableAmountS.Quo(availableAmountS, amountB)
-			if filledOrder.AvailableAmountB.Cmp(new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB)) < 0 {
-				filledOrder.AvailableAmountS.Set(availableAmountS)
-			}
-		}
+		state.filledOrder.FillAmountS = new(big.Rat).SetInt(state.fillAmountS)
+		state.filledOrder.FillAmountB = new(big.Rat).SetInt(state.fillAmountB)
+		state.filledOrder.LrcFee = new(big.Rat).SetInt(state.lrcFee)
+		state.filledOrder.FeeS = new(big.Rat).SetInt(split)
+	}
+	return nil
+}
 
-		//与上一订单的买入进行比较
-		var lastOrder *types.FilledOrder
-		if idx > 0 {
-			lastOrder = ringState.Orders[idx-1]
+func calculateOrderFillAmount(state, next *fillState, i, j, smallestIdx int) int {
+	newSmallestIdx := smallestIdx
+	order := state.filledOrder.OrderState.RawOrder
+	state.fillAmountB = new(big.Int).Mul(state.fillAmountS, order.AmountB)
+	state.fillAmountB.Quo(state.fillAmountB, state.rateAmountS)
+	if order.BuyNoMoreThanAmountB {
+		if state.fillAmountB.Cmp(state.availableAmountB) > 0 {
+			state.fillAmountB = new(big.Int).Set(state.availableAmountB)
+			state.fillAmountS = new(big.Int).Mul(state.fillAmountB, state.rateAmountS)
+			state.fillAmountS.Quo(state.fillAmountS, order.AmountB)
+			newSmallestIdx = i
 		}
+		state.lrcFee = new(big.Int).Mul(order.LrcFee, state.fillAmountB)
+		state.lrcFee.Quo(state.lrcFee, order.AmountB)
+	} else {
+		state.lrcFee = new(big.Int).Mul(order.LrcFee, state.fillAmountS)
+		state.lrcFee.Quo(state.lrcFee, order.AmountS)
+	}
 
-		filledOrder.FillAmountS = new(big.Rat)
-		if lastOrder != nil && lastOrder.FillAmountB.Cmp(filledOrder.AvailableAmountS) >= 0 {
-			//当前订单为最小订单
-			filledOrder.FillAmountS.Set(filledOrder.AvailableAmountS)
-			minVolumeIdx = idx
-			//根据minVolumeIdx进行最小交易量的计算,两个方向进行
-		} else if lastOrder == nil {
-			filledOrder.FillAmountS.Set(filledOrder.AvailableAmountS)
-		} else {
-			//上一订单为最小订单需要对remainAmountS进行折扣计算
-			filledOrder.FillAmountS.Set(lastOrder.FillAmountB)
-		}
-		filledOrder.FillAmountB = new(big.Rat).Mul(filledOrder.FillAmountS, filledOrder.BPrice)
+	if state.fillAmountB.Cmp(next.fillAmountS) <= 0 {
+		next.fillAmountS = new(big.Int).Set(state.fillAmountB)
+	} else {
+		newSmallestIdx = j
 	}
+	return newSmallestIdx
+}
 
-	//compute the volume of the ring by the min volume
-	//todo:the first and the last
-	//if (ring.RawRing.Orders[len(ring.RawRing.Orders) - 1].FillAmountB.Cmp(ring.RawRing.Orders[0].FillAmountS) < 0) {
-	//	minVolumeIdx = len(ring.RawRing.Orders) - 1
-	//	for i := minVolumeIdx-1; i >= 0; i-- {
-	//		//按照前面的，同步减少交易量
-	//		order := ring.RawRing.Orders[i]
-	//		var nextOrder *types.FilledOrder
-	//		nextOrder = ring.RawRing.Orders[i + 1]
-	//		order.FillAmountB = nextOrder.FillAmountS
-	//		order.FillAmountS.Mul(order.FillAmountB, order.EnlargedSPrice)
-	//	}
-	//}
-
-	for i := minVolumeIdx - 1; i >= 0; i-- {
-		//按照前面的，同步减少交易量
-		order := ringState.Orders[i]
-		var nextOrder *types.FilledOrder
-		nextOrder = ringState.Orders[i+1]
-		order.FillAmountB = nextOrder.FillAmountS
-		order.FillAmountS.Mul(order.FillAmountB, order.SPrice)
+// 分润，buyNoMoreThanAmountB时为tokenS，否则为tokenB；lrcFee为0时只能选择分润且比例为100%
+func calculateSplit(state, next *fillState) (*big.Int, error) {
+	order := state.filledOrder.OrderState.RawOrder
+	split := new(big.Int)
+	if order.BuyNoMoreThanAmountB {
+		split.Mul(next.fillAmountS, order.AmountS).Quo(split, order.AmountB)
+		split.Sub(split, state.fillAmountS)
+	} else {
+		split.Mul(state.fillAmountS, order.AmountB).Quo(split, order.AmountS)
+		split.Sub(next.fillAmountS, split)
+	}
+	if split.Sign() < 0 {
+		return nil, fmt.Errorf("miner,split of order:%s is negative", order.Hash.Hex())
 	}
 
-	for i := minVolumeIdx + 1; i < len(ringState.Orders); i++ {
-		order := ringState.Orders[i]
-		var lastOrder *types.FilledOrder
-		lastOrder = ringState.Orders[i-1]
-		order.FillAmountS = lastOrder.FillAmountB
-		order.FillAmountB.Mul(order.FillAmountS, order.BPrice)
+	percentage := int64(order.MarginSplitPercentage)
+	if order.LrcFee.Sign() == 0 {
+		percentage = MarginSplitPercentageBase
+	}
+	split.Mul(split, big.NewInt(percentage)).Quo(split, big.NewInt(MarginSplitPercentageBase))
+	return split, nil
+}
+
+func (e *Evaluator) ComputeRing(ringState *types.Ring) error {
+	if err := ComputeFillAmounts(ringState); nil != err {
+		return err
 	}
 
 	//compute the fee of this ring and orders, and set the feeSelection
@@ -180,70 +252,37 @@ func (e *Evaluator) ComputeRing(ringState *types.Ring) error {
 	}
 }
 
+// 选择分润时，撮合者需要将lrcFee作为lrcReward返还给订单所有者，因此收益为分润减去lrcFee
 func (e *Evaluator) computeFeeOfRingAndOrder(ringState *types.Ring) {
-
-	//the ring use the min MarginSplitPercentage as self's MarginSplitPercentage
-	minShareRate := new(big.Rat).SetInt(big.NewInt(0))
-	for _, order := range ringState.Orders {
-		percentage := new(big.Rat).SetInt64(int64(order.OrderState.RawOrder.MarginSplitPercentage))
-		if minShareRate.Cmp(percentage) > 0 {
-			minShareRate = percentage
-		}
-	}
+	ringState.LegalFee = new(big.Rat)
 
 	for _, filledOrder := range ringState.Orders {
+		order := filledOrder.OrderState.RawOrder
 		var lrcAddress common.Address
-		if implAddress, exists := e.accessor.ProtocolAddresses[filledOrder.OrderState.RawOrder.Protocol]; exists {
+		if implAddress, exists := e.accessor.ProtocolAddresses[order.Protocol]; exists {
 			lrcAddress = implAddress.LrcTokenAddress
 		}
 
-		//todo:成本节约
-		legalAmountOfSaving := new(big.Rat)
-		if filledOrder.OrderState.RawOrder.BuyNoMoreThanAmountB {
-			amountS := new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS)
-			amountB := new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB)
-			sPrice := new(big.Rat)
-			sPrice.Quo(amountS, amountB)
-			savingAmount := new(big.Rat)
-			savingAmount.Mul(filledOrder.FillAmountB, sPrice)
-			savingAmount.Sub(savingAmount, filledOrder.FillAmountS)
-			filledOrder.FeeS = savingAmount
-			legalAmountOfSaving.Mul(filledOrder.FeeS, e.marketCapProvider.GetMarketCap(filledOrder.OrderState.RawOrder.TokenS))
-			log.Debugf("miner,savingAmount:%s", savingAmount.FloatString(10))
-		} else {
-			savingAmount := new(big.Rat).Set(filledOrder.FillAmountB)
-			savingAmount.Mul(savingAmount, ringState.ReducedRate)
-			savingAmount.Sub(filledOrder.FillAmountB, savingAmount)
-			filledOrder.FeeS = savingAmount
-			//todo:address of buy token
-			legalAmountOfSaving.Mul(filledOrder.FeeS, e.marketCapProvider.GetMarketCap(filledOrder.OrderState.RawOrder.TokenB))
+		splitToken := order.TokenB
+		if order.BuyNoMoreThanAmountB {
+			splitToken = order.TokenS
 		}
+		legalAmountOfSplit := new(big.Rat).Mul(filledOrder.FeeS, e.marketCapProvider.GetMarketCap(splitToken))
+		legalAmountOfLrc := new(big.Rat).Mul(filledOrder.LrcFee, e.marketCapProvider.GetMarketCap(lrcAddress))
+		legalAmountOfSplit.Sub(legalAmountOfSplit, legalAmountOfLrc)
 
-		//compute lrcFee
-		rate := new(big.Rat).Quo(filledOrder.AvailableAmountS, new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS))
-		filledOrder.LrcFee = new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.LrcFee)
-		filledOrder.LrcFee.Mul(filledOrder.LrcFee, rate)
-
-		legalAmountOfLrc := new(big.Rat).Mul(e.marketCapProvider.GetMarketCap(lrcAddress), filledOrder.LrcFee)
-
-		//the lrcreward should be set when select  MarginSplit as the selection of fee
-		if legalAmountOfLrc.Cmp(legalAmountOfSaving) > 0 {
+		if order.LrcFee.Sign() > 0 && legalAmountOfLrc.Cmp(legalAmountOfSplit) >= 0 {
 			filledOrder.FeeSelection = 0
 			filledOrder.LegalFee = legalAmountOfLrc
+			filledOrder.LrcReward = new(big.Rat)
 		} else {
 			filledOrder.FeeSelection = 1
-			legalAmountOfSaving.Mul(legalAmountOfSaving, minShareRate)
-			filledOrder.LegalFee = legalAmountOfSaving
-			lrcReward := new(big.Rat).Set(legalAmountOfSaving)
-			lrcReward.Quo(lrcReward, new(big.Rat).SetInt64(int64(2)))
-			lrcReward.Quo(lrcReward, e.marketCapProvider.GetMarketCap(lrcAddress))
-			log.Debugf("miner,lrcReward:%s  legalFee:%s", lrcReward.FloatString(10), filledOrder.LegalFee.FloatString(10))
-			filledOrder.LrcReward = lrcReward
+			filledOrder.LegalFee = legalAmountOfSplit
+			filledOrder.LrcReward = new(big.Rat).Set(filledOrder.LrcFee)
 		}
+		log.Debugf("miner,order:%s feeSelection:%d lrcReward:%s legalFee:%s", order.Hash.Hex(), filledOrder.FeeSelection, filledOrder.LrcReward.FloatString(0), filledOrder.LegalFee.FloatString(10))
 		ringState.LegalFee.Add(ringState.LegalFee, filledOrder.LegalFee)
-
 	}
-
 }
 
 //成环之后才可计算能否成交，否则不需计算，判断是否能够成交，不能使用除法计算
@@ -253,17 +292,17 @@ func PriceValid(a2BOrder *types.OrderState, b2AOrder *types.OrderState) bool {
 	return amountS.Cmp(amountB) >= 0
 }
 
+// 与合约verifyMinerSuppliedFillRates一致，ratio = scale * rateAmountS / amountS
 func PriceRateCVSquare(ringState *types.Ring) (*big.Int, error) {
 	rateRatios := []*big.Int{}
-	scale, _ := new(big.Int).SetString("10000", 0)
+	scale := big.NewInt(RateRatioScale)
 	for _, filledOrder := range ringState.Orders {
 		rawOrder := filledOrder.OrderState.RawOrder
-		log.Debugf("miner,rawOrder.AmountS:%s, filledOrder.RateAmountS:%s", rawOrder.AmountS.String(), filledOrder.RateAmountS.FloatString(10))
-		s1b0, _ := new(big.Int).SetString(filledOrder.RateAmountS.FloatString(0), 10)
-		//s1b0 = s1b0.Mul(s1b0, rawOrder.AmountB)
-
-		s0b1 := new(big.Int).SetBytes(rawOrder.AmountS.Bytes())
-		//s0b1 = s0b1.Mul(s0b1, rawOrder.AmountB)
+		if !filledOrder.RateAmountS.IsInt() {
+			return nil, errors.New("miner,rateAmountS must be integer")
+		}
+		s1b0 := new(big.Int).Set(filledOrder.RateAmountS.Num())
+		s0b1 := new(big.Int).Set(rawOrder.AmountS)
 		if s1b0.Cmp(s0b1) > 0 {
 			return nil, errors.New("miner,rateAmountS must less than amountS")
 		}
@@ -275,7 +314,11 @@ func PriceRateCVSquare(ringState *types.Ring) (*big.Int, error) {
 	return CVSquare(rateRatios, scale), nil
 }
 
+// 与合约MathUint.cvsquare一致：cvs * scale * scale / avg / avg / (len - 1)
 func CVSquare(rateRatios []*big.Int, scale *big.Int) *big.Int {
+	if len(rateRatios) < 2 {
+		return big.NewInt(0)
+	}
 	avg := big.NewInt(0)
 	length := big.NewInt(int64(len(rateRatios)))
 	length1 := big.NewInt(int64(len(rateRatios) - 1))
@@ -283,6 +326,9 @@ func CVSquare(rateRatios []*big.Int, scale *big.Int) *big.Int {
 		avg.Add(avg, ratio)
 	}
 	avg = avg.Div(avg, length)
+	if avg.Sign() == 0 {
+		return big.NewInt(0)
+	}
 
 	cvs := big.NewInt(0)
 	for _, ratio := range rateRatios {
@@ -293,7 +339,7 @@ func CVSquare(rateRatios []*big.Int, scale *big.Int) *big.Int {
 		cvs.Add(cvs, subSquare)
 	}
 
-	return cvs.Mul(cvs, scale).Div(cvs, avg).Mul(cvs, scale).Div(cvs, avg).Div(cvs, length1)
+	return cvs.Mul(cvs, scale).Mul(cvs, scale).Div(cvs, avg).Div(cvs, avg).Div(cvs, length1)
 }
 
 func NewEvaluator(marketCapProvider *marketcap.MarketCapProvider, rateRatioCVSThreshold int64, accessor *ethaccessor.EthNodeAccessor) *Evaluator {
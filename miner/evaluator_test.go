@@ -0,0 +1,239 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+	"math/big"
+	"testing"
+)
+
+// 以下向量的每一步都按照合约LoopringProtocolImpl(protocol v1.0)中calculateRingFillAmount、calculateOrderFillAmount、
+// calculateRingFees的整数运算(向下取整)推导，推导过程写在用例中，不依赖被测代码的输出；
+// 18位精度的向量由独立的大整数计算逐步得出，并非链上RingMined/OrderFilled的记录
+
+func init() {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+}
+
+func bigFromString(s string) *big.Int {
+	i, _ := new(big.Int).SetString(s, 10)
+	return i
+}
+
+func newOrderState(amountS, amountB, lrcFee *big.Int, marginSplitPercentage uint8, buyNoMoreThanAmountB bool) types.OrderState {
+	state := types.OrderState{}
+	state.RawOrder.AmountS = amountS
+	state.RawOrder.AmountB = amountB
+	state.RawOrder.LrcFee = lrcFee
+	state.RawOrder.MarginSplitPercentage = marginSplitPercentage
+	state.RawOrder.BuyNoMoreThanAmountB = buyNoMoreThanAmountB
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	return state
+}
+
+func newRing(orderStates ...types.OrderState) *types.Ring {
+	ring := &types.Ring{}
+	for _, state := range orderStates {
+		ring.Orders = append(ring.Orders, &types.FilledOrder{OrderState: state})
+	}
+	return ring
+}
+
+type filledOrderVector struct {
+	rateAmountS string
+	fillAmountS string
+	fillAmountB string
+	lrcFee      string
+	split       string
+}
+
+func checkRing(t *testing.T, ring *types.Ring, reducedRate string, vectors []filledOrderVector) {
+	if err := miner.ComputeFillAmounts(ring); nil != err {
+		t.Fatalf("compute fill amounts err:%s", err.Error())
+	}
+	if expect := new(big.Rat).SetFrac(bigFromString(reducedRate), miner.RateScale); ring.ReducedRate.Cmp(expect) != 0 {
+		t.Errorf("reducedRate expect:%s, got:%s", expect.FloatString(18), ring.ReducedRate.FloatString(18))
+	}
+	for idx, v := range vectors {
+		filledOrder := ring.Orders[idx]
+		for _, pair := range [][2]interface{}{
+			{v.rateAmountS, filledOrder.RateAmountS},
+			{v.fillAmountS, filledOrder.FillAmountS},
+			{v.fillAmountB, filledOrder.FillAmountB},
+			{v.lrcFee, filledOrder.LrcFee},
+			{v.split, filledOrder.FeeS},
+		} {
+			expect := new(big.Rat).SetInt(bigFromString(pair[0].(string)))
+			if got := pair[1].(*big.Rat); got.Cmp(expect) != 0 {
+				t.Errorf("order:%d expect:%s, got:%s", idx, expect.FloatString(0), got.FloatString(0))
+			}
+		}
+	}
+	if cvs, err := miner.PriceRateCVSquare(ring); nil != err || cvs.Sign() != 0 {
+		t.Errorf("cvs of ring should be 0, got:%v err:%v", cvs, err)
+	}
+}
+
+func TestNthRoot(t *testing.T) {
+	cases := []struct {
+		x      *big.Int
+		n      int
+		expect *big.Int
+	}{
+		{big.NewInt(0), 2, big.NewInt(0)},
+		{big.NewInt(26), 3, big.NewInt(2)},
+		{big.NewInt(27), 3, big.NewInt(3)},
+		{new(big.Int).Lsh(big.NewInt(1), 64), 4, big.NewInt(65536)},
+		{new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 64), big.NewInt(1)), 4, big.NewInt(65535)},
+		{bigFromString("900000000000000000000000000000000000"), 2, bigFromString("948683298050513799")},
+	}
+	for _, c := range cases {
+		if got := miner.NthRoot(c.x, c.n); got.Cmp(c.expect) != 0 {
+			t.Errorf("root(%s, %d) expect:%s, got:%s", c.x.String(), c.n, c.expect.String(), got.String())
+		}
+	}
+}
+
+func TestCVSquare(t *testing.T) {
+	// 合约先乘scale^2再除以avg^2，与先除后乘的结果(554015)不同
+	cvs := miner.CVSquare([]*big.Int{big.NewInt(9000), big.NewInt(10000)}, big.NewInt(miner.RateRatioScale))
+	if cvs.Cmp(big.NewInt(554016)) != 0 {
+		t.Errorf("cvs expect:554016, got:%s", cvs.String())
+	}
+}
+
+func TestComputeFillAmountsOfTwoOrders(t *testing.T) {
+	// order0: 400->100, lrcFee:10, order1: 130->130, lrcFee:7, marginSplit均为50
+	// reducedRate = sqrt(100*130 / (400*130)) = 0.5，rateAmountS: 400*0.5=200, 130*0.5=65
+	// order0: fillAmountB = 400*100/200 = 200 > order1.fillAmountS(130)，最小订单为order1
+	// order1: fillAmountB = 130*130/65 = 260 <= 400，order0.fillAmountS = 260
+	// 修正order0: fillAmountB = 260*100/200 = 130，lrcFee = 10*260/400 = 6
+	// 分润: order0 (130 - 260*100/400)*50/100 = 32，order1 (260 - 130*130/130)*50/100 = 65
+	ring := newRing(
+		newOrderState(big.NewInt(400), big.NewInt(100), big.NewInt(10), 50, false),
+		newOrderState(big.NewInt(130), big.NewInt(130), big.NewInt(7), 50, false),
+	)
+	checkRing(t, ring, "500000000000000000", []filledOrderVector{
+		{"200", "260", "130", "6", "32"},
+		{"65", "130", "260", "7", "65"},
+	})
+}
+
+func TestComputeFillAmountsOfThreeOrders(t *testing.T) {
+	// order0: 300->100, 已成交100，lrcFee:31，marginSplit:40，可用 200->66
+	// order1: 100->150, buyNoMoreThanAmountB, 已买入90，lrcFee:0(分润比例为100%)，可用 40->60
+	// order2: 400->100, lrcFee:20，marginSplit:100
+	order1 := newOrderState(big.NewInt(300), big.NewInt(100), big.NewInt(31), 40, false)
+	order1.DealtAmountS = big.NewInt(100)
+	order2 := newOrderState(big.NewInt(100), big.NewInt(150), big.NewInt(0), 60, true)
+	order2.DealtAmountB = big.NewInt(90)
+	order3 := newOrderState(big.NewInt(400), big.NewInt(100), big.NewInt(20), 100, false)
+	for idx, state := range []*types.OrderState{&order1, &order2, &order3} {
+		state.RawOrder.Hash = common.BigToHash(big.NewInt(int64(idx)))
+	}
+
+	// reducedRate = cbrt(100*150*100 / (300*100*400)) = 0.5，rateAmountS: 150, 50, 200
+	// order0: fillAmountB = 200*100/150 = 133 > order1.fillAmountS(40)，最小订单为order1
+	// order1: fillAmountB = 40*150/50 = 120 > 可买入60，fillAmountB = 60，fillAmountS = 60*50/150 = 20，order2.fillAmountS = 60
+	// order2: fillAmountB = 60*100/200 = 30，lrcFee = 20*60/400 = 3，order0.fillAmountS = 30
+	// 修正order0: fillAmountB = 30*100/150 = 20，lrcFee = 31*30/300 = 3
+	// 分润: order0 (20 - 30*100/300)*40/100 = 4，order1 60*100/150 - 20 = 20，order2 30 - 60*100/400 = 15
+	ring := newRing(order1, order2, order3)
+	checkRing(t, ring, "500000000000000000", []filledOrderVector{
+		{"150", "30", "20", "3", "4"},
+		{"50", "20", "60", "0", "20"},
+		{"200", "60", "30", "3", "15"},
+	})
+}
+
+func ether(integer int64, fraction string) *big.Int {
+	amount := new(big.Int).Mul(big.NewInt(integer), miner.RateScale)
+	if "" != fraction {
+		amount.Add(amount, bigFromString(fraction))
+	}
+	return amount
+}
+
+// 18位精度的三个订单，reducedRate不是整数比例
+func TestComputeFillAmountsOfEtherAmounts(t *testing.T) {
+	// order0: 1000 LRC->3 WETH，已卖出400，lrcFee:15，marginSplit:50，可用 600->1.8
+	// order1: 3.1 WETH->330 EOS，buyNoMoreThanAmountB，已买入130，lrcFee:0，可用 1.878787878787878787->200
+	// order2: 340 EOS->950 LRC，lrcFee:2.345678901234567890，marginSplit:60
+	order0 := newOrderState(ether(1000, ""), ether(3, ""), ether(15, ""), 50, false)
+	order0.DealtAmountS = ether(400, "")
+	order1 := newOrderState(ether(3, "100000000000000000"), ether(330, ""), big.NewInt(0), 0, true)
+	order1.DealtAmountB = ether(130, "")
+	order2 := newOrderState(ether(340, ""), ether(950, ""), ether(2, "345678901234567890"), 60, false)
+
+	// reducedRate = floor(cbrt(10^54 * 3*330*950 / (1000*3.1*340))) = 0.962733453197852243
+	// rateAmountS: 962.733453197852243, 2.984473704913341953, 327.329374087269762620
+	// order0: fillAmountB = 600e18*3e18/962733453197852243000 = 1869676382409950736 <= order1.fillAmountS，order1.fillAmountS = 1869676382409950736
+	// order1: fillAmountB = 1869676382409950736*330e18/2984473704913341953 > 可买入200，最小订单为order1
+	//         fillAmountB = 200e18，fillAmountS = 200e18*2984473704913341953/330e18 = 1808771942371722395，order2.fillAmountS = 200e18
+	// order2: fillAmountB = 200e18*950e18/327329374087269762620 = 580455086042304967196，lrcFee = 2345678901234567890*200/340 = 1379811118373275229
+	//         580455086042304967196 <= 600e18，order0.fillAmountS = 580455086042304967196
+	// 修正order0: fillAmountB = 580455086042304967196*3e18/962733453197852243000 = 1808771942371722400 > order1.fillAmountS，不再修改order1
+	//         lrcFee = 15e18*580455086042304967196/1000e18 = 8706826290634574507
+	// 分润: order0 (1808771942371722395 - 580455086042304967196*3/1000)*50/100 = 33703342122403747
+	//       order1 200e18*3.1/330 - 1808771942371722395 = 70015936416156392
+	//       order2 (580455086042304967196 - 200e18*950/340)*60/100 = 12978933978324156788
+	ring := newRing(order0, order1, order2)
+	checkRing(t, ring, "962733453197852243", []filledOrderVector{
+		{"962733453197852243000", "580455086042304967196", "1808771942371722400", "8706826290634574507", "33703342122403747"},
+		{"2984473704913341953", "1808771942371722395", "200000000000000000000", "0", "70015936416156392"},
+		{"327329374087269762620", "200000000000000000000", "580455086042304967196", "1379811118373275229", "12978933978324156788"},
+	})
+}
+
+// 18位精度的三个订单，最小订单受余额限制
+func TestComputeFillAmountsOfSpendableAmounts(t *testing.T) {
+	// order0: 5000 LRC->12.5 WETH，lrcFee:30，marginSplit:40
+	// order1: 13 WETH->1200 EOS，lrcFee:8，marginSplit:70，余额与授权只有7.123456789012345678
+	// order2: 1300 EOS->4800 LRC，buyNoMoreThanAmountB，lrcFee:12，marginSplit:100
+	order0 := newOrderState(ether(5000, ""), ether(12, "500000000000000000"), ether(30, ""), 40, false)
+	order1 := newOrderState(ether(13, ""), ether(1200, ""), ether(8, ""), 70, false)
+	order1.AvailableAmountS = ether(7, "123456789012345678")
+	order2 := newOrderState(ether(1300, ""), ether(4800, ""), ether(12, ""), 100, true)
+
+	// reducedRate = floor(cbrt(10^54 * 12.5*1200*4800 / (5000*13*1300))) = 0.948036945807544385
+	// rateAmountS: 4740.184729037721925, 12.324480295498077005, 1232.448029549807700500
+	// order0: fillAmountB = 5000e18*12.5e18/4740184729037721925000 > order1可卖出7.123456789012345678，最小订单为order1
+	// order1: fillAmountB = 7123456789012345678*1200e18/12324480295498077005 = 693590962203680743882，lrcFee = 8e18*7123456789012345678/13e18 = 4383665716315289648
+	// order2: fillAmountB = 693590962203680743882*4800e18/1232448029549807700500 = 2701320087138912520593 <= 可买入4800，lrcFee = 12e18*2701320087138912520593/4800e18 = 6753300217847281301
+	// 修正order0: fillAmountS = 2701320087138912520593，fillAmountB = 2701320087138912520593*12.5e18/4740184729037721925000 = 7123456789012345684
+	//         lrcFee = 30e18*2701320087138912520593/5000e18 = 16207920522833475123
+	// 分润: order0 (7123456789012345678 - 2701320087138912520593*12.5/5000)*40/100 = 148062628466025750
+	//       order1 (693590962203680743882 - 7123456789012345678*1200/13)*70/100 = 25228773329471107677
+	//       order2 2701320087138912520593*1300/4800 - 693590962203680743882 = 38016561396441397111
+	ring := newRing(order0, order1, order2)
+	checkRing(t, ring, "948036945807544385", []filledOrderVector{
+		{"4740184729037721925000", "2701320087138912520593", "7123456789012345684", "16207920522833475123", "148062628466025750"},
+		{"12324480295498077005", "7123456789012345678", "693590962203680743882", "4383665716315289648", "25228773329471107677"},
+		{"1232448029549807700500", "693590962203680743882", "2701320087138912520593", "6753300217847281301", "38016561396441397111"},
+	})
+}
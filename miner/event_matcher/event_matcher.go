@@ -0,0 +1,508 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package event_matcher
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	marketLib "github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+/**
+在内存中维护每个市场的订单簿，启动时从ordermanager加载，之后根据新订单、成交、取消以及cutoff事件增量更新，
+新订单到达时立即与对手方订单匹配，环路经evaluator计算费用后交给submitter，只匹配两个订单组成的环路，
+mtx保护订单簿，roundMtx保证同一时间只有一次匹配，匹配时先在mtx下复制订单，调用节点时不持有mtx，
+链分叉后订单簿中的成交量可能已被回滚，下一个区块时从ordermanager重新读取订单状态
+*/
+
+const defaultOrderBookSize = 500
+
+type pendingFill struct {
+	ringHash common.Hash
+	amountS  *big.Int
+	amountB  *big.Int
+}
+
+type bookOrder struct {
+	state    *types.OrderState
+	pendings []*pendingFill //已提交但未确认的环路占用的金额
+}
+
+type minedRing struct {
+	orderHashes []common.Hash
+	blockNumber *big.Int //匹配时的区块，重启恢复的环路为nil，在下一个区块时设置
+}
+
+type OrderBook struct {
+	TokenA common.Address
+	TokenB common.Address
+	orders map[common.Hash]*bookOrder
+	dirty  bool //有订单金额被释放，下一个区块重新匹配
+	reload bool //有订单移出订单簿，下一个区块从数据库补充
+	stats  miner.MarketStats
+}
+
+type EventMatcher struct {
+	mtx             sync.Mutex
+	roundMtx        sync.Mutex
+	statsMtx        sync.RWMutex
+	recoverOnce     sync.Once
+	books           []*OrderBook
+	orders          map[common.Hash]*OrderBook
+	minedRings      map[common.Hash]*minedRing
+	om              ordermanager.OrderManager
+	rds             dao.RdsService
+	submitter       *miner.RingSubmitter
+	evaluator       *miner.Evaluator
+	lastBlockNumber *big.Int
+	lastBlockTime   int64
+	expireBlocks    *big.Int
+	bookSize        int
+	forked          bool //链分叉，下一个区块重新读取订单状态
+
+	newOrderWatcher    *eventemitter.Watcher
+	deleteOrderWatcher *eventemitter.Watcher
+	fillWatcher        *eventemitter.Watcher
+	cancelWatcher      *eventemitter.Watcher
+	cutoffWatcher      *eventemitter.Watcher
+	afterSubmitWatcher *eventemitter.Watcher
+	blockWatcher       *eventemitter.Watcher
+	forkWatcher        *eventemitter.Watcher
+}
+
+func NewEventMatcher(options config.MinerOptions, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, rds dao.RdsService) *EventMatcher {
+	matcher := &EventMatcher{submitter: submitter, evaluator: evaluator, om: om, rds: rds}
+	matcher.expireBlocks = big.NewInt(options.RingExpireBlocks)
+	matcher.bookSize = options.OrderBookSize
+	if matcher.bookSize <= 0 {
+		matcher.bookSize = defaultOrderBookSize
+	}
+	matcher.orders = make(map[common.Hash]*OrderBook)
+	matcher.minedRings = make(map[common.Hash]*minedRing)
+	matcher.lastBlockNumber = big.NewInt(0)
+	matcher.books = []*OrderBook{}
+	pairs := make(map[common.Address]common.Address)
+	for _, pair := range marketLib.AllTokenPairs {
+		if addr, ok := pairs[pair.TokenS]; !ok || addr != pair.TokenB {
+			if addr1, ok1 := pairs[pair.TokenB]; !ok1 || addr1 != pair.TokenS {
+				pairs[pair.TokenS] = pair.TokenB
+				book := &OrderBook{TokenA: pair.TokenS, TokenB: pair.TokenB}
+				book.orders = make(map[common.Hash]*bookOrder)
+				book.stats.Market, _ = marketLib.WrapMarketByAddress(book.TokenA.Hex(), book.TokenB.Hex())
+				book.stats.TokenA = book.TokenA
+				book.stats.TokenB = book.TokenB
+				matcher.books = append(matcher.books, book)
+			}
+		}
+	}
+	return matcher
+}
+
+func (matcher *EventMatcher) Start() {
+	matcher.mtx.Lock()
+	for _, book := range matcher.books {
+		matcher.loadOrders(book)
+	}
+	// Pause/Resume会再次调用Start，已恢复的环路不能重复计入
+	matcher.recoverOnce.Do(matcher.recoverMinedRings)
+	matcher.mtx.Unlock()
+
+	// ordermanager持有锁时发出新订单以及软取消事件，不能等待匹配完成
+	matcher.newOrderWatcher = &eventemitter.Watcher{Concurrent: true, Handle: matcher.handleNewOrder}
+	eventemitter.On(eventemitter.Miner_NewOrderState, matcher.newOrderWatcher)
+	matcher.deleteOrderWatcher = &eventemitter.Watcher{Concurrent: true, Handle: matcher.handleDeleteOrder}
+	eventemitter.On(eventemitter.Miner_DeleteOrderState, matcher.deleteOrderWatcher)
+	matcher.fillWatcher = &eventemitter.Watcher{Concurrent: false, Handle: matcher.handleFill}
+	eventemitter.On(eventemitter.OrderManagerExtractorFill, matcher.fillWatcher)
+	matcher.cancelWatcher = &eventemitter.Watcher{Concurrent: false, Handle: matcher.handleCancel}
+	eventemitter.On(eventemitter.OrderManagerExtractorCancel, matcher.cancelWatcher)
+	matcher.cutoffWatcher = &eventemitter.Watcher{Concurrent: false, Handle: matcher.handleCutoff}
+	eventemitter.On(eventemitter.OrderManagerExtractorCutoff, matcher.cutoffWatcher)
+	matcher.afterSubmitWatcher = &eventemitter.Watcher{Concurrent: false, Handle: matcher.afterSubmit}
+	eventemitter.On(eventemitter.OrderManagerExtractorRingMined, matcher.afterSubmitWatcher)
+	eventemitter.On(eventemitter.Miner_RingSubmitFailed, matcher.afterSubmitWatcher)
+	matcher.blockWatcher = &eventemitter.Watcher{Concurrent: false, Handle: matcher.handleNewBlock}
+	eventemitter.On(eventemitter.Block_New, matcher.blockWatcher)
+	matcher.forkWatcher = &eventemitter.Watcher{Concurrent: false, Handle: matcher.handleFork}
+	eventemitter.On(eventemitter.ExtractorFork, matcher.forkWatcher)
+}
+
+func (matcher *EventMatcher) Stop() {
+	eventemitter.Un(eventemitter.Miner_NewOrderState, matcher.newOrderWatcher)
+	eventemitter.Un(eventemitter.Miner_DeleteOrderState, matcher.deleteOrderWatcher)
+	eventemitter.Un(eventemitter.OrderManagerExtractorFill, matcher.fillWatcher)
+	eventemitter.Un(eventemitter.OrderManagerExtractorCancel, matcher.cancelWatcher)
+	eventemitter.Un(eventemitter.OrderManagerExtractorCutoff, matcher.cutoffWatcher)
+	eventemitter.Un(eventemitter.OrderManagerExtractorRingMined, matcher.afterSubmitWatcher)
+	eventemitter.Un(eventemitter.Miner_RingSubmitFailed, matcher.afterSubmitWatcher)
+	eventemitter.Un(eventemitter.Block_New, matcher.blockWatcher)
+	eventemitter.Un(eventemitter.ExtractorFork, matcher.forkWatcher)
+}
+
+// TriggerRound 不等待事件，对所有市场的订单簿重新匹配
+func (matcher *EventMatcher) TriggerRound() {
+	matcher.roundMtx.Lock()
+	rings := []*types.RingSubmitInfo{}
+	for _, book := range matcher.books {
+		rings = append(rings, matcher.matchBook(book)...)
+	}
+	matcher.roundMtx.Unlock()
+	matcher.emitRings(rings)
+}
+
+// Stats 返回每个市场的匹配统计，订单数为订单簿当前的订单数
+func (matcher *EventMatcher) Stats() []miner.MarketStats {
+	matcher.statsMtx.RLock()
+	defer matcher.statsMtx.RUnlock()
+
+	stats := []miner.MarketStats{}
+	for _, book := range matcher.books {
+		stats = append(stats, book.stats)
+	}
+	return stats
+}
+
+func (matcher *EventMatcher) handleNewOrder(eventData eventemitter.EventData) error {
+	state := copyOrderState(eventData.(*types.OrderState))
+
+	matcher.mtx.Lock()
+	book := matcher.bookOf(state.RawOrder.TokenS, state.RawOrder.TokenB)
+	if nil == book {
+		matcher.mtx.Unlock()
+		return nil
+	}
+	matcher.addOrder(book, state)
+	matcher.mtx.Unlock()
+
+	matcher.roundMtx.Lock()
+	rings := matcher.matchOrder(book, state.RawOrder.Hash)
+	matcher.roundMtx.Unlock()
+
+	matcher.emitRings(rings)
+	return nil
+}
+
+func (matcher *EventMatcher) handleDeleteOrder(eventData eventemitter.EventData) error {
+	matcher.mtx.Lock()
+	defer matcher.mtx.Unlock()
+
+	matcher.removeOrder(eventData.(common.Hash))
+	return nil
+}
+
+func (matcher *EventMatcher) handleFill(eventData eventemitter.EventData) error {
+	event := eventData.(*types.OrderFilledEvent)
+
+	matcher.mtx.Lock()
+	defer matcher.mtx.Unlock()
+
+	order := matcher.getOrder(event.OrderHash)
+	if nil == order {
+		return nil
+	}
+	order.state.DealtAmountS.Add(order.state.DealtAmountS, event.AmountS)
+	order.state.DealtAmountB.Add(order.state.DealtAmountB, event.AmountB)
+	// 链上成交已计入，不再重复占用
+	order.removePending(event.Ringhash)
+	if matcher.om.IsOrderFullFinished(order.state) {
+		matcher.removeOrder(event.OrderHash)
+	}
+	return nil
+}
+
+func (matcher *EventMatcher) handleCancel(eventData eventemitter.EventData) error {
+	event := eventData.(*types.OrderCancelledEvent)
+
+	matcher.mtx.Lock()
+	defer matcher.mtx.Unlock()
+
+	order := matcher.getOrder(event.OrderHash)
+	if nil == order {
+		return nil
+	}
+	if order.state.RawOrder.BuyNoMoreThanAmountB {
+		order.state.CancelledAmountB.Add(order.state.CancelledAmountB, event.AmountCancelled)
+	} else {
+		order.state.CancelledAmountS.Add(order.state.CancelledAmountS, event.AmountCancelled)
+	}
+	if matcher.om.IsOrderFullFinished(order.state) {
+		matcher.removeOrder(event.OrderHash)
+	}
+	return nil
+}
+
+func (matcher *EventMatcher) handleCutoff(eventData eventemitter.EventData) error {
+	event := eventData.(*types.CutoffEvent)
+
+	matcher.mtx.Lock()
+	defer matcher.mtx.Unlock()
+
+	for _, book := range matcher.books {
+		for orderHash, order := range book.orders {
+			rawOrder := order.state.RawOrder
+			if rawOrder.Owner == event.Owner && rawOrder.Protocol == event.ContractAddress && event.Cutoff.Cmp(rawOrder.Timestamp) >= 0 {
+				matcher.removeOrder(orderHash)
+			}
+		}
+	}
+	return nil
+}
+
+func (matcher *EventMatcher) afterSubmit(eventData eventemitter.EventData) error {
+	var ringHash common.Hash
+	switch e := eventData.(type) {
+	case *types.RingMinedEvent:
+		ringHash = e.Ringhash
+	case *types.RingSubmitFailedEvent:
+		ringHash = e.RingHash
+	default:
+		return nil
+	}
+
+	matcher.mtx.Lock()
+	defer matcher.mtx.Unlock()
+	matcher.releaseMinedRing(ringHash)
+	return nil
+}
+
+// 分叉事件与ordermanager的回滚没有先后顺序，这里只做标记，下一个区块时订单状态已经回滚
+func (matcher *EventMatcher) handleFork(eventData eventemitter.EventData) error {
+	matcher.mtx.Lock()
+	defer matcher.mtx.Unlock()
+
+	matcher.forked = true
+	return nil
+}
+
+// 每个区块移除过期订单，释放超时的环路，并重新匹配有变化的订单簿
+func (matcher *EventMatcher) handleNewBlock(eventData eventemitter.EventData) error {
+	blockEvent := eventData.(*types.BlockEvent)
+	matcher.expireMinedRings(blockEvent.BlockNumber)
+
+	matcher.mtx.Lock()
+	matcher.lastBlockNumber = new(big.Int).Set(blockEvent.BlockNumber)
+	if nil != blockEvent.BlockTime {
+		matcher.lastBlockTime = blockEvent.BlockTime.Int64()
+	}
+	if matcher.forked {
+		matcher.reloadOrderStates()
+	}
+	dirtyBooks := []*OrderBook{}
+	for _, book := range matcher.books {
+		matcher.removeExpiredOrders(book)
+		if book.reload {
+			matcher.loadOrders(book)
+		}
+		if book.dirty {
+			dirtyBooks = append(dirtyBooks, book)
+		}
+	}
+	matcher.mtx.Unlock()
+
+	matcher.roundMtx.Lock()
+	rings := []*types.RingSubmitInfo{}
+	for _, book := range dirtyBooks {
+		rings = append(rings, matcher.matchBook(book)...)
+	}
+	matcher.roundMtx.Unlock()
+
+	matcher.emitRings(rings)
+	return nil
+}
+
+func (matcher *EventMatcher) emitRings(rings []*types.RingSubmitInfo) {
+	if len(rings) > 0 {
+		eventemitter.Emit(eventemitter.Miner_NewRing, rings)
+	}
+}
+
+func (matcher *EventMatcher) bookOf(tokenS, tokenB common.Address) *OrderBook {
+	for _, book := range matcher.books {
+		if (book.TokenA == tokenS && book.TokenB == tokenB) || (book.TokenA == tokenB && book.TokenB == tokenS) {
+			return book
+		}
+	}
+	return nil
+}
+
+func (matcher *EventMatcher) getOrder(orderHash common.Hash) *bookOrder {
+	if book, ok := matcher.orders[orderHash]; ok {
+		return book.orders[orderHash]
+	}
+	return nil
+}
+
+// 调用方需持有锁
+func (matcher *EventMatcher) addOrder(book *OrderBook, state *types.OrderState) {
+	if _, exists := book.orders[state.RawOrder.Hash]; exists {
+		return
+	}
+	book.orders[state.RawOrder.Hash] = &bookOrder{state: state, pendings: []*pendingFill{}}
+	matcher.orders[state.RawOrder.Hash] = book
+	matcher.updateBookStats(book)
+}
+
+// 调用方需持有锁，已提交环路占用的金额在环路确认或失败时释放
+func (matcher *EventMatcher) removeOrder(orderHash common.Hash) {
+	book, ok := matcher.orders[orderHash]
+	if !ok {
+		return
+	}
+	delete(book.orders, orderHash)
+	delete(matcher.orders, orderHash)
+	book.reload = true
+	matcher.updateBookStats(book)
+}
+
+// 分叉回滚后重新读取订单簿中订单的状态，未确认环路的占用保留，已结束的订单移出订单簿，调用方需持有锁
+func (matcher *EventMatcher) reloadOrderStates() {
+	matcher.forked = false
+	for _, book := range matcher.books {
+		for orderHash, order := range book.orders {
+			state, err := matcher.om.GetOrderByHash(orderHash)
+			if nil != err || (state.Status != types.ORDER_NEW && state.Status != types.ORDER_PARTIAL) {
+				matcher.removeOrder(orderHash)
+				continue
+			}
+			order.state = copyOrderState(state)
+			if matcher.om.IsOrderFullFinished(order.state) {
+				matcher.removeOrder(orderHash)
+			}
+		}
+		book.dirty = true
+	}
+}
+
+func (matcher *EventMatcher) removeExpiredOrders(book *OrderBook) {
+	if matcher.lastBlockTime <= 0 {
+		return
+	}
+	for orderHash, order := range book.orders {
+		rawOrder := order.state.RawOrder
+		if new(big.Int).Add(rawOrder.Timestamp, rawOrder.Ttl).Int64() < matcher.lastBlockTime {
+			matcher.removeOrder(orderHash)
+		}
+	}
+}
+
+// 从ordermanager补充订单簿，已在订单簿中的订单作为过滤条件
+func (matcher *EventMatcher) loadOrders(book *OrderBook) {
+	book.reload = false
+	filters := []common.Hash{}
+	for orderHash := range book.orders {
+		filters = append(filters, orderHash)
+	}
+	loaded := 0
+	for _, protocolAddress := range matcher.submitter.Accessor.ProtocolAddresses {
+		atoBOrders := matcher.om.MinerOrders(protocolAddress.ContractAddress, book.TokenA, book.TokenB, matcher.bookSize, filters)
+		btoAOrders := matcher.om.MinerOrders(protocolAddress.ContractAddress, book.TokenB, book.TokenA, matcher.bookSize, filters)
+		for _, state := range append(atoBOrders, btoAOrders...) {
+			if _, exists := book.orders[state.RawOrder.Hash]; !exists {
+				matcher.addOrder(book, state)
+				loaded += 1
+			}
+		}
+	}
+	if loaded > 0 {
+		book.dirty = true
+		log.Debugf("miner,event matcher loaded %d orders of market:%s", loaded, book.stats.Market)
+	}
+}
+
+func (matcher *EventMatcher) updateBookStats(book *OrderBook) {
+	atoB, btoA := 0, 0
+	for _, order := range book.orders {
+		if order.state.RawOrder.TokenS == book.TokenA {
+			atoB += 1
+		} else {
+			btoA += 1
+		}
+	}
+	matcher.statsMtx.Lock()
+	book.stats.AtoBOrders = atoB
+	book.stats.BtoAOrders = btoA
+	matcher.statsMtx.Unlock()
+}
+
+// clone 返回订单以及占用金额的副本，匹配时使用，不影响订单簿
+func (order *bookOrder) clone() *bookOrder {
+	pendings := make([]*pendingFill, len(order.pendings))
+	copy(pendings, order.pendings)
+	return &bookOrder{state: copyOrderState(order.state), pendings: pendings}
+}
+
+func (order *bookOrder) addPending(ringForSubmit *types.RingSubmitInfo) {
+	for _, filledOrder := range ringForSubmit.RawRing.Orders {
+		if filledOrder.OrderState.RawOrder.Hash == order.state.RawOrder.Hash {
+			order.pendings = append(order.pendings, &pendingFill{
+				ringHash: ringForSubmit.RawRing.Hash,
+				amountS:  intFromRat(filledOrder.FillAmountS),
+				amountB:  intFromRat(filledOrder.FillAmountB),
+			})
+		}
+	}
+}
+
+func (order *bookOrder) removePending(ringHash common.Hash) {
+	pendings := []*pendingFill{}
+	for _, pending := range order.pendings {
+		if pending.ringHash != ringHash {
+			pendings = append(pendings, pending)
+		}
+	}
+	order.pendings = pendings
+}
+
+// remainedState 返回扣除未确认环路占用金额后的订单副本
+func (order *bookOrder) remainedState() *types.OrderState {
+	state := copyOrderState(order.state)
+	for _, pending := range order.pendings {
+		state.DealtAmountS.Add(state.DealtAmountS, pending.amountS)
+		state.DealtAmountB.Add(state.DealtAmountB, pending.amountB)
+	}
+	return state
+}
+
+func copyOrderState(src *types.OrderState) *types.OrderState {
+	state := *src
+	state.DealtAmountS = copyInt(src.DealtAmountS)
+	state.DealtAmountB = copyInt(src.DealtAmountB)
+	state.CancelledAmountS = copyInt(src.CancelledAmountS)
+	state.CancelledAmountB = copyInt(src.CancelledAmountB)
+	if nil != src.AvailableAmountS {
+		state.AvailableAmountS = new(big.Int).Set(src.AvailableAmountS)
+	}
+	return &state
+}
+
+func copyInt(i *big.Int) *big.Int {
+	if nil == i {
+		return big.NewInt(0)
+	}
+	return new(big.Int).Set(i)
+}
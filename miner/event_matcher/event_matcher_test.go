@@ -0,0 +1,352 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package event_matcher
+
+import (
+	"errors"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+)
+
+var (
+	testProtocol = common.HexToAddress("0x1000000000000000000000000000000000000001")
+	testDelegate = common.HexToAddress("0x1000000000000000000000000000000000000002")
+	testTokenA   = common.HexToAddress("0x000000000000000000000000000000000000000a")
+	testTokenB   = common.HexToAddress("0x000000000000000000000000000000000000000b")
+)
+
+// 订单由keystore中的账户签名，环路hash由订单签名计算
+var testOwner common.Address
+
+// 只实现event matcher用到的方法，剩余金额不大于0时订单完成
+type testOrderManager struct {
+	ordermanager.OrderManager
+	states map[common.Hash]*types.OrderState
+}
+
+func (om *testOrderManager) IsOrderFullFinished(state *types.OrderState) bool {
+	remained := new(big.Int).Sub(state.RawOrder.AmountS, new(big.Int).Add(state.DealtAmountS, state.CancelledAmountS))
+	return remained.Sign() <= 0
+}
+
+func (om *testOrderManager) MinerOrders(protocol, tokenS, tokenB common.Address, length int, filterOrderhashs []common.Hash) []*types.OrderState {
+	return []*types.OrderState{}
+}
+
+func (om *testOrderManager) GetOrderByHash(hash common.Hash) (*types.OrderState, error) {
+	if state, ok := om.states[hash]; ok {
+		return state, nil
+	}
+	return nil, errors.New("record not found")
+}
+
+// 模拟节点，余额和授权足够，gasPrice为1wei，每个交易估算200000gas
+type MatchApi struct{}
+
+func (api *MatchApi) Call(arg map[string]interface{}, blockParameter string) string {
+	return "0x00000000000000000000000000000000000000000000d3c21bcecceda1000000"
+}
+
+func (api *MatchApi) GasPrice() string {
+	return "0x1"
+}
+
+func (api *MatchApi) EstimateGas(arg map[string]interface{}) string {
+	return "0x30d40"
+}
+
+var testSalt int64
+
+func newTestOrder(tokenS, tokenB common.Address, amountS, amountB int64) *types.OrderState {
+	testSalt++
+	ether := big.NewInt(1e18)
+	state := &types.OrderState{}
+	state.RawOrder.Protocol = testProtocol
+	state.RawOrder.Owner = testOwner
+	state.RawOrder.TokenS = tokenS
+	state.RawOrder.TokenB = tokenB
+	state.RawOrder.AmountS = new(big.Int).Mul(big.NewInt(amountS), ether)
+	state.RawOrder.AmountB = new(big.Int).Mul(big.NewInt(amountB), ether)
+	state.RawOrder.Timestamp = big.NewInt(1506014710)
+	state.RawOrder.Ttl = big.NewInt(3600)
+	state.RawOrder.Salt = big.NewInt(testSalt)
+	state.RawOrder.LrcFee = big.NewInt(0)
+	state.RawOrder.MarginSplitPercentage = 100
+	state.RawOrder.GeneratePrice()
+	state.RawOrder.Hash = state.RawOrder.GenerateHash()
+	if err := state.RawOrder.GenerateAndSetSignature(testOwner); nil != err {
+		panic(err)
+	}
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	state.Status = types.ORDER_NEW
+	return state
+}
+
+func newTestMatcher(t *testing.T) (*EventMatcher, *OrderBook, *testOrderManager, func()) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+
+	dir, err := ioutil.TempDir("", "event-matcher-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	minerAcc, err := ks.NewAccount("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock(minerAcc, "1"); err != nil {
+		t.Fatal(err)
+	}
+	crypto.Initialize(crypto.NewCrypto(true, ks))
+	testOwner = minerAcc.Address
+
+	cfg := config.LoadConfig("../../config/relay.toml")
+	accessor := &ethaccessor.EthNodeAccessor{}
+	accessor.ProtocolImplAbi, _ = ethaccessor.NewAbi(cfg.Common.ProtocolImpl.ImplAbi)
+	accessor.Erc20Abi, _ = ethaccessor.NewAbi(cfg.Common.Erc20Abi)
+	accessor.ProtocolAddresses = map[common.Address]*ethaccessor.ProtocolAddress{
+		testProtocol: {ContractAddress: testProtocol, DelegateAddress: testDelegate},
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &MatchApi{}); err != nil {
+		t.Fatal(err)
+	}
+	accessor.Client = rpc.DialInProc(server)
+
+	marketCapProvider := marketcap.NewMarketCapProvider(cfg.Miner)
+	marketCapProvider.SetMarketCap(util.GetWethAddress(), 1000)
+	marketCapProvider.SetMarketCap(testTokenA, 1)
+	marketCapProvider.SetMarketCap(testTokenB, 1)
+
+	options := cfg.Miner
+	options.Miner = minerAcc.Address.Hex()
+	options.SimulateRing = false
+	options.IfRegistryRingHash = false
+	options.GasPrice = config.GasPriceOptions{}
+	options.MinProfit = 0
+	submitter := miner.NewSubmitter(options, accessor, nil, marketCapProvider)
+	evaluator := miner.NewEvaluator(marketCapProvider, cfg.Miner.RateRatioCVSThreshold, accessor)
+
+	om := &testOrderManager{states: make(map[common.Hash]*types.OrderState)}
+	matcher := NewEventMatcher(options, submitter, evaluator, om, nil)
+	book := &OrderBook{TokenA: testTokenA, TokenB: testTokenB, orders: make(map[common.Hash]*bookOrder)}
+	matcher.books = []*OrderBook{book}
+	return matcher, book, om, func() { os.RemoveAll(dir) }
+}
+
+func TestEventMatcher_AddAndRemoveOrder(t *testing.T) {
+	matcher, book, _, clean := newTestMatcher(t)
+	defer clean()
+
+	sellA := newTestOrder(testTokenA, testTokenB, 10, 10)
+	sellB := newTestOrder(testTokenB, testTokenA, 10, 10)
+	matcher.addOrder(book, sellA)
+	matcher.addOrder(book, sellB)
+	matcher.addOrder(book, sellA)
+	if len(book.orders) != 2 || book.stats.AtoBOrders != 1 || book.stats.BtoAOrders != 1 {
+		t.Fatalf("book orders:%d, atoB:%d, btoA:%d, expect 2 1 1", len(book.orders), book.stats.AtoBOrders, book.stats.BtoAOrders)
+	}
+	if matcher.getOrder(sellA.RawOrder.Hash) == nil || matcher.bookOf(testTokenB, testTokenA) != book {
+		t.Fatalf("order and book should be found")
+	}
+
+	matcher.removeOrder(sellA.RawOrder.Hash)
+	matcher.removeOrder(sellA.RawOrder.Hash)
+	if matcher.getOrder(sellA.RawOrder.Hash) != nil || len(book.orders) != 1 || book.stats.AtoBOrders != 0 {
+		t.Fatalf("order should be removed")
+	}
+	if !book.reload {
+		t.Fatalf("book should be reloaded after order removed")
+	}
+
+	// 与合约一致，创建时间不晚于cutoff的订单失效
+	cutoff := &types.CutoffEvent{Owner: testOwner, ContractAddress: testProtocol, Cutoff: new(big.Int).Set(sellB.RawOrder.Timestamp)}
+	matcher.handleCutoff(cutoff)
+	if matcher.getOrder(sellB.RawOrder.Hash) != nil {
+		t.Fatalf("order created at cutoff should be removed")
+	}
+}
+
+func TestEventMatcher_FillAndCancel(t *testing.T) {
+	matcher, book, _, clean := newTestMatcher(t)
+	defer clean()
+
+	order := newTestOrder(testTokenA, testTokenB, 10, 10)
+	matcher.addOrder(book, order)
+	ether := big.NewInt(1e18)
+
+	fill := &types.OrderFilledEvent{OrderHash: order.RawOrder.Hash, AmountS: new(big.Int).Mul(big.NewInt(4), ether), AmountB: new(big.Int).Mul(big.NewInt(4), ether)}
+	matcher.handleFill(fill)
+	if state := matcher.getOrder(order.RawOrder.Hash).state; state.DealtAmountS.Cmp(fill.AmountS) != 0 {
+		t.Fatalf("dealtAmountS %s, expect %s", state.DealtAmountS.String(), fill.AmountS.String())
+	}
+
+	cancel := &types.OrderCancelledEvent{OrderHash: order.RawOrder.Hash, AmountCancelled: new(big.Int).Mul(big.NewInt(6), ether)}
+	matcher.handleCancel(cancel)
+	if matcher.getOrder(order.RawOrder.Hash) != nil {
+		t.Fatalf("fully cancelled order should be removed")
+	}
+}
+
+func TestEventMatcher_MatchOrder(t *testing.T) {
+	matcher, book, _, clean := newTestMatcher(t)
+	defer clean()
+
+	taker := newTestOrder(testTokenA, testTokenB, 100, 90)
+	maker1 := newTestOrder(testTokenB, testTokenA, 50, 45)
+	maker2 := newTestOrder(testTokenB, testTokenA, 100, 100)
+	other := newTestOrder(testTokenB, testTokenA, 100, 200)
+	for _, state := range []*types.OrderState{taker, maker1, maker2, other} {
+		matcher.addOrder(book, state)
+	}
+
+	rings := matcher.matchOrder(book, taker.RawOrder.Hash)
+	if len(rings) != 2 {
+		t.Fatalf("rings %d, expect 2", len(rings))
+	}
+	if len(matcher.minedRings) != 2 {
+		t.Fatalf("mined rings %d, expect 2", len(matcher.minedRings))
+	}
+	for _, ring := range rings {
+		for _, filledOrder := range ring.RawRing.Orders {
+			if filledOrder.OrderState.RawOrder.Hash == other.RawOrder.Hash {
+				t.Fatalf("order with invalid price should not be matched")
+			}
+		}
+	}
+
+	// 占用的金额不超过taker的amountS
+	takerOrder := matcher.getOrder(taker.RawOrder.Hash)
+	if len(takerOrder.pendings) != 2 {
+		t.Fatalf("taker pendings %d, expect 2", len(takerOrder.pendings))
+	}
+	pendingS := big.NewInt(0)
+	for _, pending := range takerOrder.pendings {
+		pendingS.Add(pendingS, pending.amountS)
+	}
+	if pendingS.Sign() <= 0 || pendingS.Cmp(taker.RawOrder.AmountS) > 0 {
+		t.Fatalf("taker pending amountS %s, expect (0, %s]", pendingS.String(), taker.RawOrder.AmountS.String())
+	}
+	// 订单簿中的订单状态不因匹配改变
+	if takerOrder.state.DealtAmountS.Sign() != 0 {
+		t.Fatalf("taker dealtAmountS should not be changed by matching")
+	}
+
+	// taker已被占满，再次匹配不产生环路
+	if rings := matcher.matchOrder(book, taker.RawOrder.Hash); len(rings) != 0 {
+		t.Fatalf("rings %d after taker is matched, expect 0", len(rings))
+	}
+
+	// 环路失败后释放占用
+	for ringHash := range matcher.minedRings {
+		matcher.afterSubmit(&types.RingSubmitFailedEvent{RingHash: ringHash})
+	}
+	if len(takerOrder.pendings) != 0 || len(matcher.getOrder(maker1.RawOrder.Hash).pendings) != 0 {
+		t.Fatalf("pendings should be released after ring failed")
+	}
+	if !book.dirty {
+		t.Fatalf("book should be matched again after pendings released")
+	}
+}
+
+func TestEventMatcher_AddMinedRingsAfterOrderRemoved(t *testing.T) {
+	matcher, book, _, clean := newTestMatcher(t)
+	defer clean()
+
+	taker := newTestOrder(testTokenA, testTokenB, 100, 90)
+	maker := newTestOrder(testTokenB, testTokenA, 100, 100)
+	matcher.addOrder(book, taker)
+	matcher.addOrder(book, maker)
+
+	_, candidates := matcher.selectCandidates(book, taker.RawOrder.Hash)
+	if len(candidates) != 1 {
+		t.Fatalf("candidates %d, expect 1", len(candidates))
+	}
+	ring := types.NewRing([]types.OrderState{*taker, *maker})
+	for _, filledOrder := range ring.Orders {
+		filledOrder.FillAmountS = new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS)
+		filledOrder.FillAmountB = new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountB)
+	}
+	ring.Hash = ring.GenerateHash()
+
+	// 匹配期间maker被移出订单簿，环路不再提交
+	matcher.removeOrder(maker.RawOrder.Hash)
+	if added := matcher.addMinedRings([]*types.RingSubmitInfo{{RawRing: ring}}); len(added) != 0 {
+		t.Fatalf("ring with removed order should be dropped")
+	}
+	if len(matcher.getOrder(taker.RawOrder.Hash).pendings) != 0 || len(matcher.minedRings) != 0 {
+		t.Fatalf("dropped ring should not be pending")
+	}
+}
+
+func TestEventMatcher_Fork(t *testing.T) {
+	matcher, book, om, clean := newTestMatcher(t)
+	defer clean()
+
+	filled := newTestOrder(testTokenA, testTokenB, 10, 10)
+	cancelled := newTestOrder(testTokenB, testTokenA, 10, 10)
+	matcher.addOrder(book, filled)
+	matcher.addOrder(book, cancelled)
+	ether := big.NewInt(1e18)
+	matcher.handleFill(&types.OrderFilledEvent{OrderHash: filled.RawOrder.Hash, AmountS: new(big.Int).Mul(big.NewInt(4), ether), AmountB: new(big.Int).Mul(big.NewInt(4), ether)})
+	matcher.getOrder(filled.RawOrder.Hash).pendings = []*pendingFill{{ringHash: common.HexToHash("0x01"), amountS: big.NewInt(1), amountB: big.NewInt(1)}}
+
+	// 分叉回滚后成交被撤销，取消的订单状态在新链上已结束
+	rolledBack := newTestOrder(testTokenA, testTokenB, 10, 10)
+	rolledBack.RawOrder = filled.RawOrder
+	om.states[filled.RawOrder.Hash] = rolledBack
+	cancelledState := *cancelled
+	cancelledState.Status = types.ORDER_CANCEL
+	om.states[cancelled.RawOrder.Hash] = &cancelledState
+
+	matcher.handleFork(&types.ForkedEvent{ForkBlock: big.NewInt(10), EndBlock: big.NewInt(12)})
+	matcher.handleNewBlock(&types.BlockEvent{BlockNumber: big.NewInt(11)})
+
+	order := matcher.getOrder(filled.RawOrder.Hash)
+	if nil == order || order.state.DealtAmountS.Sign() != 0 {
+		t.Fatalf("dealt amount should be reloaded after fork")
+	}
+	if len(order.pendings) != 1 {
+		t.Fatalf("pendings should be kept after fork")
+	}
+	if matcher.getOrder(cancelled.RawOrder.Hash) != nil {
+		t.Fatalf("order cancelled after fork should be removed")
+	}
+	if matcher.forked {
+		t.Fatalf("fork flag should be reset")
+	}
+}
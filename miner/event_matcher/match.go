@@ -0,0 +1,244 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package event_matcher
+
+import (
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// 每次匹配最多计算的对手方订单数，按价格从优到劣
+const maxCandidates = 20
+
+// matchBook 以订单簿中每个订单作为taker重新匹配，调用方需持有roundMtx
+func (matcher *EventMatcher) matchBook(book *OrderBook) []*types.RingSubmitInfo {
+	matcher.mtx.Lock()
+	book.dirty = false
+	orderHashes := []common.Hash{}
+	for orderHash, order := range book.orders {
+		if order.state.RawOrder.TokenS == book.TokenA {
+			orderHashes = append(orderHashes, orderHash)
+		}
+	}
+	matcher.mtx.Unlock()
+
+	rings := []*types.RingSubmitInfo{}
+	for _, orderHash := range orderHashes {
+		rings = append(rings, matcher.matchOrder(book, orderHash)...)
+	}
+	return rings
+}
+
+// matchOrder 将订单与对手方订单逐个成环，直到订单完全匹配或者没有可以获利的环路，
+// 调用方需持有roundMtx，计算费用以及估算gas时使用订单副本，不持有mtx
+func (matcher *EventMatcher) matchOrder(book *OrderBook, orderHash common.Hash) []*types.RingSubmitInfo {
+	rings := []*types.RingSubmitInfo{}
+
+	matcher.mtx.Lock()
+	taker, candidates := matcher.selectCandidates(book, orderHash)
+	matcher.mtx.Unlock()
+	if nil == taker || len(candidates) == 0 {
+		return rings
+	}
+
+	matcher.statsMtx.Lock()
+	book.stats.Rounds += 1
+	book.stats.LastBlockNumber = matcher.lastBlockNumber.Int64()
+	book.stats.LastRoundTime = time.Now().Unix()
+	matcher.statsMtx.Unlock()
+
+	if err := matcher.refreshAvailableAmount(append([]*bookOrder{taker}, candidates...)); nil != err {
+		log.Errorf("miner,event matcher get balance and allowance err:%s", err.Error())
+		return rings
+	}
+
+	for range candidates {
+		takerState := taker.remainedState()
+		if matcher.om.IsOrderFullFinished(takerState) || !taker.hasAvailableAmount(takerState) {
+			break
+		}
+		var (
+			ringForSubmit *types.RingSubmitInfo
+			matchedMaker  *bookOrder
+		)
+		for _, maker := range candidates {
+			makerState := maker.remainedState()
+			if matcher.om.IsOrderFullFinished(makerState) || !maker.hasAvailableAmount(makerState) {
+				continue
+			}
+			ringTmp := types.NewRing([]types.OrderState{*takerState, *makerState})
+			if err := matcher.evaluator.ComputeRing(ringTmp); nil != err {
+				log.Debugf("miner,event matcher compute ring:%s err:%s", ringTmp.Hash.Hex(), err.Error())
+				continue
+			}
+			ringForSubmitTmp, err := matcher.submitter.GenerateRingSubmitInfo(ringTmp)
+			if nil != err {
+				log.Debugf("miner,event matcher generate ring:%s err:%s", ringTmp.Hash.Hex(), err.Error())
+				continue
+			}
+			if nil == ringForSubmit || ringForSubmit.Received.Cmp(ringForSubmitTmp.Received) < 0 {
+				ringForSubmit = ringForSubmitTmp
+				matchedMaker = maker
+			}
+		}
+		if nil == ringForSubmit {
+			break
+		}
+		taker.addPending(ringForSubmit)
+		matchedMaker.addPending(ringForSubmit)
+		rings = append(rings, ringForSubmit)
+	}
+
+	matcher.mtx.Lock()
+	rings = matcher.addMinedRings(rings)
+	matcher.mtx.Unlock()
+
+	if len(rings) > 0 {
+		matcher.statsMtx.Lock()
+		book.stats.MatchedOrders += 2 * len(rings)
+		book.stats.Rings += int64(len(rings))
+		matcher.statsMtx.Unlock()
+	}
+	return rings
+}
+
+// 复制taker以及按价格从优到劣的对手方订单，调用方需持有锁
+func (matcher *EventMatcher) selectCandidates(book *OrderBook, orderHash common.Hash) (*bookOrder, []*bookOrder) {
+	taker, ok := book.orders[orderHash]
+	if !ok {
+		return nil, nil
+	}
+
+	candidates := []*bookOrder{}
+	for _, maker := range book.orders {
+		rawOrder := maker.state.RawOrder
+		if rawOrder.Protocol == taker.state.RawOrder.Protocol && rawOrder.TokenS == taker.state.RawOrder.TokenB &&
+			rawOrder.TokenB == taker.state.RawOrder.TokenS && miner.PriceValid(taker.state, maker.state) {
+			candidates = append(candidates, maker.clone())
+		}
+	}
+	//taker每单位tokenB得到的tokenS越多越优
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].state.RawOrder.Price.Cmp(candidates[j].state.RawOrder.Price) > 0
+	})
+	if len(candidates) > maxCandidates {
+		candidates = candidates[:maxCandidates]
+	}
+	return taker.clone(), candidates
+}
+
+// 环路中每个订单的成交量记为未确认的占用金额，匹配期间已移出订单簿的订单所在的环路不再提交，调用方需持有锁
+func (matcher *EventMatcher) addMinedRings(rings []*types.RingSubmitInfo) []*types.RingSubmitInfo {
+	added := []*types.RingSubmitInfo{}
+	for _, ringForSubmit := range rings {
+		removed := false
+		for _, filledOrder := range ringForSubmit.RawRing.Orders {
+			if nil == matcher.getOrder(filledOrder.OrderState.RawOrder.Hash) {
+				removed = true
+			}
+		}
+		if removed {
+			log.Debugf("miner,event matcher ring:%s dropped, order removed while matching", ringForSubmit.RawRing.Hash.Hex())
+			continue
+		}
+		matcher.addMinedRing(ringForSubmit)
+		added = append(added, ringForSubmit)
+	}
+	return added
+}
+
+func (matcher *EventMatcher) addMinedRing(ringForSubmit *types.RingSubmitInfo) {
+	ringHash := ringForSubmit.RawRing.Hash
+	ringState := &minedRing{orderHashes: []common.Hash{}}
+	if matcher.lastBlockNumber.Sign() > 0 {
+		ringState.blockNumber = new(big.Int).Set(matcher.lastBlockNumber)
+	}
+	for _, filledOrder := range ringForSubmit.RawRing.Orders {
+		orderHash := filledOrder.OrderState.RawOrder.Hash
+		if order := matcher.getOrder(orderHash); nil != order {
+			order.addPending(ringForSubmit)
+		}
+		ringState.orderHashes = append(ringState.orderHashes, orderHash)
+	}
+	matcher.minedRings[ringHash] = ringState
+}
+
+// 按最新的余额以及授权计算订单可用金额，与ordermanager提供给miner的订单一致
+func (matcher *EventMatcher) refreshAvailableAmount(orders []*bookOrder) error {
+	accessor := matcher.submitter.Accessor
+	reqs := []*ethaccessor.BatchErc20Req{}
+	for _, order := range orders {
+		spender, err := accessor.GetSenderAddress(order.state.RawOrder.Protocol)
+		if nil != err {
+			return err
+		}
+		reqs = append(reqs, &ethaccessor.BatchErc20Req{
+			Owner:          order.state.RawOrder.Owner,
+			Token:          order.state.RawOrder.TokenS,
+			Spender:        spender,
+			BlockParameter: "latest",
+		})
+	}
+	if err := accessor.BatchErc20BalanceAndAllowance(reqs); nil != err {
+		return err
+	}
+	for idx, req := range reqs {
+		state := orders[idx].state
+		if nil != req.BalanceErr || nil != req.AllowanceErr {
+			state.AvailableAmountS = big.NewInt(0)
+			continue
+		}
+		available := new(big.Int).Sub(state.RawOrder.AmountS, new(big.Int).Add(state.DealtAmountS, state.CancelledAmountS))
+		if available.Cmp(req.Balance.BigInt()) > 0 {
+			available = req.Balance.BigInt()
+		}
+		if available.Cmp(req.Allowance.BigInt()) > 0 {
+			available = req.Allowance.BigInt()
+		}
+		state.AvailableAmountS = available
+	}
+	return nil
+}
+
+// 可用金额扣除未确认环路的占用后仍大于0，过小的金额由evaluator以及最低收益过滤
+func (order *bookOrder) hasAvailableAmount(state *types.OrderState) bool {
+	if nil == state.AvailableAmountS {
+		return false
+	}
+	available := new(big.Int).Set(state.AvailableAmountS)
+	for _, pending := range order.pendings {
+		available.Sub(available, pending.amountS)
+	}
+	if available.Sign() <= 0 {
+		return false
+	}
+	state.AvailableAmountS = available
+	return true
+}
+
+func intFromRat(rat *big.Rat) *big.Int {
+	return new(big.Int).Div(rat.Num(), rat.Denom())
+}
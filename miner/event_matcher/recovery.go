@@ -0,0 +1,155 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package event_matcher
+
+import (
+	"math/big"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const ringExpiredErr = "ring expired"
+
+// 根据ring_submit_info以及filled_order中未打包也未失败的环路，恢复已占用的订单金额，调用方需持有锁
+func (matcher *EventMatcher) recoverMinedRings() {
+	infos, err := matcher.rds.GetUnfinishedRingSubmitInfos()
+	if nil != err {
+		log.Errorf("miner,event matcher get unfinished rings err:%s", err.Error())
+		return
+	}
+
+	for _, info := range infos {
+		if _, err := matcher.rds.FindRingMinedByRingHash(info.RingHash); nil == err {
+			continue
+		}
+		ringhash := common.HexToHash(info.RingHash)
+		daoFilledOrders, err := matcher.rds.GetFilledOrdersByRinghash(ringhash)
+		if nil != err {
+			log.Errorf("miner,event matcher get filled orders of ring:%s err:%s", info.RingHash, err.Error())
+			continue
+		}
+		ringState := &minedRing{orderHashes: []common.Hash{}}
+		for _, daoFilledOrder := range daoFilledOrders {
+			orderHash := common.HexToHash(daoFilledOrder.OrderHash)
+			fillAmountS, okS := new(big.Rat).SetString(daoFilledOrder.FillAmountS)
+			fillAmountB, okB := new(big.Rat).SetString(daoFilledOrder.FillAmountB)
+			if !okS || !okB {
+				log.Errorf("miner,event matcher recover filled order:%s err:invalid fill amount", daoFilledOrder.OrderHash)
+				continue
+			}
+			if order := matcher.getOrder(orderHash); nil != order {
+				order.pendings = append(order.pendings, &pendingFill{ringHash: ringhash, amountS: intFromRat(fillAmountS), amountB: intFromRat(fillAmountB)})
+			}
+			ringState.orderHashes = append(ringState.orderHashes, orderHash)
+		}
+		matcher.minedRings[ringhash] = ringState
+		log.Debugf("miner,event matcher recovered ring:%s, orders:%d", info.RingHash, len(daoFilledOrders))
+	}
+}
+
+// 超过expireBlocks仍未确认的环路，交易已被打包或仍在交易池中时重新计算等待区块，否则释放其占用的订单金额，并标记为失败
+func (matcher *EventMatcher) expireMinedRings(blockNumber *big.Int) {
+	if matcher.expireBlocks.Sign() <= 0 {
+		return
+	}
+
+	matcher.mtx.Lock()
+	candidates := []common.Hash{}
+	for ringhash, ringState := range matcher.minedRings {
+		if nil == ringState.blockNumber {
+			ringState.blockNumber = new(big.Int).Set(blockNumber)
+			continue
+		}
+		if new(big.Int).Sub(blockNumber, ringState.blockNumber).Cmp(matcher.expireBlocks) > 0 {
+			candidates = append(candidates, ringhash)
+		}
+	}
+	matcher.mtx.Unlock()
+
+	//查询节点时不持有锁
+	expiredRinghashes := []common.Hash{}
+	waitingRinghashes := []common.Hash{}
+	for _, ringhash := range candidates {
+		if matcher.ringTxPending(ringhash) {
+			waitingRinghashes = append(waitingRinghashes, ringhash)
+		} else {
+			expiredRinghashes = append(expiredRinghashes, ringhash)
+		}
+	}
+
+	matcher.mtx.Lock()
+	for _, ringhash := range waitingRinghashes {
+		if ringState, ok := matcher.minedRings[ringhash]; ok {
+			ringState.blockNumber = new(big.Int).Set(blockNumber)
+		}
+	}
+	for _, ringhash := range expiredRinghashes {
+		matcher.releaseMinedRing(ringhash)
+	}
+	matcher.mtx.Unlock()
+
+	if len(expiredRinghashes) > 0 {
+		log.Infof("miner,event matcher %d rings expired at block:%s", len(expiredRinghashes), blockNumber.String())
+		if err := matcher.rds.UpdateRingSubmitInfoFailed(expiredRinghashes, ringExpiredErr); nil != err {
+			log.Errorf("miner,event matcher update expired rings err:%s", err.Error())
+		}
+	}
+}
+
+// 环路的submitRing交易已被打包或仍在节点交易池中，结果由RingMined或交易结束事件处理，查询失败时同样等待
+func (matcher *EventMatcher) ringTxPending(ringhash common.Hash) bool {
+	info, err := matcher.rds.GetRingForSubmitByHash(ringhash)
+	if nil != err || "" == info.ProtocolTxHash {
+		return false
+	}
+	accessor := matcher.submitter.Accessor
+
+	var receipt ethaccessor.TransactionReceipt
+	if err := accessor.Call(&receipt, "eth_getTransactionReceipt", info.ProtocolTxHash); nil != err {
+		log.Errorf("miner,event matcher get receipt of tx:%s err:%s", info.ProtocolTxHash, err.Error())
+		return true
+	}
+	if "" != receipt.BlockHash {
+		return true
+	}
+
+	var tx *ethaccessor.Transaction
+	if err := accessor.Call(&tx, "eth_getTransactionByHash", info.ProtocolTxHash); nil != err {
+		log.Errorf("miner,event matcher get tx:%s err:%s", info.ProtocolTxHash, err.Error())
+		return true
+	}
+	return nil != tx
+}
+
+// 释放环路占用的订单金额，涉及的订单簿在下一个区块重新匹配，调用方需持有锁
+func (matcher *EventMatcher) releaseMinedRing(ringHash common.Hash) {
+	ringState, ok := matcher.minedRings[ringHash]
+	if !ok {
+		return
+	}
+	delete(matcher.minedRings, ringHash)
+	for _, orderHash := range ringState.orderHashes {
+		if book, ok := matcher.orders[orderHash]; ok {
+			book.orders[orderHash].removePending(ringHash)
+			book.dirty = true
+		}
+	}
+}
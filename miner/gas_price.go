@@ -0,0 +1,195 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/rpc"
+)
+
+// GasPriceStrategy decides the gas price of submitting a ring, suggested is the price returned by eth_gasPrice
+type GasPriceStrategy interface {
+	GasPrice(ringState *types.Ring, gas, suggested *big.Int) (*big.Int, error)
+}
+
+func NewGasPriceStrategy(options config.GasPriceOptions, accessor *ethaccessor.EthNodeAccessor, marketCapProvider *marketcap.MarketCapProvider) (GasPriceStrategy, error) {
+	var strategy GasPriceStrategy
+	switch options.Strategy {
+	case "", "node":
+		strategy = &NodeGasPriceStrategy{}
+	case "fixed":
+		if options.FixedPrice <= 0 {
+			return nil, errors.New("miner,fixed gas price must be greater than 0")
+		}
+		strategy = &FixedGasPriceStrategy{price: big.NewInt(options.FixedPrice)}
+	case "percentile":
+		strategy = NewPercentileGasPriceStrategy(accessor, options.BlockCount, options.Percentile)
+	case "profit":
+		if options.ProfitShare <= 0 || options.ProfitShare > 1 {
+			return nil, errors.New("miner,profit share of gas price must be in (0, 1]")
+		}
+		strategy = &ProfitGasPriceStrategy{marketCapProvider: marketCapProvider, share: new(big.Rat).SetFloat64(options.ProfitShare)}
+	default:
+		return nil, fmt.Errorf("miner,unsupported gas price strategy:%s", options.Strategy)
+	}
+
+	bounded := &boundedGasPriceStrategy{strategy: strategy}
+	if options.MinPrice > 0 {
+		bounded.min = big.NewInt(options.MinPrice)
+	}
+	if options.MaxPrice > 0 {
+		bounded.max = big.NewInt(options.MaxPrice)
+	}
+	if nil != bounded.min && nil != bounded.max && bounded.min.Cmp(bounded.max) > 0 {
+		return nil, errors.New("miner,min gas price must not be greater than max gas price")
+	}
+	return bounded, nil
+}
+
+// 使用节点的eth_gasPrice
+type NodeGasPriceStrategy struct{}
+
+func (s *NodeGasPriceStrategy) GasPrice(ringState *types.Ring, gas, suggested *big.Int) (*big.Int, error) {
+	return new(big.Int).Set(suggested), nil
+}
+
+type FixedGasPriceStrategy struct {
+	price *big.Int
+}
+
+func (s *FixedGasPriceStrategy) GasPrice(ringState *types.Ring, gas, suggested *big.Int) (*big.Int, error) {
+	return new(big.Int).Set(s.price), nil
+}
+
+// 取最近blockCount个区块中所有交易gasPrice的分位数，按最新区块缓存
+type PercentileGasPriceStrategy struct {
+	accessor    *ethaccessor.EthNodeAccessor
+	blockCount  int
+	percentile  int
+	mtx         sync.Mutex
+	blockNumber *big.Int
+	price       *big.Int
+}
+
+func NewPercentileGasPriceStrategy(accessor *ethaccessor.EthNodeAccessor, blockCount, percentile int) *PercentileGasPriceStrategy {
+	if blockCount <= 0 {
+		blockCount = 20
+	}
+	if percentile < 0 {
+		percentile = 0
+	} else if percentile > 100 {
+		percentile = 100
+	}
+	return &PercentileGasPriceStrategy{accessor: accessor, blockCount: blockCount, percentile: percentile}
+}
+
+func (s *PercentileGasPriceStrategy) GasPrice(ringState *types.Ring, gas, suggested *big.Int) (*big.Int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var blockNumber types.Big
+	if err := s.accessor.Call(&blockNumber, "eth_blockNumber"); nil != err {
+		return nil, err
+	}
+	if nil != s.blockNumber && s.blockNumber.Cmp(blockNumber.BigInt()) == 0 {
+		return new(big.Int).Set(s.price), nil
+	}
+
+	latest := blockNumber.Int64()
+	blocks := make([]ethaccessor.BlockWithTxObject, s.blockCount)
+	reqElems := []rpc.BatchElem{}
+	for i := 0; i < s.blockCount && latest-int64(i) >= 0; i++ {
+		reqElems = append(reqElems, rpc.BatchElem{
+			Method: "eth_getBlockByNumber",
+			Args:   []interface{}{fmt.Sprintf("%#x", latest-int64(i)), true},
+			Result: &blocks[i],
+		})
+	}
+	if err := s.accessor.Client.BatchCall(reqElems); nil != err {
+		return nil, err
+	}
+
+	prices := []*big.Int{}
+	for idx, elem := range reqElems {
+		if nil != elem.Error {
+			return nil, elem.Error
+		}
+		for _, tx := range blocks[idx].Transactions {
+			prices = append(prices, new(big.Int).Set(tx.GasPrice.BigInt()))
+		}
+	}
+	//最近的区块中没有交易时使用节点价格
+	price := new(big.Int).Set(suggested)
+	if len(prices) > 0 {
+		sort.Slice(prices, func(i, j int) bool { return prices[i].Cmp(prices[j]) < 0 })
+		price = prices[(len(prices)-1)*s.percentile/100]
+	}
+	s.blockNumber = new(big.Int).Set(blockNumber.BigInt())
+	s.price = price
+	return new(big.Int).Set(price), nil
+}
+
+// 按环路收益出价，gas费用最多占LegalFee的share
+type ProfitGasPriceStrategy struct {
+	marketCapProvider *marketcap.MarketCapProvider
+	share             *big.Rat
+}
+
+func (s *ProfitGasPriceStrategy) GasPrice(ringState *types.Ring, gas, suggested *big.Int) (*big.Int, error) {
+	ethCap := s.marketCapProvider.GetEthCap()
+	if nil == ringState.LegalFee || ethCap.Sign() <= 0 || gas.Sign() <= 0 {
+		return new(big.Int).Set(suggested), nil
+	}
+	//price = share * legalFee / (gas * ethCap)
+	price := new(big.Rat).Mul(ringState.LegalFee, s.share)
+	price.Quo(price, new(big.Rat).Mul(new(big.Rat).SetInt(gas), ethCap))
+	if price.Sign() <= 0 {
+		return big.NewInt(0), nil
+	}
+	return new(big.Int).Quo(price.Num(), price.Denom()), nil
+}
+
+type boundedGasPriceStrategy struct {
+	strategy GasPriceStrategy
+	min      *big.Int
+	max      *big.Int
+}
+
+func (s *boundedGasPriceStrategy) GasPrice(ringState *types.Ring, gas, suggested *big.Int) (*big.Int, error) {
+	price, err := s.strategy.GasPrice(ringState, gas, suggested)
+	if nil != err {
+		return nil, err
+	}
+	if nil != s.min && price.Cmp(s.min) < 0 {
+		price.Set(s.min)
+	}
+	if nil != s.max && price.Cmp(s.max) > 0 {
+		price.Set(s.max)
+	}
+	return price, nil
+}
@@ -0,0 +1,136 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"fmt"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/miner"
+	"github.com/ethereum/go-ethereum/rpc"
+	"math/big"
+	"testing"
+)
+
+// 模拟节点，提供eth_blockNumber及带交易的eth_getBlockByNumber
+type GasPriceApi struct {
+	latest int64
+	prices map[int64][]int64
+}
+
+func (api *GasPriceApi) BlockNumber() string {
+	return fmt.Sprintf("%#x", api.latest)
+}
+
+func (api *GasPriceApi) GetBlockByNumber(number string, full bool) (map[string]interface{}, error) {
+	n, _ := new(big.Int).SetString(number[2:], 16)
+	txs := []map[string]interface{}{}
+	for _, price := range api.prices[n.Int64()] {
+		txs = append(txs, map[string]interface{}{"gasPrice": fmt.Sprintf("%#x", price)})
+	}
+	return map[string]interface{}{"number": number, "transactions": txs}, nil
+}
+
+func newGasPriceAccessor(t *testing.T, api *GasPriceApi) *ethaccessor.EthNodeAccessor {
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", api); err != nil {
+		t.Fatal(err)
+	}
+	return &ethaccessor.EthNodeAccessor{Client: rpc.DialInProc(server)}
+}
+
+func TestPercentileGasPriceStrategy_GasPrice(t *testing.T) {
+	suggested := big.NewInt(1000)
+	full := map[int64][]int64{100: {9, 3, 7, 1, 5}, 99: {2, 10, 4, 8, 6}, 98: {100}}
+
+	cases := []struct {
+		prices     map[int64][]int64
+		blockCount int
+		percentile int
+		expected   int64
+	}{
+		// 10笔交易，下标为(10-1)*percentile/100
+		{full, 2, 0, 1},
+		{full, 2, 50, 5},
+		{full, 2, 90, 9},
+		{full, 2, 100, 10},
+		{full, 3, 100, 100},
+		// 超出[0,100]的分位数按边界处理
+		{full, 2, -10, 1},
+		{full, 2, 150, 10},
+		// 没有交易时使用节点价格
+		{map[int64][]int64{}, 2, 50, 1000},
+		{map[int64][]int64{}, 2, 0, 1000},
+	}
+	for i, c := range cases {
+		accessor := newGasPriceAccessor(t, &GasPriceApi{latest: 100, prices: c.prices})
+		strategy := miner.NewPercentileGasPriceStrategy(accessor, c.blockCount, c.percentile)
+		price, err := strategy.GasPrice(nil, big.NewInt(0), suggested)
+		if err != nil {
+			t.Fatalf("case %d, %s", i, err.Error())
+		}
+		if price.Int64() != c.expected {
+			t.Errorf("case %d, blocks:%d percentile:%d, price %s, expect %d", i, c.blockCount, c.percentile, price.String(), c.expected)
+		}
+	}
+}
+
+func TestNewGasPriceStrategy_Bounds(t *testing.T) {
+	api := &GasPriceApi{latest: 100, prices: map[int64][]int64{100: {10, 20, 30}}}
+	accessor := newGasPriceAccessor(t, api)
+
+	cases := []struct {
+		options  config.GasPriceOptions
+		expected int64
+	}{
+		{config.GasPriceOptions{Strategy: "fixed", FixedPrice: 50}, 50},
+		{config.GasPriceOptions{Strategy: "fixed", FixedPrice: 50, MinPrice: 60}, 60},
+		{config.GasPriceOptions{Strategy: "fixed", FixedPrice: 50, MaxPrice: 40}, 40},
+		{config.GasPriceOptions{Strategy: "fixed", FixedPrice: 50, MinPrice: 50, MaxPrice: 50}, 50},
+		{config.GasPriceOptions{Strategy: "node", MinPrice: 10, MaxPrice: 2000}, 1000},
+		{config.GasPriceOptions{Strategy: "node", MaxPrice: 500}, 500},
+		{config.GasPriceOptions{Strategy: "percentile", BlockCount: 1, Percentile: 100, MaxPrice: 25}, 25},
+		{config.GasPriceOptions{Strategy: "percentile", BlockCount: 1, Percentile: 0, MinPrice: 15}, 15},
+	}
+	for i, c := range cases {
+		strategy, err := miner.NewGasPriceStrategy(c.options, accessor, nil)
+		if err != nil {
+			t.Fatalf("case %d, %s", i, err.Error())
+		}
+		price, err := strategy.GasPrice(nil, big.NewInt(0), big.NewInt(1000))
+		if err != nil {
+			t.Fatalf("case %d, %s", i, err.Error())
+		}
+		if price.Int64() != c.expected {
+			t.Errorf("case %d, %+v, price %s, expect %d", i, c.options, price.String(), c.expected)
+		}
+	}
+
+	invalid := []config.GasPriceOptions{
+		{Strategy: "fixed"},
+		{Strategy: "node", MinPrice: 20, MaxPrice: 10},
+		{Strategy: "profit", ProfitShare: 1.5},
+		{Strategy: "unknown"},
+	}
+	for _, options := range invalid {
+		if _, err := miner.NewGasPriceStrategy(options, accessor, nil); err == nil {
+			t.Errorf("options %+v should be rejected", options)
+		}
+	}
+}
@@ -18,7 +18,25 @@
 
 package miner
 
+import "github.com/ethereum/go-ethereum/common"
+
 type Matcher interface {
 	Start()
 	Stop()
+	TriggerRound()
+	Stats() []MarketStats
+}
+
+// MarketStats 记录每个市场的匹配情况，订单数为最近一轮的数量
+type MarketStats struct {
+	Market          string         `json:"market"`
+	TokenA          common.Address `json:"tokenA"`
+	TokenB          common.Address `json:"tokenB"`
+	Rounds          int64          `json:"rounds"`
+	LastBlockNumber int64          `json:"lastBlockNumber"`
+	LastRoundTime   int64          `json:"lastRoundTime"`
+	AtoBOrders      int            `json:"atoBOrders"`
+	BtoAOrders      int            `json:"btoAOrders"`
+	MatchedOrders   int            `json:"matchedOrders"`
+	Rings           int64          `json:"rings"`
 }
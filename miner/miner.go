@@ -19,8 +19,10 @@
 package miner
 
 import (
+	"errors"
 	"github.com/Loopring/relay/ethaccessor"
 	"github.com/Loopring/relay/marketcap"
+	"sync"
 )
 
 type Miner struct {
@@ -29,6 +31,9 @@ type Miner struct {
 	submitter         *RingSubmitter
 	marketCapProvider *marketcap.MarketCapProvider
 	evaluator         *Evaluator
+
+	paused bool
+	mtx    sync.Mutex
 }
 
 func (minerInstance *Miner) Start() {
@@ -41,6 +46,56 @@ func (minerInstance *Miner) Stop() {
 	minerInstance.submitter.stop()
 }
 
+// Pause stops matching new rings, rings already submitted are still followed by the submitter
+func (minerInstance *Miner) Pause() {
+	minerInstance.mtx.Lock()
+	defer minerInstance.mtx.Unlock()
+
+	if !minerInstance.paused {
+		minerInstance.matcher.Stop()
+		minerInstance.paused = true
+	}
+}
+
+func (minerInstance *Miner) Resume() {
+	minerInstance.mtx.Lock()
+	defer minerInstance.mtx.Unlock()
+
+	if minerInstance.paused {
+		minerInstance.matcher.Start()
+		minerInstance.paused = false
+	}
+}
+
+func (minerInstance *Miner) IsPaused() bool {
+	minerInstance.mtx.Lock()
+	defer minerInstance.mtx.Unlock()
+
+	return minerInstance.paused
+}
+
+// TriggerRound 立即进行一轮匹配，暂停时不允许
+func (minerInstance *Miner) TriggerRound() error {
+	minerInstance.mtx.Lock()
+	paused := minerInstance.paused
+	minerInstance.mtx.Unlock()
+
+	if paused {
+		return errors.New("miner,miner is paused")
+	}
+	minerInstance.matcher.TriggerRound()
+	return nil
+}
+
+func (minerInstance *Miner) Stats() []MarketStats {
+	return minerInstance.matcher.Stats()
+}
+
+// Api returns methods of miner namespace
+func (minerInstance *Miner) Api() interface{} {
+	return &MinerApi{miner: minerInstance, rds: minerInstance.submitter.dbService}
+}
+
 func NewMiner(submitter *RingSubmitter, matcher Matcher, evaluator *Evaluator, accessor *ethaccessor.EthNodeAccessor, marketCapProvider *marketcap.MarketCapProvider) *Miner {
 	return &Miner{
 		marketCapProvider: marketCapProvider,
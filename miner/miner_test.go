@@ -68,7 +68,7 @@ func TestMatch(t *testing.T) {
 	marketCapProvider := marketcap.NewMarketCapProvider(cfg.Miner)
 	submitter := miner.NewSubmitter(cfg.Miner, accessor, rdsService, marketCapProvider)
 	evaluator := miner.NewEvaluator(marketCapProvider, int64(1000000000000000), accessor)
-	matcher := timing_matcher.NewTimingMatcher(submitter, evaluator, om)
+	matcher := timing_matcher.NewTimingMatcher(cfg.Miner, submitter, evaluator, om, rdsService)
 
 	m := miner.NewMiner(submitter, matcher, evaluator, accessor, marketCapProvider)
 	m.Start()
@@ -0,0 +1,133 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"math/big"
+)
+
+const (
+	simulateBlockParameter = "pending"
+	ringMinedEventName     = "RingMined"
+)
+
+/**
+提交前在pending状态上模拟环路：
+1.通过debug_traceCall执行submitRing，失败说明环路会被revert
+2.解析模拟执行产生的RingMined事件，与evaluator计算的每个订单的成交量比较，偏差超过tolerance或者没有产生RingMined的环路不再提交
+*/
+type RingSimulator struct {
+	accessor  *ethaccessor.EthNodeAccessor
+	tolerance *big.Rat
+}
+
+func NewRingSimulator(accessor *ethaccessor.EthNodeAccessor, tolerance float64) *RingSimulator {
+	simulator := &RingSimulator{accessor: accessor, tolerance: new(big.Rat)}
+	if tolerance > 0 {
+		simulator.tolerance.SetFloat64(tolerance)
+	}
+	return simulator
+}
+
+func (simulator *RingSimulator) Simulate(sender common.Address, ringState *types.RingSubmitInfo) error {
+	frame, err := simulator.accessor.TraceTransaction(sender, ringState.ProtocolAddress, ringState.ProtocolGas, ringState.ProtocolGasPrice, ringState.ProtocolData, simulateBlockParameter)
+	if nil != err {
+		return fmt.Errorf("simulate,trace ring err:%s", err.Error())
+	}
+	if "" != frame.Error {
+		return fmt.Errorf("simulate,ring will be reverted:%s", frame.Error)
+	}
+
+	fills, err := simulator.minedFills(ringState, frame)
+	if nil != err {
+		return err
+	}
+
+	for _, filledOrder := range ringState.RawRing.Orders {
+		orderHash := filledOrder.OrderState.RawOrder.Hash
+		fill, ok := fills[orderHash]
+		if !ok {
+			return fmt.Errorf("simulate,order:%s is not filled in simulated ring", orderHash.Hex())
+		}
+		simulatedS := new(big.Rat).SetInt(fill.AmountS)
+		simulatedB := new(big.Rat).SetInt(fill.AmountB)
+		if !simulator.withinTolerance(filledOrder.FillAmountS, simulatedS) ||
+			!simulator.withinTolerance(filledOrder.FillAmountB, simulatedB) {
+			return fmt.Errorf("simulate,fill amount of order:%s deviates, fillAmountS:%s simulated:%s, fillAmountB:%s simulated:%s",
+				orderHash.Hex(),
+				filledOrder.FillAmountS.FloatString(0), fill.AmountS.String(),
+				filledOrder.FillAmountB.FloatString(0), fill.AmountB.String())
+		}
+	}
+	log.Debugf("miner,simulate ring:%s success", ringState.Ringhash.Hex())
+	return nil
+}
+
+// 从模拟执行的日志中找到协议合约的RingMined事件，按订单返回成交量
+func (simulator *RingSimulator) minedFills(ringState *types.RingSubmitInfo, frame *ethaccessor.CallFrame) (map[common.Hash]*types.OrderFilledEvent, error) {
+	protocolAbi := simulator.accessor.ProtocolImplAbi
+	event, ok := protocolAbi.Events[ringMinedEventName]
+	if !ok {
+		return nil, fmt.Errorf("simulate,protocol abi has no event %s", ringMinedEventName)
+	}
+
+	for _, evtLog := range frame.AllLogs() {
+		if common.HexToAddress(evtLog.Address) != ringState.ProtocolAddress || len(evtLog.Topics) < 2 || common.HexToHash(evtLog.Topics[0]) != event.Id() {
+			continue
+		}
+		data, err := hexutil.Decode(evtLog.Data)
+		if nil != err {
+			return nil, fmt.Errorf("simulate,decode ring mined data err:%s", err.Error())
+		}
+		contractEvent := &ethaccessor.RingMinedEvent{}
+		if err := protocolAbi.Unpack(contractEvent, ringMinedEventName, data, abi.SEL_UNPACK_EVENT); nil != err {
+			return nil, fmt.Errorf("simulate,unpack ring mined event err:%s", err.Error())
+		}
+		contractEvent.RingHash = common.HexToHash(evtLog.Topics[1])
+		if contractEvent.RingHash != ringState.Ringhash {
+			continue
+		}
+		_, fills, err := contractEvent.ConvertDown()
+		if nil != err {
+			return nil, fmt.Errorf("simulate,%s", err.Error())
+		}
+		res := make(map[common.Hash]*types.OrderFilledEvent)
+		for _, fill := range fills {
+			res[fill.OrderHash] = fill
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("simulate,ring:%s is not mined in simulation", ringState.Ringhash.Hex())
+}
+
+// |simulated - expected| <= expected * tolerance
+func (simulator *RingSimulator) withinTolerance(expected, simulated *big.Rat) bool {
+	deviation := new(big.Rat).Sub(simulated, expected)
+	deviation.Abs(deviation)
+	limit := new(big.Rat).Abs(expected)
+	limit.Mul(limit, simulator.tolerance)
+	return deviation.Cmp(limit) <= 0
+}
@@ -0,0 +1,157 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner
+
+import (
+	"fmt"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.uber.org/zap"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+func TestRingSimulator_WithinTolerance(t *testing.T) {
+	cases := []struct {
+		tolerance           float64
+		expected, simulated *big.Rat
+		within              bool
+	}{
+		{0.01, big.NewRat(100, 1), big.NewRat(100, 1), true},
+		{0.01, big.NewRat(100, 1), big.NewRat(101, 1), true},
+		{0.01, big.NewRat(100, 1), big.NewRat(99, 1), true},
+		{0.01, big.NewRat(100, 1), big.NewRat(1011, 10), false},
+		{0.01, big.NewRat(100, 1), big.NewRat(989, 10), false},
+		{0.01, big.NewRat(0, 1), big.NewRat(0, 1), true},
+		{0.01, big.NewRat(0, 1), big.NewRat(1, 1), false},
+		{0, big.NewRat(100, 1), big.NewRat(100, 1), true},
+		{0, big.NewRat(100, 1), big.NewRat(1001, 10), false},
+		{-1, big.NewRat(100, 1), big.NewRat(1001, 10), false},
+	}
+	for i, c := range cases {
+		simulator := NewRingSimulator(nil, c.tolerance)
+		if within := simulator.withinTolerance(c.expected, c.simulated); within != c.within {
+			t.Errorf("case %d, tolerance %v, expected %s simulated %s, within:%t, expect:%t", i, c.tolerance, c.expected.FloatString(2), c.simulated.FloatString(2), within, c.within)
+		}
+	}
+}
+
+// 模拟开启debug接口的节点，返回callTracer格式的调用帧
+type TraceApi struct {
+	frame map[string]interface{}
+}
+
+func (api *TraceApi) TraceCall(arg map[string]interface{}, blockParameter string, options map[string]interface{}) map[string]interface{} {
+	return api.frame
+}
+
+func word(v *big.Int) string {
+	return fmt.Sprintf("%064x", v)
+}
+
+// 按abi编码RingMined的非indexed字段:_ringIndex,_miner,_feeRecipient,_isRinghashReserved,_orderHashList,_amountsList
+func ringMinedData(orderHashes []common.Hash, amounts [][6]int64) string {
+	n := int64(len(orderHashes))
+	data := []string{
+		word(big.NewInt(1)),
+		word(big.NewInt(0)),
+		word(big.NewInt(0)),
+		word(big.NewInt(0)),
+		word(big.NewInt(6 * 32)),
+		word(big.NewInt(6*32 + 32*(1+n))),
+		word(big.NewInt(n)),
+	}
+	for _, h := range orderHashes {
+		data = append(data, fmt.Sprintf("%x", h.Bytes()))
+	}
+	data = append(data, word(big.NewInt(n)))
+	for _, a := range amounts {
+		for _, v := range a {
+			data = append(data, word(big.NewInt(v)))
+		}
+	}
+	return "0x" + strings.Join(data, "")
+}
+
+func TestRingSimulator_Simulate(t *testing.T) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+
+	cfg := config.LoadConfig("../config/relay.toml")
+	protocol := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	accessor := &ethaccessor.EthNodeAccessor{}
+	accessor.ProtocolImplAbi, _ = ethaccessor.NewAbi(cfg.Common.ProtocolImpl.ImplAbi)
+	api := &TraceApi{}
+	server := rpc.NewServer()
+	if err := server.RegisterName("debug", api); err != nil {
+		t.Fatal(err)
+	}
+	accessor.Client = rpc.DialInProc(server)
+	simulator := NewRingSimulator(accessor, 0.01)
+
+	ringhash := common.HexToHash("0xabcd")
+	orderHashes := []common.Hash{common.HexToHash("0x01"), common.HexToHash("0x02")}
+	ring := &types.Ring{}
+	for idx, orderHash := range orderHashes {
+		filledOrder := &types.FilledOrder{}
+		filledOrder.OrderState.RawOrder.Hash = orderHash
+		filledOrder.FillAmountS = big.NewRat(int64(1000*(idx+1)), 1)
+		filledOrder.FillAmountB = big.NewRat(int64(2000*(2-idx)), 1)
+		ring.Orders = append(ring.Orders, filledOrder)
+	}
+	ringState := &types.RingSubmitInfo{RawRing: ring, Ringhash: ringhash, ProtocolAddress: protocol}
+	ringMinedId := accessor.ProtocolImplAbi.Events[ringMinedEventName].Id()
+
+	minedLog := func(address common.Address, hash common.Hash, amounts [][6]int64) map[string]interface{} {
+		return map[string]interface{}{
+			"address": address.Hex(),
+			"topics":  []string{ringMinedId.Hex(), hash.Hex()},
+			"data":    ringMinedData(orderHashes, amounts),
+		}
+	}
+	exact := [][6]int64{{1000, 4000, 0, 0, 0, 0}, {2000, 2000, 0, 0, 0, 0}}
+	near := [][6]int64{{1005, 4000, 0, 0, 0, 0}, {2000, 1990, 0, 0, 0, 0}}
+	deviated := [][6]int64{{1000, 4000, 0, 0, 0, 0}, {1900, 2000, 0, 0, 0, 0}}
+
+	cases := []struct {
+		desc  string
+		frame map[string]interface{}
+		ok    bool
+	}{
+		{"mined as expected", map[string]interface{}{"logs": []interface{}{minedLog(protocol, ringhash, exact)}}, true},
+		{"mined within tolerance", map[string]interface{}{"logs": []interface{}{minedLog(protocol, ringhash, near)}}, true},
+		{"mined in sub call", map[string]interface{}{"calls": []interface{}{map[string]interface{}{"logs": []interface{}{minedLog(protocol, ringhash, exact)}}}}, true},
+		{"fill deviated", map[string]interface{}{"logs": []interface{}{minedLog(protocol, ringhash, deviated)}}, false},
+		{"reverted", map[string]interface{}{"error": "execution reverted"}, false},
+		{"not mined", map[string]interface{}{}, false},
+		{"mined by other contract", map[string]interface{}{"logs": []interface{}{minedLog(common.HexToAddress("0x02"), ringhash, exact)}}, false},
+		{"other ring mined", map[string]interface{}{"logs": []interface{}{minedLog(protocol, common.HexToHash("0x1234"), exact)}}, false},
+	}
+	for _, c := range cases {
+		api.frame = c.frame
+		err := simulator.Simulate(common.HexToAddress("0x03"), ringState)
+		if ok := err == nil; ok != c.ok {
+			t.Errorf("%s, simulated:%t, expect:%t, err:%v", c.desc, ok, c.ok, err)
+		}
+	}
+}
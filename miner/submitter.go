@@ -20,6 +20,7 @@ package miner
 
 import (
 	"errors"
+	"fmt"
 	"math/big"
 	"sync"
 
@@ -28,7 +29,9 @@ import (
 	"github.com/Loopring/relay/ethaccessor"
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/market/util"
 	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/txmanager"
 	"github.com/Loopring/relay/types"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
@@ -52,12 +55,19 @@ type RingSubmitter struct {
 
 	dbService         dao.RdsService
 	marketCapProvider *marketcap.MarketCapProvider
+	simulator         *RingSimulator
+	txManager         txmanager.TransactionManager
+	gasPriceStrategy  GasPriceStrategy
+	minProfit         *big.Rat
 
 	newRingWatcher          *eventemitter.Watcher
 	ringhashSubmitWatcher   *eventemitter.Watcher
 	registryMethodWatcher   *eventemitter.Watcher
 	batchRegistryMethodWatcher   *eventemitter.Watcher
 	ringSubmitMethodWatcher *eventemitter.Watcher
+	txReplacedWatcher       *eventemitter.Watcher
+	txFinishedWatcher       *eventemitter.Watcher
+	ringMinedWatcher        *eventemitter.Watcher
 }
 
 type RingSubmitFailed struct {
@@ -75,10 +85,24 @@ func NewSubmitter(options config.MinerOptions, accessor *ethaccessor.EthNodeAcce
 	submitter.miner = accounts.Account{Address: common.HexToAddress(options.Miner)}
 
 	submitter.feeReceipt = common.HexToAddress(options.FeeRecepient)
+	//LegalFee及cost均为wei数量乘以法币价格，比较前minProfit需要同样放大
+	submitter.minProfit = new(big.Rat).Mul(new(big.Rat).SetFloat64(options.MinProfit), new(big.Rat).SetFloat64(util.WeiToEther))
 	submitter.ifRegistryRingHash = options.IfRegistryRingHash
 
 	submitter.registeredRings = make(map[common.Hash]types.RingSubmitInfo)
 
+	submitter.txManager = txmanager.NewTransactionManager(options.TransactionManager, dbService, accessor)
+
+	if options.SimulateRing {
+		submitter.simulator = NewRingSimulator(accessor, options.SimulateTolerance)
+	}
+
+	if strategy, err := NewGasPriceStrategy(options.GasPrice, accessor, marketCapProvider); nil != err {
+		log.Fatalf("miner submitter,gas price strategy err:%s", err.Error())
+	} else {
+		submitter.gasPriceStrategy = strategy
+	}
+
 	return submitter
 }
 
@@ -134,10 +158,10 @@ func (submitter *RingSubmitter) newRings(eventData eventemitter.EventData) error
 		}
 	} else {
 		for _, ringState := range ringInfos {
+			//模拟失败的环路只记录原因，不影响其他环路的提交
 			if err := submitter.submitRing(ringState); nil != err {
-				//todo:index
-				submitter.dbService.UpdateRingSubmitInfoFailed([]common.Hash{ringState.Ringhash}, err.Error())
-				return err
+				log.Errorf("miner submitter,submit ring:%s err:%s", ringState.Ringhash.Hex(), err.Error())
+				submitter.submitFailed([]common.Hash{ringState.Ringhash}, err)
 			}
 		}
 	}
@@ -165,7 +189,7 @@ func (submitter *RingSubmitter) batchRinghashRegistry(contractAddress common.Add
 		if gas, gasPrice, err1 := submitter.Accessor.EstimateGas(registryData, ringhashRegistryAddress); nil != err {
 			return err1
 		} else {
-			if txHash, err := submitter.Accessor.ContractSendTransactionByData(submitter.miner, ringhashRegistryAddress, gas, gasPrice, nil, registryData); nil != err {
+			if txHash, err := submitter.txManager.SendTransaction(submitter.miner, ringhashRegistryAddress, gas, gasPrice, nil, registryData); nil != err {
 				return err
 			} else {
 				submitter.dbService.UpdateRingSubmitInfoRegistryTxHash(ringhashes, txHash)
@@ -184,7 +208,7 @@ func (submitter *RingSubmitter) ringhashRegistry(ringState *types.RingSubmitInfo
 		ringhashRegistryAddress = implAddress.RinghashRegistryAddress
 	}
 
-	if txHash, err := submitter.Accessor.ContractSendTransactionByData(submitter.miner, ringhashRegistryAddress, ringState.RegistryGas, ringState.RegistryGasPrice, nil, ringState.RegistryData); nil != err {
+	if txHash, err := submitter.txManager.SendTransaction(submitter.miner, ringhashRegistryAddress, ringState.RegistryGas, ringState.RegistryGasPrice, nil, ringState.RegistryData); nil != err {
 		return err
 	} else {
 		ringState.RegistryTxHash = common.HexToHash(txHash)
@@ -194,11 +218,17 @@ func (submitter *RingSubmitter) ringhashRegistry(ringState *types.RingSubmitInfo
 }
 
 func (submitter *RingSubmitter) submitRing(ringSate *types.RingSubmitInfo) error {
-	if txHash, err := submitter.Accessor.ContractSendTransactionByData(submitter.miner, ringSate.ProtocolAddress, ringSate.ProtocolGas, ringSate.ProtocolGasPrice, nil, ringSate.ProtocolData); nil != err {
+	if nil != submitter.simulator {
+		if err := submitter.simulator.Simulate(submitter.miner.Address, ringSate); nil != err {
+			return err
+		}
+	}
+	if txHash, err := submitter.txManager.SendTransaction(submitter.miner, ringSate.ProtocolAddress, ringSate.ProtocolGas, ringSate.ProtocolGasPrice, nil, ringSate.ProtocolData); nil != err {
 		return err
 	} else {
 		ringSate.SubmitTxHash = common.HexToHash(txHash)
 		submitter.dbService.UpdateRingSubmitInfoProtocolTxHash(ringSate.Ringhash, txHash)
+		submitter.dbService.UpdateRingSubmitInfoStatus(txHash, types.TX_STATUS_PENDING)
 	}
 	return nil
 }
@@ -237,11 +267,11 @@ func (submitter *RingSubmitter) handleBatchSubmitRingMethodEvent(e eventemitter.
 
 //提交错误，执行错误
 func (submitter *RingSubmitter) submitFailed(ringhashes []common.Hash, err error) {
-	if err := submitter.dbService.UpdateRingSubmitInfoFailed(ringhashes, err.Error()); nil != err {
-		log.Errorf("err:%s", err.Error())
+	if dbErr := submitter.dbService.UpdateRingSubmitInfoFailed(ringhashes, err.Error()); nil != dbErr {
+		log.Errorf("err:%s", dbErr.Error())
 	} else {
 		for _, ringhash := range ringhashes {
-			failedEvent := &types.RingSubmitFailedEvent{RingHash: ringhash}
+			failedEvent := &types.RingSubmitFailedEvent{RingHash: ringhash, Err: err}
 			eventemitter.Emit(eventemitter.Miner_RingSubmitFailed, failedEvent)
 		}
 	}
@@ -294,7 +324,7 @@ func (submitter *RingSubmitter) handleRegistryEvent(e eventemitter.EventData) er
 		if nil == err {
 			if err = submitter.submitRing(info); nil != err {
 				log.Errorf("error:%s", err.Error())
-				submitter.dbService.UpdateRingSubmitInfoFailed([]common.Hash{info.Ringhash}, err.Error())
+				submitter.submitFailed([]common.Hash{info.Ringhash}, err)
 			}
 		}
 	}
@@ -365,6 +395,10 @@ func (submitter *RingSubmitter) GenerateRingSubmitInfo(ringState *types.Ring) (*
 	if ringForSubmit.ProtocolGas.Cmp(submitter.gasLimit) > 0 {
 		ringForSubmit.ProtocolGas.Set(submitter.gasLimit)
 	}
+	ringForSubmit.ProtocolGasPrice, err = submitter.gasPriceStrategy.GasPrice(ringState, ringForSubmit.ProtocolGas, ringForSubmit.ProtocolGasPrice)
+	if nil != err {
+		return nil, err
+	}
 	protocolCost := new(big.Int).Mul(ringForSubmit.ProtocolGas, ringForSubmit.ProtocolGasPrice)
 
 	cost := new(big.Rat).SetInt(new(big.Int).Add(protocolCost, registryCost))
@@ -372,19 +406,122 @@ func (submitter *RingSubmitter) GenerateRingSubmitInfo(ringState *types.Ring) (*
 	received := new(big.Rat).Sub(ringState.LegalFee, cost)
 	ringForSubmit.Received = received
 
-	if received.Cmp(big.NewRat(int64(0), int64(1))) <= 0 {
-		// todo: warning
-		//return nil, errors.New("received can't be less than 0")
+	if received.Cmp(submitter.minProfit) < 0 {
+		log.Infof("miner submitter,ring:%s rejected, legalFee:%s, gas:%s, gasPrice:%s, cost:%s, received:%s, minProfit:%s",
+			ringState.Hash.Hex(),
+			legalString(ringState.LegalFee),
+			ringForSubmit.ProtocolGas.String(),
+			ringForSubmit.ProtocolGasPrice.String(),
+			legalString(cost),
+			legalString(received),
+			legalString(submitter.minProfit))
+		return nil, fmt.Errorf("miner submitter,received:%s of ring:%s is less than minProfit:%s", legalString(received), ringState.Hash.Hex(), legalString(submitter.minProfit))
 	}
 	return ringForSubmit, nil
 }
 
+// 将放大了1e18的法币金额还原后输出
+func legalString(v *big.Rat) string {
+	return new(big.Rat).Quo(v, new(big.Rat).SetFloat64(util.WeiToEther)).FloatString(2)
+}
+
+// 交易被替换后，ring_submit_info跟随新的交易
+func (submitter *RingSubmitter) handleTransactionReplaced(e eventemitter.EventData) error {
+	event := e.(*types.TransactionReplacedEvent)
+	return submitter.dbService.UpdateRingSubmitInfoTxHash(event.OldTxHash.Hex(), event.NewTxHash.Hex())
+}
+
+func (submitter *RingSubmitter) handleTransactionFinished(e eventemitter.EventData) error {
+	event := e.(*types.TransactionFinishedEvent)
+	txHash := event.TxHash.Hex()
+	for _, h := range event.TxHashes {
+		if h != event.TxHash {
+			if err := submitter.dbService.UpdateRingSubmitInfoTxHash(h.Hex(), txHash); nil != err {
+				log.Errorf("miner submitter,update tx hash err:%s", err.Error())
+			}
+		}
+	}
+	if err := submitter.dbService.UpdateRingSubmitInfoStatus(txHash, event.Status); nil != err {
+		log.Errorf("miner submitter,update status of tx:%s err:%s", txHash, err.Error())
+	}
+	if nil != event.GasUsed {
+		submitter.dbService.UpdateRingSubmitInfoSubmitUsedGas(txHash, event.GasUsed)
+	}
+
+	if event.Status != types.TX_STATUS_SUCCESS {
+		if ringhashes, err := submitter.dbService.GetRingHashesByTxHash(event.TxHash); nil != err {
+			log.Errorf("err:%s", err.Error())
+			return err
+		} else if len(ringhashes) > 0 {
+			submitter.submitFailed(ringhashes, fmt.Errorf("transaction:%s finished with status:%d", txHash, event.Status))
+		}
+	}
+	return nil
+}
+
+// 环路被打包后，根据RingMined事件中实际的费用以及实际使用的gas计算收益
+func (submitter *RingSubmitter) handleRingMined(e eventemitter.EventData) error {
+	event := e.(*types.RingMinedEvent)
+	info, err := submitter.dbService.GetRingForSubmitByHash(event.Ringhash)
+	if nil != err {
+		//不是本miner提交的环路
+		return nil
+	}
+
+	implAddress, exists := submitter.Accessor.ProtocolAddresses[event.ContractAddress]
+	if !exists {
+		return fmt.Errorf("miner submitter,doesn't contain this version of protocol:%s", event.ContractAddress.Hex())
+	}
+
+	legalFee := new(big.Rat)
+	for _, fill := range event.Fills {
+		// lrcFee支付给miner，选择分润时miner需要支付lrcReward
+		lrc := new(big.Int).Sub(fill.LrcFee, fill.LrcReward)
+		legalFee.Add(legalFee, new(big.Rat).Mul(new(big.Rat).SetInt(lrc), submitter.marketCapProvider.GetMarketCap(implAddress.LrcTokenAddress)))
+		if fill.SplitS.Sign() > 0 || fill.SplitB.Sign() > 0 {
+			order, err := submitter.dbService.GetOrderByHash(fill.OrderHash)
+			if nil != err {
+				return err
+			}
+			legalFee.Add(legalFee, new(big.Rat).Mul(new(big.Rat).SetInt(fill.SplitS), submitter.marketCapProvider.GetMarketCap(common.HexToAddress(order.TokenS))))
+			legalFee.Add(legalFee, new(big.Rat).Mul(new(big.Rat).SetInt(fill.SplitB), submitter.marketCapProvider.GetMarketCap(common.HexToAddress(order.TokenB))))
+		}
+	}
+
+	var (
+		receipt ethaccessor.TransactionReceipt
+		tx      ethaccessor.Transaction
+	)
+	if err := submitter.Accessor.Call(&receipt, "eth_getTransactionReceipt", event.TxHash.Hex()); nil != err {
+		return err
+	}
+	if err := submitter.Accessor.Call(&tx, "eth_getTransactionByHash", event.TxHash.Hex()); nil != err {
+		return err
+	}
+	gasCost := new(big.Int).Mul(receipt.GasUsed.BigInt(), tx.GasPrice.BigInt())
+	registryUsedGas, _ := new(big.Int).SetString(info.RegistryUsedGas, 0)
+	registryGasPrice, _ := new(big.Int).SetString(info.RegistryGasPrice, 0)
+	if nil != registryUsedGas && nil != registryGasPrice {
+		gasCost.Add(gasCost, new(big.Int).Mul(registryUsedGas, registryGasPrice))
+	}
+	legalGasCost := new(big.Rat).Mul(new(big.Rat).SetInt(gasCost), submitter.marketCapProvider.GetEthCap())
+	profit := new(big.Rat).Sub(legalFee, legalGasCost)
+
+	log.Debugf("miner submitter,ring:%s mined, legalFee:%s, gasCost:%s, profit:%s, expected:%s",
+		event.Ringhash.Hex(), legalFee.FloatString(2), legalGasCost.FloatString(2), profit.FloatString(2), info.Received)
+	return submitter.dbService.UpdateRingSubmitInfoRealizedProfit(event.Ringhash, legalFee, legalGasCost, profit)
+}
+
 func (submitter *RingSubmitter) stop() {
 	eventemitter.Un(eventemitter.Miner_NewRing, submitter.newRingWatcher)
 	eventemitter.Un(eventemitter.RingHashSubmitted, submitter.ringhashSubmitWatcher)
 	eventemitter.Un(eventemitter.Miner_SubmitRingHash_Method, submitter.registryMethodWatcher)
 	eventemitter.Un(eventemitter.Miner_BatchSubmitRingHash_Method, submitter.batchRegistryMethodWatcher)
 	eventemitter.Un(eventemitter.Miner_SubmitRing_Method, submitter.ringSubmitMethodWatcher)
+	eventemitter.Un(eventemitter.Miner_TransactionReplaced, submitter.txReplacedWatcher)
+	eventemitter.Un(eventemitter.Miner_TransactionFinished, submitter.txFinishedWatcher)
+	eventemitter.Un(eventemitter.OrderManagerExtractorRingMined, submitter.ringMinedWatcher)
+	submitter.txManager.Stop()
 }
 
 func (submitter *RingSubmitter) start() {
@@ -409,4 +546,14 @@ func (submitter *RingSubmitter) start() {
 	submitter.ringhashSubmitWatcher = watcher
 	eventemitter.On(eventemitter.RingHashSubmitted, submitter.ringhashSubmitWatcher)
 
+	submitter.txReplacedWatcher = &eventemitter.Watcher{Concurrent: false, Handle: submitter.handleTransactionReplaced}
+	eventemitter.On(eventemitter.Miner_TransactionReplaced, submitter.txReplacedWatcher)
+	submitter.txFinishedWatcher = &eventemitter.Watcher{Concurrent: false, Handle: submitter.handleTransactionFinished}
+	eventemitter.On(eventemitter.Miner_TransactionFinished, submitter.txFinishedWatcher)
+
+	submitter.ringMinedWatcher = &eventemitter.Watcher{Concurrent: false, Handle: submitter.handleRingMined}
+	eventemitter.On(eventemitter.OrderManagerExtractorRingMined, submitter.ringMinedWatcher)
+	if err := submitter.txManager.Start(); nil != err {
+		log.Fatalf("miner submitter,start transaction manager err:%s", err.Error())
+	}
 }
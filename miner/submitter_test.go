@@ -0,0 +1,136 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package miner_test
+
+import (
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/market/util"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+)
+
+// 模拟节点，gasPrice为1gwei，每个交易估算200000gas
+type SubmitterApi struct{}
+
+func (api *SubmitterApi) GasPrice() string {
+	return "0x3b9aca00"
+}
+
+func (api *SubmitterApi) EstimateGas(arg map[string]interface{}) string {
+	return "0x30d40"
+}
+
+func TestRingSubmitter_GenerateRingSubmitInfo_MinProfit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "submitter-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ks := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	minerAcc, err := ks.NewAccount("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock(minerAcc, "1"); err != nil {
+		t.Fatal(err)
+	}
+	crypto.Initialize(crypto.NewCrypto(true, ks))
+
+	cfg := config.LoadConfig("../config/relay.toml")
+	protocol := common.HexToAddress("0x1000000000000000000000000000000000000001")
+	accessor := &ethaccessor.EthNodeAccessor{}
+	accessor.ProtocolImplAbi, _ = ethaccessor.NewAbi(cfg.Common.ProtocolImpl.ImplAbi)
+	accessor.ProtocolAddresses = map[common.Address]*ethaccessor.ProtocolAddress{
+		protocol: {ContractAddress: protocol},
+	}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", &SubmitterApi{}); err != nil {
+		t.Fatal(err)
+	}
+	accessor.Client = rpc.DialInProc(server)
+
+	// 1000/ETH，gas成本为200000*1gwei=0.0002ETH，即0.2
+	marketCapProvider := marketcap.NewMarketCapProvider(cfg.Miner)
+	marketCapProvider.SetMarketCap(util.GetWethAddress(), 1000)
+
+	newRing := func() *types.Ring {
+		states := []types.OrderState{}
+		for i := int64(0); i < 2; i++ {
+			state := types.OrderState{}
+			state.RawOrder.Protocol = protocol
+			state.RawOrder.AmountS = big.NewInt(100 + i)
+			state.RawOrder.AmountB = big.NewInt(100)
+			state.RawOrder.Timestamp = big.NewInt(1506014710)
+			state.RawOrder.Ttl = big.NewInt(3600)
+			state.RawOrder.Salt = big.NewInt(i)
+			state.RawOrder.LrcFee = big.NewInt(0)
+			states = append(states, state)
+		}
+		ring := types.NewRing(states)
+		for _, filledOrder := range ring.Orders {
+			filledOrder.RateAmountS = new(big.Rat).SetInt(filledOrder.OrderState.RawOrder.AmountS)
+		}
+		// LegalFee为wei数量乘以法币价格，1.2ETH对应1.2
+		ring.LegalFee = new(big.Rat).SetFrac(big.NewInt(12), big.NewInt(10))
+		ring.LegalFee.Mul(ring.LegalFee, new(big.Rat).SetFloat64(util.WeiToEther))
+		return ring
+	}
+
+	cases := []struct {
+		minProfit float64
+		accepted  bool
+	}{
+		{0, true},
+		{0.99, true},
+		{1.0, true},
+		{1.01, false},
+		{2, false},
+	}
+	for _, c := range cases {
+		options := cfg.Miner
+		options.Miner = minerAcc.Address.Hex()
+		options.SimulateRing = false
+		options.IfRegistryRingHash = false
+		options.GasPrice = config.GasPriceOptions{}
+		options.MinProfit = c.minProfit
+		submitter := miner.NewSubmitter(options, accessor, nil, marketCapProvider)
+
+		info, err := submitter.GenerateRingSubmitInfo(newRing())
+		if accepted := err == nil; accepted != c.accepted {
+			t.Errorf("received 1.0, minProfit %v, accepted:%t, expect:%t, err:%v", c.minProfit, accepted, c.accepted, err)
+			continue
+		}
+		if c.accepted {
+			received := new(big.Rat).Quo(info.Received, new(big.Rat).SetFloat64(util.WeiToEther))
+			if received.Cmp(big.NewRat(1, 1)) != 0 {
+				t.Errorf("received %s, expect 1", received.FloatString(4))
+			}
+		}
+	}
+}
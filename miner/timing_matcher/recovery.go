@@ -0,0 +1,134 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"math/big"
+
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const ringExpiredErr = "ring expired"
+
+// 根据ring_submit_info以及filled_order中未打包也未失败的环路，恢复已占用的订单金额，避免重启后重复匹配
+func (matcher *TimingMatcher) recoverMinedRings() {
+	infos, err := matcher.rds.GetUnfinishedRingSubmitInfos()
+	if nil != err {
+		log.Errorf("miner,timing matcher get unfinished rings err:%s", err.Error())
+		return
+	}
+
+	for _, info := range infos {
+		if _, err := matcher.rds.FindRingMinedByRingHash(info.RingHash); nil == err {
+			continue
+		}
+		ringhash := common.HexToHash(info.RingHash)
+		daoFilledOrders, err := matcher.rds.GetFilledOrdersByRinghash(ringhash)
+		if nil != err {
+			log.Errorf("miner,timing matcher get filled orders of ring:%s err:%s", info.RingHash, err.Error())
+			continue
+		}
+		for _, daoFilledOrder := range daoFilledOrders {
+			filledOrder := &types.FilledOrder{}
+			if err := daoFilledOrder.ConvertUp(filledOrder, matcher.rds); nil != err {
+				log.Errorf("miner,timing matcher recover filled order:%s err:%s", daoFilledOrder.OrderHash, err.Error())
+				continue
+			}
+			matcher.addMatchedOrder(filledOrder, ringhash)
+		}
+		log.Debugf("miner,timing matcher recovered ring:%s, orders:%d", info.RingHash, len(daoFilledOrders))
+	}
+}
+
+// 超过expireBlocks仍未确认的环路，交易已被打包或仍在交易池中时重新计算等待区块，否则释放其占用的订单金额，并标记为失败
+func (matcher *TimingMatcher) expireMinedRings(blockNumber *big.Int) {
+	if matcher.expireBlocks.Sign() <= 0 {
+		return
+	}
+
+	matcher.mtx.Lock()
+	candidates := []common.Hash{}
+	for ringhash, ringState := range matcher.MinedRings {
+		if nil == ringState.blockNumber {
+			ringState.blockNumber = new(big.Int).Set(blockNumber)
+			continue
+		}
+		if new(big.Int).Sub(blockNumber, ringState.blockNumber).Cmp(matcher.expireBlocks) > 0 {
+			candidates = append(candidates, ringhash)
+		}
+	}
+	matcher.mtx.Unlock()
+
+	//查询节点时不持有锁
+	expiredRinghashes := []common.Hash{}
+	waitingRinghashes := []common.Hash{}
+	for _, ringhash := range candidates {
+		if matcher.ringTxPending(ringhash) {
+			waitingRinghashes = append(waitingRinghashes, ringhash)
+		} else {
+			expiredRinghashes = append(expiredRinghashes, ringhash)
+		}
+	}
+
+	matcher.mtx.Lock()
+	for _, ringhash := range waitingRinghashes {
+		if ringState, ok := matcher.MinedRings[ringhash]; ok {
+			ringState.blockNumber = new(big.Int).Set(blockNumber)
+		}
+	}
+	for _, ringhash := range expiredRinghashes {
+		matcher.releaseMinedRing(ringhash)
+	}
+	matcher.mtx.Unlock()
+
+	if len(expiredRinghashes) > 0 {
+		log.Infof("miner,timing matcher %d rings expired at block:%s", len(expiredRinghashes), blockNumber.String())
+		if err := matcher.rds.UpdateRingSubmitInfoFailed(expiredRinghashes, ringExpiredErr); nil != err {
+			log.Errorf("miner,timing matcher update expired rings err:%s", err.Error())
+		}
+	}
+}
+
+// 环路的submitRing交易已被打包或仍在节点交易池中，结果由RingMined或交易结束事件处理，查询失败时同样等待
+func (matcher *TimingMatcher) ringTxPending(ringhash common.Hash) bool {
+	info, err := matcher.rds.GetRingForSubmitByHash(ringhash)
+	if nil != err || "" == info.ProtocolTxHash {
+		return false
+	}
+	accessor := matcher.submitter.Accessor
+
+	var receipt ethaccessor.TransactionReceipt
+	if err := accessor.Call(&receipt, "eth_getTransactionReceipt", info.ProtocolTxHash); nil != err {
+		log.Errorf("miner,timing matcher get receipt of tx:%s err:%s", info.ProtocolTxHash, err.Error())
+		return true
+	}
+	if "" != receipt.BlockHash {
+		return true
+	}
+
+	var tx *ethaccessor.Transaction
+	if err := accessor.Call(&tx, "eth_getTransactionByHash", info.ProtocolTxHash); nil != err {
+		log.Errorf("miner,timing matcher get tx:%s err:%s", info.ProtocolTxHash, err.Error())
+		return true
+	}
+	return nil != tx
+}
@@ -0,0 +1,158 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"errors"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/miner"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.uber.org/zap"
+	"math/big"
+	"testing"
+)
+
+// 只实现恢复和过期环路用到的方法
+type recoveryRds struct {
+	dao.RdsService
+	unfinishedQueries int
+	infos             map[common.Hash]dao.RingSubmitInfo
+	failed            []common.Hash
+}
+
+func (rds *recoveryRds) GetUnfinishedRingSubmitInfos() ([]dao.RingSubmitInfo, error) {
+	rds.unfinishedQueries++
+	return []dao.RingSubmitInfo{}, nil
+}
+
+func (rds *recoveryRds) GetRingForSubmitByHash(ringhash common.Hash) (dao.RingSubmitInfo, error) {
+	if info, ok := rds.infos[ringhash]; ok {
+		return info, nil
+	}
+	return dao.RingSubmitInfo{}, errors.New("record not found")
+}
+
+func (rds *recoveryRds) UpdateRingSubmitInfoFailed(ringhashs []common.Hash, err string) error {
+	rds.failed = append(rds.failed, ringhashs...)
+	return nil
+}
+
+type RecoveryApi struct {
+	receipts map[string]map[string]interface{}
+	txs      map[string]map[string]interface{}
+}
+
+func (api *RecoveryApi) GetTransactionReceipt(txHash string) map[string]interface{} {
+	return api.receipts[txHash]
+}
+
+func (api *RecoveryApi) GetTransactionByHash(txHash string) map[string]interface{} {
+	return api.txs[txHash]
+}
+
+func newRecoveryMatcher(t *testing.T, expireBlocks int64) (*TimingMatcher, *RecoveryApi, *recoveryRds) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+
+	api := &RecoveryApi{receipts: make(map[string]map[string]interface{}), txs: make(map[string]map[string]interface{})}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", api); err != nil {
+		t.Fatal(err)
+	}
+	accessor := &ethaccessor.EthNodeAccessor{Client: rpc.DialInProc(server)}
+	rds := &recoveryRds{infos: make(map[common.Hash]dao.RingSubmitInfo)}
+	matcher := &TimingMatcher{
+		rds:           rds,
+		submitter:     &miner.RingSubmitter{Accessor: accessor},
+		expireBlocks:  big.NewInt(expireBlocks),
+		MatchedOrders: make(map[common.Hash]*OrderMatchState),
+		MinedRings:    make(map[common.Hash]*minedRing),
+	}
+	return matcher, api, rds
+}
+
+func TestTimingMatcher_RecoverOnce(t *testing.T) {
+	matcher, _, rds := newRecoveryMatcher(t, 10)
+
+	matcher.Start()
+	matcher.Stop()
+	matcher.Start()
+	matcher.Stop()
+
+	if rds.unfinishedQueries != 1 {
+		t.Fatalf("mined rings recovered %d times, expect 1", rds.unfinishedQueries)
+	}
+}
+
+func TestTimingMatcher_ExpireMinedRings(t *testing.T) {
+	matcher, api, rds := newRecoveryMatcher(t, 10)
+
+	unsent := common.HexToHash("0x01")
+	dropped := common.HexToHash("0x02")
+	pending := common.HexToHash("0x03")
+	mined := common.HexToHash("0x04")
+	recent := common.HexToHash("0x05")
+	for _, ringhash := range []common.Hash{unsent, dropped, pending, mined} {
+		matcher.MinedRings[ringhash] = &minedRing{ringHash: ringhash, blockNumber: big.NewInt(100)}
+	}
+	matcher.MinedRings[recent] = &minedRing{ringHash: recent, blockNumber: big.NewInt(105)}
+
+	rds.infos[unsent] = dao.RingSubmitInfo{RingHash: unsent.Hex()}
+	for idx, ringhash := range []common.Hash{dropped, pending, mined} {
+		txHash := common.BigToHash(big.NewInt(int64(idx + 10))).Hex()
+		rds.infos[ringhash] = dao.RingSubmitInfo{RingHash: ringhash.Hex(), ProtocolTxHash: txHash}
+		switch ringhash {
+		case pending:
+			api.txs[txHash] = map[string]interface{}{"hash": txHash}
+		case mined:
+			api.txs[txHash] = map[string]interface{}{"hash": txHash, "blockHash": common.HexToHash("0x01").Hex()}
+			api.receipts[txHash] = map[string]interface{}{"blockHash": common.HexToHash("0x01").Hex(), "blockNumber": "0x6f"}
+		}
+	}
+
+	matcher.expireMinedRings(big.NewInt(111))
+
+	expired := map[common.Hash]bool{}
+	for _, ringhash := range rds.failed {
+		expired[ringhash] = true
+	}
+	if len(rds.failed) != 2 || !expired[unsent] || !expired[dropped] {
+		t.Fatalf("expired rings %v, expect unsent and dropped", rds.failed)
+	}
+	for _, ringhash := range []common.Hash{unsent, dropped} {
+		if _, ok := matcher.MinedRings[ringhash]; ok {
+			t.Errorf("ring %s should be released", ringhash.Hex())
+		}
+	}
+	for _, ringhash := range []common.Hash{pending, mined} {
+		ringState, ok := matcher.MinedRings[ringhash]
+		if !ok {
+			t.Fatalf("ring %s with tx on chain or in pool should be kept", ringhash.Hex())
+		}
+		if ringState.blockNumber.Int64() != 111 {
+			t.Errorf("ring %s waiting block %s, expect 111", ringhash.Hex(), ringState.blockNumber.String())
+		}
+	}
+	if ringState := matcher.MinedRings[recent]; nil == ringState || ringState.blockNumber.Int64() != 105 {
+		t.Errorf("recent ring should not be checked")
+	}
+}
@@ -0,0 +1,295 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"sort"
+)
+
+/**
+多跳环路搜索：以token为节点、订单为边构建图，枚举长度为2..ringMaxLength的环路，
+通过evaluator计算收益后，每轮贪心选出互不包含相同订单且Received最大的环路
+*/
+
+const (
+	maxOrdersPerEdge        = 8  //每条边只取价格最优的订单，避免组合数爆炸
+	maxCombinationsPerCycle = 64 //每个token环路最多计算的订单组合数，环路越长每跳可选的订单越少
+	maxCandidatesPerCycle   = 10 //每个token环路只对fee最高的几个组合估算gas
+)
+
+type tokenGraph struct {
+	tokens []common.Address
+	index  map[common.Address]int
+	edges  map[common.Address]map[common.Address][]*types.OrderState
+	orders map[common.Hash]*types.OrderState
+}
+
+func newTokenGraph(markets []*Market) *tokenGraph {
+	graph := &tokenGraph{
+		tokens: []common.Address{},
+		index:  make(map[common.Address]int),
+		edges:  make(map[common.Address]map[common.Address][]*types.OrderState),
+		orders: make(map[common.Hash]*types.OrderState),
+	}
+	for _, market := range markets {
+		for _, order := range market.AtoBOrders {
+			graph.addOrder(order)
+		}
+		for _, order := range market.BtoAOrders {
+			graph.addOrder(order)
+		}
+	}
+	for _, tokenBs := range graph.edges {
+		for tokenB, orders := range tokenBs {
+			sort.Slice(orders, func(i, j int) bool {
+				return betterPrice(orders[i], orders[j])
+			})
+			if len(orders) > maxOrdersPerEdge {
+				orders = orders[:maxOrdersPerEdge]
+			}
+			tokenBs[tokenB] = orders
+		}
+	}
+	return graph
+}
+
+func (graph *tokenGraph) addToken(token common.Address) {
+	if _, exists := graph.index[token]; !exists {
+		graph.index[token] = len(graph.tokens)
+		graph.tokens = append(graph.tokens, token)
+	}
+}
+
+func (graph *tokenGraph) addOrder(order *types.OrderState) {
+	tokenS := order.RawOrder.TokenS
+	tokenB := order.RawOrder.TokenB
+	graph.addToken(tokenS)
+	graph.addToken(tokenB)
+	if _, exists := graph.edges[tokenS]; !exists {
+		graph.edges[tokenS] = make(map[common.Address][]*types.OrderState)
+	}
+	graph.edges[tokenS][tokenB] = append(graph.edges[tokenS][tokenB], order)
+	graph.orders[order.RawOrder.Hash] = order
+}
+
+// amountS/amountB越大，越容易成环
+func betterPrice(a, b *types.OrderState) bool {
+	left := new(big.Int).Mul(a.RawOrder.AmountS, b.RawOrder.AmountB)
+	right := new(big.Int).Mul(b.RawOrder.AmountS, a.RawOrder.AmountB)
+	return left.Cmp(right) > 0
+}
+
+// 枚举所有长度在2..maxLength之间的token环路，环路以序号最小的token作为起点，保证每个环路只出现一次
+func (graph *tokenGraph) cycles(maxLength int) [][]common.Address {
+	cycles := [][]common.Address{}
+	for _, start := range graph.tokens {
+		graph.walk([]common.Address{start}, maxLength, &cycles)
+	}
+	return cycles
+}
+
+func (graph *tokenGraph) walk(path []common.Address, maxLength int, cycles *[][]common.Address) {
+	start := path[0]
+	last := path[len(path)-1]
+	for _, next := range graph.tokens {
+		if _, exists := graph.edges[last][next]; !exists {
+			continue
+		}
+		if next == start {
+			if len(path) >= 2 {
+				cycle := make([]common.Address, len(path))
+				copy(cycle, path)
+				*cycles = append(*cycles, cycle)
+			}
+		} else if len(path) < maxLength && graph.index[next] > graph.index[start] && !containsToken(path, next) {
+			graph.walk(append(path, next), maxLength, cycles)
+		}
+	}
+}
+
+func containsToken(path []common.Address, token common.Address) bool {
+	for _, t := range path {
+		if t == token {
+			return true
+		}
+	}
+	return false
+}
+
+// 每跳可选的订单数n满足n^hops不超过maxCombinationsPerCycle，2跳8个，3跳4个，4跳2个，至少为1
+func ordersPerHop(hops int) int {
+	n := maxOrdersPerEdge
+	for n > 1 {
+		combinations := 1
+		for i := 0; i < hops && combinations <= maxCombinationsPerCycle; i++ {
+			combinations *= n
+		}
+		if combinations <= maxCombinationsPerCycle {
+			break
+		}
+		n--
+	}
+	return n
+}
+
+// 对token环路的每条边选择一个订单，只保留价格能够成交的组合，边上的订单已按价格排序，每跳只取前ordersPerHop个
+func (graph *tokenGraph) orderCombinations(cycle []common.Address) [][]*types.OrderState {
+	combinations := [][]*types.OrderState{}
+	perHop := ordersPerHop(len(cycle))
+	var choose func(idx int, chosen []*types.OrderState)
+	choose = func(idx int, chosen []*types.OrderState) {
+		if idx == len(cycle) {
+			if ringPriceValid(chosen) {
+				combination := make([]*types.OrderState, len(chosen))
+				copy(combination, chosen)
+				combinations = append(combinations, combination)
+			}
+			return
+		}
+		tokenB := cycle[(idx+1)%len(cycle)]
+		orders := graph.edges[cycle[idx]][tokenB]
+		if len(orders) > perHop {
+			orders = orders[:perHop]
+		}
+		for _, order := range orders {
+			choose(idx+1, append(chosen, order))
+		}
+	}
+	choose(0, []*types.OrderState{})
+	return combinations
+}
+
+// PriceValid的多跳形式，所有订单的amountS之积不小于amountB之积
+func ringPriceValid(orders []*types.OrderState) bool {
+	productAmountS := big.NewInt(1)
+	productAmountB := big.NewInt(1)
+	for _, order := range orders {
+		productAmountS.Mul(productAmountS, order.RawOrder.AmountS)
+		productAmountB.Mul(productAmountB, order.RawOrder.AmountB)
+	}
+	return productAmountS.Cmp(productAmountB) >= 0
+}
+
+func (matcher *TimingMatcher) ringCandidates(graph *tokenGraph) []*types.RingSubmitInfo {
+	candidates := []*types.RingSubmitInfo{}
+	for _, cycle := range graph.cycles(matcher.ringMaxLength) {
+		rings := []*types.Ring{}
+		for _, orders := range graph.orderCombinations(cycle) {
+			orderStates := []types.OrderState{}
+			for _, order := range orders {
+				orderStates = append(orderStates, *order)
+			}
+			ring := types.NewRing(orderStates)
+			if err := matcher.evaluator.ComputeRing(ring); nil != err {
+				log.Debugf("miner,timing matcher compute ring:%s err:%s", ring.Hash.Hex(), err.Error())
+				continue
+			}
+			rings = append(rings, ring)
+		}
+
+		sort.Slice(rings, func(i, j int) bool {
+			return rings[i].LegalFee.Cmp(rings[j].LegalFee) > 0
+		})
+		if len(rings) > maxCandidatesPerCycle {
+			rings = rings[:maxCandidatesPerCycle]
+		}
+		for _, ring := range rings {
+			if ringForSubmit, err := matcher.submitter.GenerateRingSubmitInfo(ring); nil != err {
+				log.Errorf("err: %s", err.Error())
+			} else {
+				candidates = append(candidates, ringForSubmit)
+			}
+		}
+	}
+	return candidates
+}
+
+// 按Received从大到小贪心选择，同一订单每轮只出现在一个环路中
+func selectRings(candidates []*types.RingSubmitInfo) []*types.RingSubmitInfo {
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Received.Cmp(candidates[j].Received) > 0
+	})
+	usedOrders := make(map[common.Hash]bool)
+	selected := []*types.RingSubmitInfo{}
+	for _, candidate := range candidates {
+		conflicted := false
+		for _, filledOrder := range candidate.RawRing.Orders {
+			if usedOrders[filledOrder.OrderState.RawOrder.Hash] {
+				conflicted = true
+				break
+			}
+		}
+		if conflicted {
+			continue
+		}
+		for _, filledOrder := range candidate.RawRing.Orders {
+			usedOrders[filledOrder.OrderState.RawOrder.Hash] = true
+		}
+		selected = append(selected, candidate)
+	}
+	return selected
+}
+
+func (matcher *TimingMatcher) matchRings(protocolAddress common.Address) {
+	for _, market := range matcher.markets {
+		market.getOrdersForMatching(protocolAddress)
+	}
+	graph := newTokenGraph(matcher.markets)
+	ringStates := selectRings(matcher.ringCandidates(graph))
+
+	matchedOrderHashes := make(map[common.Hash]bool) //true:fullfilled, false:partfilled
+	for _, ringForSubmit := range ringStates {
+		matcher.addRingStats(ringForSubmit.RawRing)
+		for _, filledOrder := range ringForSubmit.RawRing.Orders {
+			orderState := graph.orders[filledOrder.OrderState.RawOrder.Hash]
+			orderState.DealtAmountB.Add(orderState.DealtAmountB, intFromRat(filledOrder.FillAmountB))
+			orderState.DealtAmountS.Add(orderState.DealtAmountS, intFromRat(filledOrder.FillAmountS))
+			matchedOrderHashes[orderState.RawOrder.Hash] = matcher.om.IsOrderFullFinished(orderState)
+			matcher.addMatchedOrder(filledOrder, ringForSubmit.RawRing.Hash)
+		}
+	}
+
+	for _, market := range matcher.markets {
+		market.excludeNextRound(matchedOrderHashes)
+	}
+	eventemitter.Emit(eventemitter.Miner_NewRing, ringStates)
+}
+
+// 环路中每个订单计入其所在市场的统计，环路数按涉及的市场计
+func (matcher *TimingMatcher) addRingStats(ring *types.Ring) {
+	matchedOrders := make(map[*Market]int)
+	for _, filledOrder := range ring.Orders {
+		tokenS := filledOrder.OrderState.RawOrder.TokenS
+		tokenB := filledOrder.OrderState.RawOrder.TokenB
+		for _, market := range matcher.markets {
+			if (market.TokenA == tokenS && market.TokenB == tokenB) || (market.TokenA == tokenB && market.TokenB == tokenS) {
+				matchedOrders[market] += 1
+				break
+			}
+		}
+	}
+	for market, count := range matchedOrders {
+		market.addMatchedStats(count, 1)
+	}
+}
@@ -0,0 +1,182 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package timing_matcher
+
+import (
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+	"testing"
+)
+
+var (
+	tokenA = common.HexToAddress("0x000000000000000000000000000000000000000a")
+	tokenB = common.HexToAddress("0x000000000000000000000000000000000000000b")
+	tokenC = common.HexToAddress("0x000000000000000000000000000000000000000c")
+	tokenD = common.HexToAddress("0x000000000000000000000000000000000000000d")
+)
+
+var testOrderSeq int64
+
+func testOrder(tokenS, tokenB common.Address, amountS, amountB int64) *types.OrderState {
+	testOrderSeq++
+	state := &types.OrderState{}
+	state.RawOrder.TokenS = tokenS
+	state.RawOrder.TokenB = tokenB
+	state.RawOrder.AmountS = big.NewInt(amountS)
+	state.RawOrder.AmountB = big.NewInt(amountB)
+	state.RawOrder.Hash = common.BigToHash(big.NewInt(testOrderSeq))
+	return state
+}
+
+func testMarket(orders ...*types.OrderState) *Market {
+	market := &Market{AtoBOrders: make(map[common.Hash]*types.OrderState), BtoAOrders: make(map[common.Hash]*types.OrderState)}
+	for _, order := range orders {
+		market.AtoBOrders[order.RawOrder.Hash] = order
+	}
+	return market
+}
+
+// 环路的起点取决于token加入图的顺序，比较前统一旋转到tokenA开头
+func rotateToA(cycle []common.Address) []common.Address {
+	for i, token := range cycle {
+		if token == tokenA {
+			return append(append([]common.Address{}, cycle[i:]...), cycle[:i]...)
+		}
+	}
+	return cycle
+}
+
+func TestTokenGraph_Cycles(t *testing.T) {
+	graph := newTokenGraph([]*Market{testMarket(
+		testOrder(tokenA, tokenB, 100, 100),
+		testOrder(tokenB, tokenA, 100, 100),
+		testOrder(tokenB, tokenC, 100, 100),
+		testOrder(tokenC, tokenA, 100, 100),
+		testOrder(tokenC, tokenD, 100, 100),
+		testOrder(tokenD, tokenA, 100, 100),
+	)})
+
+	expected := map[int][]common.Address{
+		2: {tokenA, tokenB},
+		3: {tokenA, tokenB, tokenC},
+		4: {tokenA, tokenB, tokenC, tokenD},
+	}
+	for maxLength := 2; maxLength <= 4; maxLength++ {
+		cycles := graph.cycles(maxLength)
+		if len(cycles) != maxLength-1 {
+			t.Fatalf("max length %d, found %d cycles:%v, expect %d", maxLength, len(cycles), cycles, maxLength-1)
+		}
+		for _, cycle := range cycles {
+			cycle = rotateToA(cycle)
+			want := expected[len(cycle)]
+			for i := range want {
+				if cycle[i] != want[i] {
+					t.Errorf("unexpected %d-hop cycle %v, expect %v", len(cycle), cycle, want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestOrdersPerHop(t *testing.T) {
+	cases := map[int]int{1: 8, 2: 8, 3: 4, 4: 2, 10: 1}
+	for hops, expected := range cases {
+		if n := ordersPerHop(hops); n != expected {
+			t.Errorf("%d hops, %d orders per hop, expect %d", hops, n, expected)
+		}
+	}
+}
+
+func TestTokenGraph_OrderCombinations(t *testing.T) {
+	orders := []*types.OrderState{}
+	best := make(map[common.Hash]bool)
+	cycle := []common.Address{tokenA, tokenB, tokenC, tokenD}
+	for i, tokenS := range cycle {
+		tokenB := cycle[(i+1)%len(cycle)]
+		for j := int64(0); j < maxOrdersPerEdge; j++ {
+			order := testOrder(tokenS, tokenB, 200-j, 100)
+			orders = append(orders, order)
+			if j < 2 {
+				best[order.RawOrder.Hash] = true
+			}
+		}
+	}
+	graph := newTokenGraph([]*Market{testMarket(orders...)})
+
+	combinations := graph.orderCombinations(cycle)
+	if len(combinations) != 16 {
+		t.Fatalf("4-hop cycle should be capped to 2^4 combinations, got %d", len(combinations))
+	}
+	for _, combination := range combinations {
+		for _, order := range combination {
+			if !best[order.RawOrder.Hash] {
+				t.Fatalf("only orders with the best prices should be combined, got %s/%s", order.RawOrder.AmountS, order.RawOrder.AmountB)
+			}
+		}
+	}
+}
+
+func TestRingPriceValid(t *testing.T) {
+	cases := []struct {
+		orders []*types.OrderState
+		valid  bool
+	}{
+		{[]*types.OrderState{testOrder(tokenA, tokenB, 100, 10), testOrder(tokenB, tokenA, 10, 100)}, true},
+		{[]*types.OrderState{testOrder(tokenA, tokenB, 100, 10), testOrder(tokenB, tokenA, 10, 101)}, false},
+		{[]*types.OrderState{testOrder(tokenA, tokenB, 100, 10), testOrder(tokenB, tokenC, 10, 50), testOrder(tokenC, tokenA, 50, 100)}, true},
+		{[]*types.OrderState{testOrder(tokenA, tokenB, 100, 10), testOrder(tokenB, tokenC, 10, 50), testOrder(tokenC, tokenA, 49, 100)}, false},
+		{[]*types.OrderState{testOrder(tokenA, tokenB, 2, 1), testOrder(tokenB, tokenC, 1, 2), testOrder(tokenC, tokenD, 2, 1), testOrder(tokenD, tokenA, 1, 2)}, true},
+	}
+	for i, c := range cases {
+		if valid := ringPriceValid(c.orders); valid != c.valid {
+			t.Errorf("case %d, price valid:%t, expect:%t", i, valid, c.valid)
+		}
+	}
+}
+
+func testCandidate(received int64, orders ...*types.OrderState) *types.RingSubmitInfo {
+	states := []types.OrderState{}
+	for _, order := range orders {
+		states = append(states, *order)
+	}
+	return &types.RingSubmitInfo{RawRing: types.NewRing(states), Received: big.NewRat(received, 1)}
+}
+
+func TestSelectRings(t *testing.T) {
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+
+	o1 := testOrder(tokenA, tokenB, 100, 10)
+	o2 := testOrder(tokenB, tokenA, 10, 100)
+	o3 := testOrder(tokenB, tokenC, 10, 50)
+	o4 := testOrder(tokenC, tokenA, 50, 100)
+	o5 := testOrder(tokenB, tokenA, 10, 90)
+	o6 := testOrder(tokenA, tokenB, 100, 10)
+
+	low := testCandidate(10, o1, o2)
+	high := testCandidate(30, o1, o3, o4)
+	other := testCandidate(20, o6, o5)
+	selected := selectRings([]*types.RingSubmitInfo{low, other, high})
+
+	if len(selected) != 2 || selected[0] != high || selected[1] != other {
+		t.Fatalf("rings should be selected by received without sharing orders, got %d rings", len(selected))
+	}
+}
@@ -19,6 +19,8 @@
 package timing_matcher
 
 import (
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/dao"
 	"github.com/Loopring/relay/eventemiter"
 	"github.com/Loopring/relay/log"
 	marketLib "github.com/Loopring/relay/market/util"
@@ -28,6 +30,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
 	"sync"
+	"time"
 )
 
 /**
@@ -37,6 +40,7 @@ import (
 type minedRing struct {
 	ringHash    common.Hash
 	orderHashes []common.Hash
+	blockNumber *big.Int //匹配时的区块，重启恢复的环路为nil，在下一个区块时设置
 }
 
 type RoundState struct {
@@ -55,12 +59,19 @@ type TimingMatcher struct {
 	MatchedOrders   map[common.Hash]*OrderMatchState
 	MinedRings      map[common.Hash]*minedRing
 	mtx             sync.RWMutex
+	roundMtx        sync.Mutex
+	statsMtx        sync.RWMutex
 	StopChan        chan bool
 	markets         []*Market
+	om              ordermanager.OrderManager
+	rds             dao.RdsService
 	submitter       *miner.RingSubmitter
 	evaluator       *miner.Evaluator
 	lastBlockNumber *big.Int
 	duration        *big.Int
+	ringMaxLength   int
+	expireBlocks    *big.Int
+	recoverOnce     sync.Once
 
 	afterSubmitWatcher *eventemitter.Watcher
 	blockTriger        *eventemitter.Watcher
@@ -77,11 +88,15 @@ type Market struct {
 
 	AtoBOrderHashesExcludeNextRound []common.Hash
 	BtoAOrderHashesExcludeNextRound []common.Hash
+
+	stats miner.MarketStats
 }
 
-func NewTimingMatcher(submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager) *TimingMatcher {
-	matcher := &TimingMatcher{submitter: submitter, evaluator: evaluator}
+func NewTimingMatcher(options config.MinerOptions, submitter *miner.RingSubmitter, evaluator *miner.Evaluator, om ordermanager.OrderManager, rds dao.RdsService) *TimingMatcher {
+	matcher := &TimingMatcher{submitter: submitter, evaluator: evaluator, om: om, rds: rds, ringMaxLength: options.RingMaxLength}
+	matcher.expireBlocks = big.NewInt(options.RingExpireBlocks)
 	matcher.MatchedOrders = make(map[common.Hash]*OrderMatchState)
+	matcher.MinedRings = make(map[common.Hash]*minedRing)
 	matcher.markets = []*Market{}
 	matcher.duration = big.NewInt(1)
 	matcher.lastBlockNumber = big.NewInt(0)
@@ -97,6 +112,9 @@ func NewTimingMatcher(submitter *miner.RingSubmitter, evaluator *miner.Evaluator
 				m.TokenB = pair.TokenB
 				m.AtoBOrderHashesExcludeNextRound = []common.Hash{}
 				m.BtoAOrderHashesExcludeNextRound = []common.Hash{}
+				m.stats.Market, _ = marketLib.WrapMarketByAddress(m.TokenA.Hex(), m.TokenB.Hex())
+				m.stats.TokenA = m.TokenA
+				m.stats.TokenB = m.TokenB
 				matcher.markets = append(matcher.markets, m)
 			}
 		} else {
@@ -107,7 +125,10 @@ func NewTimingMatcher(submitter *miner.RingSubmitter, evaluator *miner.Evaluator
 	return matcher
 }
 
+// Pause/Resume会再次调用Start，已恢复的环路不能重复计入
 func (matcher *TimingMatcher) Start() {
+	matcher.recoverOnce.Do(matcher.recoverMinedRings)
+
 	matcher.afterSubmitWatcher = &eventemitter.Watcher{Concurrent: false, Handle: matcher.afterSubmit}
 	//todo:the topic should contain submit success
 	eventemitter.On(eventemitter.OrderManagerExtractorRingMined, matcher.afterSubmitWatcher)
@@ -118,24 +139,45 @@ func (matcher *TimingMatcher) Start() {
 
 func (matcher *TimingMatcher) blockTrigger(eventData eventemitter.EventData) error {
 	blockEvent := eventData.(*types.BlockEvent)
+	matcher.expireMinedRings(blockEvent.BlockNumber)
+
 	nextBlockNumber := new(big.Int).Add(matcher.duration, matcher.lastBlockNumber)
 	if nextBlockNumber.Cmp(blockEvent.BlockNumber) <= 0 {
 		matcher.lastBlockNumber = blockEvent.BlockNumber
-		var wg sync.WaitGroup
+		matcher.round()
+	}
+	return nil
+}
+
+// TriggerRound 不等待下一个区块，立即进行一轮匹配
+func (matcher *TimingMatcher) TriggerRound() {
+	matcher.round()
+}
+
+func (matcher *TimingMatcher) round() {
+	matcher.roundMtx.Lock()
+	defer matcher.roundMtx.Unlock()
+
+	//环路长度大于2时，需要跨市场搜索，所有市场共用订单，按协议依次进行
+	if matcher.ringMaxLength > 2 {
 		for _, protocolAddress := range matcher.submitter.Accessor.ProtocolAddresses {
-			for _, market := range matcher.markets {
-				wg.Add(1)
-				go func(market *Market) {
-					defer func() {
-						wg.Add(-1)
-					}()
-					market.match(protocolAddress.ContractAddress)
-				}(market)
-			}
+			matcher.matchRings(protocolAddress.ContractAddress)
 		}
-		wg.Wait()
+		return
 	}
-	return nil
+	var wg sync.WaitGroup
+	for _, protocolAddress := range matcher.submitter.Accessor.ProtocolAddresses {
+		for _, market := range matcher.markets {
+			wg.Add(1)
+			go func(market *Market, protocol common.Address) {
+				defer func() {
+					wg.Add(-1)
+				}()
+				market.match(protocol)
+			}(market, protocolAddress.ContractAddress)
+		}
+	}
+	wg.Wait()
 }
 
 func (market *Market) getOrdersForMatching(protocolAddress common.Address) {
@@ -163,6 +205,35 @@ func (market *Market) getOrdersForMatching(protocolAddress common.Address) {
 
 	market.AtoBOrderHashesExcludeNextRound = []common.Hash{}
 	market.BtoAOrderHashesExcludeNextRound = []common.Hash{}
+
+	market.matcher.statsMtx.Lock()
+	market.stats.Rounds += 1
+	market.stats.LastBlockNumber = market.matcher.lastBlockNumber.Int64()
+	market.stats.LastRoundTime = time.Now().Unix()
+	market.stats.AtoBOrders = len(market.AtoBOrders)
+	market.stats.BtoAOrders = len(market.BtoAOrders)
+	market.stats.MatchedOrders = 0
+	market.matcher.statsMtx.Unlock()
+}
+
+func (market *Market) addMatchedStats(matchedOrders, rings int) {
+	market.matcher.statsMtx.Lock()
+	defer market.matcher.statsMtx.Unlock()
+
+	market.stats.MatchedOrders += matchedOrders
+	market.stats.Rings += int64(rings)
+}
+
+// Stats 返回每个市场的匹配统计
+func (matcher *TimingMatcher) Stats() []miner.MarketStats {
+	matcher.statsMtx.RLock()
+	defer matcher.statsMtx.RUnlock()
+
+	stats := []miner.MarketStats{}
+	for _, market := range matcher.markets {
+		stats = append(stats, market.stats)
+	}
+	return stats
 }
 
 //sub the matched amount in new round.
@@ -205,7 +276,10 @@ func (market *Market) match(protocolAddress common.Address) {
 		for _, b2AOrder := range market.BtoAOrders {
 			if miner.PriceValid(a2BOrder, b2AOrder) {
 				ringTmp := types.NewRing([]types.OrderState{*a2BOrder, *b2AOrder})
-				market.matcher.evaluator.ComputeRing(ringTmp)
+				if err := market.matcher.evaluator.ComputeRing(ringTmp); nil != err {
+					log.Debugf("miner,timing matcher compute ring:%s err:%s", ringTmp.Hash.Hex(), err.Error())
+					continue
+				}
 				ringForSubmitTmp, err := market.matcher.submitter.GenerateRingSubmitInfo(ringTmp)
 				if nil != err {
 					log.Errorf("err: %s", err.Error())
@@ -228,6 +302,13 @@ func (market *Market) match(protocolAddress common.Address) {
 		}
 	}
 
+	market.excludeNextRound(matchedOrderHashes)
+	market.addMatchedStats(len(matchedOrderHashes), len(ringStates))
+	eventemitter.Emit(eventemitter.Miner_NewRing, ringStates)
+}
+
+//未匹配以及已完全成交的订单，下一轮不再拉取
+func (market *Market) excludeNextRound(matchedOrderHashes map[common.Hash]bool) {
 	for orderHash, _ := range market.AtoBOrders {
 		if fullFilled, exists := matchedOrderHashes[orderHash]; !exists || fullFilled {
 			market.AtoBOrderHashesExcludeNextRound = append(market.AtoBOrderHashesExcludeNextRound, orderHash)
@@ -239,37 +320,51 @@ func (market *Market) match(protocolAddress common.Address) {
 			market.BtoAOrderHashesExcludeNextRound = append(market.BtoAOrderHashesExcludeNextRound, orderHash)
 		}
 	}
-	eventemitter.Emit(eventemitter.Miner_NewRing, ringStates)
 }
 
 func (matcher *TimingMatcher) afterSubmit(eventData eventemitter.EventData) error {
 	matcher.mtx.Lock()
 	defer matcher.mtx.Unlock()
 
-	e := eventData.(*types.RingMinedEvent)
-	ringHash := e.Ringhash
-	if ringState, ok := matcher.MinedRings[ringHash]; ok {
-		delete(matcher.MinedRings, ringHash)
-		for _, orderHash := range ringState.orderHashes {
-			if minedState, ok := matcher.MatchedOrders[orderHash]; ok {
-				if len(minedState.rounds) <= 1 {
-					delete(matcher.MatchedOrders, orderHash)
-				} else {
-					for idx, s := range minedState.rounds {
-						if s.ringHash == ringHash {
-							round1 := append(minedState.rounds[:idx], minedState.rounds[idx+1:]...)
-							minedState.rounds = round1
-						}
-					}
+	var ringHash common.Hash
+	switch e := eventData.(type) {
+	case *types.RingMinedEvent:
+		ringHash = e.Ringhash
+	case *types.RingSubmitFailedEvent:
+		ringHash = e.RingHash
+	default:
+		return nil
+	}
+	matcher.releaseMinedRing(ringHash)
+	return nil
+}
+
+//释放环路占用的订单金额，调用方需持有锁
+func (matcher *TimingMatcher) releaseMinedRing(ringHash common.Hash) {
+	ringState, ok := matcher.MinedRings[ringHash]
+	if !ok {
+		return
+	}
+	delete(matcher.MinedRings, ringHash)
+	for _, orderHash := range ringState.orderHashes {
+		if minedState, ok := matcher.MatchedOrders[orderHash]; ok {
+			rounds := []*RoundState{}
+			for _, s := range minedState.rounds {
+				if s.ringHash != ringHash {
+					rounds = append(rounds, s)
 				}
 			}
+			if len(rounds) <= 0 {
+				delete(matcher.MatchedOrders, orderHash)
+			} else {
+				minedState.rounds = rounds
+			}
 		}
 	}
-	return nil
 }
 
 func (matcher *TimingMatcher) Stop() {
-	eventemitter.Un(eventemitter.Miner_RingMined, matcher.afterSubmitWatcher)
+	eventemitter.Un(eventemitter.OrderManagerExtractorRingMined, matcher.afterSubmitWatcher)
 	eventemitter.Un(eventemitter.Miner_RingSubmitFailed, matcher.afterSubmitWatcher)
 	eventemitter.Un(eventemitter.Block_New, matcher.blockTriger)
 }
@@ -296,6 +391,16 @@ func (matcher *TimingMatcher) addMatchedOrder(filledOrder *types.FilledOrder, ri
 
 	matchState.rounds = append(matchState.rounds, roundState)
 	matcher.MatchedOrders[filledOrder.OrderState.RawOrder.Hash] = matchState
+
+	ringState, ok := matcher.MinedRings[ringiHash]
+	if !ok {
+		ringState = &minedRing{ringHash: ringiHash, orderHashes: []common.Hash{}}
+		if nil != matcher.lastBlockNumber && matcher.lastBlockNumber.Sign() > 0 {
+			ringState.blockNumber = new(big.Int).Set(matcher.lastBlockNumber)
+		}
+		matcher.MinedRings[ringiHash] = ringState
+	}
+	ringState.orderHashes = append(ringState.orderHashes, filledOrder.OrderState.RawOrder.Hash)
 }
 
 func intFromRat(rat *big.Rat) *big.Int {
@@ -34,6 +34,7 @@ import (
 	"github.com/Loopring/relay/market/util"
 	"github.com/Loopring/relay/marketcap"
 	"github.com/Loopring/relay/miner"
+	"github.com/Loopring/relay/miner/event_matcher"
 	"github.com/Loopring/relay/miner/timing_matcher"
 	"github.com/Loopring/relay/ordermanager"
 	"github.com/Loopring/relay/usermanager"
@@ -52,6 +53,7 @@ type Node struct {
 	marketCapProvider *marketcap.MarketCapProvider
 	relayNode         *RelayNode
 	mineNode          *MineNode
+	adminService      gateway.AdminService
 
 	stop   chan struct{}
 	lock   sync.RWMutex
@@ -59,14 +61,16 @@ type Node struct {
 }
 
 type RelayNode struct {
-	trendManager   market.TrendManager
-	accountManager market.AccountManager
-	jsonRpcService gateway.JsonrpcServiceImpl
+	trendManager     market.TrendManager
+	accountManager   market.AccountManager
+	jsonRpcService   gateway.JsonrpcServiceImpl
+	websocketService gateway.WebsocketService
 }
 
 func (n *RelayNode) Start() {
 	//gateway.NewJsonrpcService("8080").Start()
 	n.jsonRpcService.Start()
+	n.websocketService.Start()
 }
 
 type MineNode struct {
@@ -95,13 +99,17 @@ func NewNode(logger *zap.Logger, globalConfig *config.GlobalConfig) *Node {
 	n.registerGateway()
 	n.registerCrypto(nil)
 
-	if "relay" == globalConfig.Mode {
+	// admin service should be registered after miner and before jsonrpc service
+	if "relay" == globalConfig.Mode || "readonly" == globalConfig.Mode {
+		n.registerAdminService()
 		n.registerRelayNode()
 		n.registerCrypto(keystore.NewKeyStore("", 0, 0))
 	} else if "miner" == globalConfig.Mode {
 		n.registerMineNode()
+		n.registerAdminService()
 	} else {
 		n.registerMineNode()
+		n.registerAdminService()
 		n.registerRelayNode()
 	}
 
@@ -113,6 +121,7 @@ func (n *Node) registerRelayNode() {
 	n.registerAccountManager()
 	n.registerTrendManager()
 	n.registerJsonRpcService()
+	n.registerWebsocketService()
 }
 
 func (n *Node) registerMineNode() {
@@ -125,6 +134,7 @@ func (n *Node) registerMineNode() {
 func (n *Node) Start() {
 	n.orderManager.Start()
 	n.extractorService.Start()
+	n.adminService.Start()
 
 	extractorSyncWatcher := &eventemitter.Watcher{Concurrent: false, Handle: n.startAfterSyncExtractor}
 	eventemitter.On(eventemitter.SyncChainComplete, extractorSyncWatcher)
@@ -134,7 +144,7 @@ func (n *Node) startAfterSyncExtractor(input eventemitter.EventData) error {
 	n.ipfsSubService.Start()
 	n.marketCapProvider.Start()
 
-	if "relay" == n.globalConfig.Mode {
+	if "relay" == n.globalConfig.Mode || "readonly" == n.globalConfig.Mode {
 		n.relayNode.Start()
 	} else if "miner" == n.globalConfig.Mode {
 		n.mineNode.Start()
@@ -211,18 +221,47 @@ func (n *Node) registerAccountManager() {
 
 func (n *Node) registerJsonRpcService() {
 	ethForwarder := gateway.EthForwarder{Accessor: *n.accessor}
-	n.relayNode.jsonRpcService = *gateway.NewJsonrpcService(strconv.Itoa(n.globalConfig.Jsonrpc.Port), n.relayNode.trendManager, n.orderManager, n.relayNode.accountManager, &ethForwarder, n.marketCapProvider)
+	n.relayNode.jsonRpcService = *gateway.NewJsonrpcService(n.globalConfig.Jsonrpc, n.relayNode.trendManager, n.orderManager, n.relayNode.accountManager, &ethForwarder, n.marketCapProvider, n.adminService, n.isReadOnly())
+}
+
+func (n *Node) registerWebsocketService() {
+	n.relayNode.websocketService = gateway.NewWebsocketService(strconv.Itoa(n.globalConfig.Jsonrpc.WebsocketPort), &n.relayNode.jsonRpcService)
 }
 
 func (n *Node) registerMiner() {
 	submitter := miner.NewSubmitter(n.globalConfig.Miner, n.accessor, n.rdsService, n.marketCapProvider)
 	evaluator := miner.NewEvaluator(n.marketCapProvider, n.globalConfig.Miner.RateRatioCVSThreshold, n.accessor)
-	matcher := timing_matcher.NewTimingMatcher(submitter, evaluator, n.orderManager)
+	var matcher miner.Matcher
+	switch n.globalConfig.Miner.Matcher {
+	case "", "timing":
+		matcher = timing_matcher.NewTimingMatcher(n.globalConfig.Miner, submitter, evaluator, n.orderManager, n.rdsService)
+	case "event":
+		matcher = event_matcher.NewEventMatcher(n.globalConfig.Miner, submitter, evaluator, n.orderManager, n.rdsService)
+	default:
+		log.Fatalf("miner,unsupported matcher:%s", n.globalConfig.Miner.Matcher)
+	}
 	n.mineNode.miner = miner.NewMiner(submitter, matcher, evaluator, n.accessor, n.marketCapProvider)
 }
 
+// readonly relay serves order books and queries only, orders from ipfs are accepted but never rebroadcast
+func (n *Node) isReadOnly() bool {
+	return "readonly" == n.globalConfig.Mode
+}
+
 func (n *Node) registerGateway() {
-	gateway.Initialize(&n.globalConfig.GatewayFilters, &n.globalConfig.Gateway, &n.globalConfig.Ipfs, n.orderManager)
+	options := n.globalConfig.Gateway
+	if n.isReadOnly() {
+		options.IsBroadcast = false
+	}
+	gateway.Initialize(&n.globalConfig.GatewayFilters, &options, &n.globalConfig.Ipfs, n.orderManager)
+}
+
+func (n *Node) registerAdminService() {
+	var minerController gateway.MinerController
+	if nil != n.mineNode {
+		minerController = n.mineNode.miner
+	}
+	n.adminService = gateway.NewAdminService(n.globalConfig.Admin, n.rdsService, n.userManager, n.ipfsSubService, minerController)
 }
 
 func (n *Node) registerUserManager() {
@@ -20,28 +20,33 @@ package ordermanager
 
 import (
 	"github.com/Loopring/relay/dao"
-	"github.com/Loopring/relay/ethaccessor"
 	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/marketcap"
 	"github.com/Loopring/relay/types"
-	"math/big"
 )
 
 type forkProcessor struct {
-	dao      dao.RdsService
-	accessor *ethaccessor.EthNodeAccessor
+	dao       dao.RdsService
+	rebuilder *OrderStateRebuilder
 }
 
-func newForkProcess(rds dao.RdsService, accessor *ethaccessor.EthNodeAccessor) *forkProcessor {
+func newForkProcess(rds dao.RdsService, mc *marketcap.MarketCapProvider) *forkProcessor {
 	processor := &forkProcessor{}
 	processor.dao = rds
+	processor.rebuilder = NewOrderStateRebuilder(rds, mc)
 
 	return processor
 }
 
-// todo: 回滚时需要将所有涉及到的event对应的order amount修改一遍
+// 回滚区间为(共同祖先, 旧链最新区块]，先找出受影响的订单，删除区间内的事件后根据剩余事件重建订单状态
 func (p *forkProcessor) fork(event *types.ForkedEvent) error {
 	from := event.ForkBlock.Int64()
-	to := event.DetectedBlock.Int64()
+	to := event.EndBlock.Int64()
+
+	orderhashs, err := p.rebuilder.TouchedOrders(from+1, to)
+	if err != nil {
+		return err
+	}
 
 	if err := p.dao.RollBackRingMined(from, to); err != nil {
 		log.Errorf("order manager fork error:%s", err.Error())
@@ -56,63 +61,11 @@ func (p *forkProcessor) fork(event *types.ForkedEvent) error {
 		log.Errorf("order manager fork error:%s", err.Error())
 	}
 
-	orderList, err := p.dao.GetOrdersWithBlockNumberRange(from, to)
+	rebuilt, err := p.rebuilder.Rebuild(orderhashs)
 	if err != nil {
 		return err
 	}
+	log.Infof("order manager fork,rollback blocks (%d, %d],%d orders rebuilt", from, to, rebuilt)
 
-	forkBlockNumber := big.NewInt(from)
-	forkBlockNumHex := types.BigintToHex(forkBlockNumber)
-	for _, v := range orderList {
-		state := &types.OrderState{}
-		if err := v.ConvertUp(state); err != nil {
-			log.Errorf("order manager fork error:%s", err.Error())
-			continue
-		}
-
-		// todo(fuk):get contract cancelOrFilledMap remainAmount and approval token amount,compare and get min
-		remain, err := p.accessor.GetCancelledOrFilled(state.RawOrder.Protocol, state.RawOrder.Hash, forkBlockNumHex)
-		if err != nil {
-			log.Debugf("order manager fork error:%s", err.Error())
-			continue
-		}
-
-		if state.RawOrder.BuyNoMoreThanAmountB == true {
-			state.DealtAmountB = remain // getMinAmount(remain, allowance, balance)
-		} else {
-			batchReq := ethaccessor.BatchErc20Req{}
-			batchReq.Spender, err = p.accessor.GetSenderAddress(state.RawOrder.Protocol)
-			if err != nil {
-				log.Debugf("order manager fork error:%s", err.Error())
-				continue
-			}
-			batchReq.Owner = state.RawOrder.Owner
-			batchReq.Token = state.RawOrder.TokenS
-			batchReq.BlockParameter = forkBlockNumHex
-
-			p.accessor.BatchErc20BalanceAndAllowance([]*ethaccessor.BatchErc20Req{&batchReq})
-			if err != nil || batchReq.AllowanceErr != nil || batchReq.BalanceErr != nil {
-				log.Debugf("order manager fork error:%s", err.Error())
-				continue
-			}
-
-			state.DealtAmountS = getMinAmount(remain, batchReq.Allowance.BigInt(), batchReq.Balance.BigInt())
-		}
-
-		state.CalculateRemainAmount()
-		state.UpdatedBlock = forkBlockNumber
-
-		newOrderModel := dao.Order{ID: v.ID}
-		if err := newOrderModel.ConvertDown(state); err != nil {
-			log.Debugf("order manager fork error:%s", err.Error())
-			continue
-		}
-
-		if err := p.dao.Save(newOrderModel); err != nil {
-			log.Debugf("order manager fork erorr:%s", err.Error())
-			continue
-		}
-	}
-	// todo find order in contract
 	return nil
 }
@@ -32,6 +32,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"math/big"
 	"sync"
+	"time"
 )
 
 type OrderManager interface {
@@ -46,6 +47,8 @@ type OrderManager interface {
 	RingMinedPageQuery(query map[string]interface{}, pageIndex, pageSize int) (dao.PageResult, error)
 	IsOrderCutoff(owner common.Address, createTime *big.Int) bool
 	IsOrderFullFinished(state *types.OrderState) bool
+	SoftCancelOrder(cancellation *types.OrderCancellation) error
+	CountOpenOrders(owner, tokenS, tokenB common.Address) (int, error)
 }
 
 type OrderManagerImpl struct {
@@ -64,6 +67,7 @@ type OrderManagerImpl struct {
 	cancelOrderWatcher *eventemitter.Watcher
 	cutoffOrderWatcher *eventemitter.Watcher
 	forkWatcher        *eventemitter.Watcher
+	newBlockWatcher    *eventemitter.Watcher
 }
 
 func NewOrderManager(options config.OrderManagerOptions,
@@ -77,7 +81,7 @@ func NewOrderManager(options config.OrderManagerOptions,
 	om.options = options
 	om.commonOpts = commonOpts
 	om.rds = rds
-	om.processor = newForkProcess(om.rds, accessor)
+	om.processor = newForkProcess(om.rds, market)
 	om.accessor = accessor
 	om.um = userManager
 	om.mc = market
@@ -95,13 +99,15 @@ func (om *OrderManagerImpl) Start() {
 	om.cancelOrderWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleOrderCancelled}
 	om.cutoffOrderWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleOrderCutoff}
 	om.forkWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleFork}
+	om.newBlockWatcher = &eventemitter.Watcher{Concurrent: false, Handle: om.handleNewBlock}
 
 	eventemitter.On(eventemitter.OrderManagerGatewayNewOrder, om.newOrderWatcher)
 	eventemitter.On(eventemitter.OrderManagerExtractorRingMined, om.ringMinedWatcher)
 	eventemitter.On(eventemitter.OrderManagerExtractorFill, om.fillOrderWatcher)
 	eventemitter.On(eventemitter.OrderManagerExtractorCancel, om.cancelOrderWatcher)
 	eventemitter.On(eventemitter.OrderManagerExtractorCutoff, om.cutoffOrderWatcher)
-	eventemitter.On(eventemitter.OrderManagerFork, om.forkWatcher)
+	eventemitter.On(eventemitter.ExtractorFork, om.forkWatcher)
+	eventemitter.On(eventemitter.Block_New, om.newBlockWatcher)
 }
 
 func (om *OrderManagerImpl) Stop() {
@@ -113,21 +119,53 @@ func (om *OrderManagerImpl) Stop() {
 	eventemitter.Un(eventemitter.OrderManagerExtractorFill, om.fillOrderWatcher)
 	eventemitter.Un(eventemitter.OrderManagerExtractorCancel, om.cancelOrderWatcher)
 	eventemitter.Un(eventemitter.OrderManagerExtractorCutoff, om.cutoffOrderWatcher)
-	eventemitter.Un(eventemitter.OrderManagerFork, om.forkWatcher)
+	eventemitter.Un(eventemitter.ExtractorFork, om.forkWatcher)
+	eventemitter.Un(eventemitter.Block_New, om.newBlockWatcher)
 }
 
+// 分叉事件由extractor同步发送，回滚完成前不会有新的链上事件，这里只需阻止gateway订单写入
 func (om *OrderManagerImpl) handleFork(input eventemitter.EventData) error {
-	om.Stop()
+	om.lock.Lock()
+	defer om.lock.Unlock()
 
 	if err := om.processor.fork(input.(*types.ForkedEvent)); err != nil {
 		log.Errorf("order manager,handle fork error:%s", err.Error())
 	}
 
-	om.Start()
+	return nil
+}
+
+// 根据区块时间将过期订单状态置为expire
+func (om *OrderManagerImpl) handleNewBlock(input eventemitter.EventData) error {
+	event := input.(*types.BlockEvent)
+	if event.BlockTime == nil {
+		return nil
+	}
+
+	expired, err := om.rds.SettleOrdersExpiredStatus(event.BlockTime.Int64())
+	if err != nil {
+		return fmt.Errorf("order manager,handle new block,settle expired orders error:%s", err.Error())
+	}
+	if len(expired) > 0 {
+		log.Debugf("order manager,handle new block %s,%d orders expired", event.BlockNumber.String(), len(expired))
+	}
+	om.emitStatusChanged(expired...)
 
 	return nil
 }
 
+// 批量修改状态的订单逐个发送OrderManagerOrderStatusChanged，gateway据此推送给订单owner
+func (om *OrderManagerImpl) emitStatusChanged(models ...dao.Order) {
+	for _, model := range models {
+		state := &types.OrderState{}
+		if err := model.ConvertUp(state); err != nil {
+			log.Errorf("order manager,convert order %s error:%s", model.OrderHash, err.Error())
+			continue
+		}
+		eventemitter.Emit(eventemitter.OrderManagerOrderStatusChanged, state)
+	}
+}
+
 // 来自ipfs的新订单
 // 所有来自ipfs的订单都是新订单
 func (om *OrderManagerImpl) handleGatewayOrder(input eventemitter.EventData) error {
@@ -181,7 +219,15 @@ func (om *OrderManagerImpl) handleGatewayOrder(input eventemitter.EventData) err
 	model.Market, _ = util.WrapMarketByAddress(state.RawOrder.TokenB.Hex(), state.RawOrder.TokenS.Hex())
 	model.ConvertDown(state)
 
-	return om.rds.Add(model)
+	if err := om.rds.Add(model); err != nil {
+		return err
+	}
+
+	// 通知维护订单簿的matcher
+	if state.Status != types.ORDER_FINISHED {
+		eventemitter.Emit(eventemitter.Miner_NewOrderState, state)
+	}
+	return nil
 }
 
 func (om *OrderManagerImpl) handleRingMined(input eventemitter.EventData) error {
@@ -306,6 +352,7 @@ func (om *OrderManagerImpl) handleOrderCancelled(input eventemitter.EventData) e
 	if err := om.rds.UpdateOrderWhileCancel(state.RawOrder.Hash, state.Status, state.CancelledAmountS, state.CancelledAmountB, state.UpdatedBlock); err != nil {
 		return err
 	}
+	eventemitter.Emit(eventemitter.OrderManagerOrderStatusChanged, state)
 
 	return nil
 }
@@ -313,9 +360,11 @@ func (om *OrderManagerImpl) handleOrderCancelled(input eventemitter.EventData) e
 func (om *OrderManagerImpl) handleOrderCutoff(input eventemitter.EventData) error {
 	event := input.(*types.CutoffEvent)
 
-	if err := om.rds.SettleOrdersCutoffStatus(event.Owner, event.Cutoff); err != nil {
+	cutoff, err := om.rds.SettleOrdersCutoffStatus(event.Owner, event.Cutoff)
+	if err != nil {
 		log.Debugf("order manager,handle cutoff event,%s", err.Error())
 	}
+	om.emitStatusChanged(cutoff...)
 	if err := om.cutoffCache.Add(event); err != nil {
 		return err
 	}
@@ -337,19 +386,24 @@ func (om *OrderManagerImpl) IsFundInsufficient(state *types.OrderState) bool {
 }
 
 func (om *OrderManagerImpl) IsOrderFullFinished(state *types.OrderState) bool {
+	return isOrderFullFinished(state, om.mc)
+}
+
+// 剩余金额的法币价值不超过1时认为订单已完成
+func isOrderFullFinished(state *types.OrderState, mc *marketcap.MarketCapProvider) bool {
 	var valueOfRemainAmount *big.Rat
 
 	if state.RawOrder.BuyNoMoreThanAmountB {
 		cancelOrFilledAmountB := new(big.Int).Add(state.DealtAmountB, state.CancelledAmountB)
 		remainAmountB := new(big.Int).Sub(state.RawOrder.AmountB, cancelOrFilledAmountB)
 		ratRemainAmountB := new(big.Rat).SetInt(remainAmountB)
-		price := om.mc.GetMarketCap(state.RawOrder.TokenB)
+		price := mc.GetMarketCap(state.RawOrder.TokenB)
 		valueOfRemainAmount = new(big.Rat).Mul(price, ratRemainAmountB)
 	} else {
 		cancelOrFilledAmountS := new(big.Int).Add(state.DealtAmountS, state.CancelledAmountS)
 		remainAmountS := new(big.Int).Sub(state.RawOrder.AmountS, cancelOrFilledAmountS)
 		ratRemainAmountS := new(big.Rat).SetInt(remainAmountS)
-		price := om.mc.GetMarketCap(state.RawOrder.TokenS)
+		price := mc.GetMarketCap(state.RawOrder.TokenS)
 		valueOfRemainAmount = new(big.Rat).Mul(price, ratRemainAmountS)
 	}
 
@@ -369,7 +423,7 @@ func (om *OrderManagerImpl) MinerOrders(protocol, tokenS, tokenB common.Address,
 		markBlockNumber *big.Int
 		err             error
 		orderhashstrs   []string
-		filterStatus    = []types.OrderStatus{types.ORDER_FINISHED, types.ORDER_CUTOFF, types.ORDER_CANCEL}
+		filterStatus    = []types.OrderStatus{types.ORDER_FINISHED, types.ORDER_CUTOFF, types.ORDER_CANCEL, types.ORDER_EXPIRE, types.ORDER_SOFT_CANCEL}
 	)
 
 	for _, v := range filterOrderhashs {
@@ -515,3 +569,36 @@ func (om *OrderManagerImpl) RingMinedPageQuery(query map[string]interface{}, pag
 func (om *OrderManagerImpl) IsOrderCutoff(owner common.Address, createTime *big.Int) bool {
 	return om.cutoffCache.IsOrderCutoff(owner, createTime)
 }
+
+// 统计owner在该市场(包括买卖两个方向)未完成且未过期的订单数
+func (om *OrderManagerImpl) CountOpenOrders(owner, tokenS, tokenB common.Address) (int, error) {
+	return om.rds.CountOpenOrders(owner, tokenS, tokenB, time.Now().Unix())
+}
+
+// 软取消订单,签名已在gateway验证,这里只验证订单owner及状态
+func (om *OrderManagerImpl) SoftCancelOrder(cancellation *types.OrderCancellation) error {
+	om.lock.Lock()
+	defer om.lock.Unlock()
+
+	model, err := om.rds.GetOrderByHash(cancellation.OrderHash)
+	if err != nil {
+		return fmt.Errorf("order manager,soft cancel order,order %s not found", cancellation.OrderHash.Hex())
+	}
+	if common.HexToAddress(model.Owner) != cancellation.Owner {
+		return fmt.Errorf("order manager,soft cancel order,order %s owner %s not match %s", cancellation.OrderHash.Hex(), model.Owner, cancellation.Owner.Hex())
+	}
+
+	affected, err := om.rds.UpdateOrderWhileSoftCancel(cancellation.OrderHash)
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return fmt.Errorf("order manager,soft cancel order,order %s status %d can not be cancelled", cancellation.OrderHash.Hex(), model.Status)
+	}
+
+	log.Debugf("order manager,soft cancel order %s", cancellation.OrderHash.Hex())
+	eventemitter.Emit(eventemitter.Miner_DeleteOrderState, cancellation.OrderHash)
+	model.Status = uint8(types.ORDER_SOFT_CANCEL)
+	om.emitStatusChanged(*model)
+	return nil
+}
@@ -0,0 +1,269 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+const rebuildBatchSize = 200
+
+/**
+订单状态重建：dealt/cancelled amount只由数据库中的fill、cancel事件按区块及事件顺序累加得到，
+cutoff事件早于其时间创建的订单置为cutoff，软取消及过期等链下状态保留，
+分叉回滚以及运维命令(lrc orders rebuild)都通过这里重建订单状态
+*/
+
+type OrderStateRebuilder struct {
+	rds dao.RdsService
+	mc  *marketcap.MarketCapProvider
+}
+
+func NewOrderStateRebuilder(rds dao.RdsService, mc *marketcap.MarketCapProvider) *OrderStateRebuilder {
+	return &OrderStateRebuilder{rds: rds, mc: mc}
+}
+
+// 区块区间[from, to]内有fill、cancel事件或状态更新过的订单，以及cutoff事件涉及的订单
+func (r *OrderStateRebuilder) TouchedOrders(from, to int64) ([]common.Hash, error) {
+	var (
+		orderhashs []common.Hash
+		exists     = make(map[common.Hash]bool)
+	)
+	add := func(hash string) {
+		orderhash := common.HexToHash(hash)
+		if !exists[orderhash] {
+			exists[orderhash] = true
+			orderhashs = append(orderhashs, orderhash)
+		}
+	}
+
+	fills, err := r.rds.GetFillEventsByBlockRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range fills {
+		add(v.OrderHash)
+	}
+
+	cancels, err := r.rds.GetCancelEventsByBlockRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range cancels {
+		add(v.OrderHash)
+	}
+
+	orders, err := r.rds.GetOrdersWithBlockNumberRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range orders {
+		add(v.OrderHash)
+	}
+
+	cutoffs, err := r.rds.GetCutoffEventsByBlockRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range cutoffs {
+		orders, err := r.rds.GetCutoffOrdersByOwner(common.HexToAddress(v.Owner), v.Cutoff)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range orders {
+			add(o.OrderHash)
+		}
+	}
+
+	return orderhashs, nil
+}
+
+// 重放订单的fill、cancel及cutoff事件并保存，返回重建的订单数
+func (r *OrderStateRebuilder) Rebuild(orderhashs []common.Hash) (int, error) {
+	rebuilt := 0
+	cutoffs := make(map[common.Address]int64)
+
+	for start := 0; start < len(orderhashs); start += rebuildBatchSize {
+		end := start + rebuildBatchSize
+		if end > len(orderhashs) {
+			end = len(orderhashs)
+		}
+		hashs := []string{}
+		for _, v := range orderhashs[start:end] {
+			hashs = append(hashs, v.Hex())
+		}
+
+		models, err := r.rds.GetOrdersByHash(hashs)
+		if err != nil {
+			return rebuilt, err
+		}
+		fills, err := r.rds.GetFillEventsByOrderHashs(hashs)
+		if err != nil {
+			return rebuilt, err
+		}
+		cancels, err := r.rds.GetCancelEventsByOrderHashs(hashs)
+		if err != nil {
+			return rebuilt, err
+		}
+		fillMap := make(map[string][]dao.FillEvent)
+		for _, v := range fills {
+			fillMap[v.OrderHash] = append(fillMap[v.OrderHash], v)
+		}
+		cancelMap := make(map[string][]dao.CancelEvent)
+		for _, v := range cancels {
+			cancelMap[v.OrderHash] = append(cancelMap[v.OrderHash], v)
+		}
+
+		for _, hash := range hashs {
+			model, ok := models[hash]
+			if !ok {
+				log.Debugf("order manager,rebuild order state,order %s not found", hash)
+				continue
+			}
+
+			owner := common.HexToAddress(model.Owner)
+			if _, ok := cutoffs[owner]; !ok {
+				cutoffs[owner] = 0
+				if cutoff, err := r.rds.FindCutoffEventByOwnerAddress(owner); err == nil {
+					cutoffs[owner] = cutoff.Cutoff
+				}
+			}
+
+			state, err := r.replay(&model, fillMap[hash], cancelMap[hash], cutoffs[owner])
+			if err != nil {
+				return rebuilt, err
+			}
+			// 可能与运行中的order manager同时写入，只更新重建的字段
+			if err := r.rds.UpdateOrderWhileRebuild(state.RawOrder.Hash, state.Status, state.DealtAmountS, state.DealtAmountB, state.CancelledAmountS, state.CancelledAmountB, state.UpdatedBlock); err != nil {
+				return rebuilt, err
+			}
+			log.Debugf("order manager,rebuild order %s,status:%d,dealtAmountS:%s,dealtAmountB:%s,cancelledAmountS:%s,cancelledAmountB:%s",
+				hash, state.Status, state.DealtAmountS.String(), state.DealtAmountB.String(), state.CancelledAmountS.String(), state.CancelledAmountB.String())
+			rebuilt++
+		}
+	}
+
+	return rebuilt, nil
+}
+
+func (r *OrderStateRebuilder) replay(model *dao.Order, fills []dao.FillEvent, cancels []dao.CancelEvent, cutoff int64) (*types.OrderState, error) {
+	state := &types.OrderState{}
+	if err := model.ConvertUp(state); err != nil {
+		return nil, err
+	}
+	softCancelled := state.Status == types.ORDER_SOFT_CANCEL
+
+	state.DealtAmountS = big.NewInt(0)
+	state.DealtAmountB = big.NewInt(0)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	if nil == state.UpdatedBlock {
+		state.UpdatedBlock = big.NewInt(0)
+	}
+
+	// fill与cancel按区块及日志顺序合并重放
+	for len(fills) > 0 || len(cancels) > 0 {
+		if len(cancels) == 0 || (len(fills) > 0 && !logBefore(cancels[0].BlockNumber, cancels[0].LogIndex, fills[0].BlockNumber, fills[0].LogIndex)) {
+			if err := applyFill(state, &fills[0]); err != nil {
+				return nil, err
+			}
+			fills = fills[1:]
+		} else {
+			if err := applyCancel(state, &cancels[0]); err != nil {
+				return nil, err
+			}
+			cancels = cancels[1:]
+		}
+	}
+
+	switch {
+	case r.isFinished(state):
+		state.Status = types.ORDER_FINISHED
+	case state.RawOrder.Timestamp.Int64() < cutoff:
+		state.Status = types.ORDER_CUTOFF
+	case softCancelled:
+		state.Status = types.ORDER_SOFT_CANCEL
+	case state.RawOrder.IsExpired(time.Now().Unix()):
+		state.Status = types.ORDER_EXPIRE
+	case state.DealtAmountS.Sign() > 0 || state.DealtAmountB.Sign() > 0 || state.CancelledAmountS.Sign() > 0 || state.CancelledAmountB.Sign() > 0:
+		state.Status = types.ORDER_PARTIAL
+	default:
+		state.Status = types.ORDER_NEW
+	}
+
+	return state, nil
+}
+
+// 价格未获取(为0)时无法按法币价值判断，剩余量不大于0时才视为完全成交
+func (r *OrderStateRebuilder) isFinished(state *types.OrderState) bool {
+	var remain *big.Int
+	var token common.Address
+	if state.RawOrder.BuyNoMoreThanAmountB {
+		remain = new(big.Int).Sub(state.RawOrder.AmountB, new(big.Int).Add(state.DealtAmountB, state.CancelledAmountB))
+		token = state.RawOrder.TokenB
+	} else {
+		remain = new(big.Int).Sub(state.RawOrder.AmountS, new(big.Int).Add(state.DealtAmountS, state.CancelledAmountS))
+		token = state.RawOrder.TokenS
+	}
+	if r.mc.GetMarketCap(token).Sign() <= 0 {
+		return remain.Sign() <= 0
+	}
+	return isOrderFullFinished(state, r.mc)
+}
+
+func logBefore(blockNumber, logIndex, otherBlockNumber, otherLogIndex int64) bool {
+	return blockNumber < otherBlockNumber || (blockNumber == otherBlockNumber && logIndex < otherLogIndex)
+}
+
+func applyFill(state *types.OrderState, fill *dao.FillEvent) error {
+	amountS, ok := new(big.Int).SetString(fill.AmountS, 0)
+	if !ok {
+		return fmt.Errorf("order manager,rebuild order %s,invalid fill amountS:%s", fill.OrderHash, fill.AmountS)
+	}
+	amountB, ok := new(big.Int).SetString(fill.AmountB, 0)
+	if !ok {
+		return fmt.Errorf("order manager,rebuild order %s,invalid fill amountB:%s", fill.OrderHash, fill.AmountB)
+	}
+	state.DealtAmountS.Add(state.DealtAmountS, amountS)
+	state.DealtAmountB.Add(state.DealtAmountB, amountB)
+	state.UpdatedBlock = big.NewInt(fill.BlockNumber)
+	return nil
+}
+
+func applyCancel(state *types.OrderState, cancel *dao.CancelEvent) error {
+	amount, ok := new(big.Int).SetString(cancel.AmountCancelled, 0)
+	if !ok {
+		return fmt.Errorf("order manager,rebuild order %s,invalid cancelled amount:%s", cancel.OrderHash, cancel.AmountCancelled)
+	}
+	if state.RawOrder.BuyNoMoreThanAmountB {
+		state.CancelledAmountB.Add(state.CancelledAmountB, amount)
+	} else {
+		state.CancelledAmountS.Add(state.CancelledAmountS, amount)
+	}
+	state.UpdatedBlock = big.NewInt(cancel.BlockNumber)
+	return nil
+}
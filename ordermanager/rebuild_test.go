@@ -0,0 +1,217 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager_test
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+type rebuildRds struct {
+	dao.RdsService
+	orders  map[string]dao.Order
+	fills   []dao.FillEvent
+	cancels []dao.CancelEvent
+	cutoffs map[string]int64
+}
+
+func (r *rebuildRds) GetOrdersByHash(orderhashs []string) (map[string]dao.Order, error) {
+	ret := make(map[string]dao.Order)
+	for _, v := range orderhashs {
+		if o, ok := r.orders[v]; ok {
+			ret[v] = o
+		}
+	}
+	return ret, nil
+}
+
+func (r *rebuildRds) GetFillEventsByOrderHashs(orderhashs []string) ([]dao.FillEvent, error) {
+	return r.fills, nil
+}
+
+func (r *rebuildRds) GetCancelEventsByOrderHashs(orderhashs []string) ([]dao.CancelEvent, error) {
+	return r.cancels, nil
+}
+
+func (r *rebuildRds) FindCutoffEventByOwnerAddress(owner common.Address) (*dao.CutOffEvent, error) {
+	if cutoff, ok := r.cutoffs[owner.Hex()]; ok {
+		return &dao.CutOffEvent{Owner: owner.Hex(), Cutoff: cutoff}, nil
+	}
+	return nil, errors.New("record not found")
+}
+
+func (r *rebuildRds) UpdateOrderWhileRebuild(hash common.Hash, status types.OrderStatus, dealtAmountS, dealtAmountB, cancelledAmountS, cancelledAmountB, blockNumber *big.Int) error {
+	model := r.orders[hash.Hex()]
+	model.Status = uint8(status)
+	model.DealtAmountS = dealtAmountS.String()
+	model.DealtAmountB = dealtAmountB.String()
+	model.CancelledAmountS = cancelledAmountS.String()
+	model.CancelledAmountB = cancelledAmountB.String()
+	model.UpdatedBlock = blockNumber.Int64()
+	r.orders[hash.Hex()] = model
+	return nil
+}
+
+func newRebuildOrder(t *testing.T, owner, tokenS, tokenB common.Address, status types.OrderStatus) dao.Order {
+	state := &types.OrderState{}
+	state.RawOrder.Protocol = common.HexToAddress("0x03e0f73a93993e5101362656af1162ed80fb5dc4")
+	state.RawOrder.Owner = owner
+	state.RawOrder.TokenS = tokenS
+	state.RawOrder.TokenB = tokenB
+	state.RawOrder.AmountS = big.NewInt(1000)
+	state.RawOrder.AmountB = big.NewInt(500)
+	state.RawOrder.Timestamp = big.NewInt(time.Now().Unix() - 3600)
+	state.RawOrder.Ttl = big.NewInt(86400)
+	state.RawOrder.Salt = big.NewInt(1)
+	state.RawOrder.LrcFee = big.NewInt(0)
+	state.RawOrder.GeneratePrice()
+	state.RawOrder.Hash = state.RawOrder.GenerateHash()
+
+	// 订单中已有的成交量来自被回滚的事件
+	state.DealtAmountS = big.NewInt(900)
+	state.DealtAmountB = big.NewInt(450)
+	state.CancelledAmountS = big.NewInt(0)
+	state.CancelledAmountB = big.NewInt(0)
+	state.UpdatedBlock = big.NewInt(20)
+	state.Status = status
+
+	model := dao.Order{}
+	if err := model.ConvertDown(state); nil != err {
+		t.Fatal(err)
+	}
+	return model
+}
+
+func TestOrderStateRebuilder_Rebuild(t *testing.T) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+	owner := common.HexToAddress("0xb1018949b241d76a1ab2094f473e9befeabb5ead")
+	tokenS := common.HexToAddress("0xef68e7c694f40c8202821edf525de3782458639f")
+	tokenB := common.HexToAddress("0x88699e7fee2da0462981a08a15a3b940304cc516")
+	mc := marketcap.NewMarketCapProvider(config.MinerOptions{})
+	mc.SetMarketCap(tokenS, 1)
+	mc.SetMarketCap(tokenB, 1)
+
+	type testCase struct {
+		name      string
+		status    types.OrderStatus
+		cancels   []string
+		cutoff    int64
+		expect    types.OrderStatus
+		cancelled int64
+	}
+	cases := []testCase{
+		{name: "partial", status: types.ORDER_FINISHED, cancels: []string{"100"}, expect: types.ORDER_PARTIAL, cancelled: 100},
+		{name: "finished", status: types.ORDER_PARTIAL, cancels: []string{"100", "400"}, expect: types.ORDER_FINISHED, cancelled: 500},
+		{name: "soft cancel", status: types.ORDER_SOFT_CANCEL, expect: types.ORDER_SOFT_CANCEL},
+		{name: "cutoff", status: types.ORDER_PARTIAL, cutoff: time.Now().Unix(), expect: types.ORDER_CUTOFF},
+	}
+
+	for _, c := range cases {
+		model := newRebuildOrder(t, owner, tokenS, tokenB, c.status)
+		rds := &rebuildRds{orders: map[string]dao.Order{model.OrderHash: model}, cutoffs: make(map[string]int64)}
+		rds.fills = []dao.FillEvent{
+			{OrderHash: model.OrderHash, BlockNumber: 10, AmountS: "300", AmountB: "150"},
+			{OrderHash: model.OrderHash, BlockNumber: 12, AmountS: "200", AmountB: "100"},
+		}
+		for _, v := range c.cancels {
+			rds.cancels = append(rds.cancels, dao.CancelEvent{OrderHash: model.OrderHash, BlockNumber: 11, AmountCancelled: v})
+		}
+		if c.cutoff > 0 {
+			rds.cutoffs[owner.Hex()] = c.cutoff
+		}
+
+		rebuilder := ordermanager.NewOrderStateRebuilder(rds, mc)
+		if rebuilt, err := rebuilder.Rebuild([]common.Hash{common.HexToHash(model.OrderHash), common.HexToHash("0x1234")}); nil != err || rebuilt != 1 {
+			t.Fatalf("%s,rebuilt:%d err:%v", c.name, rebuilt, err)
+		}
+
+		state := &types.OrderState{}
+		saved := rds.orders[model.OrderHash]
+		if err := saved.ConvertUp(state); nil != err {
+			t.Fatal(err)
+		}
+		if state.Status != c.expect {
+			t.Fatalf("%s,status:%d expected:%d", c.name, state.Status, c.expect)
+		}
+		if state.DealtAmountS.Int64() != 500 || state.DealtAmountB.Int64() != 250 || state.CancelledAmountS.Int64() != c.cancelled {
+			t.Fatalf("%s,dealtAmountS:%s dealtAmountB:%s cancelledAmountS:%s", c.name, state.DealtAmountS.String(), state.DealtAmountB.String(), state.CancelledAmountS.String())
+		}
+		if state.UpdatedBlock.Int64() != 12 {
+			t.Fatalf("%s,updated block:%s", c.name, state.UpdatedBlock.String())
+		}
+	}
+}
+
+// 价格未获取时(如未启动的MarketCapProvider)价格为0，剩余量大于0的订单不能视为完全成交
+func TestOrderStateRebuilder_RebuildWithoutPrice(t *testing.T) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+	owner := common.HexToAddress("0xb1018949b241d76a1ab2094f473e9befeabb5ead")
+	tokenS := common.HexToAddress("0xef68e7c694f40c8202821edf525de3782458639f")
+	tokenB := common.HexToAddress("0x88699e7fee2da0462981a08a15a3b940304cc516")
+	mc := marketcap.NewMarketCapProvider(config.MinerOptions{})
+	mc.SetMarketCap(tokenS, 0)
+	mc.SetMarketCap(tokenB, 0)
+
+	cases := []struct {
+		name    string
+		fillS   string
+		fillB   string
+		cancels []string
+		expect  types.OrderStatus
+	}{
+		{name: "dust remained", fillS: "999", fillB: "499", expect: types.ORDER_PARTIAL},
+		{name: "partial", fillS: "500", fillB: "250", cancels: []string{"100"}, expect: types.ORDER_PARTIAL},
+		{name: "finished", fillS: "500", fillB: "250", cancels: []string{"500"}, expect: types.ORDER_FINISHED},
+	}
+	for _, c := range cases {
+		model := newRebuildOrder(t, owner, tokenS, tokenB, types.ORDER_PARTIAL)
+		rds := &rebuildRds{orders: map[string]dao.Order{model.OrderHash: model}, cutoffs: make(map[string]int64)}
+		rds.fills = []dao.FillEvent{{OrderHash: model.OrderHash, BlockNumber: 10, AmountS: c.fillS, AmountB: c.fillB}}
+		for _, v := range c.cancels {
+			rds.cancels = append(rds.cancels, dao.CancelEvent{OrderHash: model.OrderHash, BlockNumber: 11, AmountCancelled: v})
+		}
+
+		rebuilder := ordermanager.NewOrderStateRebuilder(rds, mc)
+		if rebuilt, err := rebuilder.Rebuild([]common.Hash{common.HexToHash(model.OrderHash)}); nil != err || rebuilt != 1 {
+			t.Fatalf("%s,rebuilt:%d err:%v", c.name, rebuilt, err)
+		}
+		state := &types.OrderState{}
+		saved := rds.orders[model.OrderHash]
+		if err := saved.ConvertUp(state); nil != err {
+			t.Fatal(err)
+		}
+		if state.Status != c.expect {
+			t.Fatalf("%s,status:%d expected:%d", c.name, state.Status, c.expect)
+		}
+	}
+}
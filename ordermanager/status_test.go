@@ -0,0 +1,156 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package ordermanager_test
+
+import (
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/marketcap"
+	"github.com/Loopring/relay/ordermanager"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/common"
+	"go.uber.org/zap"
+)
+
+// 只实现状态变化用到的方法
+type statusRds struct {
+	dao.RdsService
+	order   dao.Order
+	settled []dao.Order
+}
+
+func (r *statusRds) FindValidCutoffEvents() ([]dao.CutOffEvent, error) {
+	return nil, errors.New("record not found")
+}
+
+func (r *statusRds) Add(item interface{}) error {
+	return nil
+}
+
+func (r *statusRds) FindCancelEvent(orderhash, txhash common.Hash) (*dao.CancelEvent, error) {
+	return nil, errors.New("record not found")
+}
+
+func (r *statusRds) GetOrderByHash(orderhash common.Hash) (*dao.Order, error) {
+	model := r.order
+	return &model, nil
+}
+
+func (r *statusRds) UpdateOrderWhileCancel(hash common.Hash, status types.OrderStatus, cancelledAmountS, cancelledAmountB, blockNumber *big.Int) error {
+	return nil
+}
+
+func (r *statusRds) UpdateOrderWhileSoftCancel(hash common.Hash) (int64, error) {
+	return 1, nil
+}
+
+func (r *statusRds) SettleOrdersCutoffStatus(owner common.Address, cutoffTime *big.Int) ([]dao.Order, error) {
+	return r.settled, nil
+}
+
+func (r *statusRds) SettleOrdersExpiredStatus(blockTime int64) ([]dao.Order, error) {
+	return r.settled, nil
+}
+
+func TestOrderManagerImpl_EmitStatusChanged(t *testing.T) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+	crypto.Initialize(crypto.NewCrypto(true, nil))
+	owner := common.HexToAddress("0xb1018949b241d76a1ab2094f473e9befeabb5ead")
+	tokenS := common.HexToAddress("0xef68e7c694f40c8202821edf525de3782458639f")
+	tokenB := common.HexToAddress("0x88699e7fee2da0462981a08a15a3b940304cc516")
+	mc := marketcap.NewMarketCapProvider(config.MinerOptions{})
+	mc.SetMarketCap(tokenS, 1)
+
+	order := newRebuildOrder(t, owner, tokenS, tokenB, types.ORDER_PARTIAL)
+	settled := func(status types.OrderStatus) []dao.Order {
+		model := order
+		model.Status = uint8(status)
+		return []dao.Order{model}
+	}
+	rds := &statusRds{order: order}
+	om := ordermanager.NewOrderManager(config.OrderManagerOptions{}, &config.CommonOptions{}, rds, nil, nil, mc)
+	om.Start()
+	defer om.Stop()
+
+	var (
+		mtx     sync.Mutex
+		changed []*types.OrderState
+	)
+	watcher := &eventemitter.Watcher{Concurrent: false, Handle: func(e eventemitter.EventData) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		changed = append(changed, e.(*types.OrderState))
+		return nil
+	}}
+	eventemitter.On(eventemitter.OrderManagerOrderStatusChanged, watcher)
+	defer eventemitter.Un(eventemitter.OrderManagerOrderStatusChanged, watcher)
+
+	now := time.Now().Unix()
+	cases := []struct {
+		name    string
+		trigger func()
+		status  types.OrderStatus
+	}{
+		{"cancel", func() {
+			eventemitter.Emit(eventemitter.OrderManagerExtractorCancel, &types.OrderCancelledEvent{OrderHash: common.HexToHash(order.OrderHash), TxHash: common.HexToHash("0x01"), AmountCancelled: big.NewInt(50), Time: big.NewInt(now), Blocknumber: big.NewInt(30)})
+		}, types.ORDER_PARTIAL},
+		{"cutoff", func() {
+			rds.settled = settled(types.ORDER_CUTOFF)
+			eventemitter.Emit(eventemitter.OrderManagerExtractorCutoff, &types.CutoffEvent{Owner: owner, Cutoff: big.NewInt(now + 3600), Time: big.NewInt(now), Blocknumber: big.NewInt(30)})
+		}, types.ORDER_CUTOFF},
+		{"soft cancel", func() {
+			if err := om.SoftCancelOrder(&types.OrderCancellation{OrderHash: common.HexToHash(order.OrderHash), Owner: owner}); err != nil {
+				t.Fatal(err)
+			}
+		}, types.ORDER_SOFT_CANCEL},
+		{"expire", func() {
+			rds.settled = settled(types.ORDER_EXPIRE)
+			eventemitter.Emit(eventemitter.Block_New, &types.BlockEvent{BlockNumber: big.NewInt(30), BlockTime: big.NewInt(now + 86400)})
+		}, types.ORDER_EXPIRE},
+	}
+	for _, c := range cases {
+		mtx.Lock()
+		changed = nil
+		mtx.Unlock()
+		c.trigger()
+
+		mtx.Lock()
+		if len(changed) != 1 || changed[0].RawOrder.Hash != common.HexToHash(order.OrderHash) || changed[0].Status != c.status {
+			t.Errorf("%s, status changed events %+v, expect one of status %d", c.name, changed, c.status)
+		}
+		mtx.Unlock()
+	}
+
+	// 取消量随状态一起推送
+	rds.settled = nil
+	changed = nil
+	eventemitter.Emit(eventemitter.OrderManagerExtractorCancel, &types.OrderCancelledEvent{OrderHash: common.HexToHash(order.OrderHash), TxHash: common.HexToHash("0x02"), AmountCancelled: big.NewInt(100), Time: big.NewInt(now), Blocknumber: big.NewInt(31)})
+	if len(changed) != 1 || changed[0].CancelledAmountS.Int64() != 100 || changed[0].Status != types.ORDER_FINISHED {
+		t.Errorf("cancelled order state %+v", changed)
+	}
+}
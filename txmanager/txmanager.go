@@ -0,0 +1,493 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package txmanager
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+/**
+管理miner账户发送的交易：
+1.nonce在本地分配，不再每次从节点获取，避免并发提交时nonce冲突
+2.所有交易使用EIP-155签名并持久化，重启后继续跟踪
+3.定时检查receipt，超时未被打包的交易提高gasPrice后使用相同nonce重新发送，超过最大替换次数后不再跟踪
+4.交易结束后发送Miner_TransactionFinished事件，由submitter记录到ring_submit_info
+检查时只在读写pendings、nonces时持有mtx，节点请求及事件发送均在锁外，pendingTransaction只由检查协程修改
+发送时在锁内预留nonce后释放锁再签名发送，发送失败时回退预留的nonce；需要从节点重新同步nonce时，等该sender正在发送的交易都返回后再同步
+*/
+
+type TransactionManager interface {
+	Start() error
+	Stop()
+	SendTransaction(sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte) (string, error)
+}
+
+// 同一nonce发送过的所有交易，txHashes最后一个为当前交易
+type pendingTransaction struct {
+	sender   accounts.Account
+	nonce    uint64
+	to       common.Address
+	gas      *big.Int
+	gasPrice *big.Int
+	value    *big.Int
+	data     []byte
+	txHashes []common.Hash
+	sendTime int64
+}
+
+type TransactionManagerImpl struct {
+	options  config.TransactionManagerOptions
+	rds      dao.RdsService
+	accessor *ethaccessor.EthNodeAccessor
+	chainId  *big.Int
+	nonces   map[common.Address]uint64
+	sending  map[common.Address]int
+	resync   map[common.Address]bool
+	pendings map[common.Address]map[uint64]*pendingTransaction
+	mtx      sync.Mutex
+	stopChan chan bool
+}
+
+func NewTransactionManager(options config.TransactionManagerOptions, rds dao.RdsService, accessor *ethaccessor.EthNodeAccessor) *TransactionManagerImpl {
+	manager := &TransactionManagerImpl{}
+	manager.options = options
+	manager.rds = rds
+	manager.accessor = accessor
+	manager.nonces = make(map[common.Address]uint64)
+	manager.sending = make(map[common.Address]int)
+	manager.resync = make(map[common.Address]bool)
+	manager.pendings = make(map[common.Address]map[uint64]*pendingTransaction)
+	if manager.options.CheckInterval <= 0 {
+		manager.options.CheckInterval = 15
+	}
+	if manager.options.ReplaceTimeout <= 0 {
+		manager.options.ReplaceTimeout = 180
+	}
+	if manager.options.GasPriceBumpPercentage < 10 {
+		manager.options.GasPriceBumpPercentage = 10
+	}
+	return manager
+}
+
+// 无法获取chain id时不能进行EIP-155签名，直接返回错误
+func (manager *TransactionManagerImpl) Start() error {
+	manager.mtx.Lock()
+	started := nil != manager.stopChan
+	manager.mtx.Unlock()
+	if started {
+		return nil
+	}
+
+	if err := manager.loadChainId(); nil != err {
+		return fmt.Errorf("txmanager,get chain id err:%s", err.Error())
+	}
+	if err := manager.restore(); nil != err {
+		return fmt.Errorf("txmanager,restore pending transactions err:%s", err.Error())
+	}
+
+	stopChan := make(chan bool)
+	manager.mtx.Lock()
+	manager.stopChan = stopChan
+	manager.mtx.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(time.Duration(manager.options.CheckInterval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				manager.checkPendings()
+			}
+		}
+	}()
+	return nil
+}
+
+func (manager *TransactionManagerImpl) Stop() {
+	manager.mtx.Lock()
+	defer manager.mtx.Unlock()
+	if nil != manager.stopChan {
+		close(manager.stopChan)
+		manager.stopChan = nil
+	}
+}
+
+func (manager *TransactionManagerImpl) loadChainId() error {
+	if manager.options.ChainId > 0 {
+		manager.chainId = big.NewInt(manager.options.ChainId)
+		return nil
+	}
+	var version string
+	if err := manager.accessor.Call(&version, "net_version"); nil != err {
+		return err
+	}
+	chainId, err := strconv.ParseInt(version, 10, 64)
+	if nil != err {
+		return err
+	}
+	manager.chainId = big.NewInt(chainId)
+	return nil
+}
+
+func (manager *TransactionManagerImpl) restore() error {
+	manager.mtx.Lock()
+	defer manager.mtx.Unlock()
+
+	txs, err := manager.rds.GetUnfinishedTransactions()
+	if nil != err {
+		return err
+	}
+	for _, tx := range txs {
+		sender := common.HexToAddress(tx.Sender)
+		nonce := uint64(tx.Nonce)
+		pending := manager.getPending(sender, nonce)
+		if nil == pending {
+			pending = &pendingTransaction{sender: accounts.Account{Address: sender}, nonce: nonce}
+			manager.addPending(pending)
+		}
+		pending.to = common.HexToAddress(tx.To)
+		pending.value = parseBigInt(tx.Value)
+		pending.gas = parseBigInt(tx.Gas)
+		pending.gasPrice = parseBigInt(tx.GasPrice)
+		pending.data = common.FromHex(tx.Data)
+		pending.txHashes = append(pending.txHashes, common.HexToHash(tx.TxHash))
+		pending.sendTime = tx.CreateTime
+	}
+	log.Infof("txmanager,restored %d unfinished transactions", len(txs))
+	return nil
+}
+
+func (manager *TransactionManagerImpl) SendTransaction(sender accounts.Account, to common.Address, gas, gasPrice, value *big.Int, callData []byte) (string, error) {
+	if nil == gasPrice || gasPrice.Sign() <= 0 {
+		return "", errors.New("txmanager,gasPrice must be setted")
+	}
+	if nil == gas || gas.Sign() <= 0 {
+		return "", errors.New("txmanager,gas must be setted")
+	}
+	if nil == value {
+		value = big.NewInt(0)
+	}
+
+	manager.mtx.Lock()
+	nonce, err := manager.nextNonce(sender.Address)
+	if nil != err {
+		manager.mtx.Unlock()
+		return "", err
+	}
+	manager.nonces[sender.Address] = nonce + 1
+	manager.sending[sender.Address]++
+	manager.mtx.Unlock()
+
+	pending := &pendingTransaction{
+		sender:   sender,
+		nonce:    nonce,
+		to:       to,
+		gas:      new(big.Int).Set(gas),
+		gasPrice: new(big.Int).Set(gasPrice),
+		value:    new(big.Int).Set(value),
+		data:     callData,
+	}
+	txHash, err := manager.signAndSend(pending, pending.gasPrice)
+	if nil != err {
+		manager.mtx.Lock()
+		if manager.nonces[sender.Address] == nonce+1 {
+			manager.nonces[sender.Address] = nonce
+		}
+		//发送失败时无法确定节点是否已收到该交易，重新从节点同步
+		manager.resync[sender.Address] = true
+		manager.sendDone(sender.Address)
+		manager.mtx.Unlock()
+		return "", err
+	}
+	manager.sent(pending, txHash, pending.gasPrice)
+
+	manager.mtx.Lock()
+	manager.addPending(pending)
+	manager.sendDone(sender.Address)
+	manager.mtx.Unlock()
+	return txHash.Hex(), nil
+}
+
+// 调用时需持有mtx，sender没有正在发送的交易时才从节点重新同步nonce，避免重复分配已预留的nonce
+func (manager *TransactionManagerImpl) sendDone(sender common.Address) {
+	manager.sending[sender]--
+	if manager.sending[sender] > 0 {
+		return
+	}
+	delete(manager.sending, sender)
+	if manager.resync[sender] {
+		delete(manager.resync, sender)
+		delete(manager.nonces, sender)
+	}
+}
+
+// 本地nonce与节点pending nonce、未完成交易的最大nonce取最大值
+func (manager *TransactionManagerImpl) nextNonce(sender common.Address) (uint64, error) {
+	if nonce, exists := manager.nonces[sender]; exists {
+		return nonce, nil
+	}
+	var count types.Big
+	if err := manager.accessor.Call(&count, "eth_getTransactionCount", sender.Hex(), "pending"); nil != err {
+		return 0, err
+	}
+	nonce := count.Uint64()
+	for pendingNonce := range manager.pendings[sender] {
+		if pendingNonce+1 > nonce {
+			nonce = pendingNonce + 1
+		}
+	}
+	manager.nonces[sender] = nonce
+	return nonce, nil
+}
+
+func (manager *TransactionManagerImpl) signAndSend(pending *pendingTransaction, gasPrice *big.Int) (common.Hash, error) {
+	var txHash string
+	tx := ethTypes.NewTransaction(pending.nonce, pending.to, pending.value, pending.gas, gasPrice, pending.data)
+	signedTx, err := crypto.SignTx(pending.sender, tx, manager.chainId)
+	if nil != err {
+		return common.Hash{}, err
+	}
+	txData, err := rlp.EncodeToBytes(signedTx)
+	if nil != err {
+		return common.Hash{}, err
+	}
+	if err := manager.accessor.Call(&txHash, "eth_sendRawTransaction", common.ToHex(txData)); nil != err {
+		log.Errorf("txmanager,send transaction from:%s nonce:%d err:%s", pending.sender.Address.Hex(), pending.nonce, err.Error())
+		return common.Hash{}, err
+	}
+	log.Debugf("txmanager,txhash:%s, nonce:%d, gas:%s, gasPrice:%s", txHash, pending.nonce, pending.gas.String(), gasPrice.String())
+	return common.HexToHash(txHash), nil
+}
+
+// 记录新发送的交易
+func (manager *TransactionManagerImpl) sent(pending *pendingTransaction, txHash common.Hash, gasPrice *big.Int) {
+	now := time.Now().Unix()
+	pending.txHashes = append(pending.txHashes, txHash)
+	pending.gasPrice = gasPrice
+	pending.sendTime = now
+
+	item := &dao.PendingTransaction{
+		Sender:     pending.sender.Address.Hex(),
+		Nonce:      int64(pending.nonce),
+		TxHash:     txHash.Hex(),
+		To:         pending.to.Hex(),
+		Value:      pending.value.String(),
+		Gas:        pending.gas.String(),
+		GasPrice:   gasPrice.String(),
+		Data:       common.ToHex(pending.data),
+		Status:     uint8(types.TX_STATUS_PENDING),
+		CreateTime: now,
+		UpdateTime: now,
+	}
+	if err := manager.rds.Add(item); nil != err {
+		log.Errorf("txmanager,save transaction:%s err:%s", txHash.Hex(), err.Error())
+	}
+}
+
+// 按sender复制未完成的交易，nonce从小到大
+func (manager *TransactionManagerImpl) snapshot() map[common.Address][]*pendingTransaction {
+	manager.mtx.Lock()
+	defer manager.mtx.Unlock()
+
+	res := make(map[common.Address][]*pendingTransaction)
+	for sender, pendings := range manager.pendings {
+		list := []*pendingTransaction{}
+		for _, pending := range pendings {
+			list = append(list, pending)
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].nonce < list[j].nonce })
+		res[sender] = list
+	}
+	return res
+}
+
+func (manager *TransactionManagerImpl) checkPendings() {
+	for sender, pendings := range manager.snapshot() {
+		var latestCount types.Big
+		if err := manager.accessor.Call(&latestCount, "eth_getTransactionCount", sender.Hex(), "latest"); nil != err {
+			log.Errorf("txmanager,get transaction count of:%s err:%s", sender.Hex(), err.Error())
+			continue
+		}
+
+		for _, pending := range pendings {
+			lastTxHash := pending.txHashes[len(pending.txHashes)-1]
+			txHash, receipt, err := manager.minedReceipt(pending)
+			if nil != err {
+				log.Errorf("txmanager,check receipt of nonce:%d err:%s", pending.nonce, err.Error())
+			} else if nil != receipt {
+				manager.finish(pending, txHash, receiptStatus(pending, receipt), receipt)
+			} else if pending.nonce < latestCount.Uint64() {
+				//nonce已经被打包，但不是这里发送的任何一笔交易
+				manager.finish(pending, lastTxHash, types.TX_STATUS_DROPPED, nil)
+			} else if time.Now().Unix()-pending.sendTime >= manager.options.ReplaceTimeout {
+				if replaced := len(pending.txHashes) - 1; replaced >= manager.options.MaxReplaceTimes {
+					log.Errorf("txmanager,transaction:%s nonce:%d is not mined after replaced %d times", lastTxHash.Hex(), pending.nonce, replaced)
+					manager.finish(pending, lastTxHash, types.TX_STATUS_TIMEOUT, nil)
+				} else {
+					manager.replace(pending)
+				}
+			}
+		}
+	}
+}
+
+// 返回已被打包的交易及其receipt，都未被打包时receipt为nil
+func (manager *TransactionManagerImpl) minedReceipt(pending *pendingTransaction) (common.Hash, *ethaccessor.TransactionReceipt, error) {
+	for _, txHash := range pending.txHashes {
+		var receipt ethaccessor.TransactionReceipt
+		if err := manager.accessor.Call(&receipt, "eth_getTransactionReceipt", txHash.Hex()); nil != err {
+			return common.Hash{}, nil, err
+		}
+		if "" != receipt.BlockHash {
+			return txHash, &receipt, nil
+		}
+	}
+	return common.Hash{}, nil, nil
+}
+
+func receiptStatus(pending *pendingTransaction, receipt *ethaccessor.TransactionReceipt) types.TransactionStatus {
+	if nil != receipt.Status {
+		if receipt.Status.Int() != 1 {
+			return types.TX_STATUS_FAILED
+		}
+	} else if receipt.GasUsed.BigInt().Cmp(pending.gas) >= 0 {
+		//byzantium之前没有status，用完全部gas视为失败
+		return types.TX_STATUS_FAILED
+	}
+	return types.TX_STATUS_SUCCESS
+}
+
+func (manager *TransactionManagerImpl) finish(pending *pendingTransaction, txHash common.Hash, status types.TransactionStatus, receipt *ethaccessor.TransactionReceipt) {
+	now := time.Now().Unix()
+	others := []string{}
+	for _, h := range pending.txHashes {
+		if h != txHash {
+			others = append(others, h.Hex())
+		}
+	}
+	if err := manager.rds.UpdatePendingTransactionStatus([]string{txHash.Hex()}, status, now); nil != err {
+		log.Errorf("txmanager,update status of transaction:%s err:%s", txHash.Hex(), err.Error())
+	}
+	if len(others) > 0 {
+		if err := manager.rds.UpdatePendingTransactionStatus(others, types.TX_STATUS_DROPPED, now); nil != err {
+			log.Errorf("txmanager,update status of replaced transactions err:%s", err.Error())
+		}
+	}
+
+	manager.mtx.Lock()
+	delete(manager.pendings[pending.sender.Address], pending.nonce)
+	if len(manager.pendings[pending.sender.Address]) == 0 {
+		delete(manager.pendings, pending.sender.Address)
+	}
+	if status == types.TX_STATUS_TIMEOUT {
+		//不再跟踪的nonce可能仍在节点的交易池中，下次发送时重新从节点同步nonce
+		if manager.sending[pending.sender.Address] > 0 {
+			manager.resync[pending.sender.Address] = true
+		} else {
+			delete(manager.nonces, pending.sender.Address)
+		}
+	}
+	manager.mtx.Unlock()
+
+	event := &types.TransactionFinishedEvent{
+		Sender:   pending.sender.Address,
+		Nonce:    pending.nonce,
+		TxHash:   txHash,
+		TxHashes: pending.txHashes,
+		Status:   status,
+	}
+	if nil != receipt {
+		event.GasUsed = new(big.Int).Set(receipt.GasUsed.BigInt())
+		event.BlockNumber = new(big.Int).Set(receipt.BlockNumber.BigInt())
+	}
+	log.Infof("txmanager,transaction:%s nonce:%d finished, status:%d", txHash.Hex(), pending.nonce, status)
+	eventemitter.Emit(eventemitter.Miner_TransactionFinished, event)
+}
+
+// 使用相同nonce、更高的gasPrice重新发送
+func (manager *TransactionManagerImpl) replace(pending *pendingTransaction) {
+	oldTxHash := pending.txHashes[len(pending.txHashes)-1]
+	gasPrice := new(big.Int).Mul(pending.gasPrice, big.NewInt(100+manager.options.GasPriceBumpPercentage))
+	gasPrice.Div(gasPrice, big.NewInt(100))
+	if gasPrice.Cmp(pending.gasPrice) <= 0 {
+		gasPrice.Add(pending.gasPrice, big.NewInt(1))
+	}
+
+	txHash, err := manager.signAndSend(pending, gasPrice)
+	if nil != err {
+		//等待下一个超时周期再试
+		pending.sendTime = time.Now().Unix()
+		return
+	}
+	if err := manager.rds.UpdatePendingTransactionStatus([]string{oldTxHash.Hex()}, types.TX_STATUS_REPLACED, time.Now().Unix()); nil != err {
+		log.Errorf("txmanager,update status of transaction:%s err:%s", oldTxHash.Hex(), err.Error())
+	}
+	manager.sent(pending, txHash, gasPrice)
+
+	log.Infof("txmanager,transaction:%s replaced by:%s, gasPrice:%s", oldTxHash.Hex(), txHash.Hex(), gasPrice.String())
+	eventemitter.Emit(eventemitter.Miner_TransactionReplaced, &types.TransactionReplacedEvent{
+		Sender:    pending.sender.Address,
+		Nonce:     pending.nonce,
+		OldTxHash: oldTxHash,
+		NewTxHash: txHash,
+		GasPrice:  new(big.Int).Set(gasPrice),
+	})
+}
+
+func (manager *TransactionManagerImpl) getPending(sender common.Address, nonce uint64) *pendingTransaction {
+	if pendings, exists := manager.pendings[sender]; exists {
+		return pendings[nonce]
+	}
+	return nil
+}
+
+func (manager *TransactionManagerImpl) addPending(pending *pendingTransaction) {
+	if _, exists := manager.pendings[pending.sender.Address]; !exists {
+		manager.pendings[pending.sender.Address] = make(map[uint64]*pendingTransaction)
+	}
+	manager.pendings[pending.sender.Address][pending.nonce] = pending
+}
+
+func parseBigInt(s string) *big.Int {
+	i, ok := new(big.Int).SetString(s, 0)
+	if !ok {
+		return big.NewInt(0)
+	}
+	return i
+}
@@ -0,0 +1,433 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package txmanager
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Loopring/relay/config"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/dao"
+	"github.com/Loopring/relay/ethaccessor"
+	"github.com/Loopring/relay/eventemiter"
+	"github.com/Loopring/relay/log"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	ethTypes "github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"go.uber.org/zap"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"testing"
+)
+
+// 只实现txmanager用到的方法
+type txRds struct {
+	dao.RdsService
+	mtx      sync.Mutex
+	txs      []*dao.PendingTransaction
+	restored []dao.PendingTransaction
+}
+
+func (rds *txRds) Add(item interface{}) error {
+	rds.mtx.Lock()
+	defer rds.mtx.Unlock()
+	rds.txs = append(rds.txs, item.(*dao.PendingTransaction))
+	return nil
+}
+
+func (rds *txRds) GetUnfinishedTransactions() ([]dao.PendingTransaction, error) {
+	return rds.restored, nil
+}
+
+func (rds *txRds) UpdatePendingTransactionStatus(txHashes []string, status types.TransactionStatus, updateTime int64) error {
+	rds.mtx.Lock()
+	defer rds.mtx.Unlock()
+	for _, h := range txHashes {
+		for _, tx := range rds.txs {
+			if tx.TxHash == h {
+				tx.Status = uint8(status)
+			}
+		}
+	}
+	return nil
+}
+
+func (rds *txRds) status(txHash common.Hash) types.TransactionStatus {
+	rds.mtx.Lock()
+	defer rds.mtx.Unlock()
+	for _, tx := range rds.txs {
+		if tx.TxHash == txHash.Hex() {
+			return types.TransactionStatus(tx.Status)
+		}
+	}
+	return types.TX_STATUS_UNKNOWN
+}
+
+// 模拟节点，记录收到的交易
+type TxApi struct {
+	mtx       sync.Mutex
+	version   string
+	pending   uint64
+	latest    uint64
+	sent      []*ethTypes.Transaction
+	receipts  map[string]map[string]interface{}
+	sendError error
+}
+
+func (api *TxApi) Version() (string, error) {
+	if "" == api.version {
+		return "", errors.New("net_version is not supported")
+	}
+	return api.version, nil
+}
+
+func (api *TxApi) GetTransactionCount(address string, blockParameter string) string {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	if "latest" == blockParameter {
+		return fmt.Sprintf("%#x", api.latest)
+	}
+	return fmt.Sprintf("%#x", api.pending)
+}
+
+func (api *TxApi) SendRawTransaction(data string) (string, error) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	if nil != api.sendError {
+		return "", api.sendError
+	}
+	tx := &ethTypes.Transaction{}
+	if err := rlp.DecodeBytes(common.FromHex(data), tx); nil != err {
+		return "", err
+	}
+	api.sent = append(api.sent, tx)
+	return tx.Hash().Hex(), nil
+}
+
+func (api *TxApi) GetTransactionReceipt(txHash string) map[string]interface{} {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	return api.receipts[txHash]
+}
+
+func (api *TxApi) mine(tx *ethTypes.Transaction) {
+	api.mtx.Lock()
+	defer api.mtx.Unlock()
+	api.receipts[tx.Hash().Hex()] = map[string]interface{}{
+		"blockHash":   common.HexToHash("0x01").Hex(),
+		"blockNumber": "0x10",
+		"gasUsed":     "0x5208",
+		"status":      "0x1",
+	}
+	api.latest = tx.Nonce() + 1
+}
+
+func newTestManager(t *testing.T, options config.TransactionManagerOptions) (*TransactionManagerImpl, *TxApi, *txRds, accounts.Account, func()) {
+	log.Initialize(config.LogOptions{ZapOpts: zap.NewDevelopmentConfig()})
+
+	dir, err := ioutil.TempDir("", "txmanager-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	sender, err := ks.NewAccount("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock(sender, "1"); err != nil {
+		t.Fatal(err)
+	}
+	crypto.Initialize(crypto.NewCrypto(true, ks))
+
+	api := &TxApi{receipts: make(map[string]map[string]interface{})}
+	server := rpc.NewServer()
+	if err := server.RegisterName("eth", api); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.RegisterName("net", api); err != nil {
+		t.Fatal(err)
+	}
+	accessor := &ethaccessor.EthNodeAccessor{Client: rpc.DialInProc(server)}
+	rds := &txRds{}
+	return NewTransactionManager(options, rds, accessor), api, rds, sender, func() { os.RemoveAll(dir) }
+}
+
+func TestTransactionManager_StartWithoutChainId(t *testing.T) {
+	manager, api, _, _, clean := newTestManager(t, config.TransactionManagerOptions{})
+	defer clean()
+
+	if err := manager.Start(); nil == err {
+		manager.Stop()
+		t.Fatalf("start should fail if chain id is unknown")
+	}
+
+	api.version = "3"
+	if err := manager.Start(); nil != err {
+		t.Fatal(err)
+	}
+	manager.Stop()
+	if manager.chainId.Int64() != 3 {
+		t.Fatalf("chain id %s, expect 3", manager.chainId.String())
+	}
+}
+
+func TestTransactionManager_SendTransaction(t *testing.T) {
+	manager, api, _, sender, clean := newTestManager(t, config.TransactionManagerOptions{ChainId: 3})
+	defer clean()
+	if err := manager.loadChainId(); nil != err {
+		t.Fatal(err)
+	}
+	to := common.HexToAddress("0x02")
+	api.pending = 5
+
+	for i := 0; i < 3; i++ {
+		if _, err := manager.SendTransaction(sender, to, big.NewInt(21000), big.NewInt(100), nil, nil); nil != err {
+			t.Fatal(err)
+		}
+	}
+	// 本地分配nonce，不受节点pending nonce变化影响
+	api.pending = 6
+	if _, err := manager.SendTransaction(sender, to, big.NewInt(21000), big.NewInt(100), nil, nil); nil != err {
+		t.Fatal(err)
+	}
+	for idx, tx := range api.sent {
+		if tx.Nonce() != uint64(5+idx) {
+			t.Errorf("transaction %d nonce %d, expect %d", idx, tx.Nonce(), 5+idx)
+		}
+		if signer, err := ethTypes.Sender(ethTypes.NewEIP155Signer(big.NewInt(3)), tx); nil != err || signer != sender.Address {
+			t.Errorf("transaction %d should be signed with EIP-155 by sender, err:%v", idx, err)
+		}
+	}
+
+	// 发送失败后nonce重新从节点和未完成的交易同步
+	api.sendError = errors.New("node is down")
+	if _, err := manager.SendTransaction(sender, to, big.NewInt(21000), big.NewInt(100), nil, nil); nil == err {
+		t.Fatalf("send should fail")
+	}
+	api.sendError = nil
+	if _, err := manager.SendTransaction(sender, to, big.NewInt(21000), big.NewInt(100), nil, nil); nil != err {
+		t.Fatal(err)
+	}
+	if nonce := api.sent[len(api.sent)-1].Nonce(); nonce != 9 {
+		t.Fatalf("nonce after failure %d, expect 9", nonce)
+	}
+}
+
+func TestTransactionManager_Replace(t *testing.T) {
+	manager, api, rds, sender, clean := newTestManager(t, config.TransactionManagerOptions{ChainId: 3, ReplaceTimeout: 60, GasPriceBumpPercentage: 12, MaxReplaceTimes: 2})
+	defer clean()
+	if err := manager.loadChainId(); nil != err {
+		t.Fatal(err)
+	}
+
+	var (
+		mtx      sync.Mutex
+		replaced []*types.TransactionReplacedEvent
+		finished []*types.TransactionFinishedEvent
+	)
+	replacedWatcher := &eventemitter.Watcher{Concurrent: false, Handle: func(e eventemitter.EventData) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		replaced = append(replaced, e.(*types.TransactionReplacedEvent))
+		return nil
+	}}
+	finishedWatcher := &eventemitter.Watcher{Concurrent: false, Handle: func(e eventemitter.EventData) error {
+		mtx.Lock()
+		defer mtx.Unlock()
+		finished = append(finished, e.(*types.TransactionFinishedEvent))
+		return nil
+	}}
+	eventemitter.On(eventemitter.Miner_TransactionReplaced, replacedWatcher)
+	eventemitter.On(eventemitter.Miner_TransactionFinished, finishedWatcher)
+	defer eventemitter.Un(eventemitter.Miner_TransactionReplaced, replacedWatcher)
+	defer eventemitter.Un(eventemitter.Miner_TransactionFinished, finishedWatcher)
+
+	to := common.HexToAddress("0x02")
+	mined, _ := manager.SendTransaction(sender, to, big.NewInt(21000), big.NewInt(100), nil, nil)
+	timeout, _ := manager.SendTransaction(sender, to, big.NewInt(21000), big.NewInt(100), nil, nil)
+
+	expire := func() {
+		for _, pendings := range manager.snapshot() {
+			for _, pending := range pendings {
+				pending.sendTime -= 60
+			}
+		}
+	}
+
+	// 未超时不替换
+	manager.checkPendings()
+	if len(api.sent) != 2 {
+		t.Fatalf("transactions should not be replaced before timeout, sent %d", len(api.sent))
+	}
+
+	expire()
+	manager.checkPendings()
+	if len(api.sent) != 4 || len(replaced) != 2 {
+		t.Fatalf("both transactions should be replaced, sent %d, replaced %d", len(api.sent), len(replaced))
+	}
+	for idx, tx := range api.sent[2:] {
+		if tx.Nonce() != api.sent[idx].Nonce() || tx.GasPrice().Int64() != 112 {
+			t.Errorf("replacement of nonce %d, nonce:%d gasPrice:%s, expect gasPrice 112", api.sent[idx].Nonce(), tx.Nonce(), tx.GasPrice().String())
+		}
+	}
+	if status := rds.status(common.HexToHash(mined)); status != types.TX_STATUS_REPLACED {
+		t.Errorf("replaced transaction status %d", status)
+	}
+
+	// 被替换的交易仍然可能被打包
+	api.mine(api.sent[0])
+	expire()
+	manager.checkPendings()
+	if len(finished) != 1 || finished[0].TxHash != common.HexToHash(mined) || finished[0].Status != types.TX_STATUS_SUCCESS {
+		t.Fatalf("replaced transaction mined should be finished, %+v", finished)
+	}
+	if len(api.sent) != 5 || api.sent[4].GasPrice().Int64() != 125 {
+		t.Fatalf("pending transaction should be replaced again with gas price 125, sent %d", len(api.sent))
+	}
+
+	// 超过最大替换次数后不再跟踪
+	expire()
+	manager.checkPendings()
+	if len(finished) != 2 || finished[1].Status != types.TX_STATUS_TIMEOUT || len(finished[1].TxHashes) != 3 || finished[1].TxHashes[0] != common.HexToHash(timeout) {
+		t.Fatalf("transaction should time out after replaced 2 times, %+v", finished)
+	}
+	if len(manager.snapshot()) != 0 {
+		t.Fatalf("timed out transaction should not be tracked")
+	}
+	if _, exists := manager.nonces[sender.Address]; exists {
+		t.Fatalf("nonce should be synced from node after timeout")
+	}
+}
+
+func TestTransactionManager_Restore(t *testing.T) {
+	manager, api, rds, sender, clean := newTestManager(t, config.TransactionManagerOptions{ChainId: 3})
+	defer clean()
+
+	hashes := []common.Hash{common.HexToHash("0x11"), common.HexToHash("0x12"), common.HexToHash("0x13")}
+	rds.restored = []dao.PendingTransaction{
+		{Sender: sender.Address.Hex(), Nonce: 7, TxHash: hashes[0].Hex(), GasPrice: "100", Gas: "21000", Value: "0", Status: uint8(types.TX_STATUS_REPLACED)},
+		{Sender: sender.Address.Hex(), Nonce: 8, TxHash: hashes[1].Hex(), GasPrice: "100", Gas: "21000", Value: "0", Status: uint8(types.TX_STATUS_PENDING)},
+		{Sender: sender.Address.Hex(), Nonce: 7, TxHash: hashes[2].Hex(), GasPrice: "110", Gas: "21000", Value: "0", Status: uint8(types.TX_STATUS_PENDING)},
+	}
+	if err := manager.restore(); nil != err {
+		t.Fatal(err)
+	}
+
+	pending := manager.getPending(sender.Address, 7)
+	if nil == pending || len(pending.txHashes) != 2 || pending.txHashes[1] != hashes[2] || pending.gasPrice.Int64() != 110 {
+		t.Fatalf("replaced transactions of the same nonce should be restored in order, %+v", pending)
+	}
+	if nil == manager.getPending(sender.Address, 8) {
+		t.Fatalf("transaction of nonce 8 should be restored")
+	}
+
+	// 节点pending nonce落后于恢复的交易时，从恢复的最大nonce之后继续
+	api.pending = 7
+	if err := manager.loadChainId(); nil != err {
+		t.Fatal(err)
+	}
+	if _, err := manager.SendTransaction(sender, common.HexToAddress("0x02"), big.NewInt(21000), big.NewInt(100), nil, nil); nil != err {
+		t.Fatal(err)
+	}
+	if nonce := api.sent[0].Nonce(); nonce != 9 {
+		t.Fatalf("nonce after restore %d, expect 9", nonce)
+	}
+}
+
+func TestTransactionManager_MaxReplaceTimes(t *testing.T) {
+	for _, maxReplaceTimes := range []int{0, 1} {
+		manager, api, _, sender, clean := newTestManager(t, config.TransactionManagerOptions{ChainId: 3, ReplaceTimeout: 60, MaxReplaceTimes: maxReplaceTimes})
+		if err := manager.loadChainId(); nil != err {
+			t.Fatal(err)
+		}
+
+		var (
+			mtx      sync.Mutex
+			finished []*types.TransactionFinishedEvent
+		)
+		finishedWatcher := &eventemitter.Watcher{Concurrent: false, Handle: func(e eventemitter.EventData) error {
+			mtx.Lock()
+			defer mtx.Unlock()
+			finished = append(finished, e.(*types.TransactionFinishedEvent))
+			return nil
+		}}
+		eventemitter.On(eventemitter.Miner_TransactionFinished, finishedWatcher)
+
+		if _, err := manager.SendTransaction(sender, common.HexToAddress("0x02"), big.NewInt(21000), big.NewInt(100), nil, nil); nil != err {
+			t.Fatal(err)
+		}
+		for i := 0; i <= maxReplaceTimes; i++ {
+			for _, pendings := range manager.snapshot() {
+				for _, pending := range pendings {
+					pending.sendTime -= 60
+				}
+			}
+			manager.checkPendings()
+		}
+
+		if len(api.sent) != 1+maxReplaceTimes {
+			t.Errorf("MaxReplaceTimes %d, sent %d transactions, expect %d", maxReplaceTimes, len(api.sent), 1+maxReplaceTimes)
+		}
+		if len(finished) != 1 || finished[0].Status != types.TX_STATUS_TIMEOUT || len(finished[0].TxHashes) != 1+maxReplaceTimes {
+			t.Errorf("MaxReplaceTimes %d, transaction should time out after replaced %d times, %+v", maxReplaceTimes, maxReplaceTimes, finished)
+		}
+		eventemitter.Un(eventemitter.Miner_TransactionFinished, finishedWatcher)
+		clean()
+	}
+}
+
+func TestTransactionManager_ConcurrentSend(t *testing.T) {
+	manager, api, _, sender, clean := newTestManager(t, config.TransactionManagerOptions{ChainId: 3, CheckInterval: 1})
+	defer clean()
+	api.version = "3"
+	api.pending = 5
+	if err := manager.Start(); nil != err {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := manager.SendTransaction(sender, common.HexToAddress("0x02"), big.NewInt(21000), big.NewInt(100), nil, nil); nil != err {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	manager.Stop()
+	manager.Stop()
+
+	nonces := make(map[uint64]bool)
+	for _, tx := range api.sent {
+		nonces[tx.Nonce()] = true
+	}
+	for nonce := uint64(5); nonce < 15; nonce++ {
+		if !nonces[nonce] {
+			t.Errorf("nonce %d is not sent, sent %v", nonce, nonces)
+		}
+	}
+}
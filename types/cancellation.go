@@ -0,0 +1,98 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package types
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/log"
+	"github.com/ethereum/go-ethereum/common"
+	"math/big"
+)
+
+// 链下软取消,由订单owner对orderHash,owner,timestamp签名
+// 链上的cancelOrder/setCutoff依然是最终依据
+type OrderCancellation struct {
+	OrderHash common.Hash    `json:"orderHash"`
+	Owner     common.Address `json:"owner"`
+	Timestamp int64          `json:"timestamp"`
+	V         uint8          `json:"v"`
+	R         Bytes32        `json:"r"`
+	S         Bytes32        `json:"s"`
+}
+
+func (c *OrderCancellation) GenerateHash() common.Hash {
+	h := &common.Hash{}
+	hashBytes := crypto.GenerateHash(
+		c.OrderHash.Bytes(),
+		c.Owner.Bytes(),
+		common.LeftPadBytes(big.NewInt(c.Timestamp).Bytes(), 32),
+	)
+	h.SetBytes(hashBytes)
+
+	return *h
+}
+
+func (c *OrderCancellation) GenerateAndSetSignature(singerAddr common.Address) error {
+	if sig, err := crypto.Sign(c.GenerateHash().Bytes(), singerAddr); nil != err {
+		return err
+	} else {
+		v, r, s := crypto.SigToVRS(sig)
+		c.V = uint8(v)
+		c.R = BytesToBytes32(r)
+		c.S = BytesToBytes32(s)
+		return nil
+	}
+}
+
+func (c *OrderCancellation) SignerAddress() (common.Address, error) {
+	address := &common.Address{}
+	sig, _ := crypto.VRSToSig(c.V, c.R.Bytes(), c.S.Bytes())
+
+	if addressBytes, err := crypto.SigToAddress(c.GenerateHash().Bytes(), sig); nil != err {
+		log.Errorf("type,order cancellation signer address error:%s", err.Error())
+		return *address, err
+	} else {
+		address.SetBytes(addressBytes)
+		return *address, nil
+	}
+}
+
+func (c *OrderCancellation) MarshalJSON() ([]byte, error) {
+	type cancellation OrderCancellation
+	return json.Marshal((*cancellation)(c))
+}
+
+// orderHash和owner必须存在,用于与ipfs中的订单数据区分
+func (c *OrderCancellation) UnmarshalJSON(input []byte) error {
+	type cancellation OrderCancellation
+	var dec cancellation
+	if err := json.Unmarshal(input, &dec); err != nil {
+		return err
+	}
+	if IsZeroHash(dec.OrderHash) {
+		return errors.New("missing required field 'orderHash' for OrderCancellation")
+	}
+	if IsZeroAddress(dec.Owner) {
+		return errors.New("missing required field 'owner' for OrderCancellation")
+	}
+	*c = OrderCancellation(dec)
+	return nil
+}
@@ -0,0 +1,97 @@
+/*
+
+  Copyright 2017 Loopring Project Ltd (Loopring Foundation).
+
+  Licensed under the Apache License, Version 2.0 (the "License");
+  you may not use this file except in compliance with the License.
+  You may obtain a copy of the License at
+
+  http://www.apache.org/licenses/LICENSE-2.0
+
+  Unless required by applicable law or agreed to in writing, software
+  distributed under the License is distributed on an "AS IS" BASIS,
+  WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+  See the License for the specific language governing permissions and
+  limitations under the License.
+
+*/
+
+package types_test
+
+import (
+	"github.com/Loopring/relay/crypto"
+	"github.com/Loopring/relay/types"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOrderCancellation_UnmarshalJSON(t *testing.T) {
+	src := types.OrderCancellation{
+		OrderHash: common.HexToHash("0xc7756d5d556383b2f965094464bdff3ebe658f263f552858cc4eff4ed0aeafeb"),
+		Owner:     common.HexToAddress("0xb5fab0b11776aad5ce60588c16bd59dcfd61a1c2"),
+		Timestamp: 1506014710,
+		V:         27,
+		R:         types.HexToBytes32("0x239dskjfsn23ck34323434md93jchek3"),
+		S:         types.HexToBytes32("0xdsfsdf234ccvcbdsfsdf23438cjdkldy"),
+	}
+	bs, err := src.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var dst types.OrderCancellation
+	if err := dst.UnmarshalJSON(bs); err != nil {
+		t.Fatal(err)
+	}
+	if dst != src {
+		t.Fatalf("cancellation changed after unmarshal, %v != %v", dst, src)
+	}
+
+	// order data shares the ipfs topic and should not be taken as cancellation
+	ord := []byte(`{"protocol":"0xc01172a87f6cc20e1e3b9ad13a9e715fbc2d5aa9","owner":"0xb5fab0b11776aad5ce60588c16bd59dcfd61a1c2","hash":"0xc7756d5d556383b2f965094464bdff3ebe658f263f552858cc4eff4ed0aeafeb"}`)
+	if err := dst.UnmarshalJSON(ord); err == nil {
+		t.Fatalf("order data should not be unmarshaled as cancellation")
+	}
+}
+
+func TestOrderCancellation_GenerateAndSetSignature(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cancellation-keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ks := keystore.NewKeyStore(dir, keystore.LightScryptN, keystore.LightScryptP)
+	acc, err := ks.NewAccount("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ks.Unlock(acc, "1"); err != nil {
+		t.Fatal(err)
+	}
+	crypto.Initialize(crypto.NewCrypto(true, ks))
+
+	cancellation := types.OrderCancellation{
+		OrderHash: common.HexToHash("0xc7756d5d556383b2f965094464bdff3ebe658f263f552858cc4eff4ed0aeafeb"),
+		Owner:     acc.Address,
+		Timestamp: 1506014710,
+	}
+	if err := cancellation.GenerateAndSetSignature(acc.Address); err != nil {
+		t.Fatal(err)
+	}
+	if signer, err := cancellation.SignerAddress(); err != nil {
+		t.Fatal(err)
+	} else if signer != acc.Address {
+		t.Fatalf("signer %s, expect %s", signer.Hex(), acc.Address.Hex())
+	}
+
+	// the timestamp is covered by the signature and can not be refreshed by a replayer
+	replayed := cancellation
+	replayed.Timestamp += 3600
+	if signer, err := replayed.SignerAddress(); err == nil && signer == acc.Address {
+		t.Fatalf("signature still valid after timestamp changed")
+	}
+}
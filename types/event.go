@@ -110,6 +110,7 @@ type OrderFilledEvent struct {
 	OrderHash       common.Hash
 	NextOrderHash   common.Hash
 	TxHash          common.Hash
+	LogIndex        int64
 	ContractAddress common.Address
 	Owner           common.Address
 	TokenS          common.Address
@@ -129,6 +130,7 @@ type OrderFilledEvent struct {
 type OrderCancelledEvent struct {
 	OrderHash       common.Hash
 	TxHash          common.Hash
+	LogIndex        int64
 	ContractAddress common.Address
 	Time            *big.Int
 	Blocknumber     *big.Int
@@ -139,6 +141,7 @@ type CutoffEvent struct {
 	Owner           common.Address
 	ContractAddress common.Address
 	TxHash          common.Hash
+	LogIndex        int64
 	Time            *big.Int
 	Blocknumber     *big.Int
 	Cutoff          *big.Int
@@ -152,10 +155,12 @@ type RingMinedEvent struct {
 	TradeAmount        int
 	Ringhash           common.Hash
 	TxHash             common.Hash
+	LogIndex           int64
 	Miner              common.Address
 	FeeRecipient       common.Address
 	ContractAddress    common.Address
 	IsRinghashReserved bool
+	Fills              []*OrderFilledEvent
 }
 
 type WethDepositMethodEvent struct {
@@ -207,14 +212,53 @@ type RingSubmitFailedEvent struct {
 	Err      error
 }
 
+type TransactionStatus uint8
+
+const (
+	TX_STATUS_UNKNOWN TransactionStatus = iota
+	TX_STATUS_PENDING
+	TX_STATUS_SUCCESS
+	TX_STATUS_FAILED
+	TX_STATUS_REPLACED //已被gasPrice更高的交易替换，等待结果
+	TX_STATUS_DROPPED  //nonce已被其他交易使用
+	TX_STATUS_TIMEOUT  //超过最大替换次数仍未被打包，不再跟踪
+)
+
+type TransactionReplacedEvent struct {
+	Sender    common.Address
+	Nonce     uint64
+	OldTxHash common.Hash
+	NewTxHash common.Hash
+	GasPrice  *big.Int
+}
+
+// TxHash is the mined one, TxHashes contains all transactions sent with the same nonce
+type TransactionFinishedEvent struct {
+	Sender      common.Address
+	Nonce       uint64
+	TxHash      common.Hash
+	TxHashes    []common.Hash
+	Status      TransactionStatus
+	GasUsed     *big.Int
+	BlockNumber *big.Int
+}
+
+// 分叉回滚事件，区间(ForkBlock, EndBlock]内已处理的区块及事件需要回滚
 type ForkedEvent struct {
-	DetectedBlock *big.Int
+	DetectedBlock *big.Int // 发现分叉的新链区块
 	DetectedHash  common.Hash
-	ForkBlock     *big.Int
+	ForkBlock     *big.Int // 新旧链的共同祖先
 	ForkHash      common.Hash
+	EndBlock      *big.Int // 旧链已处理的最新区块
+}
+
+// 未确认区块被分叉，FromBlock及之后区块已发送的pending事件作废，新链上的pending事件会重新发送
+type PendingRetractedEvent struct {
+	FromBlock *big.Int
 }
 
 type BlockEvent struct {
 	BlockNumber *big.Int
 	BlockHash   common.Hash
+	BlockTime   *big.Int
 }
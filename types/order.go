@@ -34,6 +34,8 @@ const (
 	ORDER_FINISHED
 	ORDER_CANCEL
 	ORDER_CUTOFF
+	ORDER_EXPIRE
+	ORDER_SOFT_CANCEL
 )
 
 //订单原始信息
@@ -228,11 +230,16 @@ type OrderState struct {
 func (ord *OrderState) SettleFinishedStatus(isFullFinished bool) {
 	if isFullFinished {
 		ord.Status = ORDER_FINISHED
-	} else {
+	} else if ord.Status != ORDER_EXPIRE && ord.Status != ORDER_SOFT_CANCEL {
 		ord.Status = ORDER_PARTIAL
 	}
 }
 
+// 订单过期时间为timestamp+ttl
+func (o *Order) IsExpired(now int64) bool {
+	return o.Timestamp.Int64()+o.Ttl.Int64() <= now
+}
+
 func (orderState *OrderState) RemainedAmount() (remainedAmountS *big.Rat, remainedAmountB *big.Rat) {
 	remainedAmountS = new(big.Rat)
 	remainedAmountB = new(big.Rat)
@@ -66,7 +66,7 @@ func (c *WhiteListCache) AddWhiteListUser(user types.WhiteListUser) error {
 		return err
 	}
 
-	return c.rds.Add(model)
+	return c.rds.AddWhiteList(&model)
 }
 
 func (c *WhiteListCache) DelWhiteListUser(user types.WhiteListUser) error {
@@ -79,12 +79,8 @@ func (c *WhiteListCache) DelWhiteListUser(user types.WhiteListUser) error {
 	}
 
 	delete(c.users, user.Owner)
-	model := dao.WhiteList{}
-	if err := model.ConvertDown(&user); err != nil {
-		return err
-	}
 
-	return c.rds.Del(model)
+	return c.rds.DelWhiteList(user.Owner.Hex())
 }
 
 func (c *WhiteListCache) InWhiteList(user common.Address) bool {